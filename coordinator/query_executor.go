@@ -299,7 +299,7 @@ func (e *QueryExecutor) executeDropDatabaseStatement(stmt *influxql.DropDatabase
 	}
 
 	// Locally delete the datababse.
-	if err := e.TSDBStore.DeleteDatabase(stmt.Name); err != nil {
+	if _, err := e.TSDBStore.DeleteDatabase(stmt.Name); err != nil {
 		return err
 	}
 
@@ -357,7 +357,7 @@ func (e *QueryExecutor) executeDropRetentionPolicyStatement(stmt *influxql.DropR
 	}
 
 	// Locally drop the retention policy.
-	if err := e.TSDBStore.DeleteRetentionPolicy(stmt.Database, stmt.Name); err != nil {
+	if _, err := e.TSDBStore.DeleteRetentionPolicy(stmt.Database, stmt.Name); err != nil {
 		return err
 	}
 
@@ -1090,9 +1090,9 @@ type TSDBStore interface {
 	CreateShard(database, policy string, shardID uint64) error
 	WriteToShard(shardID uint64, points []models.Point) error
 
-	DeleteDatabase(name string) error
+	DeleteDatabase(name string) (bool, error)
 	DeleteMeasurement(database, name string) error
-	DeleteRetentionPolicy(database, name string) error
+	DeleteRetentionPolicy(database, name string) (bool, error)
 	DeleteSeries(database string, sources []influxql.Source, condition influxql.Expr) error
 	ExecuteShowFieldKeysStatement(stmt *influxql.ShowFieldKeysStatement, database string) (models.Rows, error)
 	ExecuteShowTagValuesStatement(stmt *influxql.ShowTagValuesStatement, database string) (models.Rows, error)
@@ -190,9 +190,9 @@ type TSDBStore struct {
 	CreateShardFn  func(database, policy string, shardID uint64) error
 	WriteToShardFn func(shardID uint64, points []models.Point) error
 
-	DeleteDatabaseFn                func(name string) error
+	DeleteDatabaseFn                func(name string) (bool, error)
 	DeleteMeasurementFn             func(database, name string) error
-	DeleteRetentionPolicyFn         func(database, name string) error
+	DeleteRetentionPolicyFn         func(database, name string) (bool, error)
 	DeleteSeriesFn                  func(database string, sources []influxql.Source, condition influxql.Expr) error
 	ExecuteShowFieldKeysStatementFn func(stmt *influxql.ShowFieldKeysStatement, database string) (models.Rows, error)
 	ExecuteShowTagValuesStatementFn func(stmt *influxql.ShowTagValuesStatement, database string) (models.Rows, error)
@@ -211,7 +211,7 @@ func (s *TSDBStore) WriteToShard(shardID uint64, points []models.Point) error {
 	return s.WriteToShardFn(shardID, points)
 }
 
-func (s *TSDBStore) DeleteDatabase(name string) error {
+func (s *TSDBStore) DeleteDatabase(name string) (bool, error) {
 	return s.DeleteDatabaseFn(name)
 }
 
@@ -219,7 +219,7 @@ func (s *TSDBStore) DeleteMeasurement(database, name string) error {
 	return s.DeleteMeasurementFn(database, name)
 }
 
-func (s *TSDBStore) DeleteRetentionPolicy(database, name string) error {
+func (s *TSDBStore) DeleteRetentionPolicy(database, name string) (bool, error) {
 	return s.DeleteRetentionPolicyFn(database, name)
 }
 
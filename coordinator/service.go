@@ -221,13 +221,15 @@ func (s *Service) processExecuteStatementRequest(buf []byte) error {
 func (s *Service) executeStatement(stmt influxql.Statement, database string) error {
 	switch t := stmt.(type) {
 	case *influxql.DropDatabaseStatement:
-		return s.TSDBStore.DeleteDatabase(t.Name)
+		_, err := s.TSDBStore.DeleteDatabase(t.Name)
+		return err
 	case *influxql.DropMeasurementStatement:
 		return s.TSDBStore.DeleteMeasurement(database, t.Name)
 	case *influxql.DropSeriesStatement:
 		return s.TSDBStore.DeleteSeries(database, t.Sources, t.Condition)
 	case *influxql.DropRetentionPolicyStatement:
-		return s.TSDBStore.DeleteRetentionPolicy(database, t.Name)
+		_, err := s.TSDBStore.DeleteRetentionPolicy(database, t.Name)
+		return err
 	default:
 		return fmt.Errorf("%q should not be executed across a cluster", stmt.String())
 	}
@@ -62,6 +62,10 @@ type Point interface {
 	// precision of nanoseconds
 	String() string
 
+	// StringSize returns the length of the string returned by String without
+	// building it.
+	StringSize() int
+
 	// Bytes returns a []byte representation of the point similar to string.
 	MarshalBinary() ([]byte, error)
 
@@ -1276,6 +1280,15 @@ func (p *point) String() string {
 	return string(p.Key()) + " " + string(p.fields) + " " + strconv.FormatInt(p.UnixNano(), 10)
 }
 
+func (p *point) StringSize() int {
+	size := len(p.key) + 1 + len(p.fields)
+	if !p.Time().IsZero() {
+		var buf [20]byte
+		size += 1 + len(strconv.AppendInt(buf[:0], p.UnixNano(), 10))
+	}
+	return size
+}
+
 func (p *point) MarshalBinary() ([]byte, error) {
 	tb, err := p.time.MarshalBinary()
 	if err != nil {
@@ -1355,6 +1355,26 @@ func TestParsePointToString(t *testing.T) {
 	}
 }
 
+func TestPoint_StringSize(t *testing.T) {
+	for _, line := range []string{
+		`cpu,host=serverA,region=us-east bool=false,float=11,str="string val" 1000000000`,
+		`cpu,host=serverA value=1 -1000000000`,
+	} {
+		pts, err := models.ParsePoints([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, exp := pts[0].StringSize(), len(pts[0].String()); got != exp {
+			t.Errorf("StringSize() mismatch for %q: got %v, exp %v", line, got, exp)
+		}
+	}
+
+	pt := models.MustNewPoint("cpu", models.Tags{"host": "serverA"}, models.Fields{"value": 1.0}, time.Time{})
+	if got, exp := pt.StringSize(), len(pt.String()); got != exp {
+		t.Errorf("StringSize() mismatch for zero time: got %v, exp %v", got, exp)
+	}
+}
+
 func TestParsePointsWithPrecision(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -0,0 +1,27 @@
+package models
+
+// Statistic is a single set of statistics reported by a subsystem.
+type Statistic struct {
+	Name   string                 `json:"name"`
+	Tags   map[string]string      `json:"tags"`
+	Values map[string]interface{} `json:"values"`
+}
+
+// NewStatistic returns an initialized Statistic with the given name.
+func NewStatistic(name string) Statistic {
+	return Statistic{
+		Name:   name,
+		Tags:   make(map[string]string),
+		Values: make(map[string]interface{}),
+	}
+}
+
+// AddTags adds tags to the statistic. Tags already on the statistic are
+// not overwritten.
+func (s *Statistic) AddTags(tags map[string]string) {
+	for k, v := range tags {
+		if _, ok := s.Tags[k]; !ok {
+			s.Tags[k] = v
+		}
+	}
+}
@@ -2581,6 +2581,10 @@ type ShowTagValuesStatement struct {
 	// Tag key(s) to pull values from.
 	TagKeys []string
 
+	// Regex that selects the tag keys to pull values from. It is set
+	// instead of TagKeys by "WITH KEY =~ /regex/".
+	TagKeyRegex *RegexLiteral
+
 	// An expression evaluated on data point.
 	Condition Expr
 
@@ -2604,14 +2608,19 @@ func (s *ShowTagValuesStatement) String() string {
 		_, _ = buf.WriteString(" FROM ")
 		_, _ = buf.WriteString(s.Sources.String())
 	}
-	_, _ = buf.WriteString(" WITH KEY IN (")
-	for idx, tagKey := range s.TagKeys {
-		if idx != 0 {
-			_, _ = buf.WriteString(", ")
+	if s.TagKeyRegex != nil {
+		_, _ = buf.WriteString(" WITH KEY =~ ")
+		_, _ = buf.WriteString(s.TagKeyRegex.String())
+	} else {
+		_, _ = buf.WriteString(" WITH KEY IN (")
+		for idx, tagKey := range s.TagKeys {
+			if idx != 0 {
+				_, _ = buf.WriteString(", ")
+			}
+			_, _ = buf.WriteString(QuoteIdent(tagKey))
 		}
-		_, _ = buf.WriteString(QuoteIdent(tagKey))
+		_, _ = buf.WriteString(")")
 	}
-	_, _ = buf.WriteString(")")
 	if s.Condition != nil {
 		_, _ = buf.WriteString(" WHERE ")
 		_, _ = buf.WriteString(s.Condition.String())
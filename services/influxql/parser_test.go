@@ -953,6 +953,16 @@ func TestParser_ParseStatement(t *testing.T) {
 			},
 		},
 
+		// SHOW TAG VALUES FROM ... WITH KEY =~ /<regex>/
+		{
+			s: `SHOW TAG VALUES FROM cpu WITH KEY =~ /^reg/ LIMIT 5`,
+			stmt: &influxql.ShowTagValuesStatement{
+				Sources:     []influxql.Source{&influxql.Measurement{Name: "cpu"}},
+				TagKeyRegex: &influxql.RegexLiteral{Val: regexp.MustCompile(`^reg`)},
+				Limit:       5,
+			},
+		},
+
 		// SHOW USERS
 		{
 			s:    `SHOW USERS`,
@@ -1743,6 +1753,8 @@ func TestParser_ParseStatement(t *testing.T) {
 		{s: `SHOW RETENTION POLICIES ON`, err: `found EOF, expected identifier at line 1, char 28`},
 		{s: `SHOW SHARD`, err: `found EOF, expected GROUPS at line 1, char 12`},
 		{s: `SHOW FOO`, err: `found FOO, expected CONTINUOUS, DATABASES, DIAGNOSTICS, FIELD, GRANTS, MEASUREMENTS, RETENTION, SERIES, SERVERS, SHARD, SHARDS, STATS, SUBSCRIPTIONS, TAG, USERS at line 1, char 6`},
+		{s: `SHOW TAG VALUES WITH KEY =~ host`, err: `found host, expected regex at line 1, char 29`},
+		{s: `SHOW TAG VALUES WITH KEY > host`, err: `found >, expected IN, =, =~ at line 1, char 26`},
 		{s: `SHOW STATS FOR`, err: `found EOF, expected string at line 1, char 16`},
 		{s: `SHOW DIAGNOSTICS FOR`, err: `found EOF, expected string at line 1, char 22`},
 		{s: `SHOW GRANTS`, err: `found EOF, expected FOR at line 1, char 13`},
@@ -93,8 +93,15 @@ func rewriteShowTagValuesStatement(stmt *ShowTagValuesStatement) (Statement, err
 	}
 
 	condition := stmt.Condition
-	if len(stmt.TagKeys) > 0 {
+	if stmt.TagKeyRegex != nil || len(stmt.TagKeys) > 0 {
 		var expr Expr
+		if stmt.TagKeyRegex != nil {
+			expr = &BinaryExpr{
+				Op:  EQREGEX,
+				LHS: &VarRef{Val: "_tagKey"},
+				RHS: stmt.TagKeyRegex,
+			}
+		}
 		for _, tagKey := range stmt.TagKeys {
 			tagExpr := &BinaryExpr{
 				Op:  EQ,
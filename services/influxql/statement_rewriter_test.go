@@ -71,6 +71,10 @@ func TestRewriteStatement(t *testing.T) {
 			stmt: `SHOW TAG VALUES FROM cpu WITH KEY IN (region, host)`,
 			s:    `SELECT _tagKey AS "key", value FROM _tags WHERE (_name = 'cpu') AND (_tagKey = 'region' OR _tagKey = 'host')`,
 		},
+		{
+			stmt: `SHOW TAG VALUES FROM cpu WITH KEY =~ /^reg/`,
+			s:    `SELECT _tagKey AS "key", value FROM _tags WHERE (_name = 'cpu') AND (_tagKey =~ /^reg/)`,
+		},
 		{
 			stmt: `SELECT value FROM cpu`,
 			s:    `SELECT value FROM cpu`,
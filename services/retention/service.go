@@ -17,7 +17,7 @@ type Service struct {
 	}
 	TSDBStore interface {
 		ShardIDs() []uint64
-		DeleteShard(shardID uint64) error
+		DeleteShard(shardID uint64) (bool, error)
 	}
 
 	enabled       bool
@@ -134,7 +134,7 @@ func (s *Service) deleteShards() {
 
 			for _, id := range s.TSDBStore.ShardIDs() {
 				if di, ok := deletedShardIDs[id]; ok {
-					if err := s.TSDBStore.DeleteShard(id); err != nil {
+					if _, err := s.TSDBStore.DeleteShard(id); err != nil {
 						s.logger.Info("Failed to delete shard",
 							logger.Shard(id),
 							logger.Database(di.db),
@@ -45,6 +45,14 @@ const (
 	// DefaultMaxPointsPerBlock is the maximum number of points in an encoded
 	// block in a TSM file
 	DefaultMaxPointsPerBlock = 1000
+
+	// DefaultVacuumMinTombstones is the number of tombstones a shard must
+	// have before Store.Vacuum rewrites its files.
+	DefaultVacuumMinTombstones = 100
+
+	// DefaultAsyncWriteQueueSize is the number of writes Store.WriteToShardAsync
+	// queues for a shard before refusing more.
+	DefaultAsyncWriteQueueSize = 100
 )
 
 // Config holds the configuration for the tsbd package.
@@ -58,6 +66,13 @@ type Config struct {
 	WALDir            string `toml:"wal-dir"`
 	WALLoggingEnabled bool   `toml:"wal-logging-enabled"`
 
+	// WALFsyncDelay is how long writes may go without being synced to disk.
+	// Zero syncs every write before it is acknowledged. A positive delay
+	// batches syncs, and acknowledged writes made since the last sync can be
+	// lost if the host crashes. A negative delay disables syncing, for data
+	// that can be written again.
+	WALFsyncDelay toml.Duration `toml:"wal-fsync-delay"`
+
 	// Query logging
 	QueryLogEnabled bool `toml:"query-log-enabled"`
 
@@ -5,8 +5,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/freetsdb/freetsdb/models"
@@ -35,16 +39,114 @@ type Engine interface {
 	CreateIterator(opt influxql.IteratorOptions) (influxql.Iterator, error)
 	SeriesKeys(opt influxql.IteratorOptions) (influxql.SeriesList, error)
 	WritePoints(points []models.Point, measurementFieldsToSave map[string]*MeasurementFields, seriesToCreate []*SeriesCreate) error
+
+	// TryWritePoints is like WritePoints but returns ErrShardBusy instead of
+	// waiting when the engine is locked by another operation.
+	TryWritePoints(points []models.Point, measurementFieldsToSave map[string]*MeasurementFields, seriesToCreate []*SeriesCreate) error
+
 	DeleteSeries(keys []string) error
+	DeleteSeriesRange(keys []string, min, max int64) error
+	ImportFiles(paths []string) error
 	DeleteMeasurement(name string, seriesKeys []string) error
+
+	// DeleteField removes the values of a field from the series, keeping
+	// the values of their other fields.
+	DeleteField(field string, seriesKeys []string) error
+
+	// RenameMeasurement stages the rename of a measurement's series. Nothing
+	// is visible until the returned rename is committed, and writes to the
+	// engine block until it is committed or aborted.
+	RenameMeasurement(oldName, newName string) (PendingRename, error)
 	SeriesCount() (n int, err error)
 
+	// WriteSnapshot writes the in-memory cache to a new TSM file and removes
+	// the WAL segments that were flushed.
+	WriteSnapshot() error
+
 	// Format will return the format for the engine
 	Format() EngineFormat
 
 	io.WriterTo
 
 	Backup(w io.Writer, basePath string, since time.Time) error
+
+	// BackupFiles calls fn with the path of each data file of the engine,
+	// after snapshotting the cache. The files are not removed while fn runs.
+	BackupFiles(fn func(path string) error) error
+
+	// SetCacheMaxSize changes the maximum number of bytes the engine's
+	// cache may consume. Zero means unlimited.
+	SetCacheMaxSize(maxSize uint64)
+
+	// SetWALFsyncDelay sets how long writes may go without being synced to
+	// disk. See Config.WALFsyncDelay.
+	SetWALFsyncDelay(d time.Duration)
+
+	// TimeRange returns the minimum and maximum timestamps of the values
+	// held by the engine. ok is false if the engine holds no values.
+	TimeRange() (min, max int64, ok bool)
+
+	// SeriesTimeRange returns the minimum and maximum timestamps of the
+	// values of a series. ok is false if the engine holds no values for it.
+	SeriesTimeRange(seriesKey string) (min, max int64, ok bool)
+
+	// Verify checks the engine's files for corruption.
+	Verify() (*ShardVerifyResult, error)
+
+	// Tombstones returns the deletions recorded in the engine's files that
+	// have not been purged by a compaction yet.
+	Tombstones() ([]Tombstone, error)
+
+	// PurgeTombstones rewrites the engine's files that have tombstones
+	// without the deleted data and returns the number of bytes reclaimed.
+	// wait is called with the size of each file before it is rewritten, and
+	// an error from it stops the purge.
+	PurgeTombstones(wait func(size int64) error) (reclaimed int64, err error)
+
+	// CompactionStatus returns the compactions of the engine's files that are
+	// in progress.
+	CompactionStatus() CompactionStatus
+}
+
+// PendingRename is a measurement rename staged by an engine.
+type PendingRename interface {
+	// Commit replaces the engine's data with the renamed data.
+	Commit() error
+
+	// Abort discards the renamed data.
+	Abort()
+}
+
+// CompactionStatus describes the compactions of a shard's files that are in
+// progress. A shard may run several compactions at once, of different levels
+// or of different groups of files.
+type CompactionStatus struct {
+	// Active reports whether any compaction is in progress, and Compactions
+	// how many are.
+	Active      bool
+	Compactions int
+
+	// Level is the highest level being compacted, from 1 for the files
+	// written from the cache up to FullCompactionLevel.
+	Level int
+
+	// Bytes is the number of bytes written by the compactions so far.
+	Bytes int64
+
+	// Start is when the oldest of the compactions started.
+	Start time.Time
+}
+
+// FullCompactionLevel is the level of a CompactionStatus for a compaction of
+// all of a shard's files into the fewest possible.
+const FullCompactionLevel = 4
+
+// Tombstone is a deletion of the values of a key between Min and Max, in
+// nanoseconds, that is still recorded in a shard's files.
+type Tombstone struct {
+	Key string
+	Min int64
+	Max int64
 }
 
 // EngineFormat represents the format for an engine.
@@ -61,6 +163,10 @@ type NewEngineFunc func(path string, walPath string, options EngineOptions) Engi
 // newEngineFuncs is a lookup of engine constructors by name.
 var newEngineFuncs = make(map[string]NewEngineFunc)
 
+// EngineFormatFile is the name of the file in a shard directory that records
+// the engine the shard was created with. Shards without it are tsm1.
+const EngineFormatFile = "engine"
+
 // RegisterEngine registers a storage engine initializer by name.
 func RegisterEngine(name string, fn NewEngineFunc) {
 	if _, ok := newEngineFuncs[name]; ok {
@@ -87,14 +193,17 @@ func NewEngine(path string, walPath string, options EngineOptions) (Engine, erro
 		return newEngineFuncs[options.EngineVersion](path, walPath, options), nil
 	}
 
-	// If it's a dir then it's a tsm1 engine
+	// If it's a dir then it's a tsm1 engine, unless the shard recorded the
+	// engine it was created with.
 	format := "tsm1"
 	if fi, err := os.Stat(path); err != nil {
 		return nil, err
 	} else if !fi.Mode().IsDir() {
 		return nil, ErrUnknownEngineFormat
-	} else {
-		format = "tsm1"
+	} else if b, err := ioutil.ReadFile(filepath.Join(path, EngineFormatFile)); err == nil {
+		format = strings.TrimSpace(string(b))
+	} else if !os.IsNotExist(err) {
+		return nil, err
 	}
 
 	// Lookup engine by format.
@@ -110,6 +219,119 @@ func NewEngine(path string, walPath string, options EngineOptions) (Engine, erro
 type EngineOptions struct {
 	EngineVersion string
 
+	// OpenLimit is the maximum number of shards opened concurrently when the
+	// store is opened, and closed concurrently when it is closed. A limit of
+	// 1 opens shards one at a time, in directory order. Values less than 1
+	// default to GOMAXPROCS.
+	OpenLimit int
+
+	// ReadOnly opens the store and its shards without modifying anything on
+	// disk. Writes, deletes and shard creation return ErrStoreReadOnly, and
+	// data that has not been flushed from the WAL is not loaded.
+	ReadOnly bool
+
+	// MaxSeriesPerDatabase is the maximum number of series a database may
+	// hold. Writes that would create series beyond it are rejected with
+	// ErrMaxSeriesLimitExceeded, while writes to existing series still
+	// succeed. Zero means unlimited.
+	MaxSeriesPerDatabase int
+
+	// StrictOpen causes the store to fail to open if any shard can't be
+	// opened. By default such shards are skipped and reported by
+	// Store.ShardOpenErrors.
+	StrictOpen bool
+
+	// RecoverMissingWAL causes the store to recreate the WAL directory of a
+	// shard that is missing when the store opens, and to open the shard from
+	// its data files. Writes that were only in the WAL are lost. By default
+	// such shards fail to open with ErrWALMissing. A WAL is only considered
+	// missing if the WAL directory of its retention policy exists, so a store
+	// opened from a Snapshot starts with empty WALs, unless WALInline is set.
+	RecoverMissingWAL bool
+
+	// ShardPathFunc, if set, returns the data and WAL directories of new
+	// shards instead of <store path>/<db>/<rp>/<id> and <WALDir>/<db>/<rp>/<id>.
+	// Both directories must still end in <db>/<rp>/<id>. Shards placed outside
+	// the store path are only loaded on open if their root directory is
+	// listed by ShardRootsFunc.
+	ShardPathFunc func(database, retentionPolicy string, shardID uint64) (dataPath, walPath string)
+
+	// WALInline keeps the WAL of each new shard in a wal directory inside the
+	// shard's data directory, <db>/<rp>/<id>/wal, instead of under
+	// Config.WALDir, so that one directory holds everything of a shard. It
+	// also applies to shards placed by ShardPathFunc. Existing shards keep
+	// the layout they were created with.
+	WALInline bool
+
+	// ShardRootsFunc returns the directories, besides the store path, that
+	// are searched for <db>/<rp>/<id> shard directories when the store is
+	// opened.
+	ShardRootsFunc func() []string
+
+	// DatabaseFilter, if not empty, limits the store to the named databases.
+	// Other databases are not loaded when the store is opened, are left
+	// untouched on disk and can't be created or deleted through the store.
+	// Their shards are reported as not found.
+	DatabaseFilter []string
+
+	// MaintenanceInterval is how often the store runs maintenance on its
+	// shards. Each pass writes the cache of every shard that was written to
+	// since its previous snapshot, and has not been written to for at least
+	// the interval, to a new TSM file, so that idle shards don't keep their
+	// data in memory and in WAL segments. Compactions are scheduled by the
+	// engines themselves and are not affected. Values less than or equal to
+	// zero default to one minute.
+	MaintenanceInterval time.Duration
+
+	// DisableMaintenance turns off periodic maintenance, for nodes where
+	// snapshots are triggered externally. Maintenance never runs on a
+	// read-only store.
+	DisableMaintenance bool
+
+	// DedupWrites collapses the points of a write to a shard that have the
+	// same series and timestamp into one point before it is written, so that
+	// points a client retried within a batch are not written to the WAL and
+	// cache more than once. Fields are merged with the values of later points
+	// winning, so a field that changes type between duplicates takes the
+	// type of the last one instead of failing the write.
+	DedupWrites bool
+
+	// VacuumMinTombstones is the number of tombstones a shard must have for
+	// Store.Vacuum to rewrite its files. Values less than 1 default to
+	// DefaultVacuumMinTombstones.
+	VacuumMinTombstones int
+
+	// VacuumBytesPerSecond limits how fast Store.Vacuum reads the files it
+	// rewrites, so that it doesn't saturate the disks. Zero means unlimited.
+	VacuumBytesPerSecond int64
+
+	// AsyncWriteQueueSize is the number of writes Store.WriteToShardAsync
+	// queues for a shard before refusing more with ErrWriteQueueFull. Values
+	// less than 1 default to DefaultAsyncWriteQueueSize.
+	AsyncWriteQueueSize int
+
+	// InternTags causes the index of a database to share the storage of
+	// identical tag keys and values across its series, which reduces memory
+	// use when many series repeat the same tags. It applies to indexes
+	// created while it is set, such as when the store opens. See
+	// Store.InternStats.
+	InternTags bool
+
+	// MaxOpenShards limits how many shards the store keeps open. When more
+	// are open, the least recently used ones are closed, and they are opened
+	// again when they are next returned by Store.Shard or written to. This
+	// bounds the memory held by the caches and indexes of shards that are
+	// rarely used, at the cost of the first read or write of a closed shard
+	// waiting for it to load its files. Queries still holding a shard when
+	// it is closed fail with ErrEngineClosed. Shards with queued writes are
+	// not closed. Zero means unlimited.
+	MaxOpenShards int
+
+	// RecordLockStats makes the store record how often its lock is taken and
+	// how long it is waited for and held, as reported by Store.LockStats. It
+	// is meant for diagnosing lock contention and is off by default.
+	RecordLockStats bool
+
 	Config Config
 }
 
@@ -117,10 +339,57 @@ type EngineOptions struct {
 func NewEngineOptions() EngineOptions {
 	return EngineOptions{
 		EngineVersion: DefaultEngine,
+		OpenLimit:     runtime.GOMAXPROCS(0),
 		Config:        NewConfig(),
 	}
 }
 
+// includesDatabase returns true if name passes the DatabaseFilter.
+func (o EngineOptions) includesDatabase(name string) bool {
+	if len(o.DatabaseFilter) == 0 {
+		return true
+	}
+	for _, db := range o.DatabaseFilter {
+		if db == name {
+			return true
+		}
+	}
+	return false
+}
+
+// openLimit returns the number of shards that may be opened concurrently.
+func (o EngineOptions) openLimit() int {
+	if o.OpenLimit < 1 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return o.OpenLimit
+}
+
+// maintenanceInterval returns the interval between maintenance passes.
+func (o EngineOptions) maintenanceInterval() time.Duration {
+	if o.MaintenanceInterval <= 0 {
+		return maintenanceCheckInterval
+	}
+	return o.MaintenanceInterval
+}
+
+// vacuumMinTombstones returns the number of tombstones a shard must have to
+// be vacuumed.
+func (o EngineOptions) vacuumMinTombstones() int {
+	if o.VacuumMinTombstones < 1 {
+		return DefaultVacuumMinTombstones
+	}
+	return o.VacuumMinTombstones
+}
+
+// asyncWriteQueueSize returns the number of writes queued for a shard.
+func (o EngineOptions) asyncWriteQueueSize() int {
+	if o.AsyncWriteQueueSize < 1 {
+		return DefaultAsyncWriteQueueSize
+	}
+	return o.AsyncWriteQueueSize
+}
+
 // DedupeEntries returns slices with unique keys (the first 8 bytes).
 func DedupeEntries(a [][]byte) [][]byte {
 	// Convert to a map where the last slice is used.
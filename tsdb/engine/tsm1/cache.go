@@ -3,6 +3,7 @@ package tsm1
 import (
 	"expvar"
 	"fmt"
+	"math"
 	"os"
 	"sort"
 	"sync"
@@ -72,6 +73,25 @@ func (e *entry) deduplicate() {
 	e.needSort = false
 }
 
+// deleteRange removes the values with timestamps between min and max, inclusive,
+// and returns the size of the removed values.
+func (e *entry) deleteRange(min, max int64) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var removed int
+	values := make(Values, 0, len(e.values))
+	for _, v := range e.values {
+		if t := v.UnixNano(); t >= min && t <= max {
+			removed += v.Size()
+			continue
+		}
+		values = append(values, v)
+	}
+	e.values = values
+	return removed
+}
+
 func (e *entry) count() int {
 	e.mu.RLock()
 	defer e.mu.RUnlock()
@@ -273,9 +293,20 @@ func (c *Cache) Size() uint64 {
 
 // MaxSize returns the maximum number of bytes the cache may consume.
 func (c *Cache) MaxSize() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.maxSize
 }
 
+// SetMaxSize changes the maximum number of bytes the cache may consume. Zero
+// means unlimited. Values already in the cache are kept if they exceed the
+// new limit, and writes fail until enough of them are snapshotted.
+func (c *Cache) SetMaxSize(maxSize uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxSize = maxSize
+}
+
 // Keys returns a sorted slice of all keys under management by the cache.
 func (c *Cache) Keys() []string {
 	c.mu.RLock()
@@ -306,6 +337,97 @@ func (c *Cache) Delete(keys []string) {
 	}
 }
 
+// DeleteRange removes the values between min and max, inclusive, for the keys
+// from the cache and from any snapshot that has not been written yet.
+func (c *Cache) DeleteRange(keys []string, min, max int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var removed int
+	for _, k := range keys {
+		if e := c.store[k]; e != nil {
+			removed += e.deleteRange(min, max)
+			if e.count() == 0 {
+				delete(c.store, k)
+			}
+		}
+
+		if c.snapshot == nil {
+			continue
+		}
+		if e := c.snapshot.store[k]; e != nil {
+			c.snapshotSize -= uint64(e.deleteRange(min, max))
+			if e.count() == 0 {
+				delete(c.snapshot.store, k)
+			}
+		}
+	}
+
+	c.size -= uint64(removed)
+	c.updateMemSize(-int64(removed))
+}
+
+// TimeRange returns the minimum and maximum timestamps of the values in the
+// cache, including a snapshot that has not been written yet. ok is false if
+// the cache is empty.
+func (c *Cache) TimeRange() (min, max int64, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	min, max = math.MaxInt64, math.MinInt64
+	stores := []map[string]*entry{c.store}
+	if c.snapshot != nil {
+		stores = append(stores, c.snapshot.store)
+	}
+	for _, store := range stores {
+		for _, e := range store {
+			e.mu.RLock()
+			for _, v := range e.values {
+				if t := v.UnixNano(); t < min {
+					min = t
+				}
+				if t := v.UnixNano(); t > max {
+					max = t
+				}
+				ok = true
+			}
+			e.mu.RUnlock()
+		}
+	}
+	return min, max, ok
+}
+
+// KeyTimeRange returns the minimum and maximum timestamps of the values for
+// key in the cache, including a snapshot that has not been written yet. ok is
+// false if the cache holds no values for key.
+func (c *Cache) KeyTimeRange(key string) (min, max int64, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	min, max = math.MaxInt64, math.MinInt64
+	entries := []*entry{c.store[key]}
+	if c.snapshot != nil {
+		entries = append(entries, c.snapshot.store[key])
+	}
+	for _, e := range entries {
+		if e == nil {
+			continue
+		}
+		e.mu.RLock()
+		for _, v := range e.values {
+			if t := v.UnixNano(); t < min {
+				min = t
+			}
+			if t := v.UnixNano(); t > max {
+				max = t
+			}
+			ok = true
+		}
+		e.mu.RUnlock()
+	}
+	return min, max, ok
+}
+
 // merged returns a copy of hot and snapshot values. The copy will be merged, deduped, and
 // sorted. It assumes all necessary locks have been taken. If the caller knows that the
 // the hot source data for the key will not be changed, it is safe to call this function
@@ -468,6 +590,8 @@ func (cl *CacheLoader) Load(cache *Cache) error {
 					}
 				case *DeleteWALEntry:
 					cache.Delete(t.Keys)
+				case *DeleteRangeWALEntry:
+					cache.DeleteRange(t.Keys, t.Min, t.Max)
 				}
 			}
 
@@ -276,6 +276,38 @@ func TestCache_CacheWriteMemoryExceeded(t *testing.T) {
 	}
 }
 
+func TestCache_SetMaxSize(t *testing.T) {
+	v0 := NewValue(1, 1.0)
+	v1 := NewValue(2, 2.0)
+
+	c := NewCache(uint64(v0.Size()), "")
+	if err := c.Write("foo", Values{v0}); err != nil {
+		t.Fatalf("failed to write key foo to cache: %s", err.Error())
+	} else if err := c.Write("bar", Values{v1}); err != ErrCacheMemoryExceeded {
+		t.Fatalf("wrong error writing key bar to cache: %v", err)
+	}
+
+	c.SetMaxSize(uint64(v0.Size() + v1.Size()))
+	if c.MaxSize() != uint64(v0.Size()+v1.Size()) {
+		t.Fatalf("cache max size not correct: %d", c.MaxSize())
+	} else if err := c.Write("bar", Values{v1}); err != nil {
+		t.Fatalf("failed to write key bar to cache: %s", err.Error())
+	}
+
+	// Lowering the limit keeps the values but refuses new writes.
+	c.SetMaxSize(1)
+	if err := c.Write("baz", Values{v1}); err != ErrCacheMemoryExceeded {
+		t.Fatalf("wrong error writing key baz to cache: %v", err)
+	} else if exp, keys := []string{"bar", "foo"}, c.Keys(); !reflect.DeepEqual(keys, exp) {
+		t.Fatalf("cache keys incorrect, exp %v, got %v", exp, keys)
+	}
+
+	c.SetMaxSize(0)
+	if err := c.Write("baz", Values{v1}); err != nil {
+		t.Fatalf("failed to write key baz to cache: %s", err.Error())
+	}
+}
+
 // Ensure the CacheLoader can correctly load from a single segment, even if it's corrupted.
 func TestCacheLoader_LoadSingle(t *testing.T) {
 	// Create a WAL segment.
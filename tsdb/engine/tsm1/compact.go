@@ -18,6 +18,7 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"sync/atomic"
 	"time"
 
 	"github.com/freetsdb/freetsdb/tsdb"
@@ -419,8 +420,10 @@ func (c *Compactor) WriteSnapshot(cache *Cache) ([]string, error) {
 	return c.writeNewFiles(c.FileStore.NextGeneration(), 0, iter)
 }
 
-// Compact will write multiple smaller TSM files into 1 or more larger files
-func (c *Compactor) compact(fast bool, tsmFiles []string) ([]string, error) {
+// Compact will write multiple smaller TSM files into 1 or more larger files.
+// If written is not nil, the size of each block is added to it as the block is
+// written.
+func (c *Compactor) compact(fast bool, tsmFiles []string, written *int64) ([]string, error) {
 	size := c.Size
 	if size <= 0 {
 		size = tsdb.DefaultMaxPointsPerBlock
@@ -472,18 +475,89 @@ func (c *Compactor) compact(fast bool, tsmFiles []string) ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
+	if written != nil {
+		tsm = &countingKeyIterator{iter: tsm, n: written}
+	}
 
 	return c.writeNewFiles(maxGeneration, maxSequence, tsm)
 }
 
 // Compact will write multiple smaller TSM files into 1 or more larger files
 func (c *Compactor) CompactFull(tsmFiles []string) ([]string, error) {
-	return c.compact(false, tsmFiles)
+	return c.compact(false, tsmFiles, nil)
 }
 
 // Compact will write multiple smaller TSM files into 1 or more larger files
 func (c *Compactor) CompactFast(tsmFiles []string) ([]string, error) {
-	return c.compact(true, tsmFiles)
+	return c.compact(true, tsmFiles, nil)
+}
+
+// DeleteRange writes a copy of tsmFile without the values between min and max,
+// inclusive, for keys. The new files keep the generation of tsmFile and are
+// numbered after sequence, which must be the highest sequence in use for that
+// generation.
+func (c *Compactor) DeleteRange(tsmFile string, sequence int, keys map[string]struct{}, min, max int64) ([]string, error) {
+	size := c.Size
+	if size <= 0 {
+		size = tsdb.DefaultMaxPointsPerBlock
+	}
+
+	generation, _, err := ParseTSMFileName(tsmFile)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(tsmFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tr, err := NewTSMReaderWithOptions(
+		TSMReaderOptions{
+			MMAPFile: f,
+		})
+	if err != nil {
+		return nil, err
+	}
+	defer tr.Close()
+
+	tsm, err := NewTSMKeyIterator(size, true, tr)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.writeNewFiles(generation, sequence, &rangeDeleteKeyIterator{
+		iter: tsm,
+		keys: keys,
+		min:  min,
+		max:  max,
+	})
+}
+
+// RenameMeasurement rewrites a TSM file with the keys of the measurement
+// oldName renamed to newName. The new files keep the generation of the file
+// and are numbered from sequence+1.
+func (c *Compactor) RenameMeasurement(tsmFile string, sequence int, oldName, newName string) ([]string, error) {
+	generation, _, err := ParseTSMFileName(tsmFile)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(tsmFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tr, err := NewTSMReaderWithOptions(
+		TSMReaderOptions{
+			MMAPFile: f,
+		})
+	if err != nil {
+		return nil, err
+	}
+	defer tr.Close()
+
+	return c.writeNewFiles(generation, sequence, newRenameKeyIterator(tr, oldName, newName))
 }
 
 // Clone will return a new compactor that can be used even if the engine is closed
@@ -897,6 +971,143 @@ func (k *tsmKeyIterator) Close() error {
 	return nil
 }
 
+// rangeDeleteKeyIterator wraps a KeyIterator and drops the values between min
+// and max, inclusive, for a set of keys. Blocks left without values are skipped.
+type rangeDeleteKeyIterator struct {
+	iter     KeyIterator
+	keys     map[string]struct{}
+	min, max int64
+
+	key              string
+	minTime, maxTime int64
+	block            []byte
+	err              error
+}
+
+func (k *rangeDeleteKeyIterator) Next() bool {
+	for k.iter.Next() {
+		k.key, k.minTime, k.maxTime, k.block, k.err = k.iter.Read()
+		if k.err != nil {
+			return true
+		}
+
+		// Blocks of other keys or outside the range are passed through as is.
+		if _, ok := k.keys[k.key]; !ok || k.maxTime < k.min || k.minTime > k.max {
+			return true
+		}
+
+		values, err := DecodeBlock(k.block, nil)
+		if err != nil {
+			k.err = err
+			return true
+		}
+
+		remaining := values[:0]
+		for _, v := range values {
+			if t := v.UnixNano(); t < k.min || t > k.max {
+				remaining = append(remaining, v)
+			}
+		}
+		if len(remaining) == 0 {
+			continue
+		}
+
+		k.block, k.err = Values(remaining).Encode(nil)
+		k.minTime, k.maxTime = remaining[0].UnixNano(), remaining[len(remaining)-1].UnixNano()
+		return true
+	}
+	return false
+}
+
+func (k *rangeDeleteKeyIterator) Read() (string, int64, int64, []byte, error) {
+	return k.key, k.minTime, k.maxTime, k.block, k.err
+}
+
+func (k *rangeDeleteKeyIterator) Close() error {
+	return k.iter.Close()
+}
+
+// countingKeyIterator wraps a KeyIterator and atomically adds the size of each
+// block read to n.
+type countingKeyIterator struct {
+	iter KeyIterator
+	n    *int64
+}
+
+func (k *countingKeyIterator) Next() bool { return k.iter.Next() }
+
+func (k *countingKeyIterator) Read() (string, int64, int64, []byte, error) {
+	key, minTime, maxTime, block, err := k.iter.Read()
+	atomic.AddInt64(k.n, int64(len(block)))
+	return key, minTime, maxTime, block, err
+}
+
+func (k *countingKeyIterator) Close() error {
+	return k.iter.Close()
+}
+
+// renameKeyIterator iterates over the blocks of a TSM file with the keys of a
+// measurement renamed. Keys are returned in order of their new names. When a
+// renamed key already exists in the file, the blocks of both are returned
+// under it ordered by time.
+type renameKeyIterator struct {
+	r    *TSMReader
+	keys []renamedKey // sorted by new key
+	i    int
+
+	entries          []*IndexEntry // remaining blocks of the current key
+	key              string
+	minTime, maxTime int64
+	block            []byte
+	err              error
+}
+
+// renamedKey maps a key in the TSM file to the key it is written as.
+type renamedKey struct {
+	key string
+	src string
+}
+
+func newRenameKeyIterator(r *TSMReader, oldName, newName string) *renameKeyIterator {
+	keys := make([]renamedKey, r.KeyCount())
+	for i := range keys {
+		src := r.KeyAt(i)
+		key, _ := renameMeasurementKey(src, oldName, newName)
+		keys[i] = renamedKey{key: key, src: src}
+	}
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].key < keys[j].key })
+
+	return &renameKeyIterator{r: r, keys: keys}
+}
+
+func (k *renameKeyIterator) Next() bool {
+	for len(k.entries) == 0 {
+		if k.i >= len(k.keys) {
+			return false
+		}
+
+		k.key = k.keys[k.i].key
+		for ; k.i < len(k.keys) && k.keys[k.i].key == k.key; k.i++ {
+			k.entries = append(k.entries, k.r.Entries(k.keys[k.i].src)...)
+		}
+		sort.SliceStable(k.entries, func(i, j int) bool { return k.entries[i].MinTime < k.entries[j].MinTime })
+	}
+
+	ie := k.entries[0]
+	k.entries = k.entries[1:]
+	k.minTime, k.maxTime = ie.MinTime, ie.MaxTime
+	k.block, k.err = k.r.readBytes(ie, nil)
+	return true
+}
+
+func (k *renameKeyIterator) Read() (string, int64, int64, []byte, error) {
+	return k.key, k.minTime, k.maxTime, k.block, k.err
+}
+
+func (k *renameKeyIterator) Close() error {
+	return nil
+}
+
 type cacheKeyIterator struct {
 	cache *Cache
 	size  int
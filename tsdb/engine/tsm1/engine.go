@@ -2,12 +2,17 @@ package tsm1 // import "github.com/freetsdb/freetsdb/tsdb/engine/tsm1"
 
 import (
 	"archive/tar"
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/freetsdb/freetsdb/logger"
@@ -38,6 +43,16 @@ type Engine struct {
 	done chan struct{}
 	wg   sync.WaitGroup
 
+	// rewriteMu is held for reading by snapshots and compactions while they
+	// write TSM files, and for writing by DeleteSeriesRange while it rewrites
+	// TSM files, so that no file is written from data that is being deleted.
+	rewriteMu sync.RWMutex
+
+	// compactions holds the TSM compactions in progress, see
+	// CompactionStatus.
+	compactionsMu sync.Mutex
+	compactions   map[*compaction]struct{}
+
 	path   string
 	logger *zap.Logger
 
@@ -53,6 +68,10 @@ type Engine struct {
 
 	MaxPointsPerBlock int
 
+	// readOnly prevents the engine from modifying its files. The WAL is not
+	// opened and no compactions are run.
+	readOnly bool
+
 	// CacheFlushMemorySizeThreshold specifies the minimum size threshodl for
 	// the cache when the engine should write a snapshot to a TSM file
 	CacheFlushMemorySizeThreshold uint64
@@ -67,6 +86,7 @@ type Engine struct {
 func NewEngine(path string, walPath string, opt tsdb.EngineOptions) tsdb.Engine {
 	w := NewWAL(walPath)
 	w.LoggingEnabled = opt.Config.WALLoggingEnabled
+	w.SetFsyncDelay(time.Duration(opt.Config.WALFsyncDelay))
 
 	fs := NewFileStore(path)
 	fs.traceLogging = opt.Config.DataLoggingEnabled
@@ -92,6 +112,8 @@ func NewEngine(path string, walPath string, opt tsdb.EngineOptions) tsdb.Engine
 			CompactFullWriteColdDuration: time.Duration(opt.Config.CompactFullWriteColdDuration),
 		},
 		MaxPointsPerBlock: opt.Config.MaxPointsPerBlock,
+		readOnly:          opt.ReadOnly,
+		compactions:       make(map[*compaction]struct{}),
 
 		CacheFlushMemorySizeThreshold: opt.Config.CacheSnapshotMemorySize,
 		CacheFlushWriteColdDuration:   time.Duration(opt.Config.CacheSnapshotWriteColdDuration),
@@ -138,6 +160,11 @@ func (e *Engine) Open() error {
 	e.done = make(chan struct{})
 	e.Compactor.Cancel = e.done
 
+	// A read-only engine only serves the existing TSM files.
+	if e.readOnly {
+		return e.FileStore.Open()
+	}
+
 	if err := os.MkdirAll(e.path, 0777); err != nil {
 		return err
 	}
@@ -252,8 +279,11 @@ func (e *Engine) LoadMetadataIndex(_ *tsdb.Shard, index *tsdb.DatabaseIndex, mea
 // backup is running. For shards that are still acively getting writes, this
 // could cause the WAL to backup, increasing memory usage and evenutally rejecting writes.
 func (e *Engine) Backup(w io.Writer, basePath string, since time.Time) error {
-	if err := e.WriteSnapshot(); err != nil {
-		return err
+	// A read-only engine has no cache to snapshot.
+	if !e.readOnly {
+		if err := e.WriteSnapshot(); err != nil {
+			return err
+		}
 	}
 	e.FileStore.mu.RLock()
 	defer e.FileStore.mu.RUnlock()
@@ -286,6 +316,32 @@ func (e *Engine) Backup(w io.Writer, basePath string, since time.Time) error {
 
 // writeFileToBackup will copy the file into the tar archive. Files will use the shardRelativePath
 // in their names. This should be the <db>/<retention policy>/<id> part of the path
+// BackupFiles snapshots the cache and calls fn with the path of each TSM and
+// tombstone file. The file store is locked for reading while fn runs, so
+// compactions cannot remove the files but new TSM files cannot be created.
+func (e *Engine) BackupFiles(fn func(path string) error) error {
+	// A read-only engine has no cache to snapshot.
+	if !e.readOnly {
+		if err := e.WriteSnapshot(); err != nil {
+			return err
+		}
+	}
+	e.FileStore.mu.RLock()
+	defer e.FileStore.mu.RUnlock()
+
+	for _, f := range e.FileStore.files {
+		if err := fn(f.Path()); err != nil {
+			return err
+		}
+		for _, t := range f.TombstoneFiles() {
+			if err := fn(t.Path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (e *Engine) writeFileToBackup(f FileStat, shardRelativePath string, tw *tar.Writer) error {
 	h := &tar.Header{
 		Name:    filepath.Join(shardRelativePath, filepath.Base(f.Path)),
@@ -343,6 +399,38 @@ func (e *Engine) addToIndexFromKey(key string, fieldType influxql.DataType, inde
 // WritePoints writes metadata and point data into the engine.
 // Returns an error if new points are added to an existing key.
 func (e *Engine) WritePoints(points []models.Point, measurementFieldsToSave map[string]*tsdb.MeasurementFields, seriesToCreate []*tsdb.SeriesCreate) error {
+	if e.readOnly {
+		return tsdb.ErrStoreReadOnly
+	}
+
+	values := pointValues(points)
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return e.writeValues(values)
+}
+
+// TryWritePoints writes metadata and point data into the engine like
+// WritePoints, but returns tsdb.ErrShardBusy if the engine is locked by a
+// snapshot, rename or other exclusive operation.
+func (e *Engine) TryWritePoints(points []models.Point, measurementFieldsToSave map[string]*tsdb.MeasurementFields, seriesToCreate []*tsdb.SeriesCreate) error {
+	if e.readOnly {
+		return tsdb.ErrStoreReadOnly
+	}
+
+	values := pointValues(points)
+
+	if !e.mu.TryRLock() {
+		return tsdb.ErrShardBusy
+	}
+	defer e.mu.RUnlock()
+
+	return e.writeValues(values)
+}
+
+// pointValues returns the values of points keyed by series and field.
+func pointValues(points []models.Point) map[string][]Value {
 	values := map[string][]Value{}
 	for _, p := range points {
 		for k, v := range p.Fields() {
@@ -350,10 +438,11 @@ func (e *Engine) WritePoints(points []models.Point, measurementFieldsToSave map[
 			values[key] = append(values[key], NewValue(p.Time().UnixNano(), v))
 		}
 	}
+	return values
+}
 
-	e.mu.RLock()
-	defer e.mu.RUnlock()
-
+// writeValues writes values to the cache and the WAL. e.mu must be held.
+func (e *Engine) writeValues(values map[string][]Value) error {
 	// first try to write to the cache
 	err := e.Cache.WriteMulti(values)
 	if err != nil {
@@ -366,6 +455,10 @@ func (e *Engine) WritePoints(points []models.Point, measurementFieldsToSave map[
 
 // DeleteSeries deletes the series from the engine.
 func (e *Engine) DeleteSeries(seriesKeys []string) error {
+	if e.readOnly {
+		return tsdb.ErrStoreReadOnly
+	}
+
 	e.mu.RLock()
 	defer e.mu.RUnlock()
 
@@ -406,20 +499,730 @@ func (e *Engine) DeleteSeries(seriesKeys []string) error {
 	return err
 }
 
+// DeleteSeriesRange deletes the values between min and max, inclusive, for the
+// series from the engine. TSM files holding values in the range are rewritten
+// without them. The series themselves are kept.
+func (e *Engine) DeleteSeriesRange(seriesKeys []string, min, max int64) error {
+	if e.readOnly {
+		return tsdb.ErrStoreReadOnly
+	}
+
+	e.rewriteMu.Lock()
+	defer e.rewriteMu.Unlock()
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	// keyMap is used to see if a given key should be deleted.  seriesKey
+	// are the measurement + tagset (minus separate & field)
+	keyMap := map[string]struct{}{}
+	for _, k := range seriesKeys {
+		keyMap[k] = struct{}{}
+	}
+
+	// go through the keys in the file store
+	deleteKeys := map[string]struct{}{}
+	for _, k := range e.FileStore.Keys() {
+		seriesKey, _ := seriesAndFieldFromCompositeKey(k)
+		if _, ok := keyMap[seriesKey]; ok {
+			deleteKeys[k] = struct{}{}
+		}
+	}
+	if err := e.deleteRangeFromFiles(deleteKeys, min, max); err != nil {
+		return err
+	}
+
+	// find the keys in the cache, including an unwritten snapshot
+	var walKeys []string
+	e.Cache.Lock()
+	for k := range e.Cache.Store() {
+		seriesKey, _ := seriesAndFieldFromCompositeKey(k)
+		if _, ok := keyMap[seriesKey]; ok {
+			walKeys = append(walKeys, k)
+		}
+	}
+	if e.Cache.snapshot != nil {
+		for k := range e.Cache.snapshot.store {
+			seriesKey, _ := seriesAndFieldFromCompositeKey(k)
+			if _, ok := keyMap[seriesKey]; ok {
+				walKeys = append(walKeys, k)
+			}
+		}
+	}
+	e.Cache.Unlock()
+	e.Cache.DeleteRange(walKeys, min, max)
+
+	// delete from the WAL
+	_, err := e.WAL.DeleteRange(walKeys, min, max)
+
+	return err
+}
+
+// deleteRangeFromFiles rewrites the TSM files that hold values between min and
+// max for any of keys and replaces them in the file store.
+func (e *Engine) deleteRangeFromFiles(keys map[string]struct{}, min, max int64) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	// The rewritten files keep their generation, so find the highest sequence
+	// used by each generation to name them uniquely.
+	files := e.FileStore.Files()
+	sequences, err := fileSequences(files)
+	if err != nil {
+		return err
+	}
+
+	var oldFiles, newFiles []string
+	for _, f := range files {
+		if !containsRange(f, keys, min, max) {
+			continue
+		}
+
+		gen, _, _ := ParseTSMFileName(f.Path())
+		rewritten, err := e.Compactor.DeleteRange(f.Path(), sequences[gen], keys, min, max)
+		if err != nil {
+			for _, name := range newFiles {
+				os.Remove(name)
+			}
+			return err
+		}
+		sequences[gen] += len(rewritten)
+
+		oldFiles = append(oldFiles, f.Path())
+		newFiles = append(newFiles, rewritten...)
+	}
+
+	if len(oldFiles) == 0 {
+		return nil
+	}
+	return e.FileStore.Replace(oldFiles, newFiles)
+}
+
+// fileSequences returns the highest sequence used by each generation of files.
+func fileSequences(files []TSMFile) (map[int]int, error) {
+	sequences := map[int]int{}
+	for _, f := range files {
+		gen, seq, err := ParseTSMFileName(f.Path())
+		if err != nil {
+			return nil, err
+		}
+		if seq > sequences[gen] {
+			sequences[gen] = seq
+		}
+	}
+	return sequences, nil
+}
+
+// containsRange returns true if f has a block for any of keys that overlaps
+// min and max.
+func containsRange(f TSMFile, keys map[string]struct{}, min, max int64) bool {
+	if fmin, fmax := f.TimeRange(); fmax < min || fmin > max {
+		return false
+	}
+
+	for k := range keys {
+		for _, ie := range f.Entries(k) {
+			if ie.MaxTime >= min && ie.MinTime <= max {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RenameMeasurement stages the rename of a measurement's series. The cache is
+// written to TSM files first, then every TSM file holding series of the
+// measurement is rewritten under the new name, one block at a time, into
+// temporary files. Series that already exist under newName are merged. The
+// rewritten files replace the old ones when the rename is committed; writes to
+// the engine are blocked until then or until the rename is aborted.
+func (e *Engine) RenameMeasurement(oldName, newName string) (tsdb.PendingRename, error) {
+	if e.readOnly {
+		return nil, tsdb.ErrStoreReadOnly
+	}
+
+	e.rewriteMu.Lock()
+	e.mu.Lock()
+	r := &pendingRename{e: e}
+
+	if err := e.writeSnapshotLocked(); err != nil {
+		r.Abort()
+		return nil, err
+	}
+
+	files := e.FileStore.Files()
+	sequences, err := fileSequences(files)
+	if err != nil {
+		r.Abort()
+		return nil, err
+	}
+
+	for _, f := range files {
+		if !containsMeasurement(f, oldName) {
+			continue
+		}
+
+		gen, _, _ := ParseTSMFileName(f.Path())
+		rewritten, err := e.Compactor.RenameMeasurement(f.Path(), sequences[gen], oldName, newName)
+		if err != nil {
+			r.Abort()
+			return nil, err
+		}
+		sequences[gen] += len(rewritten)
+
+		r.oldFiles = append(r.oldFiles, f.Path())
+		r.newFiles = append(r.newFiles, rewritten...)
+	}
+	return r, nil
+}
+
+// pendingRename holds the engine's locks and the rewritten files of a staged
+// measurement rename.
+type pendingRename struct {
+	e        *Engine
+	once     sync.Once
+	oldFiles []string
+	newFiles []string
+}
+
+// Commit replaces the renamed TSM files by their rewritten versions. It does
+// nothing if the rename was already committed or aborted.
+func (r *pendingRename) Commit() (err error) {
+	r.once.Do(func() {
+		defer r.unlock()
+		if len(r.oldFiles) > 0 {
+			err = r.e.FileStore.Replace(r.oldFiles, r.newFiles)
+		}
+	})
+	return err
+}
+
+// Abort removes the rewritten files. It does nothing if the rename was
+// already committed or aborted.
+func (r *pendingRename) Abort() {
+	r.once.Do(func() {
+		defer r.unlock()
+		for _, name := range r.newFiles {
+			os.Remove(name)
+		}
+	})
+}
+
+func (r *pendingRename) unlock() {
+	r.e.mu.Unlock()
+	r.e.rewriteMu.Unlock()
+}
+
+// containsMeasurement returns true if f has a key of the measurement name.
+func containsMeasurement(f TSMFile, name string) bool {
+	for _, k := range f.Keys() {
+		if _, ok := renameMeasurementKey(k, name, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// renameMeasurementKey returns key with its measurement replaced by newName if
+// it is a key of the measurement oldName.
+func renameMeasurementKey(key, oldName, newName string) (string, bool) {
+	seriesKey, _ := seriesAndFieldFromCompositeKey(key)
+	prefix := string(models.MakeKey([]byte(oldName), nil))
+	if !strings.HasPrefix(seriesKey, prefix) || (len(seriesKey) > len(prefix) && seriesKey[len(prefix)] != ',') {
+		return key, false
+	}
+	return string(models.MakeKey([]byte(newName), nil)) + key[len(prefix):], true
+}
+
 // DeleteMeasurement deletes a measurement and all related series.
 func (e *Engine) DeleteMeasurement(name string, seriesKeys []string) error {
 	return e.DeleteSeries(seriesKeys)
 }
 
-// SeriesCount returns the number of series buckets on the shard.
+// DeleteField removes the values of field from the series, keeping the values
+// of their other fields.
+func (e *Engine) DeleteField(field string, seriesKeys []string) error {
+	if e.readOnly {
+		return tsdb.ErrStoreReadOnly
+	}
+
+	e.rewriteMu.Lock()
+	defer e.rewriteMu.Unlock()
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	keyMap := make(map[string]struct{}, len(seriesKeys))
+	for _, k := range seriesKeys {
+		keyMap[SeriesFieldKey(k, field)] = struct{}{}
+	}
+
+	// go through the keys in the file store
+	var deleteKeys []string
+	for _, k := range e.FileStore.Keys() {
+		if _, ok := keyMap[k]; ok {
+			deleteKeys = append(deleteKeys, k)
+		}
+	}
+	if err := e.FileStore.Delete(deleteKeys); err != nil {
+		return err
+	}
+
+	// find the keys in the cache, including an unwritten snapshot
+	var walKeys []string
+	e.Cache.Lock()
+	for k := range e.Cache.Store() {
+		if _, ok := keyMap[k]; ok {
+			walKeys = append(walKeys, k)
+		}
+	}
+	if e.Cache.snapshot != nil {
+		for k := range e.Cache.snapshot.store {
+			if _, ok := keyMap[k]; ok {
+				walKeys = append(walKeys, k)
+			}
+		}
+	}
+	e.Cache.Unlock()
+	e.Cache.DeleteRange(walKeys, math.MinInt64, math.MaxInt64)
+
+	// delete from the WAL
+	_, err := e.WAL.Delete(walKeys)
+	return err
+}
+
+// Verify checks the header and index of each TSM file and the checksum of each
+// of their blocks, and decodes every entry of the closed WAL segments. The
+// files are opened separately from the file store so that writes, snapshots
+// and compactions continue while they are verified. Files removed by a
+// compaction or snapshot before they are opened are skipped.
+func (e *Engine) Verify() (*tsdb.ShardVerifyResult, error) {
+	res := &tsdb.ShardVerifyResult{}
+
+	for _, f := range e.FileStore.Files() {
+		good, bad, err := verifyTSMFile(f.Path())
+		if os.IsNotExist(err) {
+			continue
+		}
+		res.TSMFiles++
+		res.GoodBlocks += good
+		res.BadBlocks += bad
+		if err != nil && res.FirstBadFile == "" {
+			res.FirstBadFile, res.FirstError = f.Path(), err
+		}
+	}
+
+	segments, err := e.WAL.ClosedSegments()
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range segments {
+		good, bad, err := verifyWALSegment(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		res.WALSegments++
+		res.GoodBlocks += good
+		res.BadBlocks += bad
+		if err != nil && res.FirstBadFile == "" {
+			res.FirstBadFile, res.FirstError = path, err
+		}
+	}
+
+	return res, nil
+}
+
+// verifyTSMFile returns the number of blocks of the TSM file at path whose
+// checksum matches and the number that don't. The returned error describes
+// the first problem found.
+func verifyTSMFile(path string) (good, bad int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	r, err := NewTSMReader(f)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var buf []byte
+	var firstErr error
+	for i := 0; i < r.KeyCount(); i++ {
+		key, entries := r.Key(i)
+		for _, ie := range entries {
+			if int(ie.Size) > len(buf) {
+				buf = make([]byte, ie.Size)
+			}
+			b := buf[:ie.Size]
+
+			if _, err := f.ReadAt(b, ie.Offset); err != nil || len(b) < 4 {
+				bad++
+				if firstErr == nil {
+					firstErr = fmt.Errorf("key %s: cannot read block at offset %d: %v", key, ie.Offset, err)
+				}
+				continue
+			}
+			if binary.BigEndian.Uint32(b[:4]) != crc32.ChecksumIEEE(b[4:]) {
+				bad++
+				if firstErr == nil {
+					firstErr = fmt.Errorf("key %s: checksum mismatch for block at offset %d", key, ie.Offset)
+				}
+				continue
+			}
+			good++
+		}
+	}
+	return good, bad, firstErr
+}
+
+// verifyWALSegment returns the number of entries of the WAL segment at path
+// that could be decoded. Decoding stops at the first corrupt entry, which is
+// counted as bad and described by the returned error.
+func verifyWALSegment(path string) (good, bad int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	r := NewWALSegmentReader(f)
+	defer r.Close()
+
+	for r.Next() {
+		if _, err := r.Read(); err != nil {
+			return good, 1, fmt.Errorf("entry %d: %v", good, err)
+		}
+		good++
+	}
+	return good, 0, nil
+}
+
+// ImportFiles copies prebuilt TSM files into the engine and adds their series
+// to the index. A file is rejected if it is not a valid TSM file or if any of
+// its keys has values in the engine within the time range the file covers for
+// that key. Nothing is imported unless every file is accepted.
+func (e *Engine) ImportFiles(paths []string) error {
+	if e.readOnly {
+		return tsdb.ErrStoreReadOnly
+	}
+
+	e.rewriteMu.Lock()
+	defer e.rewriteMu.Unlock()
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	for _, path := range paths {
+		if err := e.verifyImportFile(path); err != nil {
+			return fmt.Errorf("import %s: %v", path, err)
+		}
+	}
+
+	var newFiles []string
+	for _, path := range paths {
+		name := filepath.Join(e.path, fmt.Sprintf("%09d-%09d.%s.tmp", e.FileStore.NextGeneration(), 1, TSMFileExtension))
+		if err := copyFile(path, name); err != nil {
+			for _, name := range newFiles {
+				os.Remove(name)
+			}
+			return err
+		}
+		newFiles = append(newFiles, name)
+	}
+
+	if err := e.FileStore.Replace(nil, newFiles); err != nil {
+		return err
+	}
+
+	for _, name := range newFiles {
+		if err := e.loadImportedKeys(strings.TrimSuffix(name, ".tmp")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyImportFile returns an error if the TSM file at path cannot be read or
+// overlaps data already held by the engine.
+func (e *Engine) verifyImportFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := NewTSMReader(f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	files := e.FileStore.Files()
+	for _, key := range r.Keys() {
+		entries := r.Entries(key)
+		min, max := entries[0].MinTime, entries[len(entries)-1].MaxTime
+
+		for _, f := range files {
+			for _, ie := range f.Entries(key) {
+				if ie.OverlapsTimeRange(min, max) {
+					return fmt.Errorf("key %s overlaps existing data in %s", key, f.Path())
+				}
+			}
+		}
+
+		if values := e.Cache.Values(key); len(values) > 0 {
+			if values[len(values)-1].UnixNano() >= min && values[0].UnixNano() <= max {
+				return fmt.Errorf("key %s overlaps existing data in cache", key)
+			}
+		}
+	}
+	return nil
+}
+
+// loadImportedKeys adds the keys of the imported TSM file at path to the index.
+func (e *Engine) loadImportedKeys(path string) error {
+	for _, f := range e.FileStore.Files() {
+		if f.Path() != path {
+			continue
+		}
+
+		for _, key := range f.Keys() {
+			typ, err := f.Type(key)
+			if err != nil {
+				return err
+			}
+			fieldType, err := tsmFieldTypeToInfluxQLDataType(typ)
+			if err != nil {
+				return err
+			}
+			if err := e.addToIndexFromKey(key, fieldType, e.index, e.measurementFields); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// copyFile copies the file at src to a new file at dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_RDWR|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+// SetCacheMaxSize changes the maximum number of bytes the engine's cache may
+// consume.
+func (e *Engine) SetCacheMaxSize(maxSize uint64) {
+	e.Cache.SetMaxSize(maxSize)
+}
+
+// SetWALFsyncDelay sets how long writes to the engine may go without being
+// synced to disk. See WAL.SetFsyncDelay.
+func (e *Engine) SetWALFsyncDelay(d time.Duration) {
+	e.WAL.SetFsyncDelay(d)
+}
+
+// TimeRange returns the minimum and maximum timestamps of the values in the
+// TSM files and the cache. Values removed by tombstones are still included.
+func (e *Engine) TimeRange() (min, max int64, ok bool) {
+	min, max, ok = e.Cache.TimeRange()
+	for _, f := range e.FileStore.Files() {
+		fmin, fmax := f.TimeRange()
+		if fmin < min {
+			min = fmin
+		}
+		if fmax > max {
+			max = fmax
+		}
+		ok = true
+	}
+	return min, max, ok
+}
+
+// SeriesTimeRange returns the minimum and maximum timestamps of the values of
+// any field of the series. ok is false if the engine holds no values for it.
+func (e *Engine) SeriesTimeRange(seriesKey string) (min, max int64, ok bool) {
+	e.mu.RLock()
+	var fields []string
+	if mf := e.measurementFields[tsdb.MeasurementFromSeriesKey(seriesKey)]; mf != nil {
+		for name := range mf.Fields {
+			fields = append(fields, name)
+		}
+	}
+	e.mu.RUnlock()
+
+	min, max = math.MaxInt64, math.MinInt64
+	files := e.FileStore.Files()
+	for _, field := range fields {
+		key := SeriesFieldKey(seriesKey, field)
+		if cmin, cmax, cok := e.Cache.KeyTimeRange(key); cok {
+			if cmin < min {
+				min = cmin
+			}
+			if cmax > max {
+				max = cmax
+			}
+			ok = true
+		}
+
+		// Range deletes rewrite the files, so the index entries only
+		// cover values that still exist.
+		for _, f := range files {
+			for _, ie := range f.Entries(key) {
+				if ie.MinTime < min {
+					min = ie.MinTime
+				}
+				if ie.MaxTime > max {
+					max = ie.MaxTime
+				}
+				ok = true
+			}
+		}
+	}
+	return min, max, ok
+}
+
+// Tombstones returns the keys deleted from each TSM file, sorted by key. A
+// tombstone removes a key from a whole file, so its time range is that of
+// the file.
+func (e *Engine) Tombstones() ([]tsdb.Tombstone, error) {
+	var a []tsdb.Tombstone
+	for _, f := range e.FileStore.Files() {
+		if !f.HasTombstones() {
+			continue
+		}
+		keys, err := f.TombstoneKeys()
+		if err != nil {
+			return nil, err
+		}
+		min, max := f.TimeRange()
+		for _, k := range keys {
+			a = append(a, tsdb.Tombstone{Key: k, Min: min, Max: max})
+		}
+	}
+	sort.SliceStable(a, func(i, j int) bool { return a[i].Key < a[j].Key })
+	return a, nil
+}
+
+// PurgeTombstones rewrites each TSM file that has tombstones without the
+// deleted keys, and removes its tombstone file. wait is called with the size
+// of each file before it is rewritten, and an error from it stops the purge.
+// It returns the number of bytes the rewritten files and their tombstones
+// used on disk beyond the files that replaced them.
+func (e *Engine) PurgeTombstones(wait func(size int64) error) (reclaimed int64, err error) {
+	if e.readOnly {
+		return 0, tsdb.ErrStoreReadOnly
+	}
+
+	for _, f := range e.FileStore.Files() {
+		if !f.HasTombstones() {
+			continue
+		}
+		if err := wait(int64(f.Size())); err != nil {
+			return reclaimed, err
+		}
+		n, err := e.purgeFile(f.Path())
+		if err != nil {
+			return reclaimed, err
+		}
+		reclaimed += n
+	}
+	return reclaimed, nil
+}
+
+// purgeFile rewrites the TSM file at path without its tombstoned keys and
+// returns the number of bytes reclaimed. Files that were removed or replaced
+// by a compaction since they were listed are skipped.
+func (e *Engine) purgeFile(path string) (int64, error) {
+	e.rewriteMu.Lock()
+	defer e.rewriteMu.Unlock()
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	files := e.FileStore.Files()
+	var f TSMFile
+	for _, tf := range files {
+		if tf.Path() == path {
+			f = tf
+			break
+		}
+	}
+	if f == nil || !f.HasTombstones() {
+		return 0, nil
+	}
+
+	before := int64(f.Size())
+	for _, t := range f.TombstoneFiles() {
+		before += int64(t.Size)
+	}
+
+	sequences, err := fileSequences(files)
+	if err != nil {
+		return 0, err
+	}
+	gen, _, _ := ParseTSMFileName(path)
+	newFiles, err := e.Compactor.DeleteRange(path, sequences[gen], nil, 0, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	var after int64
+	for _, name := range newFiles {
+		fi, err := os.Stat(name)
+		if err != nil {
+			for _, name := range newFiles {
+				os.Remove(name)
+			}
+			return 0, err
+		}
+		after += fi.Size()
+	}
+
+	if err := e.FileStore.Replace([]string{path}, newFiles); err != nil {
+		return 0, err
+	}
+	return before - after, nil
+}
+
+// SeriesCount returns the number of series in the TSM files and the cache.
 func (e *Engine) SeriesCount() (n int, err error) {
-	return 0, nil
+	series := make(map[string]struct{})
+	for _, keys := range [][]string{e.FileStore.Keys(), e.Cache.Keys()} {
+		for _, k := range keys {
+			seriesKey, _ := seriesAndFieldFromCompositeKey(k)
+			series[seriesKey] = struct{}{}
+		}
+	}
+	return len(series), nil
 }
 
 func (e *Engine) WriteTo(w io.Writer) (n int64, err error) { panic("not implemented") }
 
 // WriteSnapshot will snapshot the cache and write a new TSM file with its contents, releasing the snapshot when done.
 func (e *Engine) WriteSnapshot() error {
+	if e.readOnly {
+		return tsdb.ErrStoreReadOnly
+	}
+
+	e.rewriteMu.RLock()
+	defer e.rewriteMu.RUnlock()
+
 	// Lock and grab the cache snapshot along with all the closed WAL
 	// filenames associated with the snapshot
 	started := time.Now()
@@ -488,6 +1291,13 @@ func (e *Engine) writeSnapshotAndCommit(closedFiles []string, snapshot *Cache, c
 	e.mu.RLock()
 	defer e.mu.RUnlock()
 
+	return e.commitSnapshot(closedFiles, newFiles)
+}
+
+// commitSnapshot adds the TSM files written from the cache snapshot to the
+// file store, then clears the snapshot and removes the closed WAL segments.
+// e.mu must be held.
+func (e *Engine) commitSnapshot(closedFiles, newFiles []string) error {
 	// update the file store with these new files
 	if err := e.FileStore.Replace(nil, newFiles); err != nil {
 		e.logger.Info("Error adding new TSM files from snapshot", zap.Error(err))
@@ -504,6 +1314,40 @@ func (e *Engine) writeSnapshotAndCommit(closedFiles []string, snapshot *Cache, c
 	return nil
 }
 
+// writeSnapshotLocked writes the whole cache to TSM files while e.mu is held
+// for writing, so that no values are written to the cache in the meantime.
+func (e *Engine) writeSnapshotLocked() error {
+	if len(e.Cache.Keys()) == 0 {
+		return nil
+	}
+
+	if err := e.WAL.CloseSegment(); err != nil {
+		return err
+	}
+
+	segments, err := e.WAL.ClosedSegments()
+	if err != nil {
+		return err
+	}
+
+	snapshot, err := e.Cache.Snapshot()
+	if err != nil {
+		return err
+	}
+	snapshot.Deduplicate()
+
+	newFiles, err := e.Compactor.WriteSnapshot(snapshot)
+	if err != nil {
+		e.Cache.ClearSnapshot(false)
+		return err
+	}
+	if err := e.commitSnapshot(segments, newFiles); err != nil {
+		e.Cache.ClearSnapshot(false)
+		return err
+	}
+	return nil
+}
+
 // compactCache continually checks if the WAL cache should be written to disk
 func (e *Engine) compactCache() {
 	defer e.wg.Done()
@@ -539,6 +1383,51 @@ func (e *Engine) ShouldCompactCache(lastWriteTime time.Time) bool {
 		time.Now().Sub(lastWriteTime) > e.CacheFlushWriteColdDuration
 }
 
+// compaction is a TSM compaction in progress.
+type compaction struct {
+	level int
+	start time.Time
+	bytes int64 // written so far, updated atomically
+}
+
+// beginCompaction records a compaction of level as in progress until
+// endCompaction is called with it.
+func (e *Engine) beginCompaction(level int) *compaction {
+	c := &compaction{level: level, start: time.Now()}
+	e.compactionsMu.Lock()
+	e.compactions[c] = struct{}{}
+	e.compactionsMu.Unlock()
+	return c
+}
+
+func (e *Engine) endCompaction(c *compaction) {
+	e.compactionsMu.Lock()
+	delete(e.compactions, c)
+	e.compactionsMu.Unlock()
+}
+
+// CompactionStatus returns the TSM compactions in progress. Full compactions
+// are reported as tsdb.FullCompactionLevel, and snapshots of the cache are
+// not included.
+func (e *Engine) CompactionStatus() tsdb.CompactionStatus {
+	e.compactionsMu.Lock()
+	defer e.compactionsMu.Unlock()
+
+	var status tsdb.CompactionStatus
+	for c := range e.compactions {
+		if !status.Active || c.start.Before(status.Start) {
+			status.Start = c.start
+		}
+		if c.level > status.Level {
+			status.Level = c.level
+		}
+		status.Bytes += atomic.LoadInt64(&c.bytes)
+		status.Active = true
+		status.Compactions++
+	}
+	return status
+}
+
 func (e *Engine) compactTSMLevel(fast bool, level int) {
 	defer e.wg.Done()
 
@@ -560,7 +1449,11 @@ func (e *Engine) compactTSMLevel(fast bool, level int) {
 				wg.Add(1)
 				go func(groupNum int, group CompactionGroup) {
 					defer wg.Done()
-					start := time.Now()
+					e.rewriteMu.RLock()
+					defer e.rewriteMu.RUnlock()
+					c := e.beginCompaction(level)
+					defer e.endCompaction(c)
+					start := c.start
 					e.logger.Info("Beginning compaction",
 						zap.Int("level", level),
 						zap.Int("group", groupNum),
@@ -574,23 +1467,11 @@ func (e *Engine) compactTSMLevel(fast bool, level int) {
 							zap.Int("", i))    // index
 					}
 
-					var files []string
-					var err error
-
-					if fast {
-						files, err = e.Compactor.CompactFast(group)
-						if err != nil {
-							e.logger.Info("Error compacting TSM files", zap.Error(err))
-							time.Sleep(time.Second)
-							return
-						}
-					} else {
-						files, err = e.Compactor.CompactFull(group)
-						if err != nil {
-							e.logger.Info("Error compacting TSM files", zap.Error(err))
-							time.Sleep(time.Second)
-							return
-						}
+					files, err := e.Compactor.compact(fast, group, &c.bytes)
+					if err != nil {
+						e.logger.Info("Error compacting TSM files", zap.Error(err))
+						time.Sleep(time.Second)
+						return
 					}
 
 					if err := e.FileStore.Replace(group, files); err != nil {
@@ -640,7 +1521,11 @@ func (e *Engine) compactTSMFull() {
 				wg.Add(1)
 				go func(groupNum int, group CompactionGroup) {
 					defer wg.Done()
-					start := time.Now()
+					e.rewriteMu.RLock()
+					defer e.rewriteMu.RUnlock()
+					c := e.beginCompaction(tsdb.FullCompactionLevel)
+					defer e.endCompaction(c)
+					start := c.start
 					e.logger.Info("Beginning full compaction",
 						zap.Int("group", groupNum),
 						zap.Int("tsm_files", len(group)))
@@ -651,7 +1536,7 @@ func (e *Engine) compactTSMFull() {
 							zap.Int("", i))
 					}
 
-					files, err := e.Compactor.CompactFull(group)
+					files, err := e.Compactor.compact(false, group, &c.bytes)
 					if err != nil {
 						e.logger.Info("Error compacting TSM files", zap.Error(err))
 						time.Sleep(time.Second)
@@ -0,0 +1,99 @@
+package tsm1
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/freetsdb/freetsdb/tsdb"
+)
+
+// Ensure the engine reports the compactions in progress.
+func TestEngine_CompactionStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tsm1-compaction-status-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	e := NewEngine(filepath.Join(dir, "data"), filepath.Join(dir, "wal"), tsdb.NewEngineOptions()).(*Engine)
+	if status := e.CompactionStatus(); status != (tsdb.CompactionStatus{}) {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+
+	c1 := e.beginCompaction(2)
+	c2 := e.beginCompaction(tsdb.FullCompactionLevel)
+	atomic.AddInt64(&c1.bytes, 10)
+	atomic.AddInt64(&c2.bytes, 5)
+	if status := e.CompactionStatus(); status != (tsdb.CompactionStatus{Active: true, Compactions: 2, Level: tsdb.FullCompactionLevel, Bytes: 15, Start: c1.start}) {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+
+	e.endCompaction(c2)
+	if status := e.CompactionStatus(); status != (tsdb.CompactionStatus{Active: true, Compactions: 1, Level: 2, Bytes: 10, Start: c1.start}) {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+	e.endCompaction(c1)
+	if status := e.CompactionStatus(); status != (tsdb.CompactionStatus{}) {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+}
+
+// Ensure a compaction counts the bytes of the blocks it writes.
+func TestCompactor_CompactWritten(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tsm1-compact-written-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var files []string
+	for gen := 1; gen <= 2; gen++ {
+		path := filepath.Join(dir, fmt.Sprintf("%09d-%09d.%s", gen, 1, TSMFileExtension))
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := NewTSMWriter(f)
+		if err != nil {
+			t.Fatal(err)
+		} else if err := w.Write("cpu,host=A#!~#value", []Value{NewValue(int64(gen), float64(gen))}); err != nil {
+			t.Fatal(err)
+		} else if err := w.WriteIndex(); err != nil {
+			t.Fatal(err)
+		} else if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, path)
+	}
+
+	var written int64
+	c := &Compactor{Dir: dir}
+	newFiles, err := c.compact(false, files, &written)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(newFiles) != 1 {
+		t.Fatalf("unexpected files: %v", newFiles)
+	}
+
+	f, err := os.Open(newFiles[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewTSMReaderWithOptions(TSMReaderOptions{MMAPFile: f})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	var exp int64
+	for _, ie := range r.Entries("cpu,host=A#!~#value") {
+		exp += int64(ie.Size) - 4 // blocks are stored after their checksum
+	}
+	if exp <= 0 || written != exp {
+		t.Fatalf("unexpected bytes written: got %d, exp %d", written, exp)
+	}
+}
@@ -3,6 +3,7 @@ package tsm1_test
 import (
 	"archive/tar"
 	"bytes"
+	"errors"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -127,6 +128,134 @@ func TestEngine_DeleteWALLoadMetadata(t *testing.T) {
 	}
 }
 
+// Ensure the engine counts each series once across the cache and TSM files.
+func TestEngine_SeriesCount(t *testing.T) {
+	e := MustOpenEngine()
+	defer e.Close()
+
+	if err := e.WritePointsString(
+		`cpu,host=A value=1.1,idle=2.1 1000000000`,
+		`cpu,host=B value=1.2 1000000000`,
+	); err != nil {
+		t.Fatalf("failed to write points: %s", err.Error())
+	}
+	e.MustWriteSnapshot()
+	if err := e.WritePointsString(
+		`cpu,host=A value=1.3 2000000000`,
+		`mem,host=A value=1.4 2000000000`,
+	); err != nil {
+		t.Fatalf("failed to write points: %s", err.Error())
+	}
+
+	if n, err := e.SeriesCount(); err != nil {
+		t.Fatal(err)
+	} else if n != 3 {
+		t.Fatalf("unexpected series count: %d", n)
+	}
+}
+
+// Ensure engine can delete a time range of a series from the cache and TSM
+// files, and that the delete survives a reopen.
+func TestEngine_DeleteSeriesRange(t *testing.T) {
+	e := MustOpenEngine()
+	defer e.Close()
+
+	e.Index().CreateMeasurementIndexIfNotExists("cpu")
+	e.MeasurementFields("cpu").CreateFieldIfNotExists("value", influxql.Float, false)
+	e.Index().CreateSeriesIndexIfNotExists("cpu", tsdb.NewSeries("cpu,host=A", map[string]string{"host": "A"}))
+	e.Index().CreateSeriesIndexIfNotExists("cpu", tsdb.NewSeries("cpu,host=B", map[string]string{"host": "B"}))
+	if err := e.WritePointsString(
+		`cpu,host=A value=1.1 1000000000`,
+		`cpu,host=A value=1.2 2000000000`,
+		`cpu,host=A value=1.3 3000000000`,
+		`cpu,host=B value=2.2 2000000000`,
+	); err != nil {
+		t.Fatalf("failed to write points: %s", err.Error())
+	}
+	e.MustWriteSnapshot()
+	if err := e.WritePointsString(
+		`cpu,host=A value=1.4 4000000000`,
+		`cpu,host=A value=1.5 5000000000`,
+	); err != nil {
+		t.Fatalf("failed to write points: %s", err.Error())
+	}
+
+	if err := e.DeleteSeriesRange([]string{"cpu,host=A"}, 2000000000, 4000000000); err != nil {
+		t.Fatalf("failed to delete series range: %s", err.Error())
+	}
+
+	exp := []int64{1000000000, 5000000000, 2000000000}
+	if got := MustReadTimes(e); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected times: got %v, exp %v", got, exp)
+	}
+
+	if err := e.Reopen(); err != nil {
+		t.Fatal(err)
+	} else if err := e.LoadMetadataIndex(nil, tsdb.NewDatabaseIndex("db"), make(map[string]*tsdb.MeasurementFields)); err != nil {
+		t.Fatal(err)
+	}
+	e.Index().CreateSeriesIndexIfNotExists("cpu", tsdb.NewSeries("cpu,host=A", map[string]string{"host": "A"}))
+	e.Index().CreateSeriesIndexIfNotExists("cpu", tsdb.NewSeries("cpu,host=B", map[string]string{"host": "B"}))
+	if got := MustReadTimes(e); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected times after reopen: got %v, exp %v", got, exp)
+	}
+}
+
+// Ensure the engine rewrites files with tombstones without the deleted keys.
+func TestEngine_PurgeTombstones(t *testing.T) {
+	e := MustOpenEngine()
+	defer e.Close()
+
+	if err := e.WritePointsString(
+		`cpu,host=A value=1.1 1000000000`,
+		`cpu,host=A value=1.2 2000000000`,
+		`cpu,host=B value=2.1 1000000000`,
+	); err != nil {
+		t.Fatalf("failed to write points: %s", err.Error())
+	}
+	e.MustWriteSnapshot()
+	if err := e.DeleteSeries([]string{"cpu,host=A"}); err != nil {
+		t.Fatalf("failed to delete series: %s", err.Error())
+	}
+
+	// An error from wait stops the purge before the file is rewritten.
+	errStop := errors.New("stop")
+	if _, err := e.PurgeTombstones(func(int64) error { return errStop }); err != errStop {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var sizes []int64
+	wait := func(size int64) error {
+		sizes = append(sizes, size)
+		return nil
+	}
+	if n, err := e.PurgeTombstones(wait); err != nil {
+		t.Fatal(err)
+	} else if n <= 0 {
+		t.Fatalf("unexpected bytes reclaimed: %d", n)
+	} else if len(sizes) != 1 || sizes[0] <= 0 {
+		t.Fatalf("unexpected file sizes: %v", sizes)
+	}
+
+	if a, err := e.Tombstones(); err != nil {
+		t.Fatal(err)
+	} else if len(a) != 0 {
+		t.Fatalf("unexpected tombstones: %v", a)
+	} else if n, err := e.SeriesCount(); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatalf("unexpected series count: %d", n)
+	}
+
+	// Nothing is left to purge.
+	sizes = nil
+	if n, err := e.PurgeTombstones(wait); err != nil {
+		t.Fatal(err)
+	} else if n != 0 || len(sizes) != 0 {
+		t.Fatalf("unexpected purge: %d bytes, sizes %v", n, sizes)
+	}
+}
+
 // Ensure that the engine will backup any TSM files created since the passed in time
 func TestEngine_Backup(t *testing.T) {
 	// Generate temporary file.
@@ -557,6 +686,30 @@ func (e *Engine) MustWriteSnapshot() {
 	}
 }
 
+// MustReadTimes returns the times of all cpu values in the engine, ordered by
+// host and then time. Panic on error.
+func MustReadTimes(e *Engine) []int64 {
+	itr, err := e.CreateIterator(influxql.IteratorOptions{
+		Expr:       influxql.MustParseExpr(`value`),
+		Dimensions: []string{"host"},
+		Sources:    []influxql.Source{&influxql.Measurement{Name: "cpu"}},
+		StartTime:  influxql.MinTime,
+		EndTime:    influxql.MaxTime,
+		Ascending:  true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer itr.Close()
+
+	var times []int64
+	fitr := itr.(influxql.FloatIterator)
+	for p := fitr.Next(); p != nil; p = fitr.Next() {
+		times = append(times, p.Time)
+	}
+	return times
+}
+
 // WritePointsString parses a string buffer and writes the points.
 func (e *Engine) WritePointsString(buf ...string) error {
 	return e.WritePoints(MustParsePointsString(strings.Join(buf, "\n")), nil, nil)
@@ -66,6 +66,9 @@ type TSMFile interface {
 	// written for this file.
 	TombstoneFiles() []FileStat
 
+	// TombstoneKeys returns the keys recorded as deleted from this file.
+	TombstoneKeys() ([]string, error)
+
 	// Close the underlying file resources
 	Close() error
 
@@ -348,6 +348,13 @@ func (t *TSMReader) TombstoneFiles() []FileStat {
 	return t.tombstoner.TombstoneFiles()
 }
 
+// TombstoneKeys returns the keys recorded as deleted from this TSM file.
+func (t *TSMReader) TombstoneKeys() ([]string, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.tombstoner.ReadAll()
+}
+
 func (t *TSMReader) Stats() FileStat {
 	minTime, maxTime := t.index.TimeRange()
 	minKey, maxKey := t.index.KeyRange()
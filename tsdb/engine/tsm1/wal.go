@@ -51,11 +51,15 @@ type SegmentInfo struct {
 type WalEntryType byte
 
 const (
-	WriteWALEntryType  WalEntryType = 0x01
-	DeleteWALEntryType WalEntryType = 0x02
+	WriteWALEntryType       WalEntryType = 0x01
+	DeleteWALEntryType      WalEntryType = 0x02
+	DeleteRangeWALEntryType WalEntryType = 0x03
 )
 
-var ErrWALClosed = fmt.Errorf("WAL closed")
+var (
+	ErrWALClosed  = fmt.Errorf("WAL closed")
+	ErrWALCorrupt = fmt.Errorf("corrupted WAL entry")
+)
 
 // Statistics gathered by the WAL.
 const (
@@ -86,6 +90,14 @@ type WAL struct {
 	// LoggingEnabled specifies if detailed logs should be output
 	LoggingEnabled bool
 
+	// fsyncDelay is how long a write may go without being synced to disk,
+	// see SetFsyncDelay. lastSync is when the current segment was last
+	// synced, and syncTimer syncs it when writes were left unsynced.
+	fsyncDelay time.Duration
+	lastSync   time.Time
+	syncTimer  *time.Timer
+	unsynced   bool
+
 	statMap *expvar.Map
 }
 
@@ -305,7 +317,63 @@ func (l *WAL) writeToLog(entry WALEntry) (int, error) {
 
 	l.lastWriteTime = time.Now()
 
-	return l.currentSegmentID, l.currentSegmentWriter.sync()
+	return l.currentSegmentID, l.syncSegment()
+}
+
+// SetFsyncDelay sets how long a write may go without being synced to disk.
+// Zero syncs every write before it returns. A positive delay syncs at most
+// once per delay, so writes that return in between may be lost if the host
+// crashes before the next sync. A negative delay never syncs, leaving it to
+// the operating system.
+func (l *WAL) SetFsyncDelay(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.fsyncDelay = d
+}
+
+// FsyncDelay returns the delay set by SetFsyncDelay.
+func (l *WAL) FsyncDelay() time.Duration {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.fsyncDelay
+}
+
+// syncSegment syncs the current segment after a write, or schedules it to be
+// synced later according to fsyncDelay. The lock must be held.
+func (l *WAL) syncSegment() error {
+	switch {
+	case l.fsyncDelay < 0:
+		return nil
+	case l.fsyncDelay == 0 || time.Since(l.lastSync) >= l.fsyncDelay:
+		return l.syncNow()
+	}
+
+	l.unsynced = true
+	if l.syncTimer == nil {
+		l.syncTimer = time.AfterFunc(l.fsyncDelay-time.Since(l.lastSync), l.delayedSync)
+	}
+	return nil
+}
+
+// syncNow syncs the current segment. The lock must be held.
+func (l *WAL) syncNow() error {
+	l.unsynced = false
+	l.lastSync = time.Now()
+	return l.currentSegmentWriter.sync()
+}
+
+// delayedSync syncs writes that syncSegment left unsynced.
+func (l *WAL) delayedSync() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.syncTimer = nil
+	if !l.unsynced || l.currentSegmentWriter == nil {
+		return
+	}
+	if err := l.syncNow(); err != nil {
+		l.logger.Info("Error syncing WAL segment", zap.Error(err))
+	}
 }
 
 // rollSegment closes the current segment and opens a new one if the current segment is over
@@ -354,6 +422,25 @@ func (l *WAL) Delete(keys []string) (int, error) {
 	return id, nil
 }
 
+// DeleteRange deletes the values between min and max, inclusive, for the given
+// keys, returning the segment ID for the operation.
+func (l *WAL) DeleteRange(keys []string, min, max int64) (int, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	entry := &DeleteRangeWALEntry{
+		Keys: keys,
+		Min:  min,
+		Max:  max,
+	}
+
+	id, err := l.writeToLog(entry)
+	if err != nil {
+		return -1, err
+	}
+	return id, nil
+}
+
 // Close will finish any flush that is currently in process and close file handles
 func (l *WAL) Close() error {
 	l.mu.Lock()
@@ -362,7 +449,15 @@ func (l *WAL) Close() error {
 	// Close, but don't set to nil so future goroutines can still be signaled
 	close(l.closing)
 
+	if l.syncTimer != nil {
+		l.syncTimer.Stop()
+		l.syncTimer = nil
+	}
+
 	if l.currentSegmentWriter != nil {
+		if l.unsynced {
+			l.syncNow()
+		}
 		l.currentSegmentWriter.close()
 		l.currentSegmentWriter = nil
 	}
@@ -384,6 +479,11 @@ func segmentFileNames(dir string) ([]string, error) {
 func (l *WAL) newSegmentFile() error {
 	l.currentSegmentID++
 	if l.currentSegmentWriter != nil {
+		if l.unsynced {
+			if err := l.syncNow(); err != nil {
+				return err
+			}
+		}
 		if err := l.currentSegmentWriter.close(); err != nil {
 			return err
 		}
@@ -673,6 +773,58 @@ func (w *DeleteWALEntry) Type() WalEntryType {
 	return DeleteWALEntryType
 }
 
+// DeleteRangeWALEntry represents the deletion of the values of multiple series
+// between two timestamps, inclusive.
+type DeleteRangeWALEntry struct {
+	Keys     []string
+	Min, Max int64
+}
+
+func (w *DeleteRangeWALEntry) MarshalBinary() ([]byte, error) {
+	b := make([]byte, defaultBufLen)
+	return w.Encode(b)
+}
+
+func (w *DeleteRangeWALEntry) UnmarshalBinary(b []byte) error {
+	if len(b) < 16 {
+		return ErrWALCorrupt
+	}
+
+	w.Min = int64(binary.BigEndian.Uint64(b[:8]))
+	w.Max = int64(binary.BigEndian.Uint64(b[8:16]))
+	w.Keys = nil
+	if len(b) > 16 {
+		w.Keys = strings.Split(string(b[16:]), "\n")
+	}
+	return nil
+}
+
+func (w *DeleteRangeWALEntry) Encode(dst []byte) ([]byte, error) {
+	sz := 16
+	for _, k := range w.Keys {
+		sz += len(k) + 1
+	}
+	if len(dst) < sz {
+		dst = make([]byte, sz)
+	}
+
+	binary.BigEndian.PutUint64(dst[:8], uint64(w.Min))
+	binary.BigEndian.PutUint64(dst[8:16], uint64(w.Max))
+
+	n := 16
+	for i, k := range w.Keys {
+		if i > 0 {
+			n += copy(dst[n:], "\n")
+		}
+		n += copy(dst[n:], k)
+	}
+	return dst[:n], nil
+}
+
+func (w *DeleteRangeWALEntry) Type() WalEntryType {
+	return DeleteRangeWALEntryType
+}
+
 // WALSegmentWriter writes WAL segments.
 type WALSegmentWriter struct {
 	w    io.WriteCloser
@@ -794,6 +946,8 @@ func (r *WALSegmentReader) Next() bool {
 		}
 	case DeleteWALEntryType:
 		r.entry = &DeleteWALEntry{}
+	case DeleteRangeWALEntryType:
+		r.entry = &DeleteRangeWALEntry{}
 	default:
 		r.err = fmt.Errorf("unknown wal entry type: %v", entryType)
 		return true
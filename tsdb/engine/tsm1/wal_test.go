@@ -3,7 +3,10 @@ package tsm1_test
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/freetsdb/freetsdb/tsdb/engine/tsm1"
 
@@ -239,6 +242,47 @@ func TestWALWriter_WriteDelete_Single(t *testing.T) {
 	}
 }
 
+func TestWALWriter_WriteDeleteRange_Single(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+	f := MustTempFile(dir)
+	w := tsm1.NewWALSegmentWriter(f)
+
+	entry := &tsm1.DeleteRangeWALEntry{
+		Keys: []string{"cpu,host=A#!~#value", "cpu,host=B#!~#value"},
+		Min:  -10,
+		Max:  20,
+	}
+
+	if err := w.Write(mustMarshalEntry(entry)); err != nil {
+		fatal(t, "write points", err)
+	}
+
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		fatal(t, "seek", err)
+	}
+
+	r := tsm1.NewWALSegmentReader(f)
+
+	if !r.Next() {
+		t.Fatalf("expected next, got false")
+	}
+
+	we, err := r.Read()
+	if err != nil {
+		fatal(t, "read entry", err)
+	}
+
+	e, ok := we.(*tsm1.DeleteRangeWALEntry)
+	if !ok {
+		t.Fatalf("expected DeleteRangeWALEntry: got %#v", we)
+	}
+
+	if !reflect.DeepEqual(e, entry) {
+		t.Fatalf("entry mismatch: got %#v, exp %#v", e, entry)
+	}
+}
+
 func TestWALWriter_WritePointsDelete_Multiple(t *testing.T) {
 	dir := MustTempDir()
 	defer os.RemoveAll(dir)
@@ -413,6 +457,61 @@ func TestWAL_Delete(t *testing.T) {
 	}
 }
 
+// Ensure writes reach the segment when syncs are delayed or disabled.
+func TestWAL_SetFsyncDelay(t *testing.T) {
+	for _, d := range []time.Duration{-1, 20 * time.Millisecond} {
+		dir := MustTempDir()
+		defer os.RemoveAll(dir)
+
+		w := tsm1.NewWAL(dir)
+		w.SetFsyncDelay(d)
+		if err := w.Open(); err != nil {
+			t.Fatalf("error opening WAL: %v", err)
+		} else if got := w.FsyncDelay(); got != d {
+			t.Fatalf("unexpected fsync delay: got %v, exp %v", got, d)
+		}
+
+		for i := 0; i < 3; i++ {
+			if _, err := w.WritePoints(map[string][]tsm1.Value{
+				"cpu,host=A#!~#value": []tsm1.Value{
+					tsm1.NewValue(int64(i), 1.1),
+				},
+			}); err != nil {
+				t.Fatalf("error writing points: %v", err)
+			}
+		}
+
+		// Let a delayed sync run before closing.
+		time.Sleep(2 * d)
+		if err := w.Close(); err != nil {
+			t.Fatalf("error closing wal: %v", err)
+		}
+
+		files, err := filepath.Glob(filepath.Join(dir, "*."+tsm1.WALFileExtension))
+		if err != nil {
+			t.Fatal(err)
+		} else if len(files) != 1 {
+			t.Fatalf("unexpected segments: %v", files)
+		}
+		f, err := os.Open(files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := tsm1.NewWALSegmentReader(f)
+		var n int
+		for r.Next() {
+			if _, err := r.Read(); err != nil {
+				t.Fatalf("error reading entry: %v", err)
+			}
+			n++
+		}
+		r.Close()
+		if n != 3 {
+			t.Fatalf("delay %v: unexpected entries: got %d, exp 3", d, n)
+		}
+	}
+}
+
 func TestWALWriter_Corrupt(t *testing.T) {
 	dir := MustTempDir()
 	defer os.RemoveAll(dir)
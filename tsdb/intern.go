@@ -0,0 +1,108 @@
+package tsdb
+
+import "sync"
+
+// InternStats describes how the tag keys and values of the series in the
+// store share their strings. See EngineOptions.InternTags.
+type InternStats struct {
+	// Strings is the number of distinct tag keys and values held, and Bytes
+	// their total length.
+	Strings int
+	Bytes   int64
+
+	// Lookups is the number of tag keys and values of new series that were
+	// interned, and Hits the number of them that reused a string already held.
+	Lookups uint64
+	Hits    uint64
+}
+
+// DedupRatio returns the fraction of lookups that reused a string already
+// held, or zero if nothing was interned.
+func (s InternStats) DedupRatio() float64 {
+	if s.Lookups == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Lookups)
+}
+
+// internedString is a string held by a tagInterner and the number of tags
+// sharing it.
+type internedString struct {
+	s    string
+	refs int
+}
+
+// tagInterner shares the backing storage of identical tag keys and values.
+// Strings are reference counted so that those of dropped series are released.
+type tagInterner struct {
+	mu      sync.Mutex
+	strings map[string]*internedString
+	bytes   int64
+	lookups uint64
+	hits    uint64
+}
+
+func newTagInterner() *tagInterner {
+	return &tagInterner{strings: make(map[string]*internedString)}
+}
+
+// internTags returns a copy of tags whose keys and values are held by the
+// interner.
+func (i *tagInterner) internTags(tags map[string]string) map[string]string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	m := make(map[string]string, len(tags))
+	for k, v := range tags {
+		m[i.intern(k)] = i.intern(v)
+	}
+	return m
+}
+
+// releaseTags drops the references of tags returned by internTags.
+func (i *tagInterner) releaseTags(tags map[string]string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for k, v := range tags {
+		i.release(k)
+		i.release(v)
+	}
+}
+
+// intern returns the held copy of s, adding s if it isn't held. i.mu must be
+// held.
+func (i *tagInterner) intern(s string) string {
+	i.lookups++
+	if is := i.strings[s]; is != nil {
+		is.refs++
+		i.hits++
+		return is.s
+	}
+	i.strings[s] = &internedString{s: s, refs: 1}
+	i.bytes += int64(len(s))
+	return s
+}
+
+// release drops a reference to s. i.mu must be held.
+func (i *tagInterner) release(s string) {
+	is := i.strings[s]
+	if is == nil {
+		return
+	}
+	if is.refs--; is.refs == 0 {
+		delete(i.strings, s)
+		i.bytes -= int64(len(s))
+	}
+}
+
+func (i *tagInterner) stats() InternStats {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return InternStats{
+		Strings: len(i.strings),
+		Bytes:   i.bytes,
+		Lookups: i.lookups,
+		Hits:    i.hits,
+	}
+}
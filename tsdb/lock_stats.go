@@ -0,0 +1,172 @@
+package tsdb
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LockHistogramBuckets are the upper bounds of the buckets of a LockHistogram.
+var LockHistogramBuckets = [...]time.Duration{
+	10 * time.Microsecond,
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+}
+
+// LockHistogram counts durations by bucket. Element i is the number of
+// durations no longer than LockHistogramBuckets[i] and longer than the
+// previous bucket. The final element counts the durations longer than the
+// last bucket.
+type LockHistogram [len(LockHistogramBuckets) + 1]uint64
+
+// Total returns the number of durations in the histogram.
+func (h LockHistogram) Total() uint64 {
+	var n uint64
+	for _, c := range h {
+		n += c
+	}
+	return n
+}
+
+// add records d in the histogram. It is safe for concurrent use.
+func (h *LockHistogram) add(d time.Duration) {
+	i := 0
+	for i < len(LockHistogramBuckets) && d > LockHistogramBuckets[i] {
+		i++
+	}
+	atomic.AddUint64(&h[i], 1)
+}
+
+// load returns a copy of the histogram that is safe to read while it is
+// being updated.
+func (h *LockHistogram) load() LockHistogram {
+	var c LockHistogram
+	for i := range h {
+		c[i] = atomic.LoadUint64(&h[i])
+	}
+	return c
+}
+
+// reset clears the histogram.
+func (h *LockHistogram) reset() {
+	for i := range h {
+		atomic.StoreUint64(&h[i], 0)
+	}
+}
+
+// LockStats describes how the store lock has been used since the store was
+// opened with EngineOptions.RecordLockStats set.
+type LockStats struct {
+	// Locks and RLocks are the number of times the lock was acquired for
+	// writing and for reading.
+	Locks  uint64
+	RLocks uint64
+
+	// LockWait and RLockWait are the time spent waiting to acquire the lock
+	// for writing and for reading.
+	LockWait  LockHistogram
+	RLockWait LockHistogram
+
+	// LockHold is the time the lock was held for writing. Read locks overlap
+	// each other, so their hold time isn't recorded.
+	LockHold LockHistogram
+}
+
+// storeMutex is a sync.RWMutex that can record how it is used. Recording
+// is off until enable is called, and costs an atomic load per call while off.
+type storeMutex struct {
+	sync.RWMutex
+
+	enabled int32
+
+	// lockedAt is when the write lock was last acquired. It is only accessed
+	// while the write lock is held, and is zero if the acquisition wasn't
+	// recorded.
+	lockedAt time.Time
+
+	locks     uint64
+	rlocks    uint64
+	lockWait  LockHistogram
+	rlockWait LockHistogram
+	lockHold  LockHistogram
+}
+
+// enable turns recording on or off and resets the recorded stats. It must
+// not be called while the lock is held.
+func (m *storeMutex) enable(on bool) {
+	atomic.StoreUint64(&m.locks, 0)
+	atomic.StoreUint64(&m.rlocks, 0)
+	m.lockWait.reset()
+	m.rlockWait.reset()
+	m.lockHold.reset()
+
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&m.enabled, v)
+}
+
+func (m *storeMutex) recording() bool { return atomic.LoadInt32(&m.enabled) == 1 }
+
+// Lock locks the mutex for writing.
+func (m *storeMutex) Lock() {
+	if !m.recording() {
+		m.RWMutex.Lock()
+		return
+	}
+
+	start := time.Now()
+	m.RWMutex.Lock()
+	m.lockedAt = time.Now()
+	atomic.AddUint64(&m.locks, 1)
+	m.lockWait.add(m.lockedAt.Sub(start))
+}
+
+// Unlock unlocks the mutex for writing.
+func (m *storeMutex) Unlock() {
+	if !m.lockedAt.IsZero() {
+		m.lockHold.add(time.Since(m.lockedAt))
+		m.lockedAt = time.Time{}
+	}
+	m.RWMutex.Unlock()
+}
+
+// RLock locks the mutex for reading.
+func (m *storeMutex) RLock() {
+	if !m.recording() {
+		m.RWMutex.RLock()
+		return
+	}
+
+	start := time.Now()
+	m.RWMutex.RLock()
+	atomic.AddUint64(&m.rlocks, 1)
+	m.rlockWait.add(time.Since(start))
+}
+
+// TryRLock tries to lock the mutex for reading and reports whether it did.
+func (m *storeMutex) TryRLock() bool {
+	if !m.RWMutex.TryRLock() {
+		return false
+	}
+	if m.recording() {
+		atomic.AddUint64(&m.rlocks, 1)
+		m.rlockWait.add(0)
+	}
+	return true
+}
+
+// stats returns the recorded stats.
+func (m *storeMutex) stats() LockStats {
+	return LockStats{
+		Locks:     atomic.LoadUint64(&m.locks),
+		RLocks:    atomic.LoadUint64(&m.rlocks),
+		LockWait:  m.lockWait.load(),
+		RLockWait: m.rlockWait.load(),
+		LockHold:  m.lockHold.load(),
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/freetsdb/freetsdb"
 	"github.com/freetsdb/freetsdb/services/influxql"
 	"github.com/freetsdb/freetsdb/pkg/escape"
+	"github.com/freetsdb/freetsdb/pkg/estimator/hll"
 	"github.com/freetsdb/freetsdb/tsdb/internal"
 
 	"github.com/gogo/protobuf/proto"
@@ -37,6 +38,17 @@ type DatabaseIndex struct {
 
 	name string // name of the database represented by this index
 
+	// seriesSketch holds every series key added to the index and
+	// seriesTSSketch every key dropped from it, for SeriesCardinalityEstimate.
+	// They are guarded by sketchMu, as counting a sketch can modify it.
+	sketchMu       sync.Mutex
+	seriesSketch   *hll.Plus
+	seriesTSSketch *hll.Plus
+
+	// interner holds the tag keys and values of the series, if they are
+	// interned. See EngineOptions.InternTags.
+	interner *tagInterner
+
 	statMap *expvar.Map
 }
 
@@ -46,6 +58,10 @@ func NewDatabaseIndex(name string) *DatabaseIndex {
 		measurements: make(map[string]*Measurement),
 		series:       make(map[string]*Series),
 		name:         name,
+
+		seriesSketch:   hll.NewDefaultPlus(),
+		seriesTSSketch: hll.NewDefaultPlus(),
+
 		statMap:      freetsdb.NewStatistics("database:"+name, "database", map[string]string{"database": name}),
 	}
 }
@@ -71,6 +87,40 @@ func (d *DatabaseIndex) Measurement(name string) *Measurement {
 	return d.measurements[name]
 }
 
+// SeriesCardinalityEstimate returns an estimate of the number of series,
+// which takes constant time however many series the index holds. It is the
+// estimated number of distinct keys ever added less those ever dropped, so a
+// series that was dropped and created again is not counted.
+func (d *DatabaseIndex) SeriesCardinalityEstimate() int64 {
+	d.sketchMu.Lock()
+	defer d.sketchMu.Unlock()
+	n := int64(d.seriesSketch.Count()) - int64(d.seriesTSSketch.Count())
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// InternStats returns how the tag keys and values of the series share their
+// strings. It is zero if the index doesn't intern them.
+func (d *DatabaseIndex) InternStats() InternStats {
+	if d.interner == nil {
+		return InternStats{}
+	}
+	return d.interner.stats()
+}
+
+// addSeriesToSketch records key in the sketch of added or dropped series.
+func (d *DatabaseIndex) addSeriesToSketch(key string, dropped bool) {
+	d.sketchMu.Lock()
+	defer d.sketchMu.Unlock()
+	if dropped {
+		d.seriesTSSketch.Add([]byte(key))
+	} else {
+		d.seriesSketch.Add([]byte(key))
+	}
+}
+
 // MeasurementsByName returns a list of measurements.
 func (d *DatabaseIndex) MeasurementsByName(names []string) []*Measurement {
 	d.mu.RLock()
@@ -110,9 +160,13 @@ func (d *DatabaseIndex) CreateSeriesIndexIfNotExists(measurementName string, ser
 	d.lastID++
 
 	series.measurement = m
+	if d.interner != nil {
+		series.Tags = d.interner.internTags(series.Tags)
+	}
 	d.series[series.Key] = series
 
 	m.AddSeries(series)
+	d.addSeriesToSketch(series.Key, false)
 
 	d.statMap.Add(statDatabaseSeries, 1)
 
@@ -318,6 +372,22 @@ func (d *DatabaseIndex) MeasurementsByRegex(re *regexp.Regexp) Measurements {
 	return matches
 }
 
+// MeasurementsByTagValue returns the sorted measurements with at least one
+// series having the tag key set to value.
+func (d *DatabaseIndex) MeasurementsByTagValue(key, value string) Measurements {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	measurements := Measurements{}
+	for _, m := range d.measurements {
+		if m.HasTagValue(key, value) {
+			measurements = append(measurements, m)
+		}
+	}
+	sort.Sort(measurements)
+	return measurements
+}
+
 // Measurements returns a list of all measurements.
 func (d *DatabaseIndex) Measurements() Measurements {
 	measurements := make(Measurements, 0, len(d.measurements))
@@ -327,6 +397,46 @@ func (d *DatabaseIndex) Measurements() Measurements {
 	return measurements
 }
 
+// SeriesIterator iterates over the series of a database.
+type SeriesIterator interface {
+	// Next returns the measurement and key of the next series. ok is false
+	// once every series has been returned.
+	Next() (measurement, seriesKey string, ok bool)
+}
+
+// databaseSeriesIterator iterates over the series of a database index by
+// measurement name and then by series ID. Only the measurements are
+// collected up front. Each call to Next locks the current measurement just
+// long enough to find the series after the last one returned, so series
+// dropped before they are reached are skipped.
+type databaseSeriesIterator struct {
+	measurements Measurements
+	minID        uint64 // lowest series ID left in measurements[0]
+}
+
+// seriesIterator returns an iterator over the series of the database.
+func (d *DatabaseIndex) seriesIterator() *databaseSeriesIterator {
+	d.mu.RLock()
+	measurements := d.Measurements()
+	d.mu.RUnlock()
+
+	sort.Sort(measurements)
+	return &databaseSeriesIterator{measurements: measurements}
+}
+
+// Next returns the next series.
+func (itr *databaseSeriesIterator) Next() (measurement, seriesKey string, ok bool) {
+	for len(itr.measurements) > 0 {
+		m := itr.measurements[0]
+		if s := m.seriesFrom(itr.minID); s != nil {
+			itr.minID = s.id + 1
+			return m.Name, s.Key, true
+		}
+		itr.measurements, itr.minID = itr.measurements[1:], 0
+	}
+	return "", "", false
+}
+
 // DropMeasurement removes the measurement and all of its underlying series from the database index
 func (d *DatabaseIndex) DropMeasurement(name string) {
 	d.mu.Lock()
@@ -340,6 +450,10 @@ func (d *DatabaseIndex) DropMeasurement(name string) {
 	delete(d.measurements, name)
 	for _, s := range m.seriesByID {
 		delete(d.series, s.Key)
+		d.addSeriesToSketch(s.Key, true)
+		if d.interner != nil {
+			d.interner.releaseTags(s.Tags)
+		}
 	}
 
 	d.statMap.Add(statDatabaseSeries, int64(-len(m.seriesByID)))
@@ -359,6 +473,10 @@ func (d *DatabaseIndex) DropSeries(keys []string) {
 		}
 		series.measurement.DropSeries(series.id)
 		delete(d.series, k)
+		d.addSeriesToSketch(k, true)
+		if d.interner != nil {
+			d.interner.releaseTags(series.Tags)
+		}
 		nDeleted++
 	}
 
@@ -445,6 +563,15 @@ func (m *Measurement) HasTagKey(k string) bool {
 	return hasTag
 }
 
+// HasTagValue returns true if at least one series in this measurement has the
+// tag key set to value.
+func (m *Measurement) HasTagValue(key, value string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.seriesByTagKeyValue[key][value]
+	return ok
+}
+
 // HasSeries returns true if there is at least 1 series under this measurement
 func (m *Measurement) HasSeries() bool {
 	m.mu.RLock()
@@ -452,6 +579,28 @@ func (m *Measurement) HasSeries() bool {
 	return len(m.seriesByID) > 0
 }
 
+// SeriesN returns the number of series in this measurement.
+func (m *Measurement) SeriesN() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.seriesIDs)
+}
+
+// seriesFrom returns the series with the lowest ID that is at least min, or
+// nil if there is none.
+func (m *Measurement) seriesFrom(min uint64) *Series {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	i := sort.Search(len(m.seriesIDs), func(i int) bool { return m.seriesIDs[i] >= min })
+	for ; i < len(m.seriesIDs); i++ {
+		if s := m.seriesByID[m.seriesIDs[i]]; s != nil {
+			return s
+		}
+	}
+	return nil
+}
+
 // AddSeries will add a series to the measurementIndex. Returns false if already present
 func (m *Measurement) AddSeries(s *Series) bool {
 	m.mu.Lock()
@@ -1504,6 +1653,13 @@ func (m *Measurement) SetFieldName(name string) {
 	m.mu.Unlock()
 }
 
+// deleteFieldName removes a field name from the measurement.
+func (m *Measurement) deleteFieldName(name string) {
+	m.mu.Lock()
+	delete(m.fieldNames, name)
+	m.mu.Unlock()
+}
+
 // FieldNames returns a list of the measurement's field names
 func (m *Measurement) FieldNames() []string {
 	m.mu.RLock()
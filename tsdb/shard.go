@@ -6,17 +6,22 @@ import (
 	"errors"
 	"expvar"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"math"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gogo/protobuf/proto"
 	"github.com/freetsdb/freetsdb"
 	"github.com/freetsdb/freetsdb/models"
 	"github.com/freetsdb/freetsdb/services/influxql"
+	"github.com/freetsdb/freetsdb/toml"
 	"github.com/freetsdb/freetsdb/tsdb/internal"
 	"go.uber.org/zap"
 )
@@ -28,6 +33,7 @@ const (
 	statWritePointsFail = "writePointsFail"
 	statWritePointsOK   = "writePointsOk"
 	statWriteBytes      = "writeBytes"
+	statVacuumBytes     = "vacuumBytes"
 )
 
 var (
@@ -43,6 +49,14 @@ var (
 	// ErrFieldUnmappedID is returned when the system is presented, during decode, with a field ID
 	// there is no mapping for.
 	ErrFieldUnmappedID = errors.New("field ID not mapped")
+
+	// ErrEngineClosed is returned when a caller attempts to use a shard
+	// whose engine is closed.
+	ErrEngineClosed = errors.New("engine is closed")
+
+	// ErrShardReadOnly is returned when writing to a shard that was made
+	// read-only.
+	ErrShardReadOnly = errors.New("shard is read-only")
 )
 
 // A ShardError implements the error interface, and contains extra
@@ -64,11 +78,39 @@ func (e ShardError) Error() string {
 	return fmt.Sprintf("[shard %d] %s", e.id, e.Err)
 }
 
+// Unwrap returns the underlying error.
+func (e ShardError) Unwrap() error { return e.Err }
+
+// inlineWALDir is the directory inside a shard's data directory that holds
+// its WAL when EngineOptions.WALInline is set.
+const inlineWALDir = "wal"
+
 // Shard represents a self-contained time series database. An inverted index of
 // the measurement and tag data is kept along with the raw time series data.
 // Data can be split across many shards. The query engine in TSDB is responsible
 // for combining the output of many shards into a single query result.
 type Shard struct {
+	// lastWrite is the time of the last successful write in nanoseconds. It is
+	// accessed atomically and kept first in the struct for 64-bit alignment.
+	lastWrite int64
+
+	// pointsWritten and bytesWritten count successful writes since the shard
+	// was created or last reset. They are accessed atomically.
+	pointsWritten uint64
+	bytesWritten  uint64
+
+	// writeSeq counts the points written since the shard was created. Unlike
+	// pointsWritten it is never reset. It is accessed atomically.
+	writeSeq uint64
+
+	// readOnly is set to refuse writes, see SetReadOnly. It is accessed
+	// atomically.
+	readOnly int32
+
+	// writeMu is held for reading by writes from before they check readOnly
+	// until they are done, so that waitForWrites can wait for them.
+	writeMu sync.RWMutex
+
 	index   *DatabaseIndex
 	path    string
 	walPath string
@@ -86,6 +128,16 @@ type Shard struct {
 	mu                sync.RWMutex
 	measurementFields map[string]*MeasurementFields // measurement name to their fields
 
+	// Bounds of the values in the shard, loaded at open and widened on
+	// write. See cachedTimeRange.
+	timeMu  sync.Mutex
+	minTime int64
+	maxTime int64
+	hasTime bool
+
+	// writes records when the write sequence grew, see PointsWrittenSince.
+	writes *writeHistory
+
 	// expvar-based stats.
 	statMap *expvar.Map
 
@@ -123,6 +175,7 @@ func NewShard(id uint64, index *DatabaseIndex, path string, walPath string, opti
 		logger:     logger,
 		baseLogger: logger,
 
+		writes:  newWriteHistory(time.Now()),
 		statMap: statMap,
 	}
 }
@@ -136,20 +189,55 @@ func (s *Shard) WithLogger(log *zap.Logger) {
 // Path returns the path set on the shard when it was created.
 func (s *Shard) Path() string { return s.path }
 
+// WALPath returns the WAL directory set on the shard when it was created.
+func (s *Shard) WALPath() string { return s.walPath }
+
+// walInline returns true if the shard's WAL is inside its data directory.
+func (s *Shard) walInline() bool {
+	return filepath.Clean(s.walPath) == filepath.Join(s.path, inlineWALDir)
+}
+
+// rebasedPaths returns where the shard's data and WAL directories move to
+// when the shard moves to database and retentionPolicy. An inline WAL moves
+// with the data directory.
+func (s *Shard) rebasedPaths(database, retentionPolicy string) (path, walPath string) {
+	path = rebasePath(s.path, database, retentionPolicy)
+	if s.walInline() {
+		return path, filepath.Join(path, inlineWALDir)
+	}
+	return path, rebasePath(s.walPath, database, retentionPolicy)
+}
+
+// ID returns the ID of the shard.
+func (s *Shard) ID() uint64 { return s.id }
+
+// Database returns the database the shard belongs to.
+func (s *Shard) Database() string { return s.database }
+
+// RetentionPolicy returns the retention policy the shard belongs to.
+func (s *Shard) RetentionPolicy() string { return s.retentionPolicy }
+
 // Open initializes and opens the shard's store.
 func (s *Shard) Open() error {
 	if err := func() error {
 		s.mu.Lock()
 		defer s.mu.Unlock()
 
-		s.index.mu.Lock()
-		defer s.index.mu.Unlock()
-
 		// Return if the shard is already open
 		if s.engine != nil {
 			return nil
 		}
 
+		// Estimate the last write from the files on disk before the engine
+		// opens them, since opening may create new WAL segments.
+		lastWrite, err := lastModified(s.path, s.walPath)
+		if err != nil {
+			return err
+		}
+		if !lastWrite.IsZero() {
+			atomic.StoreInt64(&s.lastWrite, lastWrite.UnixNano())
+		}
+
 		// Initialize underlying engine.
 		e, err := NewEngine(s.path, s.walPath, s.options)
 		if err != nil {
@@ -165,11 +253,19 @@ func (s *Shard) Open() error {
 			return err
 		}
 
-		// Load metadata index.
+		// Load metadata index. The index is shared by all shards of the
+		// database so it is only locked while it is being populated.
+		s.index.mu.Lock()
+		defer s.index.mu.Unlock()
 		if err := s.engine.LoadMetadataIndex(s, s.index, s.measurementFields); err != nil {
 			return err
 		}
 
+		min, max, ok := s.engine.TimeRange()
+		s.timeMu.Lock()
+		s.minTime, s.maxTime, s.hasTime = min, max, ok
+		s.timeMu.Unlock()
+
 		return nil
 	}(); err != nil {
 		s.close()
@@ -198,6 +294,24 @@ func (s *Shard) close() error {
 	return err
 }
 
+// IsOpen returns true if the shard's engine is open.
+func (s *Shard) IsOpen() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.engine != nil
+}
+
+// openEngine returns the shard's engine, or ErrEngineClosed if the shard has
+// been closed.
+func (s *Shard) openEngine() (Engine, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.engine == nil {
+		return nil, ErrEngineClosed
+	}
+	return s.engine, nil
+}
+
 // DiskSize returns the size on disk of this shard
 func (s *Shard) DiskSize() (int64, error) {
 	stats, err := os.Stat(s.path)
@@ -207,6 +321,116 @@ func (s *Shard) DiskSize() (int64, error) {
 	return stats.Size(), nil
 }
 
+// walSize returns the total size of the files in the shard's WAL directory.
+// A missing directory has a size of zero.
+func (s *Shard) walSize() (int64, error) {
+	return dirSize(s.walPath)
+}
+
+// diskSizes returns the total size of the files in the shard's data and WAL
+// directories. A missing directory has a size of zero.
+func (s *Shard) diskSizes() (data int64, wal int64, err error) {
+	if data, err = dirSize(s.path); err != nil {
+		return 0, 0, err
+	}
+	if wal, err = dirSize(s.walPath); err != nil {
+		return 0, 0, err
+	}
+	if s.walInline() {
+		data -= wal
+	}
+	return data, wal, nil
+}
+
+// ShardInfo describes a shard of the store.
+type ShardInfo struct {
+	ID              uint64
+	Database        string
+	RetentionPolicy string
+	Path            string
+	WALPath         string
+
+	// DiskSize is the size in bytes of the shard's data and WAL files.
+	DiskSize int64
+
+	// SeriesCount is the number of series in the shard, or zero if the
+	// shard is closed.
+	SeriesCount int
+
+	// MinTime and MaxTime bound the values in the shard, in nanoseconds, as
+	// returned by Store.ShardTimeRange. HasData is false if the shard holds
+	// no values.
+	MinTime, MaxTime int64
+	HasData          bool
+}
+
+// info returns a description of the shard.
+func (s *Shard) info() (*ShardInfo, error) {
+	data, wal, err := s.diskSizes()
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := s.SeriesCount()
+	if err != nil && err != ErrEngineClosed {
+		return nil, err
+	}
+
+	min, max, ok := s.cachedTimeRange()
+	return &ShardInfo{
+		ID:              s.id,
+		Database:        s.database,
+		RetentionPolicy: s.retentionPolicy,
+		Path:            s.path,
+		WALPath:         s.walPath,
+		DiskSize:        data + wal,
+		SeriesCount:     n,
+		MinTime:         min,
+		MaxTime:         max,
+		HasData:         ok,
+	}, nil
+}
+
+// lastModified returns the most recent modification time of the regular files
+// under the given paths. Missing paths are ignored.
+func lastModified(paths ...string) (time.Time, error) {
+	var t time.Time
+	for _, path := range paths {
+		err := filepath.Walk(path, func(_ string, fi os.FileInfo, err error) error {
+			if os.IsNotExist(err) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if fi.Mode().IsRegular() && fi.ModTime().After(t) {
+				t = fi.ModTime()
+			}
+			return nil
+		})
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	return t, nil
+}
+
+// dirSize returns the total size of all regular files under path.
+func dirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(_ string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
 // FieldCodec returns the field encoding for a measurement.
 // TODO: this is temporarily exported to make tx.go work. When the query engine gets refactored
 // into the tsdb package this should be removed. No one outside tsdb should know the underlying field encoding scheme.
@@ -220,6 +444,251 @@ func (s *Shard) FieldCodec(measurementName string) *FieldCodec {
 	return m.Codec
 }
 
+// hasMeasurement returns true if the shard holds fields of the measurement.
+func (s *Shard) hasMeasurement(name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.measurementFields[name] != nil
+}
+
+// fieldTypes returns the type of each field of a measurement in the shard.
+func (s *Shard) fieldTypes(measurementName string) map[string]influxql.DataType {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m := s.measurementFields[measurementName]
+	if m == nil {
+		return nil
+	}
+	types := make(map[string]influxql.DataType, len(m.Fields))
+	for name, f := range m.Fields {
+		types[name] = f.Type
+	}
+	return types
+}
+
+// measurementNames returns the sorted names of the measurements with fields
+// in the shard.
+func (s *Shard) measurementNames() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.measurementFields))
+	for name := range s.measurementFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// seriesKeys returns the keys of the series of the measurements in the
+// shard. Series of those measurements that only have values in other shards
+// are included.
+func (s *Shard) seriesKeys() []string {
+	var keys []string
+	for _, name := range s.measurementNames() {
+		if m := s.index.Measurement(name); m != nil {
+			keys = append(keys, m.SeriesKeys()...)
+		}
+	}
+	return keys
+}
+
+// exportLineProtocol writes the values of the named measurements with
+// timestamps between min and max, inclusive, to w as line protocol. Points
+// are read through the engine's iterators and written as they are read.
+func (s *Shard) exportLineProtocol(w io.Writer, names []string, min, max int64) error {
+	for _, name := range names {
+		if err := s.readPoints(name, min, max, func(pt models.Point) error {
+			_, err := io.WriteString(w, pt.String()+"\n")
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checksum returns a hash of the points of the shard that doesn't depend on
+// how they are stored. Each point is hashed as line protocol with FNV-1a and
+// the hashes are added, so the order the points are read in doesn't matter.
+// Points are read like queries read them, with deleted values left out.
+func (s *Shard) checksum() (uint64, error) {
+	if _, err := s.openEngine(); err != nil {
+		return 0, err
+	}
+
+	var sum uint64
+	h := fnv.New64a()
+	for _, name := range s.measurementNames() {
+		if err := s.readPoints(name, math.MinInt64, math.MaxInt64, func(pt models.Point) error {
+			h.Reset()
+			io.WriteString(h, pt.String())
+			sum += h.Sum64()
+			return nil
+		}); err != nil {
+			return 0, err
+		}
+	}
+	return sum, nil
+}
+
+// readPoints calls fn with each point of a measurement with a timestamp
+// between min and max, inclusive, ordered by series and time. Each field is
+// read by its own iterator, and the values of a series at the same time are
+// merged into one point.
+func (s *Shard) readPoints(name string, min, max int64, fn func(models.Point) error) error {
+	types := s.fieldTypes(name)
+	m := s.index.Measurement(name)
+	if len(types) == 0 || m == nil {
+		return nil
+	}
+
+	fields := make([]string, 0, len(types))
+	for f := range types {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+
+	readers := make([]*exportFieldReader, 0, len(fields))
+	defer func() {
+		for _, r := range readers {
+			r.itr.Close()
+		}
+	}()
+	for _, f := range fields {
+		itr, err := s.CreateIterator(influxql.IteratorOptions{
+			Expr:       &influxql.VarRef{Val: f},
+			Sources:    influxql.Sources{&influxql.Measurement{Name: name}},
+			Dimensions: m.TagKeys(),
+			StartTime:  min,
+			EndTime:    max,
+			Ascending:  true,
+		})
+		if err != nil {
+			return err
+		}
+		r := &exportFieldReader{field: f, itr: itr}
+		r.read()
+		readers = append(readers, r)
+	}
+
+	for {
+		// Find the series and time of the next point.
+		var next *exportFieldReader
+		for _, r := range readers {
+			if r.ok && (next == nil || r.before(next)) {
+				next = r
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		id, t := next.tags.ID(), next.time
+
+		// Tags missing from the series are returned with empty values.
+		tags := make(models.Tags)
+		for k, v := range next.tags.KeyValues() {
+			if v != "" {
+				tags[k] = v
+			}
+		}
+
+		values := make(models.Fields)
+		for _, r := range readers {
+			if r.ok && r.time == t && r.tags.ID() == id {
+				values[r.field] = r.value
+				r.read()
+			}
+		}
+
+		pt, err := models.NewPoint(name, tags, values, time.Unix(0, t))
+		if err != nil {
+			return err
+		}
+		if err := fn(pt); err != nil {
+			return err
+		}
+	}
+}
+
+// exportFieldReader holds the current value of an iterator over a field.
+type exportFieldReader struct {
+	field string
+	itr   influxql.Iterator
+
+	ok    bool // false once the iterator is exhausted
+	tags  influxql.Tags
+	time  int64
+	value interface{}
+}
+
+// read moves the reader to the next value of the iterator.
+func (r *exportFieldReader) read() {
+	switch itr := r.itr.(type) {
+	case influxql.FloatIterator:
+		p := itr.Next()
+		if r.ok = p != nil; r.ok {
+			r.tags, r.time, r.value = p.Tags, p.Time, p.Value
+		}
+	case influxql.IntegerIterator:
+		p := itr.Next()
+		if r.ok = p != nil; r.ok {
+			r.tags, r.time, r.value = p.Tags, p.Time, p.Value
+		}
+	case influxql.StringIterator:
+		p := itr.Next()
+		if r.ok = p != nil; r.ok {
+			r.tags, r.time, r.value = p.Tags, p.Time, p.Value
+		}
+	case influxql.BooleanIterator:
+		p := itr.Next()
+		if r.ok = p != nil; r.ok {
+			r.tags, r.time, r.value = p.Tags, p.Time, p.Value
+		}
+	default:
+		r.ok = false
+	}
+}
+
+// before returns true if the current value of r comes before the one of
+// other, in the order of the iterators: by series, then by time.
+func (r *exportFieldReader) before(other *exportFieldReader) bool {
+	if id, otherID := r.tags.ID(), other.tags.ID(); id != otherID {
+		return id < otherID
+	}
+	return r.time < other.time
+}
+
+// ErrMaxSeriesLimitExceeded is returned when a write would create more series
+// in a database than EngineOptions.MaxSeriesPerDatabase allows.
+type ErrMaxSeriesLimitExceeded struct {
+	Database string
+	Series   int // number of series in the database
+	Limit    int
+}
+
+func (e ErrMaxSeriesLimitExceeded) Error() string {
+	return fmt.Sprintf("max series per database exceeded: %s has %d series, limit %d", e.Database, e.Series, e.Limit)
+}
+
+// FieldTypeConflictError is returned by a write when a point has a field
+// whose type differs from the type of the field in the shard or in an earlier
+// point of the same write. None of the points are written.
+type FieldTypeConflictError struct {
+	Index       int    // index of the offending point in the write
+	SeriesKey   string // series key of the offending point
+	Measurement string
+	Field       string
+	InputType   string            // Go type of the offending value
+	Type        influxql.DataType // type the field already has
+}
+
+func (e FieldTypeConflictError) Error() string {
+	return fmt.Sprintf("field type conflict: input field \"%s\" on measurement \"%s\" is type %s, already exists as type %s", e.Field, e.Measurement, e.InputType, e.Type)
+}
+
+// Unwrap returns ErrFieldTypeConflict.
+func (e FieldTypeConflictError) Unwrap() error { return ErrFieldTypeConflict }
+
 // FieldCreate holds information for a field to create on a measurement
 type FieldCreate struct {
 	Measurement string
@@ -232,20 +701,113 @@ type SeriesCreate struct {
 	Series      *Series
 }
 
+// dedupPoints collapses the points of a write that have the same series and
+// timestamp into one point holding the fields of all of them, the fields of
+// later points winning. A collapsed point takes the place of the last of its
+// duplicates. index holds the position in points of each returned point; it
+// is nil, and points is returned as is, if there were no duplicates.
+func dedupPoints(points []models.Point) (deduped []models.Point, index []int, err error) {
+	type pointKey struct {
+		series string
+		time   int64
+	}
+
+	last := make(map[pointKey]int, len(points))
+	for i, p := range points {
+		last[pointKey{string(p.Key()), p.UnixNano()}] = i
+	}
+	if len(last) == len(points) {
+		return points, nil, nil
+	}
+
+	deduped = make([]models.Point, 0, len(last))
+	index = make([]int, 0, len(last))
+	merged := make(map[pointKey]models.Fields)
+	for i, p := range points {
+		k := pointKey{string(p.Key()), p.UnixNano()}
+		fields, ok := merged[k]
+		if !ok && last[k] != i {
+			fields = make(models.Fields)
+			merged[k] = fields
+		}
+		if fields != nil {
+			for name, v := range p.Fields() {
+				fields[name] = v
+			}
+		}
+		if last[k] != i {
+			continue
+		}
+
+		if fields != nil {
+			if p, err = models.NewPoint(p.Name(), p.Tags(), fields, p.Time()); err != nil {
+				return nil, nil, err
+			}
+		}
+		deduped = append(deduped, p)
+		index = append(index, i)
+	}
+	return deduped, index, nil
+}
+
 // WritePoints will write the raw data points and any new metadata to the index in the shard
 func (s *Shard) WritePoints(points []models.Point) error {
+	return s.writePoints(points, false)
+}
+
+// TryWritePoints is like WritePoints but returns ErrShardBusy instead of
+// waiting when the engine is locked. New series and fields may already have
+// been added to the index when ErrShardBusy is returned.
+func (s *Shard) TryWritePoints(points []models.Point) error {
+	return s.writePoints(points, true)
+}
+
+func (s *Shard) writePoints(points []models.Point, try bool) error {
 	s.statMap.Add(statWriteReq, 1)
 
-	seriesToCreate, fieldsToCreate, seriesToAddShardTo, err := s.validateSeriesAndFields(points)
+	if !try {
+		s.writeMu.RLock()
+	} else if !s.writeMu.TryRLock() {
+		return ErrShardBusy
+	}
+	defer s.writeMu.RUnlock()
+
+	if s.ReadOnly() {
+		return ErrShardReadOnly
+	}
+
+	engine, err := s.openEngine()
 	if err != nil {
 		return err
 	}
+
+	// Collapse duplicate points, keeping the position of a conflicting point
+	// in the caller's write.
+	var index []int
+	if s.options.DedupWrites {
+		if points, index, err = dedupPoints(points); err != nil {
+			return err
+		}
+	}
+
+	seriesToCreate, fieldsToCreate, seriesToAddShardTo, err := s.validateSeriesAndFields(points)
+	if conflict, ok := err.(FieldTypeConflictError); ok && index != nil {
+		conflict.Index = index[conflict.Index]
+		return conflict
+	} else if err != nil {
+		return err
+	}
 	s.statMap.Add(statSeriesCreate, int64(len(seriesToCreate)))
 	s.statMap.Add(statFieldsCreate, int64(len(fieldsToCreate)))
 
 	// add any new series to the in-memory index
 	if len(seriesToCreate) > 0 {
 		s.index.mu.Lock()
+		if max := s.options.MaxSeriesPerDatabase; max > 0 && len(s.index.series)+s.newSeriesN(seriesToCreate) > max {
+			n := len(s.index.series)
+			s.index.mu.Unlock()
+			return ErrMaxSeriesLimitExceeded{Database: s.database, Series: n, Limit: max}
+		}
 		for _, ss := range seriesToCreate {
 			s.index.CreateSeriesIndexIfNotExists(ss.Measurement, ss.Series)
 		}
@@ -271,7 +833,7 @@ func (s *Shard) WritePoints(points []models.Point) error {
 
 	// make sure all data is encoded before attempting to save to bolt
 	// only required for the b1 and bz1 formats
-	if s.engine.Format() != TSM1Format {
+	if engine.Format() != TSM1Format {
 		for _, p := range points {
 			// Ignore if raw data has already been marshaled.
 			if p.Data() != nil {
@@ -297,18 +859,288 @@ func (s *Shard) WritePoints(points []models.Point) error {
 	}
 
 	// Write to the engine.
-	if err := s.engine.WritePoints(points, measurementFieldsToSave, seriesToCreate); err != nil {
+	write := engine.WritePoints
+	if try {
+		write = engine.TryWritePoints
+	}
+	if err := write(points, measurementFieldsToSave, seriesToCreate); err == ErrShardBusy {
+		return err
+	} else if err != nil {
 		s.statMap.Add(statWritePointsFail, 1)
-		return fmt.Errorf("engine: %s", err)
+		return fmt.Errorf("engine: %w", err)
 	}
 	s.statMap.Add(statWritePointsOK, int64(len(points)))
+	atomic.StoreInt64(&s.lastWrite, time.Now().UnixNano())
+	s.extendTimeRange(points)
+
+	var n int
+	for _, p := range points {
+		n += p.StringSize()
+	}
+	atomic.AddUint64(&s.pointsWritten, uint64(len(points)))
+	atomic.AddUint64(&s.bytesWritten, uint64(n))
+	s.writes.record(atomic.AddUint64(&s.writeSeq, uint64(len(points))))
 
 	return nil
 }
 
+// LastWrite returns the time of the last successful write to the shard. For
+// a shard that has not been written to since it was opened, this is the most
+// recent modification time of its files.
+func (s *Shard) LastWrite() time.Time {
+	ns := atomic.LoadInt64(&s.lastWrite)
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// WriteStats returns the number of points and line protocol bytes written to
+// the shard since it was created or last reset.
+func (s *Shard) WriteStats() (points, bytes uint64) {
+	return atomic.LoadUint64(&s.pointsWritten), atomic.LoadUint64(&s.bytesWritten)
+}
+
+// WriteSequence returns the number of points written to the shard since it
+// was created. It only grows, and isn't affected by ResetWriteStats.
+func (s *Shard) WriteSequence() uint64 {
+	return atomic.LoadUint64(&s.writeSeq)
+}
+
+// PointsWrittenSince returns the number of points written to the shard after
+// since. Write times are kept in memory with one second resolution, so points
+// written during the same second as since aren't counted. If since is before
+// the shard was created or more than WriteHistoryWindow ago,
+// ErrWriteHistoryUnavailable is returned.
+func (s *Shard) PointsWrittenSince(since time.Time) (int64, error) {
+	seq := s.WriteSequence()
+	at, err := s.writes.seqAt(since)
+	if err != nil {
+		return 0, err
+	} else if at > seq {
+		return 0, nil
+	}
+	return int64(seq - at), nil
+}
+
+// SetReadOnly sets whether writes to the shard are refused with
+// ErrShardReadOnly. Reads, backups and deletes are not affected. The setting
+// is kept while the shard is closed and reopened, but not persisted.
+func (s *Shard) SetReadOnly(ro bool) {
+	var v int32
+	if ro {
+		v = 1
+	}
+	atomic.StoreInt32(&s.readOnly, v)
+}
+
+// waitForWrites waits for the writes in progress to finish. Called after
+// SetReadOnly(true), no write is in progress once it returns.
+func (s *Shard) waitForWrites() {
+	s.writeMu.Lock()
+	s.writeMu.Unlock()
+}
+
+// ReadOnly returns true if writes to the shard are refused.
+func (s *Shard) ReadOnly() bool {
+	return atomic.LoadInt32(&s.readOnly) == 1
+}
+
+// SetCacheMaxSize changes the maximum number of bytes the shard's cache may
+// consume, overriding Config.CacheMaxMemorySize. Zero means unlimited. The
+// limit applies to the running engine and is kept if the shard is closed
+// and reopened, but not when the store is reopened.
+func (s *Shard) SetCacheMaxSize(maxSize uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.options.Config.CacheMaxMemorySize = maxSize
+	if s.engine != nil {
+		s.engine.SetCacheMaxSize(maxSize)
+	}
+}
+
+// CacheMaxSize returns the maximum number of bytes the shard's cache may
+// consume.
+func (s *Shard) CacheMaxSize() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.options.Config.CacheMaxMemorySize
+}
+
+// SetWALFsyncDelay changes how long writes to the shard may go without being
+// synced to disk, overriding Config.WALFsyncDelay. The delay applies to the
+// running engine and is kept if the shard is closed and reopened, but not
+// when the store is reopened.
+func (s *Shard) SetWALFsyncDelay(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.options.Config.WALFsyncDelay = toml.Duration(d)
+	if s.engine != nil {
+		s.engine.SetWALFsyncDelay(d)
+	}
+}
+
+// WALFsyncDelay returns how long writes to the shard may go without being
+// synced to disk.
+func (s *Shard) WALFsyncDelay() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return time.Duration(s.options.Config.WALFsyncDelay)
+}
+
+// ResetWriteStats sets the shard's write counters back to zero.
+func (s *Shard) ResetWriteStats() {
+	atomic.StoreUint64(&s.pointsWritten, 0)
+	atomic.StoreUint64(&s.bytesWritten, 0)
+}
+
+// TimeRange returns the times of the oldest and newest values in the shard.
+// ok is false if the shard holds no values.
+func (s *Shard) TimeRange() (min, max time.Time, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.engine == nil {
+		return time.Time{}, time.Time{}, false
+	}
+
+	tmin, tmax, ok := s.engine.TimeRange()
+	if !ok {
+		return time.Time{}, time.Time{}, false
+	}
+	return time.Unix(0, tmin).UTC(), time.Unix(0, tmax).UTC(), true
+}
+
+// cachedTimeRange returns the bounds of the values in the shard, in
+// nanoseconds, without asking the engine. The range is not narrowed when
+// values are deleted, so it may be wider than the data.
+func (s *Shard) cachedTimeRange() (min, max int64, ok bool) {
+	s.timeMu.Lock()
+	defer s.timeMu.Unlock()
+	return s.minTime, s.maxTime, s.hasTime
+}
+
+// extendTimeRange widens the cached time range to include points.
+func (s *Shard) extendTimeRange(points []models.Point) {
+	if len(points) == 0 {
+		return
+	}
+
+	s.timeMu.Lock()
+	defer s.timeMu.Unlock()
+	for _, p := range points {
+		t := p.UnixNano()
+		if !s.hasTime {
+			s.minTime, s.maxTime, s.hasTime = t, t, true
+			continue
+		}
+		if t < s.minTime {
+			s.minTime = t
+		}
+		if t > s.maxTime {
+			s.maxTime = t
+		}
+	}
+}
+
+// Tombstones returns the deletions still recorded in the shard's files.
+func (s *Shard) Tombstones() ([]Tombstone, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.engine == nil {
+		return nil, ErrEngineClosed
+	}
+	return s.engine.Tombstones()
+}
+
+// CompactionStatus returns the compactions of the shard's files that are in
+// progress.
+func (s *Shard) CompactionStatus() (CompactionStatus, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.engine == nil {
+		return CompactionStatus{}, ErrEngineClosed
+	}
+	return s.engine.CompactionStatus(), nil
+}
+
+// Verify checks the shard's files for corruption.
+func (s *Shard) Verify() (*ShardVerifyResult, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.engine == nil {
+		return nil, ErrEngineClosed
+	}
+	return s.engine.Verify()
+}
+
+// WriteSnapshot flushes the shard's cache and WAL to a new TSM file.
+func (s *Shard) WriteSnapshot() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.engine == nil {
+		return ErrEngineClosed
+	}
+	return s.engine.WriteSnapshot()
+}
+
 // DeleteSeries deletes a list of series.
 func (s *Shard) DeleteSeries(seriesKeys []string) error {
-	return s.engine.DeleteSeries(seriesKeys)
+	engine, err := s.openEngine()
+	if err != nil {
+		return err
+	}
+	return engine.DeleteSeries(seriesKeys)
+}
+
+// DeleteSeriesRange deletes the values between min and max, inclusive, for a
+// list of series.
+func (s *Shard) DeleteSeriesRange(seriesKeys []string, min, max int64) error {
+	engine, err := s.openEngine()
+	if err != nil {
+		return err
+	}
+	return engine.DeleteSeriesRange(seriesKeys, min, max)
+}
+
+// RenameMeasurement stages the rename of a measurement in the shard's data.
+// The shard's index is not updated; the shard must be reopened to reload it
+// once the rename is committed.
+func (s *Shard) RenameMeasurement(oldName, newName string) (PendingRename, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.engine == nil {
+		return nil, ErrEngineClosed
+	}
+	return s.engine.RenameMeasurement(oldName, newName)
+}
+
+// checkFieldTypes returns an error if a field of measurement a has a different
+// type than the field with the same name in measurement b.
+func (s *Shard) checkFieldTypes(a, b string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ma, mb := s.measurementFields[a], s.measurementFields[b]
+	if ma == nil || mb == nil {
+		return nil
+	}
+	for name, fa := range ma.Fields {
+		if fb := mb.Fields[name]; fb != nil && fb.Type != fa.Type {
+			return fmt.Errorf("%w: %s.%s is %s, %s.%s is %s", ErrFieldTypeConflict, a, name, fa.Type, b, name, fb.Type)
+		}
+	}
+	return nil
+}
+
+// ImportFiles loads prebuilt data files into the shard and indexes their
+// series.
+func (s *Shard) ImportFiles(paths []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.engine == nil {
+		return ErrEngineClosed
+	}
+	return s.engine.ImportFiles(paths)
 }
 
 // DeleteMeasurement deletes a measurement and all underlying series.
@@ -316,6 +1148,9 @@ func (s *Shard) DeleteMeasurement(name string, seriesKeys []string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.engine == nil {
+		return ErrEngineClosed
+	}
 	if err := s.engine.DeleteMeasurement(name, seriesKeys); err != nil {
 		return err
 	}
@@ -326,6 +1161,28 @@ func (s *Shard) DeleteMeasurement(name string, seriesKeys []string) error {
 	return nil
 }
 
+// DeleteField removes a field of a measurement from the shard's data and
+// field metadata. The database index is not updated.
+func (s *Shard) DeleteField(measurement, field string, seriesKeys []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.engine == nil {
+		return ErrEngineClosed
+	}
+	if err := s.engine.DeleteField(field, seriesKeys); err != nil {
+		return err
+	}
+
+	if mf := s.measurementFields[measurement]; mf != nil {
+		mf.deleteField(field)
+		if len(mf.Fields) == 0 {
+			delete(s.measurementFields, measurement)
+		}
+	}
+	return nil
+}
+
 func (s *Shard) createFieldsAndMeasurements(fieldsToCreate []*FieldCreate) (map[string]*MeasurementFields, error) {
 	if len(fieldsToCreate) == 0 {
 		return nil, nil
@@ -363,6 +1220,19 @@ func (s *Shard) createFieldsAndMeasurements(fieldsToCreate []*FieldCreate) (map[
 	return measurementsToSave, nil
 }
 
+// newSeriesN returns the number of distinct series in a that are not in the
+// index yet. Some of a may already be in the index from writes to other shards.
+// s.index.mu must be held.
+func (s *Shard) newSeriesN(a []*SeriesCreate) int {
+	keys := make(map[string]struct{}, len(a))
+	for _, ss := range a {
+		if s.index.series[ss.Series.Key] == nil {
+			keys[ss.Series.Key] = struct{}{}
+		}
+	}
+	return len(keys)
+}
+
 // validateSeriesAndFields checks which series and fields are new and whose metadata should be saved and indexed
 func (s *Shard) validateSeriesAndFields(points []models.Point) ([]*SeriesCreate, []*FieldCreate, []string, error) {
 	var seriesToCreate []*SeriesCreate
@@ -377,7 +1247,24 @@ func (s *Shard) validateSeriesAndFields(points []models.Point) ([]*SeriesCreate,
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	for _, p := range points {
+	// newFields holds the types of the fields first seen in this write, so
+	// that points disagreeing on a new field are caught here too.
+	var newFields map[[2]string]influxql.DataType
+	checkNewField := func(i int, p models.Point, name string, value interface{}) error {
+		typ := influxql.InspectDataType(value)
+		key := [2]string{p.Name(), name}
+		if newFields == nil {
+			newFields = make(map[[2]string]influxql.DataType)
+		}
+		if prev, ok := newFields[key]; !ok {
+			newFields[key] = typ
+		} else if prev != typ {
+			return FieldTypeConflictError{Index: i, SeriesKey: string(p.Key()), Measurement: p.Name(), Field: name, InputType: fmt.Sprintf("%T", value), Type: prev}
+		}
+		return nil
+	}
+
+	for i, p := range points {
 		// see if the series should be added to the index
 		if ss := s.index.series[string(p.Key())]; ss == nil {
 			series := NewSeries(string(p.Key()), p.Tags())
@@ -393,6 +1280,9 @@ func (s *Shard) validateSeriesAndFields(points []models.Point) ([]*SeriesCreate,
 		mf := s.measurementFields[p.Name()]
 		if mf == nil {
 			for name, value := range p.Fields() {
+				if err := checkNewField(i, p, name, value); err != nil {
+					return nil, nil, nil, err
+				}
 				fieldsToCreate = append(fieldsToCreate, &FieldCreate{p.Name(), &Field{Name: name, Type: influxql.InspectDataType(value)}})
 			}
 			continue // skip validation since all fields are new
@@ -403,12 +1293,15 @@ func (s *Shard) validateSeriesAndFields(points []models.Point) ([]*SeriesCreate,
 			if f := mf.Fields[name]; f != nil {
 				// Field present in shard metadata, make sure there is no type conflict.
 				if f.Type != influxql.InspectDataType(value) {
-					return nil, nil, nil, fmt.Errorf("field type conflict: input field \"%s\" on measurement \"%s\" is type %T, already exists as type %s", name, p.Name(), value, f.Type)
+					return nil, nil, nil, FieldTypeConflictError{Index: i, SeriesKey: string(p.Key()), Measurement: p.Name(), Field: name, InputType: fmt.Sprintf("%T", value), Type: f.Type}
 				}
 
 				continue // Field is present, and it's of the same type. Nothing more to do.
 			}
 
+			if err := checkNewField(i, p, name, value); err != nil {
+				return nil, nil, nil, err
+			}
 			fieldsToCreate = append(fieldsToCreate, &FieldCreate{p.Name(), &Field{Name: name, Type: influxql.InspectDataType(value)}})
 		}
 	}
@@ -417,11 +1310,21 @@ func (s *Shard) validateSeriesAndFields(points []models.Point) ([]*SeriesCreate,
 }
 
 // SeriesCount returns the number of series buckets on the shard.
-func (s *Shard) SeriesCount() (int, error) { return s.engine.SeriesCount() }
+func (s *Shard) SeriesCount() (int, error) {
+	engine, err := s.openEngine()
+	if err != nil {
+		return 0, err
+	}
+	return engine.SeriesCount()
+}
 
 // WriteTo writes the shard's data to w.
 func (s *Shard) WriteTo(w io.Writer) (int64, error) {
-	n, err := s.engine.WriteTo(w)
+	engine, err := s.openEngine()
+	if err != nil {
+		return 0, err
+	}
+	n, err := engine.WriteTo(w)
 	s.statMap.Add(statWriteBytes, int64(n))
 	return n, err
 }
@@ -431,7 +1334,11 @@ func (s *Shard) CreateIterator(opt influxql.IteratorOptions) (influxql.Iterator,
 	if influxql.Sources(opt.Sources).HasSystemSource() {
 		return s.createSystemIterator(opt)
 	}
-	return s.engine.CreateIterator(opt)
+	engine, err := s.openEngine()
+	if err != nil {
+		return nil, err
+	}
+	return engine.CreateIterator(opt)
 }
 
 // createSystemIterator returns an iterator for a system source.
@@ -502,7 +1409,11 @@ func (s *Shard) SeriesKeys(opt influxql.IteratorOptions) (influxql.SeriesList, e
 		return []influxql.Series{{Aux: auxFields}}, nil
 	}
 
-	return s.engine.SeriesKeys(opt)
+	engine, err := s.openEngine()
+	if err != nil {
+		return nil, err
+	}
+	return engine.SeriesKeys(opt)
 }
 
 // Shards represents a sortable list of shards.
@@ -572,6 +1483,22 @@ func (m *MeasurementFields) CreateFieldIfNotExists(name string, typ influxql.Dat
 	return nil
 }
 
+// deleteField removes a field. The IDs of the fields after it are decremented,
+// as CreateFieldIfNotExists numbers new fields by the count of fields.
+func (m *MeasurementFields) deleteField(name string) {
+	f := m.Fields[name]
+	if f == nil {
+		return
+	}
+	delete(m.Fields, name)
+	for _, other := range m.Fields {
+		if other.ID > f.ID {
+			other.ID--
+		}
+	}
+	m.Codec = NewFieldCodec(m.Fields)
+}
+
 // Field represents a series field.
 type Field struct {
 	ID   uint8             `json:"id,omitempty"`
@@ -0,0 +1,112 @@
+package tsdb
+
+import (
+	"container/list"
+	"sync"
+)
+
+// shardLRU orders the open shards of a store by when they were last used, to
+// keep at most EngineOptions.MaxOpenShards of them open. Shards are tracked by
+// pointer, as a shard that is moved or renamed is replaced by a new one with
+// the same ID; entries of shards that left the store are dropped when they
+// reach the end of the list.
+type shardLRU struct {
+	mu        sync.Mutex
+	order     *list.List // of *Shard, most recently used first
+	elems     map[*Shard]*list.Element
+	evicted   map[*Shard]struct{} // closed by evict, reopened when used
+	evictions int64
+}
+
+func newShardLRU() *shardLRU {
+	return &shardLRU{
+		order:   list.New(),
+		elems:   make(map[*Shard]*list.Element),
+		evicted: make(map[*Shard]struct{}),
+	}
+}
+
+// touch marks sh as the most recently used open shard. It reports whether sh
+// was closed by evict and must be reopened, in which case it isn't marked
+// until reopened is called.
+func (l *shardLRU) touch(sh *Shard) (closed bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.evicted[sh]; ok {
+		return true
+	}
+	l.moveToFront(sh)
+	return false
+}
+
+// reopened marks sh, which was closed by evict, as open and most recently
+// used.
+func (l *shardLRU) reopened(sh *Shard) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.evicted, sh)
+	l.moveToFront(sh)
+}
+
+// moveToFront marks sh as the most recently used. l.mu must be held.
+func (l *shardLRU) moveToFront(sh *Shard) {
+	if e := l.elems[sh]; e != nil {
+		l.order.MoveToFront(e)
+		return
+	}
+	l.elems[sh] = l.order.PushFront(sh)
+}
+
+// remove stops tracking sh.
+func (l *shardLRU) remove(sh *Shard) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e := l.elems[sh]; e != nil {
+		l.order.Remove(e)
+		delete(l.elems, sh)
+	}
+	delete(l.evicted, sh)
+}
+
+// evict closes the least recently used shards until at most max are open.
+// keep reports whether a shard is still in the store and may be closed; a
+// shard that is in the store but may not be closed is passed over. It returns
+// the IDs of the shards that were closed.
+func (l *shardLRU) evict(max int, keep func(sh *Shard) (inStore, closable bool)) []uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var ids []uint64
+	for e := l.order.Back(); e != nil && l.order.Len() > max; {
+		sh := e.Value.(*Shard)
+		prev := e.Prev()
+
+		inStore, closable := keep(sh)
+		if !inStore {
+			l.order.Remove(e)
+			delete(l.elems, sh)
+		} else if closable && sh.Close() == nil {
+			l.order.Remove(e)
+			delete(l.elems, sh)
+			l.evicted[sh] = struct{}{}
+			l.evictions++
+			ids = append(ids, sh.id)
+		}
+		e = prev
+	}
+
+	// Forget closed shards that have since left the store.
+	for sh := range l.evicted {
+		if inStore, _ := keep(sh); !inStore {
+			delete(l.evicted, sh)
+		}
+	}
+	return ids
+}
+
+// evictionN returns the number of shards closed by evict so far.
+func (l *shardLRU) evictionN() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.evictions
+}
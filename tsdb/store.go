@@ -1,12 +1,21 @@
 package tsdb // import "github.com/freetsdb/freetsdb/tsdb"
 
 import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
@@ -15,6 +24,7 @@ import (
 
 	"github.com/freetsdb/freetsdb/logger"
 	"github.com/freetsdb/freetsdb/models"
+	"github.com/freetsdb/freetsdb/pkg/limiter"
 	"github.com/freetsdb/freetsdb/services/influxql"
 	"go.uber.org/zap"
 )
@@ -24,15 +34,68 @@ var (
 	ErrShardNotFound = fmt.Errorf("shard not found")
 	// ErrStoreClosed gets returned when trying to use a closed Store.
 	ErrStoreClosed = fmt.Errorf("store is closed")
+	// ErrStoreReadOnly gets returned when trying to modify a read-only Store.
+	ErrStoreReadOnly = fmt.Errorf("store is read-only")
+	// ErrStoreCloseTimeout gets returned when the Store doesn't close in time.
+	ErrStoreCloseTimeout = fmt.Errorf("timed out closing store")
+	// ErrShardBusy gets returned by TryWriteToShard when the write would have
+	// to wait for a lock held by another operation.
+	ErrShardBusy = fmt.Errorf("shard busy")
+	// ErrShardEmpty gets returned by ShardTimeRange when the shard holds no
+	// values.
+	ErrShardEmpty = fmt.Errorf("shard has no data")
+	// ErrSeriesEmpty gets returned by SeriesTimeRange when no shard holds
+	// values for the series.
+	ErrSeriesEmpty = fmt.Errorf("series has no data")
+	// ErrInvalidPoint gets returned for points that can't be written, such as
+	// points without a measurement name or fields.
+	ErrInvalidPoint = fmt.Errorf("invalid point")
+	// ErrDatabaseExists gets returned when creating or renaming to a
+	// database that already exists.
+	ErrDatabaseExists = fmt.Errorf("database already exists")
+	// ErrWALMissing gets returned when opening a shard whose WAL directory was
+	// removed, unless EngineOptions.RecoverMissingWAL is set.
+	ErrWALMissing = fmt.Errorf("shard WAL directory is missing")
+
+	// ErrWriteQueueFull is returned by WriteToShardAsync when the shard
+	// already has EngineOptions.AsyncWriteQueueSize writes waiting.
+	ErrWriteQueueFull = fmt.Errorf("shard write queue is full")
 )
 
 const (
 	maintenanceCheckInterval = time.Minute
+
+	// mergeBatchSize is the number of points MergeShards writes at a time.
+	mergeBatchSize = 10000
+
+	// restoreTempExtension is appended to files while they are being restored
+	// so that a partially restored file is never loaded by the engine.
+	restoreTempExtension = "tmp"
+
+	// DatabaseManifestFile is the name of the manifest entry at the end of an
+	// archive written by BackupDatabase.
+	DatabaseManifestFile = "manifest.json"
+
+	// SnapshotManifestFile is the name of the manifest written at the root
+	// of a store copy made by Snapshot.
+	SnapshotManifestFile = "snapshot.json"
+)
+
+// Statistic values reported by Store.Statistics.
+const (
+	statDiskBytes    = "diskBytes"       // bytes used by TSM and other data files
+	statWALDiskBytes = "walDiskBytes"    // bytes used by WAL segments
+	statOpenShards   = "numShards"       // number of open shards
+	statFailedShards = "numFailedShards" // number of shards that failed to open
+	statOpenEngines  = "numOpenEngines"  // number of shards whose engine is open
+	statEvictions    = "shardEvictions"  // number of shards closed by MaxOpenShards
+	statPointsWrite  = "pointsWritten"   // number of points written to a shard
+	statBytesWrite   = "bytesWritten"    // line protocol bytes written to a shard
 )
 
 // Store manages shards and indexes for databases.
 type Store struct {
-	mu   sync.RWMutex
+	mu   storeMutex
 	path string
 
 	databaseIndexes map[string]*DatabaseIndex
@@ -40,13 +103,57 @@ type Store struct {
 	// shards is a map of shard IDs to the associated Shard.
 	shards map[uint64]*Shard
 
+	// failedShards is a map of shard IDs to shards that failed to open.
+	failedShards map[uint64]*failedShard
+
+	// creatingShards holds the shards that are being opened by CreateShard
+	// so that concurrent creates of the same shard wait for the first one.
+	creatingShards map[uint64]*shardCreation
+
+	// restoringShards holds the shards whose archive is being read by
+	// RestoreShard, so that concurrent restores of a shard don't write the
+	// same files.
+	restoringShards map[uint64]struct{}
+
+	// shardWaiters holds the shards that WaitForShard is waiting for.
+	shardWaiters map[uint64]*shardWaiter
+
+	// lru orders the open shards by last use for EngineOptions.MaxOpenShards.
+	lru *shardLRU
+
+	// skippedShards is the number of entries in the data directory that
+	// were ignored when the store was opened.
+	skippedShards int
+
+	// EngineOptions are the options the store is opened with. They are not
+	// modified once it is open; SetEngineOptions changes the options of an
+	// open store and Options returns them.
 	EngineOptions EngineOptions
 	Logger        *zap.Logger
 	baseLogger    *zap.Logger
 
+	// options holds the options set by SetEngineOptions, and databaseOptions
+	// the engine options of databases set by SetDatabaseEngineOptions. They
+	// are guarded by optionsMu rather than mu since they are read by code
+	// that may or may not hold mu.
+	optionsMu       sync.RWMutex
+	options         *EngineOptions
+	databaseOptions map[string]EngineOptions
+
 	closing chan struct{}
 	wg      sync.WaitGroup
 	opened  bool
+
+	// asyncWrites holds the writes queued by WriteToShardAsync for each
+	// shard. A shard has an entry while a goroutine is writing its queue.
+	asyncMu     sync.Mutex
+	asyncWrites map[*Shard][]asyncWrite
+
+	// hooksMu guards the shard event handlers. It is separate from mu so
+	// that handlers are called without the store being locked.
+	hooksMu        sync.RWMutex
+	shardCreatedFn []func(id uint64, database, retentionPolicy string)
+	shardDeletedFn []func(id uint64)
 }
 
 // NewStore returns a new store with the given path and a default configuration.
@@ -64,6 +171,156 @@ func NewStore(path string) *Store {
 	}
 }
 
+// SetDatabaseEngineOptions sets the engine options of the shards of a
+// database, so that databases with different workloads can be tuned
+// separately, for example with their own Config.CacheMaxMemorySize. It is
+// usually called before Open; shards that are already open keep the options
+// they were opened with.
+//
+// The options of a shard are, in order of precedence: those passed to
+// CreateShardWithOptions when the shard was created in this process, the
+// options set here for its database, and the store's EngineOptions. Options
+// that apply to the whole store, such as ReadOnly, OpenLimit, DatabaseFilter,
+// ShardPathFunc and the WAL directory, are always taken from EngineOptions.
+// An empty EngineVersion means the store's engine; shards created with
+// another engine record it so that they are reopened with the same engine.
+func (s *Store) SetDatabaseEngineOptions(database string, opts EngineOptions) {
+	s.optionsMu.Lock()
+	defer s.optionsMu.Unlock()
+	if s.databaseOptions == nil {
+		s.databaseOptions = make(map[string]EngineOptions)
+	}
+	s.databaseOptions[database] = opts
+}
+
+// engineOptions returns the engine options of the shards of a database. See
+// SetDatabaseEngineOptions.
+func (s *Store) engineOptions(database string) EngineOptions {
+	s.optionsMu.RLock()
+	opts, ok := s.databaseOptions[database]
+	s.optionsMu.RUnlock()
+	if !ok {
+		return s.Options()
+	}
+	if opts.EngineVersion == "" {
+		opts.EngineVersion = s.EngineOptions.EngineVersion
+	}
+	opts.ReadOnly = s.EngineOptions.ReadOnly
+	return opts
+}
+
+// hasDatabaseOptions returns true if options were set for the database by
+// SetDatabaseEngineOptions.
+func (s *Store) hasDatabaseOptions(database string) bool {
+	s.optionsMu.RLock()
+	defer s.optionsMu.RUnlock()
+	_, ok := s.databaseOptions[database]
+	return ok
+}
+
+// Options returns the current options of the store: its EngineOptions, as
+// changed by SetEngineOptions.
+func (s *Store) Options() EngineOptions {
+	s.optionsMu.RLock()
+	defer s.optionsMu.RUnlock()
+	if s.options != nil {
+		return *s.options
+	}
+	return s.EngineOptions
+}
+
+// SetEngineOptions changes the options of an open store, so that it can be
+// retuned without being restarted. The options are used by shards created
+// from then on, except those of databases with options set by
+// SetDatabaseEngineOptions. Config.CacheMaxMemorySize and Config.WALFsyncDelay
+// are also applied to the open shards still using the previous values, so
+// limits set on single shards with SetShardCacheSize or SetShardWALFsyncDelay
+// are kept. VacuumBytesPerSecond applies from the next Vacuum; the engine does
+// not limit the throughput of its compactions, so there is no compaction
+// setting to apply to open shards. Other options of existing shards keep the
+// values the shards were opened with. The options last until the store is
+// reopened, which uses EngineOptions again.
+//
+// Options that are fixed for the life of the store are EngineVersion,
+// ReadOnly, DatabaseFilter, ShardPathFunc, ShardRootsFunc, WALInline,
+// MaintenanceInterval, DisableMaintenance, MaxOpenShards, RecordLockStats,
+// Config.Dir and Config.WALDir. Changes to them are logged and ignored.
+func (s *Store) SetEngineOptions(opts EngineOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.closing:
+		return ErrStoreClosed
+	default:
+	}
+
+	old := s.Options()
+	for _, name := range fixedEngineOptionChanges(old, opts) {
+		s.Logger.Warn("Ignoring engine option that can't be changed while the store is open", zap.String("option", name))
+	}
+
+	next := old
+	next.OpenLimit = opts.OpenLimit
+	next.MaxSeriesPerDatabase = opts.MaxSeriesPerDatabase
+	next.StrictOpen = opts.StrictOpen
+	next.RecoverMissingWAL = opts.RecoverMissingWAL
+	next.DedupWrites = opts.DedupWrites
+	next.VacuumMinTombstones = opts.VacuumMinTombstones
+	next.VacuumBytesPerSecond = opts.VacuumBytesPerSecond
+	next.AsyncWriteQueueSize = opts.AsyncWriteQueueSize
+	next.InternTags = opts.InternTags
+	next.Config = opts.Config
+	next.Config.Dir, next.Config.WALDir = old.Config.Dir, old.Config.WALDir
+
+	s.optionsMu.Lock()
+	s.options = &next
+	s.optionsMu.Unlock()
+
+	for _, sh := range s.shardsSlice() {
+		if s.hasDatabaseOptions(sh.database) {
+			continue
+		}
+		if size := next.Config.CacheMaxMemorySize; size != old.Config.CacheMaxMemorySize && sh.CacheMaxSize() == old.Config.CacheMaxMemorySize {
+			sh.SetCacheMaxSize(size)
+		}
+		if d := time.Duration(next.Config.WALFsyncDelay); d != time.Duration(old.Config.WALFsyncDelay) && sh.WALFsyncDelay() == time.Duration(old.Config.WALFsyncDelay) {
+			sh.SetWALFsyncDelay(d)
+		}
+	}
+	return nil
+}
+
+// fixedEngineOptionChanges returns the names of the options that differ
+// between old and opts but can't be changed by SetEngineOptions.
+func fixedEngineOptionChanges(old, opts EngineOptions) []string {
+	var names []string
+	add := func(name string, changed bool) {
+		if changed {
+			names = append(names, name)
+		}
+	}
+	add("EngineVersion", old.EngineVersion != opts.EngineVersion)
+	add("ReadOnly", old.ReadOnly != opts.ReadOnly)
+	add("DatabaseFilter", !reflect.DeepEqual(old.DatabaseFilter, opts.DatabaseFilter))
+	add("ShardPathFunc", funcPointer(old.ShardPathFunc) != funcPointer(opts.ShardPathFunc))
+	add("ShardRootsFunc", funcPointer(old.ShardRootsFunc) != funcPointer(opts.ShardRootsFunc))
+	add("WALInline", old.WALInline != opts.WALInline)
+	add("MaintenanceInterval", old.MaintenanceInterval != opts.MaintenanceInterval)
+	add("DisableMaintenance", old.DisableMaintenance != opts.DisableMaintenance)
+	add("MaxOpenShards", old.MaxOpenShards != opts.MaxOpenShards)
+	add("RecordLockStats", old.RecordLockStats != opts.RecordLockStats)
+	add("Config.Dir", old.Config.Dir != opts.Config.Dir)
+	add("Config.WALDir", old.Config.WALDir != opts.Config.WALDir)
+	return names
+}
+
+// funcPointer returns the address of the code of fn, or zero if fn is nil,
+// so that funcs can be compared.
+func funcPointer(fn interface{}) uintptr {
+	return reflect.ValueOf(fn).Pointer()
+}
+
 // WithLogger sets the logger for the store.
 func (s *Store) WithLogger(log *zap.Logger) {
 	s.baseLogger = log
@@ -79,19 +336,32 @@ func (s *Store) Path() string { return s.path }
 // Open initializes the store, creating all necessary directories, loading all
 // shards and indexes and initializing periodic maintenance of all shards.
 func (s *Store) Open() error {
+	s.mu.enable(s.EngineOptions.RecordLockStats)
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	s.closing = make(chan struct{})
 
+	s.optionsMu.Lock()
+	s.options = nil
+	s.optionsMu.Unlock()
+
 	s.shards = map[uint64]*Shard{}
+	s.failedShards = map[uint64]*failedShard{}
+	s.creatingShards = map[uint64]*shardCreation{}
+	s.restoringShards = map[uint64]struct{}{}
+	s.shardWaiters = map[uint64]*shardWaiter{}
+	s.lru = newShardLRU()
 	s.databaseIndexes = map[string]*DatabaseIndex{}
+	s.skippedShards = 0
 
 	s.Logger.Info("Using data dir", zap.String("path", s.Path()))
 
 	// Create directory.
-	if err := os.MkdirAll(s.path, 0777); err != nil {
-		return err
+	if !s.EngineOptions.ReadOnly {
+		if err := os.MkdirAll(s.path, 0777); err != nil {
+			return err
+		}
 	}
 
 	// TODO: Start AE for Node
@@ -102,571 +372,5298 @@ func (s *Store) Open() error {
 	if err := s.loadShards(); err != nil {
 		return err
 	}
+	if s.EngineOptions.MaxOpenShards > 0 {
+		for _, sh := range s.shardsSlice() {
+			s.lru.touch(sh)
+		}
+		s.evictShardsLocked()
+	}
+
+	if !s.EngineOptions.ReadOnly && !s.EngineOptions.DisableMaintenance {
+		// Shards loaded from disk are only snapshotted once written to.
+		snapshotted := make(map[uint64]time.Time, len(s.shards))
+		for id, sh := range s.shards {
+			snapshotted[id] = sh.LastWrite()
+		}
+
+		s.wg.Add(1)
+		go s.performMaintenance(s.closing, s.EngineOptions.maintenanceInterval(), snapshotted)
+	}
 
 	s.opened = true
 
 	return nil
 }
 
-func (s *Store) loadIndexes() error {
-	dbs, err := ioutil.ReadDir(s.path)
-	if err != nil {
-		return err
+// performMaintenance runs a maintenance pass every interval until closing is
+// closed. snapshotted holds the last write of each shard when its cache was
+// last snapshotted.
+func (s *Store) performMaintenance(closing <-chan struct{}, interval time.Duration, snapshotted map[uint64]time.Time) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-closing:
+			return
+		case <-ticker.C:
+			s.snapshotIdleShards(closing, interval, snapshotted)
+		}
+	}
+}
+
+// snapshotIdleShards writes a snapshot of the cache of each shard that was
+// written to since its last snapshot and has been idle for at least d.
+func (s *Store) snapshotIdleShards(closing <-chan struct{}, d time.Duration, snapshotted map[uint64]time.Time) {
+	// Skip the pass if the store is locked, so that a long-running operation
+	// holding the lock doesn't delay Close, which waits for maintenance to
+	// exit.
+	if !s.mu.TryRLock() {
+		return
+	}
+	shards := s.shardsSlice()
+	s.mu.RUnlock()
+
+	current := make(map[uint64]struct{}, len(shards))
+	for _, sh := range shards {
+		current[sh.id] = struct{}{}
+
+		select {
+		case <-closing:
+			return
+		default:
+		}
+
+		lw := sh.LastWrite()
+		if lw.IsZero() || time.Since(lw) < d || !lw.After(snapshotted[sh.id]) {
+			continue
+		}
+		if err := sh.WriteSnapshot(); err != nil {
+			if err != ErrEngineClosed {
+				s.Logger.Info("Failed to snapshot idle shard", logger.Shard(sh.id), zap.Error(err))
+			}
+			continue
+		}
+		snapshotted[sh.id] = lw
+	}
+
+	// Forget shards that were deleted.
+	for id := range snapshotted {
+		if _, ok := current[id]; !ok {
+			delete(snapshotted, id)
+		}
 	}
-	for _, db := range dbs {
-		if !db.IsDir() {
-			s.Logger.Info("Skipping database dir, Not a directory",
-				logger.Database(db.Name()))
+}
+
+func (s *Store) loadIndexes() error {
+	for i, root := range s.dataRoots() {
+		dbs, err := ioutil.ReadDir(root)
+		if os.IsNotExist(err) && i > 0 {
 			continue
+		} else if err != nil {
+			return err
+		}
+		for _, db := range dbs {
+			if !db.IsDir() {
+				s.skipPath("Skipping database dir", filepath.Join(root, db.Name()), "not a directory",
+					logger.Database(db.Name()))
+				continue
+			}
+			if !s.EngineOptions.includesDatabase(db.Name()) {
+				s.Logger.Info("Skipping database, Excluded by filter", logger.Database(db.Name()))
+				continue
+			}
+			if _, ok := s.databaseIndexes[db.Name()]; !ok {
+				s.databaseIndexes[db.Name()] = s.newDatabaseIndex(db.Name())
+			}
 		}
-		s.databaseIndexes[db.Name()] = NewDatabaseIndex(db.Name())
 	}
 	return nil
 }
 
 func (s *Store) loadShards() error {
-	// loop through the current database indexes
-	for db := range s.databaseIndexes {
-		rps, err := ioutil.ReadDir(filepath.Join(s.path, db))
-		if err != nil {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs shardErrors
+	)
+
+	// Limit the number of shards being opened at once. Taking the token
+	// before starting each goroutine keeps a limit of one strictly serial.
+	t := limiter.NewFixed(s.Options().openLimit())
+
+	// Wait for shards still opening if a directory can't be read.
+	defer wg.Wait()
+
+	// loop through the current database indexes in every data root
+	for _, dbPath := range s.databaseLoadDirs() {
+		db := filepath.Base(dbPath)
+		rps, err := ioutil.ReadDir(dbPath)
+		if os.IsNotExist(err) {
+			// The database only has shards in other roots.
+			continue
+		} else if err != nil {
 			return err
 		}
 
 		for _, rp := range rps {
 			// retention policies should be directories.  Skip anything that is not a dir.
 			if !rp.IsDir() {
-				s.Logger.Info("Skipping retention policy dir, Not a directory",
-					logger.RetentionPolicy(rp.Name()))
+				s.skipPath("Skipping retention policy dir", filepath.Join(dbPath, rp.Name()), "not a directory",
+					logger.Database(db), logger.RetentionPolicy(rp.Name()))
 				continue
 			}
 
-			shards, err := ioutil.ReadDir(filepath.Join(s.path, db, rp.Name()))
+			shards, err := ioutil.ReadDir(filepath.Join(dbPath, rp.Name()))
 			if err != nil {
 				return err
 			}
 			for _, sh := range shards {
-				path := filepath.Join(s.path, db, rp.Name(), sh.Name())
-				walPath := filepath.Join(s.EngineOptions.Config.WALDir, db, rp.Name(), sh.Name())
+				path := filepath.Join(dbPath, rp.Name(), sh.Name())
 
 				// Shard file names are numeric shardIDs
 				shardID, err := strconv.ParseUint(sh.Name(), 10, 64)
 				if err != nil {
-					s.Logger.Info("Invalid ID, Skipping shard", zap.String("name", sh.Name()))
+					s.skipPath("Skipping shard", path, "invalid shard ID",
+						logger.Database(db), logger.RetentionPolicy(rp.Name()), zap.String("name", sh.Name()))
 					continue
 				}
+				walPath := s.existingWALPath(path, db, rp.Name(), shardID)
 
-				shard := NewShard(shardID, s.databaseIndexes[db], path, walPath, s.EngineOptions)
+				shard := NewShard(shardID, s.databaseIndexes[db], path, walPath, s.engineOptions(db))
 				shard.WithLogger(s.baseLogger)
 
-				err = shard.Open()
-				if err != nil {
-					return err
-				}
-
-				s.shards[shardID] = shard
+				t.Take()
+				wg.Add(1)
+				go func(shard *Shard) {
+					defer wg.Done()
+					defer t.Release()
+
+					err := s.checkShardWAL(shard)
+					if err == nil {
+						err = shard.Open()
+					}
+
+					mu.Lock()
+					defer mu.Unlock()
+					if err != nil && s.Options().StrictOpen {
+						errs = append(errs, err)
+						return
+					} else if err != nil {
+						s.Logger.Info("Failed to open shard, Skipping shard",
+							logger.Shard(shard.id), zap.Error(err))
+						s.failedShards[shard.id] = &failedShard{shard: shard, err: err}
+						return
+					}
+					s.shards[shard.id] = shard
+				}(shard)
 			}
 		}
 	}
 
+	wg.Wait()
+	if len(errs) > 0 {
+		return errs
+	}
 	return nil
 }
 
-// Close closes the store and all associated shards. After calling Close accessing
-// shards through the Store will result in ErrStoreClosed being returned.
-func (s *Store) Close() error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	if s.opened {
-		close(s.closing)
+// checkShardWAL makes sure the WAL directory of a shard found on disk exists.
+// A missing directory is recreated if EngineOptions.RecoverMissingWAL is set.
+// If the parent directory is missing too the store has no WAL for the
+// retention policy at all, and the WAL is created when the shard opens.
+func (s *Store) checkShardWAL(sh *Shard) error {
+	if _, err := os.Stat(sh.walPath); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return NewShardError(sh.id, err)
+	} else if _, err := os.Stat(filepath.Dir(sh.walPath)); os.IsNotExist(err) {
+		return nil
 	}
-	s.wg.Wait()
 
-	for _, sh := range s.shards {
-		if err := sh.Close(); err != nil {
-			return err
-		}
+	if !s.Options().RecoverMissingWAL {
+		return NewShardError(sh.id, ErrWALMissing)
+	}
+	s.Logger.Warn("Recreating missing WAL directory, unflushed writes may have been lost",
+		logger.Shard(sh.id), zap.String("path", sh.walPath))
+	if err := os.MkdirAll(sh.walPath, 0777); err != nil {
+		return NewShardError(sh.id, err)
 	}
-	s.opened = false
-	s.shards = nil
-	s.databaseIndexes = nil
-
 	return nil
 }
 
-// DatabaseIndexN returns the number of databases indicies in the store.
-func (s *Store) DatabaseIndexN() int {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	return len(s.databaseIndexes)
-}
+// Reload opens the shards that were added to the data directory since the
+// store was opened, such as by an external restore tool, and creates the
+// indexes of new database directories. Shards that are already open, being
+// created or that failed to open are left alone. The data directory is
+// scanned with the store locked for reading, and it is only locked for
+// writing while the new shards are reserved and inserted, so writes to
+// other shards continue while the new shards open. A shard that fails to
+// open is handled as by Open, and OnShardCreated handlers are called for
+// each shard that is added.
+func (s *Store) Reload() error {
+	type reloadShard struct {
+		database, retentionPolicy string
+		id                        uint64
+		path                      string
+		creation                  *shardCreation
+	}
 
-// Shard returns a shard by id.
-func (s *Store) Shard(id uint64) *Shard {
 	s.mu.RLock()
-	defer s.mu.RUnlock()
-	sh, ok := s.shards[id]
-	if !ok {
-		return nil
+	select {
+	case <-s.closing:
+		s.mu.RUnlock()
+		return ErrStoreClosed
+	default:
+	}
+	known := func(id uint64) bool {
+		if _, ok := s.shards[id]; ok {
+			return true
+		} else if _, ok := s.creatingShards[id]; ok {
+			return true
+		}
+		_, ok := s.failedShards[id]
+		return ok
 	}
-	return sh
-}
 
-// Shards returns a list of shards by id.
-func (s *Store) Shards(ids []uint64) []*Shard {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	a := make([]*Shard, 0, len(ids))
-	for _, id := range ids {
-		sh, ok := s.shards[id]
-		if !ok {
+	var (
+		databases []string
+		found     []*reloadShard
+	)
+	seen := make(map[uint64]struct{})
+	for i, root := range s.dataRoots() {
+		dbs, err := ioutil.ReadDir(root)
+		if os.IsNotExist(err) && i > 0 {
 			continue
+		} else if err != nil {
+			s.mu.RUnlock()
+			return err
+		}
+		for _, db := range dbs {
+			if !db.IsDir() || !s.EngineOptions.includesDatabase(db.Name()) {
+				continue
+			}
+			if _, ok := s.databaseIndexes[db.Name()]; !ok {
+				databases = append(databases, db.Name())
+			}
+			rps, err := ioutil.ReadDir(filepath.Join(root, db.Name()))
+			if err != nil {
+				s.mu.RUnlock()
+				return err
+			}
+			for _, rp := range rps {
+				if !rp.IsDir() {
+					continue
+				}
+				shards, err := ioutil.ReadDir(filepath.Join(root, db.Name(), rp.Name()))
+				if err != nil {
+					s.mu.RUnlock()
+					return err
+				}
+				for _, sh := range shards {
+					id, err := strconv.ParseUint(sh.Name(), 10, 64)
+					if err != nil || known(id) {
+						continue
+					} else if _, ok := seen[id]; ok {
+						continue
+					}
+					seen[id] = struct{}{}
+					found = append(found, &reloadShard{
+						database:        db.Name(),
+						retentionPolicy: rp.Name(),
+						id:              id,
+						path:            filepath.Join(root, db.Name(), rp.Name(), sh.Name()),
+					})
+				}
+			}
 		}
-		a = append(a, sh)
 	}
-	return a
-}
-
-// ShardN returns the number of shards in the store.
-func (s *Store) ShardN() int {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	return len(s.shards)
-}
+	s.mu.RUnlock()
 
-// CreateShard creates a shard with the given id and retention policy on a database.
-func (s *Store) CreateShard(database, retentionPolicy string, shardID uint64) error {
+	// Reserve the new shards so that concurrent creates of the same IDs wait
+	// for them rather than opening the same files. A shard created or
+	// deleted since the scan is skipped.
 	s.mu.Lock()
-	defer s.mu.Unlock()
-
 	select {
 	case <-s.closing:
+		s.mu.Unlock()
 		return ErrStoreClosed
 	default:
 	}
-
-	// shard already exists
-	if _, ok := s.shards[shardID]; ok {
-		return nil
+	var reloads []*reloadShard
+	for _, r := range found {
+		if known(r.id) {
+			continue
+		} else if _, err := os.Stat(r.path); err != nil {
+			continue
+		}
+		r.creation = &shardCreation{done: make(chan struct{})}
+		s.creatingShards[r.id] = r.creation
+		reloads = append(reloads, r)
 	}
-
-	// created the db and retention policy dirs if they don't exist
-	if err := os.MkdirAll(filepath.Join(s.path, database, retentionPolicy), 0700); err != nil {
-		return err
+	// New database directories get an index even if they have no shards.
+	for _, name := range databases {
+		s.createDatabaseIndex(name)
 	}
-
-	// create the WAL directory
-	walPath := filepath.Join(s.EngineOptions.Config.WALDir, database, retentionPolicy, fmt.Sprintf("%d", shardID))
-	if err := os.MkdirAll(walPath, 0700); err != nil {
-		return err
+	indexes := make(map[string]*DatabaseIndex)
+	for _, r := range reloads {
+		indexes[r.database] = s.createDatabaseIndex(r.database)
 	}
+	s.mu.Unlock()
 
-	// create the database index if it does not exist
-	db, ok := s.databaseIndexes[database]
-	if !ok {
-		db = NewDatabaseIndex(database)
-		s.databaseIndexes[database] = db
+	var wg sync.WaitGroup
+	t := limiter.NewFixed(s.Options().openLimit())
+	for _, r := range reloads {
+		walPath := s.existingWALPath(r.path, r.database, r.retentionPolicy, r.id)
+		sh := NewShard(r.id, indexes[r.database], r.path, walPath, s.engineOptions(r.database))
+		sh.WithLogger(s.baseLogger)
+		r.creation.shard = sh
+
+		t.Take()
+		wg.Add(1)
+		go func(r *reloadShard) {
+			defer wg.Done()
+			defer t.Release()
+			r.creation.err = r.creation.shard.Open()
+		}(r)
 	}
+	wg.Wait()
 
-	path := filepath.Join(s.path, database, retentionPolicy, strconv.FormatUint(shardID, 10))
-	shard := NewShard(shardID, db, path, walPath, s.EngineOptions)
-	shard.WithLogger(s.baseLogger)
-
-	if err := shard.Open(); err != nil {
-		return err
+	s.mu.Lock()
+	var closed bool
+	select {
+	case <-s.closing:
+		closed = true
+	default:
+	}
+	var (
+		errs  shardErrors
+		added []*reloadShard
+	)
+	for _, r := range reloads {
+		delete(s.creatingShards, r.id)
+		c := r.creation
+		if closed {
+			c.shard.Close()
+			c.shard, c.err = nil, ErrStoreClosed
+			continue
+		} else if c.err != nil && s.Options().StrictOpen {
+			errs = append(errs, c.err)
+			c.shard = nil
+			continue
+		} else if c.err != nil {
+			s.Logger.Info("Failed to open shard, Skipping shard",
+				logger.Shard(r.id), zap.Error(c.err))
+			s.failedShards[r.id] = &failedShard{shard: c.shard, err: c.err}
+			c.shard = nil
+			continue
+		}
+		s.addShard(c.shard)
+		added = append(added, r)
 	}
+	s.mu.Unlock()
 
-	s.shards[shardID] = shard
+	for _, r := range reloads {
+		close(r.creation.done)
+	}
+	for _, r := range added {
+		s.notifyShardCreated(r.id, r.database, r.retentionPolicy)
+	}
 
+	if closed {
+		return ErrStoreClosed
+	} else if len(errs) > 0 {
+		return errs
+	}
 	return nil
 }
 
-// DeleteShard removes a shard from disk.
-func (s *Store) DeleteShard(shardID uint64) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	return s.deleteShard(shardID)
+// checkDatabaseFilter returns an error if EngineOptions.DatabaseFilter
+// excludes the database, so that its files on disk are not modified.
+func (s *Store) checkDatabaseFilter(name string) error {
+	if !s.EngineOptions.includesDatabase(name) {
+		return fmt.Errorf("database %s is excluded by the database filter", name)
+	}
+	return nil
 }
 
-// deleteShard removes a shard from disk. Callers of deleteShard need
-// to handle locks appropriately.
-func (s *Store) deleteShard(shardID uint64) error {
-	// ensure shard exists
-	sh, ok := s.shards[shardID]
-	if !ok {
-		return nil
+// shardPaths returns the data and WAL directories of a new shard, as
+// decided by EngineOptions.ShardPathFunc if it is set. With
+// EngineOptions.WALInline the WAL is inside the data directory.
+func (s *Store) shardPaths(database, retentionPolicy string, shardID uint64) (path, walPath string) {
+	path, walPath = s.separateShardPaths(database, retentionPolicy, shardID)
+	if s.EngineOptions.WALInline {
+		walPath = filepath.Join(path, inlineWALDir)
 	}
+	return path, walPath
+}
 
-	if err := sh.Close(); err != nil {
-		return err
+// separateShardPaths returns the data and WAL directories of a shard whose
+// WAL is not inline.
+func (s *Store) separateShardPaths(database, retentionPolicy string, shardID uint64) (path, walPath string) {
+	if fn := s.EngineOptions.ShardPathFunc; fn != nil {
+		return fn(database, retentionPolicy, shardID)
 	}
+	id := strconv.FormatUint(shardID, 10)
+	return filepath.Join(s.path, database, retentionPolicy, id), filepath.Join(s.EngineOptions.Config.WALDir, database, retentionPolicy, id)
+}
 
-	if err := os.RemoveAll(sh.path); err != nil {
-		return err
+// existingWALPath returns the WAL directory of a shard found at path, which
+// keeps the layout the shard was created with if EngineOptions.WALInline
+// has changed since.
+func (s *Store) existingWALPath(path, database, retentionPolicy string, shardID uint64) string {
+	inline := filepath.Join(path, inlineWALDir)
+	if fi, err := os.Stat(inline); err == nil && fi.IsDir() {
+		return inline
 	}
 
-	if err := os.RemoveAll(sh.walPath); err != nil {
-		return err
+	_, walPath := s.separateShardPaths(database, retentionPolicy, shardID)
+	if !s.EngineOptions.WALInline {
+		return walPath
+	} else if _, err := os.Stat(walPath); err == nil {
+		return walPath
 	}
-
-	delete(s.shards, shardID)
-	return nil
+	return inline
 }
 
-// ShardIteratorCreator returns an iterator creator for a shard.
-func (s *Store) ShardIteratorCreator(id uint64) influxql.IteratorCreator {
-	sh := s.Shard(id)
-	if sh == nil {
-		return nil
+// dataRoots returns the store path followed by the extra roots listed by
+// EngineOptions.ShardRootsFunc.
+func (s *Store) dataRoots() []string {
+	roots := []string{s.path}
+	if fn := s.EngineOptions.ShardRootsFunc; fn != nil {
+		for _, root := range fn() {
+			if filepath.Clean(root) != filepath.Clean(s.path) {
+				roots = append(roots, root)
+			}
+		}
 	}
-	return &shardIteratorCreator{sh: sh}
+	return roots
 }
 
-// DeleteDatabase will close all shards associated with a database and remove the directory and files from disk.
-func (s *Store) DeleteDatabase(name string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	// Close and delete all shards on the database.
-	for shardID, sh := range s.shards {
-		if sh.database == name {
-			// Delete the shard from disk.
-			if err := s.deleteShard(shardID); err != nil {
-				return err
-			}
+// databaseLoadDirs returns the directory of each database index in each data
+// root. Not all of them need to exist.
+func (s *Store) databaseLoadDirs() []string {
+	var dirs []string
+	for _, root := range s.dataRoots() {
+		for db := range s.databaseIndexes {
+			dirs = append(dirs, filepath.Join(root, db))
 		}
 	}
+	return dirs
+}
 
-	if err := os.RemoveAll(filepath.Join(s.path, name)); err != nil {
-		return err
+// databaseDirs returns every directory named after database that holds
+// shard data or WAL files: those in the store path, the WAL directory and
+// the extra data roots, and the parents of the store's shards placed
+// elsewhere. s.mu must be held.
+func (s *Store) databaseDirs(database string) []string {
+	set := newStringSet()
+	for _, root := range append(s.dataRoots(), s.EngineOptions.Config.WALDir) {
+		set.add(filepath.Join(root, database))
 	}
-	if err := os.RemoveAll(filepath.Join(s.EngineOptions.Config.WALDir, name)); err != nil {
-		return err
+	add := func(sh *Shard) {
+		if sh.database == database {
+			set.add(filepath.Join(shardRoot(sh.path), database))
+			if !sh.walInline() {
+				set.add(filepath.Join(shardRoot(sh.walPath), database))
+			}
+		}
 	}
+	for _, sh := range s.shards {
+		add(sh)
+	}
+	for _, f := range s.failedShards {
+		add(f.shard)
+	}
+	return set.list()
+}
 
-	delete(s.databaseIndexes, name)
-	return nil
+// shardRoot returns the directory holding the database directories of a
+// shard's data or WAL path laid out as <root>/<db>/<rp>/<id>.
+func shardRoot(path string) string {
+	return filepath.Dir(filepath.Dir(filepath.Dir(filepath.Clean(path))))
 }
 
-// DeleteRetentionPolicy will close all shards associated with the
-// provided retention policy, remove the retention policy directories on
-// both the DB and WAL, and remove all shard files from disk.
-func (s *Store) DeleteRetentionPolicy(database, name string) error {
+// rebasePath returns where a shard's data or WAL path moves to when the
+// shard moves to database and retentionPolicy. It stays on the same root so
+// that it can be renamed in place.
+func rebasePath(path, database, retentionPolicy string) string {
+	return filepath.Join(shardRoot(path), database, retentionPolicy, filepath.Base(path))
+}
+
+// skipPath logs an entry of the data directory that is not loaded and
+// counts it in SkippedShardsN.
+func (s *Store) skipPath(msg, path, reason string, fields ...zap.Field) {
+	s.skippedShards++
+	s.Logger.Warn(msg, append(fields, zap.String("path", path), zap.String("reason", reason))...)
+}
+
+// SkippedShardsN returns the number of files and directories in the data
+// directory that were not loaded as a database, retention policy or shard
+// the last time the store was opened. Any such entry may be data that was
+// copied into the wrong place.
+func (s *Store) SkippedShardsN() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.skippedShards
+}
+
+// shardErrors combines the errors returned by several shards.
+type shardErrors []error
+
+func (a shardErrors) Error() string {
+	msgs := make([]string, len(a))
+	for i, err := range a {
+		msgs[i] = err.Error()
+	}
+	sort.Strings(msgs)
+	return strings.Join(msgs, "; ")
+}
+
+// failedShard is a shard that was found on disk but could not be opened.
+type failedShard struct {
+	shard *Shard
+	err   error
+}
+
+// ShardOpenErrors returns the error of each shard that could not be opened
+// when the store was opened. These shards are not available until they are
+// successfully reopened with ReopenShard.
+func (s *Store) ShardOpenErrors() map[uint64]error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m := make(map[uint64]error, len(s.failedShards))
+	for id, f := range s.failedShards {
+		m[id] = f.err
+	}
+	return m
+}
+
+// ReopenShard closes and reopens a shard. A shard that failed to open when the
+// store was opened is retried and, if it opens, becomes available in the store.
+func (s *Store) ReopenShard(id uint64) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// Close and delete all shards under the retention policy on the
-	// database.
-	for shardID, sh := range s.shards {
-		if sh.database == database && sh.retentionPolicy == name {
-			// Delete the shard from disk.
-			if err := s.deleteShard(shardID); err != nil {
-				return err
-			}
+	select {
+	case <-s.closing:
+		return ErrStoreClosed
+	default:
+	}
+
+	if sh := s.shards[id]; sh != nil {
+		if err := sh.Close(); err != nil {
+			return err
 		}
+		if err := sh.Open(); err != nil {
+			// Keep the shard around so it can be retried.
+			delete(s.shards, id)
+			s.failedShards[id] = &failedShard{shard: sh, err: err}
+			return err
+		}
+		return nil
+	}
+
+	f := s.failedShards[id]
+	if f == nil {
+		return ErrShardNotFound
 	}
 
-	// Remove the rentention policy folder.
-	if err := os.RemoveAll(filepath.Join(s.path, database, name)); err != nil {
+	if err := f.shard.Open(); err != nil {
+		f.err = err
 		return err
 	}
 
-	// Remove the retention policy folder from the the WAL.
-	return os.RemoveAll(filepath.Join(s.EngineOptions.Config.WALDir, database, name))
+	delete(s.failedShards, id)
+	s.addShard(f.shard)
+	return nil
 }
 
-// DeleteMeasurement removes a measurement and all associated series from a database.
-func (s *Store) DeleteMeasurement(database, name string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// Close closes the store and all associated shards. After calling Close accessing
+// shards through the Store will result in ErrStoreClosed being returned.
+func (s *Store) Close() error {
+	return s.CloseWithTimeout(0)
+}
 
-	// Find the database.
-	db := s.databaseIndexes[database]
-	if db == nil {
-		return nil
+// CloseWithTimeout closes the store, waiting up to d for background
+// goroutines to exit and for shards to close. If d elapses first,
+// ErrStoreCloseTimeout is returned and the shards that have not closed yet
+// are logged; they continue closing in the background and the store keeps
+// them. A non-positive d waits indefinitely. At most EngineOptions.OpenLimit
+// shards are closed at once. The store is not locked while waiting for background
+// goroutines, so that the done callbacks of async writes may use it.
+func (s *Store) CloseWithTimeout(d time.Duration) error {
+	var timeout <-chan time.Time
+	if d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
 	}
 
-	// Find the measurement.
-	m := db.Measurement(name)
-	if m == nil {
-		return influxql.ErrMeasurementNotFound(name)
+	// Once closing is closed no new background goroutine is started.
+	s.mu.Lock()
+	select {
+	case <-s.closing:
+	default:
+		if s.opened {
+			close(s.closing)
+		}
 	}
+	s.mu.Unlock()
 
-	// Remove measurement from index.
-	db.DropMeasurement(m.Name)
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
 
-	// Remove underlying data.
-	for _, sh := range s.shards {
-		if sh.database != database {
-			continue
-		}
+	var timedOut bool
+	select {
+	case <-done:
+	case <-timeout:
+		s.Logger.Info("Timed out waiting for background tasks, Closing shards")
+		timedOut = true
+	}
 
-		if err := sh.DeleteMeasurement(m.Name, m.SeriesKeys()); err != nil {
-			return err
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Close all shards, even if the background tasks did not exit in time.
+	type result struct {
+		id  uint64
+		err error
+	}
+	shards := s.shardsSlice()
+	resC := make(chan result, len(shards))
+	pending := make(map[uint64]struct{}, len(shards))
+	for _, sh := range shards {
+		pending[sh.id] = struct{}{}
+	}
+
+	// Limit the number of shards being closed at once. Shards are handed
+	// out from a separate goroutine so that the timeout is still observed
+	// while waiting for a token.
+	t := limiter.NewFixed(s.Options().openLimit())
+	go func() {
+		for _, sh := range shards {
+			t.Take()
+			go func(sh *Shard) {
+				defer t.Release()
+				resC <- result{id: sh.id, err: sh.Close()}
+			}(sh)
+		}
+	}()
+
+	var errs shardErrors
+	for len(pending) > 0 && !timedOut {
+		select {
+		case res := <-resC:
+			delete(pending, res.id)
+			if res.err != nil {
+				errs = append(errs, NewShardError(res.id, res.err))
+			}
+		case <-timeout:
+			timedOut = true
 		}
 	}
+	for id := range pending {
+		s.Logger.Info("Shard did not close in time", logger.Shard(id))
+	}
+
+	s.opened = false
+	if timedOut {
+		// Shards still closing and background tasks that did not exit may
+		// still use the shards and indexes, so they are kept.
+		return ErrStoreCloseTimeout
+	}
+	s.shards = nil
+	s.failedShards = nil
+	s.databaseIndexes = nil
 
+	if len(errs) > 0 {
+		return errs
+	}
 	return nil
 }
 
-// ShardIDs returns a slice of all ShardIDs under management.
-func (s *Store) ShardIDs() []uint64 {
+// DatabaseIndexN returns the number of databases indicies in the store.
+func (s *Store) DatabaseIndexN() int {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.shardIDs()
+	return len(s.databaseIndexes)
 }
 
-func (s *Store) shardIDs() []uint64 {
-	a := make([]uint64, 0, len(s.shards))
-	for shardID := range s.shards {
-		a = append(a, shardID)
+// Shard returns a shard by id. A shard closed because of
+// EngineOptions.MaxOpenShards is opened again first.
+func (s *Store) Shard(id uint64) *Shard {
+	s.mu.RLock()
+	sh, ok := s.shards[id]
+	s.mu.RUnlock()
+	if !ok {
+		return nil
 	}
-	return a
+	if err := s.useShard(sh); err != nil && err != ErrStoreClosed {
+		s.Logger.Warn("Failed to reopen shard", logger.Shard(id), zap.Error(err))
+	}
+	return sh
 }
 
-// shardsSlice returns an ordered list of shards.
-func (s *Store) shardsSlice() []*Shard {
-	a := make([]*Shard, 0, len(s.shards))
-	for _, sh := range s.shards {
+// Shards returns a list of shards by id.
+func (s *Store) Shards(ids []uint64) []*Shard {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	a := make([]*Shard, 0, len(ids))
+	for _, id := range ids {
+		sh, ok := s.shards[id]
+		if !ok {
+			continue
+		}
 		a = append(a, sh)
 	}
-	sort.Sort(Shards(a))
 	return a
 }
 
-// DatabaseIndex returns the index for a database by its name.
-func (s *Store) DatabaseIndex(name string) *DatabaseIndex {
+// ShardN returns the number of shards in the store.
+func (s *Store) ShardN() int {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.databaseIndexes[name]
+	return len(s.shards)
 }
 
-// Databases returns all the databases in the indexes
-func (s *Store) Databases() []string {
+// EnforceRetention deletes the shards of a retention policy whose newest value
+// is older than maxAge and returns the IDs of the deleted shards. Shards
+// without any values are kept since their age is not known. A maxAge of zero
+// or less keeps all shards. If a shard fails to delete, the shards deleted so
+// far are returned with the error.
+func (s *Store) EnforceRetention(database, retentionPolicy string, maxAge time.Duration) ([]uint64, error) {
+	if s.EngineOptions.ReadOnly {
+		return nil, ErrStoreReadOnly
+	}
+	if err := validateDatabaseAndRetentionPolicy(database, retentionPolicy); err != nil {
+		return nil, err
+	}
+	if maxAge <= 0 {
+		return nil, nil
+	}
+
+	s.mu.RLock()
+	shards := s.retentionPolicyShards(database, retentionPolicy)
+	s.mu.RUnlock()
+
+	cutoff := time.Now().Add(-maxAge)
+
+	var deleted []uint64
+	for _, sh := range shards {
+		if _, max, ok := sh.TimeRange(); !ok || !max.Before(cutoff) {
+			continue
+		}
+
+		if _, err := s.DeleteShard(sh.id); err != nil {
+			return deleted, NewShardError(sh.id, err)
+		}
+		s.Logger.Info("Deleted expired shard", logger.Shard(sh.id), logger.Database(database))
+		deleted = append(deleted, sh.id)
+	}
+	return deleted, nil
+}
+
+// ShardsForTimeRange returns the shards of a retention policy whose values
+// may fall within [min, max], in nanoseconds, sorted by ID. Shards holding
+// no values are not returned. The time range of each shard is cached, so
+// shards are not read to answer this.
+func (s *Store) ShardsForTimeRange(database, rp string, min, max int64) []*Shard {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	databases := make([]string, 0, len(s.databaseIndexes))
-	for db := range s.databaseIndexes {
-		databases = append(databases, db)
+
+	var a []*Shard
+	for _, sh := range s.retentionPolicyShards(database, rp) {
+		if tmin, tmax, ok := sh.cachedTimeRange(); ok && tmin <= max && tmax >= min {
+			a = append(a, sh)
+		}
 	}
-	return databases
+	return a
 }
 
-// Measurement returns a measurement by name from the given database.
-func (s *Store) Measurement(database, name string) *Measurement {
+// ShardsOrderedByTime returns the shards of a retention policy sorted by the
+// oldest value they hold, so that queries can merge them as a stream. Shards
+// starting at the same time are sorted by their newest value and then by ID,
+// and shards holding no values come last, by ID. The cached time range of
+// each shard is used, see ShardTimeRange.
+func (s *Store) ShardsOrderedByTime(database, rp string) ([]*Shard, error) {
 	s.mu.RLock()
-	db := s.databaseIndexes[database]
+	defer s.mu.RUnlock()
+
+	if s.databaseIndexes[database] == nil {
+		return nil, influxql.ErrDatabaseNotFound(database)
+	}
+
+	type shardRange struct {
+		sh       *Shard
+		min, max int64
+		ok       bool
+	}
+	var ranges []shardRange
+	for _, sh := range s.retentionPolicyShards(database, rp) {
+		min, max, ok := sh.cachedTimeRange()
+		ranges = append(ranges, shardRange{sh: sh, min: min, max: max, ok: ok})
+	}
+
+	// The shards are already sorted by ID, which breaks the remaining ties.
+	sort.SliceStable(ranges, func(i, j int) bool {
+		a, b := ranges[i], ranges[j]
+		if a.ok != b.ok {
+			return a.ok
+		} else if a.min != b.min {
+			return a.min < b.min
+		}
+		return a.max < b.max
+	})
+
+	a := make([]*Shard, len(ranges))
+	for i, r := range ranges {
+		a[i] = r.sh
+	}
+	return a, nil
+}
+
+// ShardTimeRange returns the bounds of the values in a shard, in nanoseconds.
+// The range is cached when the shard is opened and widened on each write, so
+// it may still include values that have since been deleted. ErrShardEmpty is
+// returned if the shard holds no values.
+func (s *Store) ShardTimeRange(id uint64) (min, max int64, err error) {
+	sh := s.Shard(id)
+	if sh == nil {
+		return 0, 0, ErrShardNotFound
+	}
+
+	min, max, ok := sh.cachedTimeRange()
+	if !ok {
+		return 0, 0, ErrShardEmpty
+	}
+	return min, max, nil
+}
+
+// SeriesTimeRange returns the minimum and maximum timestamps, in nanoseconds,
+// of the values of a series across the shards of a database. It returns
+// ErrSeriesEmpty if no shard holds values for the series.
+func (s *Store) SeriesTimeRange(database, seriesKey string) (first, last int64, err error) {
+	s.mu.RLock()
+	if s.databaseIndexes[database] == nil {
+		s.mu.RUnlock()
+		return 0, 0, influxql.ErrDatabaseNotFound(database)
+	}
+	shards := s.databaseShards(database)
 	s.mu.RUnlock()
-	if db == nil {
-		return nil
+
+	first, last = math.MaxInt64, math.MinInt64
+	var found bool
+	for _, sh := range shards {
+		if _, _, ok := sh.cachedTimeRange(); !ok {
+			continue
+		}
+		engine, err := sh.openEngine()
+		if err == ErrEngineClosed {
+			continue
+		} else if err != nil {
+			return 0, 0, err
+		}
+
+		min, max, ok := engine.SeriesTimeRange(seriesKey)
+		if !ok {
+			continue
+		}
+		if min < first {
+			first = min
+		}
+		if max > last {
+			last = max
+		}
+		found = true
 	}
-	return db.Measurement(name)
+	if !found {
+		return 0, 0, ErrSeriesEmpty
+	}
+	return first, last, nil
 }
 
-// DiskSize returns the size of all the shard files in bytes.  This size does not include the WAL size.
-func (s *Store) DiskSize() (int64, error) {
+// ForEachShard calls fn for each shard in the store, ordered by ID, and stops
+// at the first error, which is returned. The shards are listed while the store
+// is locked but fn is called without the lock held, so it may take long or
+// call back into the store. Shards created or deleted while iterating may or
+// may not be visited.
+func (s *Store) ForEachShard(fn func(sh *Shard) error) error {
 	s.mu.RLock()
-	defer s.mu.RUnlock()
-	var size int64
-	for _, shardID := range s.ShardIDs() {
-		shard := s.Shard(shardID)
-		sz, err := shard.DiskSize()
-		if err != nil {
-			return 0, err
+	shards := s.shardsSlice()
+	s.mu.RUnlock()
+
+	for _, sh := range shards {
+		if err := fn(sh); err != nil {
+			return err
 		}
-		size += sz
 	}
-	return size, nil
+	return nil
 }
 
-// BackupShard will get the shard and have the engine backup since the passed in time to the writer
-func (s *Store) BackupShard(id uint64, since time.Time, w io.Writer) error {
-	shard := s.Shard(id)
-	if shard == nil {
-		return fmt.Errorf("shard %d doesn't exist on this server", id)
+// CreateShard creates a shard with the given id and retention policy on a database.
+func (s *Store) CreateShard(database, retentionPolicy string, shardID uint64) error {
+	_, err := s.CreateShardAndGet(database, retentionPolicy, shardID)
+	return err
+}
+
+// CreateShardAndGet creates a shard like CreateShard and returns it, so that
+// callers that need its paths don't have to look it up again. If the shard
+// already exists it is returned unchanged.
+func (s *Store) CreateShardAndGet(database, retentionPolicy string, shardID uint64) (*Shard, error) {
+	if s.EngineOptions.ReadOnly {
+		return nil, ErrStoreReadOnly
 	}
 
-	path, err := relativePath(s.path, shard.path)
-	if err != nil {
+	if err := validateDatabaseAndRetentionPolicy(database, retentionPolicy); err != nil {
+		return nil, err
+	}
+	if err := s.checkDatabaseFilter(database); err != nil {
+		return nil, err
+	}
+
+	opts := s.engineOptions(database)
+	sh, created, err := s.createShardOnce(database, retentionPolicy, shardID, opts, opts.EngineVersion != s.EngineOptions.EngineVersion)
+	if created {
+		s.notifyShardCreated(shardID, database, retentionPolicy)
+	}
+	return sh, err
+}
+
+// PrecreateShards creates and opens the shards with the given ids in a
+// retention policy on a database ahead of the writes that will use them, so
+// that the first writes don't wait for the shards to be opened. Shards that
+// already exist are left as they are. The store lock is taken for the whole
+// batch rather than for each shard, and is not held while shards are opened.
+// Shards that fail to open are skipped and the first error is returned once
+// the others are created.
+func (s *Store) PrecreateShards(database, retentionPolicy string, ids []uint64) error {
+	if s.EngineOptions.ReadOnly {
+		return ErrStoreReadOnly
+	}
+
+	if err := validateDatabaseAndRetentionPolicy(database, retentionPolicy); err != nil {
+		return err
+	}
+	if err := s.checkDatabaseFilter(database); err != nil {
 		return err
 	}
 
-	return shard.engine.Backup(w, path, since)
+	opts := s.engineOptions(database)
+	_, created, err := s.createShards(database, retentionPolicy, ids, opts, opts.EngineVersion != s.EngineOptions.EngineVersion)
+	for _, id := range created {
+		s.notifyShardCreated(id, database, retentionPolicy)
+	}
+	return err
 }
 
-// ShardRelativePath will return the relative path to the shard. i.e. <database>/<retention>/<id>
-func (s *Store) ShardRelativePath(id uint64) (string, error) {
-	shard := s.Shard(id)
-	if shard == nil {
-		return "", fmt.Errorf("shard %d doesn't exist on this server", id)
+// CreateShardWithOptions creates a shard with the given id and retention
+// policy on a database, overriding the store's engine options for that shard,
+// such as Config.CacheMaxMemorySize to give it its own cache limit or
+// Config.WALFsyncDelay to relax how often its WAL is synced.
+// The engine version is recorded in the shard directory so that the shard is
+// opened with the same engine when the store is reopened. The WAL location
+// is always taken from the store's options.
+func (s *Store) CreateShardWithOptions(database, retentionPolicy string, shardID uint64, opts EngineOptions) error {
+	if s.EngineOptions.ReadOnly {
+		return ErrStoreReadOnly
+	}
+
+	if err := validateDatabaseAndRetentionPolicy(database, retentionPolicy); err != nil {
+		return err
+	}
+	if err := s.checkDatabaseFilter(database); err != nil {
+		return err
+	}
+	if opts.EngineVersion == "" {
+		opts.EngineVersion = s.EngineOptions.EngineVersion
 	}
-	return relativePath(s.path, shard.path)
+	if _, ok := newEngineFuncs[opts.EngineVersion]; !ok {
+		return fmt.Errorf("unrecognized engine %s", opts.EngineVersion)
+	}
+
+	_, created, err := s.createShardOnce(database, retentionPolicy, shardID, opts, true)
+	if created {
+		s.notifyShardCreated(shardID, database, retentionPolicy)
+	}
+	return err
 }
 
-// DeleteSeries loops through the local shards and deletes the series data and metadata for the passed in series keys
-func (s *Store) DeleteSeries(database string, sources []influxql.Source, condition influxql.Expr) error {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// shardWaiter is a shard that WaitForShard calls are waiting for. ready is
+// closed when the shard is added to the store, and n is the number of calls
+// still waiting.
+type shardWaiter struct {
+	ready chan struct{}
+	n     int
+}
 
-	// Find the database.
-	db := s.DatabaseIndex(database)
-	if db == nil {
-		return nil
+// addShard adds an open shard to the store and wakes the WaitForShard calls
+// waiting for it. s.mu must be held for writing.
+func (s *Store) addShard(sh *Shard) {
+	s.shards[sh.id] = sh
+	if w := s.shardWaiters[sh.id]; w != nil {
+		close(w.ready)
+		delete(s.shardWaiters, sh.id)
+	}
+	if s.EngineOptions.MaxOpenShards > 0 {
+		s.lru.touch(sh)
+		s.evictShardsLocked()
+	}
+}
+
+// useShard records a use of sh for EngineOptions.MaxOpenShards, opening it
+// again if it was closed to stay within the limit. s.mu must not be held.
+func (s *Store) useShard(sh *Shard) error {
+	if s.EngineOptions.MaxOpenShards <= 0 || !s.lru.touch(sh) {
+		return nil
+	}
+
+	// The shard is opened without the store lock, as by OpenShard.
+	if err := sh.Open(); err != nil {
+		return NewShardError(sh.id, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.closing:
+		sh.Close()
+		return ErrStoreClosed
+	default:
+	}
+	s.lru.reopened(sh)
+	s.evictShardsLocked()
+	return nil
+}
+
+// openShardLocked returns the engine of sh, opening sh first if it was closed
+// because of EngineOptions.MaxOpenShards. It returns ErrEngineClosed if sh was
+// closed by CloseShard. s.mu must be held for writing; the caller evicts the
+// shards beyond the limit once it is done with them.
+func (s *Store) openShardLocked(sh *Shard) (Engine, error) {
+	if s.EngineOptions.MaxOpenShards > 0 && s.lru.touch(sh) {
+		if err := sh.Open(); err != nil {
+			return nil, err
+		}
+		s.lru.reopened(sh)
+	}
+	return sh.openEngine()
+}
+
+// useShardID calls useShard with the shard with the given id, if any.
+func (s *Store) useShardID(id uint64) error {
+	s.mu.RLock()
+	sh := s.shards[id]
+	s.mu.RUnlock()
+	if sh == nil {
+		return nil
+	}
+	return s.useShard(sh)
+}
+
+// evictShardsLocked closes the least recently used shards until at most
+// EngineOptions.MaxOpenShards are open. Shards with queued async writes are
+// kept open. s.mu must be held for writing, so that no write is in progress
+// on the shards it closes.
+func (s *Store) evictShardsLocked() {
+	s.asyncMu.Lock()
+	defer s.asyncMu.Unlock()
+
+	ids := s.lru.evict(s.EngineOptions.MaxOpenShards, func(sh *Shard) (inStore, closable bool) {
+		if s.shards[sh.id] != sh {
+			return false, false
+		}
+		_, writing := s.asyncWrites[sh]
+		return true, !writing
+	})
+	for _, id := range ids {
+		s.Logger.Info("Closed least recently used shard", logger.Shard(id),
+			zap.Int("max_open_shards", s.EngineOptions.MaxOpenShards))
+	}
+}
+
+// WaitForShard returns the shard with the given id, waiting for it to be
+// created if it isn't in the store yet. It returns the error of ctx if the
+// shard isn't created before ctx is done, and ErrStoreClosed if the store is
+// closed first.
+func (s *Store) WaitForShard(ctx context.Context, id uint64) (*Shard, error) {
+	if sh := s.Shard(id); sh != nil {
+		return sh, nil
+	}
+
+	for {
+		s.mu.Lock()
+		select {
+		case <-s.closing:
+			s.mu.Unlock()
+			return nil, ErrStoreClosed
+		default:
+		}
+		if sh := s.shards[id]; sh != nil {
+			s.mu.Unlock()
+			return sh, nil
+		}
+		w := s.shardWaiters[id]
+		if w == nil {
+			w = &shardWaiter{ready: make(chan struct{})}
+			s.shardWaiters[id] = w
+		}
+		w.n++
+		s.mu.Unlock()
+
+		select {
+		case <-w.ready:
+			// Look the shard up again, it may have been deleted since.
+		case <-s.closing:
+			return nil, ErrStoreClosed
+		case <-ctx.Done():
+			s.mu.Lock()
+			if w.n--; w.n == 0 && s.shardWaiters[id] == w {
+				delete(s.shardWaiters, id)
+			}
+			s.mu.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// shardCreation is a shard being opened by createShards. shard and err are
+// set before done is closed.
+type shardCreation struct {
+	done  chan struct{}
+	shard *Shard
+	err   error
+}
+
+// createShardOnce creates and opens a shard using opts unless it already
+// exists, and returns it. created reports whether this call created the
+// shard. See createShards.
+func (s *Store) createShardOnce(database, retentionPolicy string, shardID uint64, opts EngineOptions, recordEngine bool) (sh *Shard, created bool, err error) {
+	shards, ids, err := s.createShards(database, retentionPolicy, []uint64{shardID}, opts, recordEngine)
+	return shards[0], len(ids) > 0, err
+}
+
+// createShards creates and opens the shards that don't exist yet using
+// opts. Concurrent calls for the same shard wait for the first one and get
+// its result. The store is locked once to register all of the shards and
+// once to add them, but not while they are opened, so creates of different
+// shards do not block each other. Shards that fail to open are left out and
+// the first error is returned. Shards that failed to open when the store was
+// opened are not created again; their open error is returned. shards holds
+// the shard of each id, or nil if it could not be created, and created holds
+// the IDs of the shards created by this call. s.mu must not be held.
+func (s *Store) createShards(database, retentionPolicy string, ids []uint64, opts EngineOptions, recordEngine bool) (shards []*Shard, created []uint64, err error) {
+	shards = make([]*Shard, len(ids))
+
+	s.mu.Lock()
+	select {
+	case <-s.closing:
+		s.mu.Unlock()
+		return shards, nil, ErrStoreClosed
+	default:
+	}
+
+	var (
+		reserved  []uint64
+		creations []*shardCreation
+		waiting   []*shardCreation
+		db        *DatabaseIndex
+	)
+	byID := make(map[uint64]*shardCreation, len(ids))
+	for _, id := range ids {
+		if _, ok := byID[id]; ok {
+			continue
+		}
+
+		// shard already exists
+		if sh, ok := s.shards[id]; ok {
+			byID[id] = &shardCreation{shard: sh}
+			continue
+		}
+
+		// shard failed to open and is only retried by ReopenShard, so that
+		// no second shard is opened on its directories
+		if f, ok := s.failedShards[id]; ok {
+			byID[id] = &shardCreation{err: f.err}
+			if err == nil {
+				err = f.err
+			}
+			continue
+		}
+
+		// shard is being created by another caller
+		if c, ok := s.creatingShards[id]; ok {
+			byID[id] = c
+			waiting = append(waiting, c)
+			continue
+		}
+
+		c := &shardCreation{done: make(chan struct{})}
+		s.creatingShards[id] = c
+		byID[id] = c
+		reserved = append(reserved, id)
+		creations = append(creations, c)
+	}
+	if len(reserved) > 0 {
+		db = s.createDatabaseIndex(database)
+	}
+	s.mu.Unlock()
+
+	for i, id := range reserved {
+		creations[i].shard, creations[i].err = s.openNewShard(db, database, retentionPolicy, id, opts, recordEngine)
+	}
+
+	if len(reserved) > 0 {
+		s.mu.Lock()
+		var closed bool
+		select {
+		case <-s.closing:
+			closed = true
+		default:
+		}
+		for i, id := range reserved {
+			delete(s.creatingShards, id)
+			c := creations[i]
+			if c.err != nil {
+				continue
+			} else if closed {
+				c.shard.Close()
+				c.shard, c.err = nil, ErrStoreClosed
+				continue
+			}
+			s.addShard(c.shard)
+			created = append(created, id)
+		}
+		s.mu.Unlock()
+	}
+
+	for _, c := range creations {
+		if err == nil {
+			err = c.err
+		}
+		close(c.done)
+	}
+	for _, c := range waiting {
+		<-c.done
+		if err == nil {
+			err = c.err
+		}
+	}
+
+	for i, id := range ids {
+		shards[i] = byID[id].shard
+	}
+	return shards, created, err
+}
+
+// newDatabaseIndex returns a new index for a database that interns tags if
+// the database's options say so.
+func (s *Store) newDatabaseIndex(database string) *DatabaseIndex {
+	db := NewDatabaseIndex(database)
+	if s.engineOptions(database).InternTags {
+		db.interner = newTagInterner()
+	}
+	return db
+}
+
+// createDatabaseIndex returns the index of a database, creating it if it does
+// not exist. s.mu must be held for writing.
+func (s *Store) createDatabaseIndex(database string) *DatabaseIndex {
+	db, ok := s.databaseIndexes[database]
+	if !ok {
+		db = s.newDatabaseIndex(database)
+		s.databaseIndexes[database] = db
+	}
+	return db
+}
+
+// openNewShard creates the directories of a shard and opens it. The
+// directories are always derived from the store's options. If recordEngine is
+// set, the engine version of opts is recorded in the shard directory first so
+// that a partially created shard is still opened with the right engine.
+func (s *Store) openNewShard(db *DatabaseIndex, database, retentionPolicy string, shardID uint64, opts EngineOptions, recordEngine bool) (*Shard, error) {
+	path, walPath := s.shardPaths(database, retentionPolicy, shardID)
+
+	// created the db and retention policy dirs if they don't exist
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	if recordEngine {
+		if err := os.MkdirAll(path, 0700); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(filepath.Join(path, EngineFormatFile), []byte(opts.EngineVersion), 0600); err != nil {
+			return nil, err
+		}
+	}
+
+	// create the WAL directory
+	if err := os.MkdirAll(walPath, 0700); err != nil {
+		return nil, err
+	}
+
+	shard := NewShard(shardID, db, path, walPath, opts)
+	shard.WithLogger(s.baseLogger)
+
+	if err := shard.Open(); err != nil {
+		return nil, err
+	}
+	return shard, nil
+}
+
+// OnShardCreated registers fn to be called after a shard is created. Handlers
+// are called in registration order, without the store locked, so they may
+// call back into the store.
+func (s *Store) OnShardCreated(fn func(id uint64, database, retentionPolicy string)) {
+	s.hooksMu.Lock()
+	defer s.hooksMu.Unlock()
+	s.shardCreatedFn = append(s.shardCreatedFn, fn)
+}
+
+// OnShardDeleted registers fn to be called after a shard is deleted. Handlers
+// are called in registration order, without the store locked, so they may
+// call back into the store.
+func (s *Store) OnShardDeleted(fn func(id uint64)) {
+	s.hooksMu.Lock()
+	defer s.hooksMu.Unlock()
+	s.shardDeletedFn = append(s.shardDeletedFn, fn)
+}
+
+// notifyShardCreated calls the OnShardCreated handlers. s.mu must not be held.
+func (s *Store) notifyShardCreated(id uint64, database, retentionPolicy string) {
+	s.hooksMu.RLock()
+	fns := s.shardCreatedFn
+	s.hooksMu.RUnlock()
+
+	for _, fn := range fns {
+		fn(id, database, retentionPolicy)
+	}
+}
+
+// notifyShardsDeleted calls the OnShardDeleted handlers for each of ids. s.mu
+// must not be held.
+func (s *Store) notifyShardsDeleted(ids []uint64) {
+	s.hooksMu.RLock()
+	fns := s.shardDeletedFn
+	s.hooksMu.RUnlock()
+
+	for _, id := range ids {
+		for _, fn := range fns {
+			fn(id)
+		}
+	}
+}
+
+// DeleteShard removes a shard from disk, including a shard that failed to
+// open. deleted is false if the shard did not exist, in which case nothing is
+// done.
+func (s *Store) DeleteShard(shardID uint64) (deleted bool, err error) {
+	if s.EngineOptions.ReadOnly {
+		return false, ErrStoreReadOnly
+	}
+
+	s.mu.Lock()
+	_, ok := s.shards[shardID]
+	if _, failed := s.failedShards[shardID]; failed {
+		ok = true
+	}
+	err = s.deleteShard(shardID)
+	s.mu.Unlock()
+
+	if !ok || err != nil {
+		return false, err
+	}
+	s.notifyShardsDeleted([]uint64{shardID})
+	return true, nil
+}
+
+// deleteShard removes a shard from disk. Callers of deleteShard need
+// to handle locks appropriately.
+func (s *Store) deleteShard(shardID uint64) error {
+	// A shard that failed to open only has its directories to remove.
+	if f, ok := s.failedShards[shardID]; ok {
+		if err := os.RemoveAll(f.shard.path); err != nil {
+			return err
+		} else if err := os.RemoveAll(f.shard.walPath); err != nil {
+			return err
+		}
+		delete(s.failedShards, shardID)
+		return nil
+	}
+
+	// ensure shard exists
+	sh, ok := s.shards[shardID]
+	if !ok {
+		return nil
+	}
+
+	if err := sh.Close(); err != nil {
+		return err
+	}
+	s.cancelAsyncWrites(sh, ErrShardNotFound)
+
+	if err := os.RemoveAll(sh.path); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(sh.walPath); err != nil {
+		return err
+	}
+
+	delete(s.shards, shardID)
+	return nil
+}
+
+// CloseShard closes a shard's engine, releasing its files, but keeps the
+// shard in the store. Writes and queries against a closed shard return
+// ErrEngineClosed until it is reopened with OpenShard.
+func (s *Store) CloseShard(id uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.closing:
+		return ErrStoreClosed
+	default:
+	}
+
+	sh, ok := s.shards[id]
+	if !ok {
+		return ErrShardNotFound
+	}
+	if err := sh.Close(); err != nil {
+		return NewShardError(id, err)
+	}
+	s.cancelAsyncWrites(sh, ErrEngineClosed)
+	s.lru.remove(sh)
+	return nil
+}
+
+// OpenShard reopens a shard closed by CloseShard. Opening a shard that is
+// already open is a no-op.
+func (s *Store) OpenShard(id uint64) error {
+	s.mu.RLock()
+	select {
+	case <-s.closing:
+		s.mu.RUnlock()
+		return ErrStoreClosed
+	default:
+	}
+	sh, ok := s.shards[id]
+	closing := s.closing
+	s.mu.RUnlock()
+	if !ok {
+		return ErrShardNotFound
+	}
+
+	// The shard is opened without the store lock so that other shards can be
+	// used meanwhile.
+	if err := sh.Open(); err != nil {
+		return err
+	}
+
+	select {
+	case <-closing:
+		sh.Close()
+		return ErrStoreClosed
+	default:
+	}
+	if s.EngineOptions.MaxOpenShards > 0 {
+		s.mu.Lock()
+		s.lru.reopened(sh)
+		s.evictShardsLocked()
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// ShardIteratorCreator returns an iterator creator for a shard.
+func (s *Store) ShardIteratorCreator(id uint64) influxql.IteratorCreator {
+	sh := s.Shard(id)
+	if sh == nil {
+		return nil
+	}
+	return &shardIteratorCreator{sh: sh}
+}
+
+// CreateDatabase creates an empty database: its directory in the store path
+// and its index. Databases are also created implicitly with their first
+// shard, but creating one up front lets it exist without shards. An error
+// wrapping ErrDatabaseExists is returned if the database already exists.
+func (s *Store) CreateDatabase(name string) error {
+	if s.EngineOptions.ReadOnly {
+		return ErrStoreReadOnly
+	}
+
+	if err := validateName("database", name); err != nil {
+		return err
+	}
+	if err := s.checkDatabaseFilter(name); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.closing:
+		return ErrStoreClosed
+	default:
+	}
+
+	if _, ok := s.databaseIndexes[name]; ok {
+		return fmt.Errorf("%w: %s", ErrDatabaseExists, name)
+	}
+	if err := os.MkdirAll(filepath.Join(s.path, name), 0700); err != nil {
+		return err
+	}
+	s.createDatabaseIndex(name)
+	return nil
+}
+
+// DeleteDatabase will close all shards associated with a database and remove the directory and files from disk.
+// Every shard of the database is attempted even if some fail. The directories
+// and index are only removed once all of the shards were deleted, otherwise
+// the returned error lists the shards that remain. ok is false if the
+// database had no index, shards or directories, in which case nothing is done.
+func (s *Store) DeleteDatabase(name string) (ok bool, err error) {
+	if s.EngineOptions.ReadOnly {
+		return false, ErrStoreReadOnly
+	}
+
+	if err := validateName("database", name); err != nil {
+		return false, err
+	}
+	if err := s.checkDatabaseFilter(name); err != nil {
+		return false, err
+	}
+
+	// Handlers are called once the store is unlocked.
+	var deleted []uint64
+	defer func() { s.notifyShardsDeleted(deleted) }()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok = s.databaseIndexes[name]
+
+	// Find the directories before the shards are removed from the store.
+	dirs := s.databaseDirs(name)
+
+	// Close and delete all shards on the database.
+	var errs shardErrors
+	var remaining []string
+	for _, sh := range s.databaseShards(name) {
+		// Delete the shard from disk.
+		if err := s.deleteShard(sh.id); err != nil {
+			errs = append(errs, NewShardError(sh.id, err))
+			remaining = append(remaining, strconv.FormatUint(sh.id, 10))
+			continue
+		}
+		deleted = append(deleted, sh.id)
+	}
+
+	if len(errs) > 0 {
+		return ok || len(deleted) > 0, fmt.Errorf("delete database %s: shards %s remain: %s", name, strings.Join(remaining, ", "), errs)
+	}
+
+	for _, dir := range dirs {
+		removed, err := removeAllIfExists(dir)
+		if err != nil {
+			return true, err
+		}
+		ok = ok || removed
+	}
+
+	delete(s.databaseIndexes, name)
+	return ok, nil
+}
+
+// removeAllIfExists removes path and any children it contains. removed is
+// false if path did not exist.
+func removeAllIfExists(path string) (removed bool, err error) {
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if err := os.RemoveAll(path); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RenameDatabase renames a database without copying its data. The shards of
+// the database are closed, the data and WAL directories are moved to the new
+// name and the shards are reopened under it. An error is returned if newName
+// already exists. If any step fails the directories are moved back and the
+// shards are reopened under oldName.
+func (s *Store) RenameDatabase(oldName, newName string) error {
+	if s.EngineOptions.ReadOnly {
+		return ErrStoreReadOnly
+	}
+
+	if err := validateName("database", newName); err != nil {
+		return err
+	}
+	if err := s.checkDatabaseFilter(newName); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.closing:
+		return ErrStoreClosed
+	default:
+	}
+
+	if _, ok := s.databaseIndexes[oldName]; !ok {
+		return influxql.ErrDatabaseNotFound(oldName)
+	} else if oldName == newName {
+		return nil
+	} else if _, ok := s.databaseIndexes[newName]; ok {
+		return fmt.Errorf("%w: %s", ErrDatabaseExists, newName)
+	}
+
+	// Each data and WAL directory of the database is renamed in place.
+	oldPaths := s.databaseDirs(oldName)
+	newPaths := make([]string, len(oldPaths))
+	for i, path := range oldPaths {
+		newPaths[i] = filepath.Join(filepath.Dir(path), newName)
+		if _, err := os.Stat(newPaths[i]); err == nil {
+			return fmt.Errorf("%w: %s", ErrDatabaseExists, newName)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	shards := s.databaseShards(oldName)
+
+	// rollback reopens the shards under the old name after a failure.
+	rollback := func(err error) error {
+		if rerr := s.reopenDatabaseShards(oldName, shards); rerr != nil {
+			s.Logger.Info("Failed to reopen shards after failed rename",
+				logger.Database(oldName), zap.Error(rerr))
+		}
+		return err
+	}
+
+	for _, sh := range shards {
+		if err := sh.Close(); err != nil {
+			return rollback(err)
+		}
+	}
+
+	// restore moves the first n directories back to the old name.
+	restore := func(n int) error {
+		for i := n - 1; i >= 0; i-- {
+			if err := renameIfExists(newPaths[i], oldPaths[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for i := range oldPaths {
+		if err := renameIfExists(oldPaths[i], newPaths[i]); err != nil {
+			if rerr := restore(i); rerr != nil {
+				return rerr
+			}
+			return rollback(err)
+		}
+	}
+
+	if err := s.reopenDatabaseShards(newName, shards); err != nil {
+		if rerr := restore(len(oldPaths)); rerr != nil {
+			return rerr
+		}
+		return rollback(err)
+	}
+	delete(s.databaseIndexes, oldName)
+
+	// Shards that failed to open now live under the new name too.
+	for id, f := range s.failedShards {
+		if f.shard.database != oldName {
+			continue
+		}
+		path, walPath := f.shard.rebasedPaths(newName, f.shard.retentionPolicy)
+		sh := NewShard(id, s.databaseIndexes[newName], path, walPath, f.shard.options)
+		sh.WithLogger(s.baseLogger)
+		s.failedShards[id] = &failedShard{shard: sh, err: f.err}
+	}
+
+	return nil
+}
+
+// reopenDatabaseShards opens a new shard for each of shards under database
+// with a new index and replaces them in the store. If any shard fails to
+// open, the shards opened so far are closed and the store is not changed.
+// s.mu must be held for writing.
+func (s *Store) reopenDatabaseShards(database string, shards []*Shard) error {
+	db := s.newDatabaseIndex(database)
+
+	opened := make([]*Shard, 0, len(shards))
+	for _, sh := range shards {
+		path, walPath := sh.rebasedPaths(database, sh.retentionPolicy)
+
+		shard := NewShard(sh.id, db, path, walPath, sh.options)
+		shard.WithLogger(s.baseLogger)
+		if err := shard.Open(); err != nil {
+			for _, sh := range opened {
+				sh.Close()
+			}
+			return NewShardError(sh.id, err)
+		}
+		opened = append(opened, shard)
+	}
+
+	s.databaseIndexes[database] = db
+	for _, sh := range opened {
+		s.shards[sh.id] = sh
+	}
+	return nil
+}
+
+// MoveShard moves a shard to another database or retention policy. The shard
+// is closed, its data and WAL directories are moved to the new location and it
+// is reopened there. An error is returned if the destination directories
+// already exist. If any step fails the directories are moved back and the
+// shard is reopened where it was, so it is never dropped from the store.
+func (s *Store) MoveShard(shardID uint64, newDatabase, newRetentionPolicy string) error {
+	return s.moveShard(shardID, newDatabase, newRetentionPolicy, false)
+}
+
+// MoveShardDryRun returns the error MoveShard would return before moving
+// anything, without closing or moving the shard.
+func (s *Store) MoveShardDryRun(shardID uint64, newDatabase, newRetentionPolicy string) error {
+	return s.moveShard(shardID, newDatabase, newRetentionPolicy, true)
+}
+
+func (s *Store) moveShard(shardID uint64, newDatabase, newRetentionPolicy string, dryRun bool) error {
+	if s.EngineOptions.ReadOnly {
+		return ErrStoreReadOnly
+	}
+
+	if err := validateDatabaseAndRetentionPolicy(newDatabase, newRetentionPolicy); err != nil {
+		return err
+	}
+	if err := s.checkDatabaseFilter(newDatabase); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.closing:
+		return ErrStoreClosed
+	default:
+	}
+
+	sh, ok := s.shards[shardID]
+	if !ok {
+		return ErrShardNotFound
+	} else if sh.database == newDatabase && sh.retentionPolicy == newRetentionPolicy {
+		return fmt.Errorf("shard %d is already in %s.%s", shardID, newDatabase, newRetentionPolicy)
+	}
+
+	newPath, newWALPath := sh.rebasedPaths(newDatabase, newRetentionPolicy)
+	dirs := []string{newPath, newWALPath}
+	if sh.walInline() {
+		// The WAL moves with the data directory.
+		dirs = dirs[:1]
+	}
+	for _, path := range dirs {
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("shard %d already exists in %s.%s", shardID, newDatabase, newRetentionPolicy)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if dryRun {
+		return nil
+	}
+
+	// Series of the shard that no other shard of its database holds are
+	// dropped from the database's index once the shard has moved.
+	var movedKeys []string
+	if newDatabase != sh.database {
+		movedKeys = sh.seriesKeys()
+	}
+
+	// rollback reopens the shard at its old location after a failure.
+	rollback := func(err error) error {
+		if rerr := sh.Open(); rerr != nil {
+			s.Logger.Info("Failed to reopen shard after failed move",
+				logger.Shard(shardID), zap.Error(rerr))
+		}
+		return err
+	}
+
+	if err := sh.Close(); err != nil {
+		return rollback(err)
+	}
+
+	for _, path := range dirs {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return rollback(err)
+		}
+	}
+	if err := renameIfExists(sh.path, newPath); err != nil {
+		return rollback(err)
+	}
+	if len(dirs) > 1 {
+		if err := renameIfExists(sh.walPath, newWALPath); err != nil {
+			if rerr := renameIfExists(newPath, sh.path); rerr != nil {
+				return rerr
+			}
+			return rollback(err)
+		}
+	}
+
+	db, ok := s.databaseIndexes[newDatabase]
+	if !ok {
+		db = s.newDatabaseIndex(newDatabase)
+	}
+
+	shard := NewShard(shardID, db, newPath, newWALPath, sh.options)
+	shard.WithLogger(s.baseLogger)
+	if err := shard.Open(); err != nil {
+		shard.Close()
+		if len(dirs) > 1 {
+			if rerr := renameIfExists(newWALPath, sh.walPath); rerr != nil {
+				return rerr
+			}
+		}
+		if rerr := renameIfExists(newPath, sh.path); rerr != nil {
+			return rerr
+		}
+		return rollback(err)
+	}
+
+	s.cancelAsyncWrites(sh, ErrEngineClosed)
+	s.lru.remove(sh)
+	s.databaseIndexes[newDatabase] = db
+	s.addShard(shard)
+	s.dropUnusedSeries(sh.database, movedKeys)
+	return nil
+}
+
+// dropUnusedSeries removes the series in keys that no shard of database has
+// values for from the database's index, and the measurements left without
+// series. Nothing is removed if a shard can't be opened to check it. s.mu
+// must be held for writing.
+func (s *Store) dropUnusedSeries(database string, keys []string) {
+	db := s.databaseIndexes[database]
+	if db == nil || len(keys) == 0 {
+		return
+	}
+
+	if s.EngineOptions.MaxOpenShards > 0 {
+		defer s.evictShardsLocked()
+	}
+	shards := s.databaseShards(database)
+	engines := make([]Engine, len(shards))
+	for i, sh := range shards {
+		engine, err := s.openShardLocked(sh)
+		if err != nil {
+			s.Logger.Info("Failed to open shard, keeping series in index",
+				logger.Shard(sh.id), zap.Error(err))
+			return
+		}
+		engines[i] = engine
+	}
+
+	var unused []string
+	names := make(map[string]struct{})
+	for _, key := range keys {
+		var found bool
+		for _, engine := range engines {
+			if _, _, found = engine.SeriesTimeRange(key); found {
+				break
+			}
+		}
+		if ser := db.Series(key); !found && ser != nil {
+			unused = append(unused, key)
+			names[ser.measurement.Name] = struct{}{}
+		}
+	}
+	db.DropSeries(unused)
+	for name := range names {
+		if m := db.Measurement(name); m != nil && m.SeriesN() == 0 {
+			db.DropMeasurement(name)
+		}
+	}
+}
+
+// RenameMeasurement renames a measurement of a database. The series of the
+// measurement are rewritten in every shard of the database and the shards are
+// reopened to rebuild the database index. The rewritten files replace the old
+// ones only once every shard has been rewritten, so an error while rewriting
+// leaves the measurement unchanged. If newName already exists, the
+// series are merged into it and fields with the same name must have the same
+// type. Data files are rewritten one block at a time. The store is locked
+// while the measurement is renamed, so writes to the affected measurement,
+// and to every other one, block until the rename completes.
+func (s *Store) RenameMeasurement(database, oldName, newName string) error {
+	if s.EngineOptions.ReadOnly {
+		return ErrStoreReadOnly
+	}
+
+	if newName == "" || strings.ContainsAny(newName, ", ") {
+		return fmt.Errorf("invalid measurement name: %q", newName)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.closing:
+		return ErrStoreClosed
+	default:
+	}
+
+	db := s.databaseIndexes[database]
+	if db == nil {
+		return influxql.ErrDatabaseNotFound(database)
+	} else if db.Measurement(oldName) == nil {
+		return influxql.ErrMeasurementNotFound(oldName)
+	} else if oldName == newName {
+		return nil
+	}
+
+	shards := s.databaseShards(database)
+
+	for _, sh := range shards {
+		if err := sh.checkFieldTypes(oldName, newName); err != nil {
+			return NewShardError(sh.id, err)
+		}
+	}
+
+	if s.EngineOptions.MaxOpenShards > 0 {
+		defer s.evictShardsLocked()
+	}
+
+	// Stage the rename in every shard before committing any of them, so
+	// that a failure leaves the measurement under its old name everywhere.
+	pending := make([]PendingRename, 0, len(shards))
+	abort := func() {
+		for _, r := range pending {
+			r.Abort()
+		}
+	}
+	for _, sh := range shards {
+		if _, err := s.openShardLocked(sh); err != nil {
+			abort()
+			return NewShardError(sh.id, err)
+		}
+		r, err := sh.RenameMeasurement(oldName, newName)
+		if err != nil {
+			abort()
+			return NewShardError(sh.id, err)
+		}
+		pending = append(pending, r)
+	}
+
+	// The rewritten files are all on disk, so a shard that fails to swap
+	// them in does not stop the others from committing.
+	var renameErr error
+	for i, r := range pending {
+		if err := r.Commit(); err != nil && renameErr == nil {
+			renameErr = NewShardError(shards[i].id, err)
+		}
+	}
+
+	var closeErr error
+	for _, sh := range shards {
+		if err := sh.Close(); err != nil && closeErr == nil {
+			closeErr = NewShardError(sh.id, err)
+		}
+	}
+	if closeErr == nil {
+		closeErr = s.reopenDatabaseShards(database, shards)
+	}
+	if closeErr != nil {
+		// Keep serving the shards with the old index.
+		for _, sh := range shards {
+			if err := sh.Open(); err != nil {
+				s.Logger.Info("Failed to reopen shard after failed rename",
+					logger.Shard(sh.id), zap.Error(err))
+			}
+		}
+		return closeErr
+	}
+
+	s.rebindFailedShards(database)
+	return renameErr
+}
+
+// RebuildIndex discards the index of a database and rebuilds it from the
+// series keys in the files and caches of the database's shards. The shards are
+// closed and reopened against a new index, which replaces the old one once
+// every shard has opened. If any shard fails to open, the shards are reopened
+// with the old index and the error is returned. The store is locked while the
+// index is rebuilt.
+func (s *Store) RebuildIndex(database string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.closing:
+		return ErrStoreClosed
+	default:
+	}
+
+	if s.databaseIndexes[database] == nil {
+		return influxql.ErrDatabaseNotFound(database)
+	}
+
+	shards := s.databaseShards(database)
+
+	for _, sh := range shards {
+		if err := sh.Close(); err != nil {
+			return NewShardError(sh.id, err)
+		}
+	}
+	if err := s.reopenDatabaseShards(database, shards); err != nil {
+		// Keep serving the shards with the old index.
+		for _, sh := range shards {
+			if rerr := sh.Open(); rerr != nil {
+				s.Logger.Info("Failed to reopen shard after failed index rebuild",
+					logger.Shard(sh.id), zap.Error(rerr))
+			}
+		}
+		return err
+	}
+	s.rebindFailedShards(database)
+
+	measurements, series := s.databaseIndexes[database].MeasurementSeriesCounts()
+	s.Logger.Info("Rebuilt database index", logger.Database(database),
+		zap.Int("shards", len(shards)), zap.Int("measurements", measurements), zap.Int("series", series))
+	return nil
+}
+
+// rebindFailedShards replaces the shards of database that failed to open with
+// shards using the database's current index, so that they are retried
+// against it. s.mu must be held for writing.
+func (s *Store) rebindFailedShards(database string) {
+	for id, f := range s.failedShards {
+		if f.shard.database != database {
+			continue
+		}
+		sh := NewShard(id, s.databaseIndexes[database], f.shard.path, f.shard.walPath, f.shard.options)
+		sh.WithLogger(s.baseLogger)
+		s.failedShards[id] = &failedShard{shard: sh, err: f.err}
+	}
+}
+
+// validateName returns an error if name can't safely be used as a single
+// directory name in the store. kind describes the name in the error.
+func validateName(kind, name string) error {
+	if name == "" {
+		return fmt.Errorf("%s name required", kind)
+	} else if name == "." || strings.Contains(name, "..") || strings.ContainsAny(name, "/"+string(os.PathSeparator)) {
+		return fmt.Errorf("invalid %s name: %q", kind, name)
+	}
+	return nil
+}
+
+// validateDatabaseAndRetentionPolicy validates the names used for a retention
+// policy's directories.
+func validateDatabaseAndRetentionPolicy(database, retentionPolicy string) error {
+	if err := validateName("database", database); err != nil {
+		return err
+	}
+	return validateName("retention policy", retentionPolicy)
+}
+
+// renameIfExists renames oldpath to newpath. A missing oldpath is ignored.
+func renameIfExists(oldpath, newpath string) error {
+	if err := os.Rename(oldpath, newpath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// DeleteRetentionPolicy will close all shards associated with the
+// provided retention policy, remove the retention policy directories on
+// both the DB and WAL, and remove all shard files from disk. ok is false if
+// the retention policy had no shards or directories, in which case nothing
+// is done.
+func (s *Store) DeleteRetentionPolicy(database, name string) (ok bool, err error) {
+	if s.EngineOptions.ReadOnly {
+		return false, ErrStoreReadOnly
+	}
+
+	if err := validateDatabaseAndRetentionPolicy(database, name); err != nil {
+		return false, err
+	}
+	if err := s.checkDatabaseFilter(database); err != nil {
+		return false, err
+	}
+
+	// Handlers are called once the store is unlocked.
+	var deleted []uint64
+	defer func() { s.notifyShardsDeleted(deleted) }()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Find the directories before the shards are removed from the store.
+	dirs := s.databaseDirs(database)
+
+	// Close and delete all shards under the retention policy on the
+	// database.
+	for _, sh := range s.retentionPolicyShards(database, name) {
+		// Delete the shard from disk.
+		if err := s.deleteShard(sh.id); err != nil {
+			return len(deleted) > 0, err
+		}
+		deleted = append(deleted, sh.id)
+	}
+	ok = len(deleted) > 0
+
+	// Remove the rentention policy folders from the data and WAL
+	// directories.
+	for _, dir := range dirs {
+		removed, err := removeAllIfExists(filepath.Join(dir, name))
+		if err != nil {
+			return ok, err
+		}
+		ok = ok || removed
+	}
+	return ok, nil
+}
+
+// DeleteMeasurement removes a measurement and all associated series from a database.
+//
+// The data is deleted from every shard of the database before the measurement
+// is removed from the index. If any shard fails, the measurement is left in
+// the index and the returned error names the shards that may still contain
+// its data, so the delete can be retried.
+func (s *Store) DeleteMeasurement(database, name string) error {
+	if s.EngineOptions.ReadOnly {
+		return ErrStoreReadOnly
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Find the database.
+	db := s.databaseIndexes[database]
+	if db == nil {
+		return nil
+	}
+
+	// Find the measurement.
+	m := db.Measurement(name)
+	if m == nil {
+		return influxql.ErrMeasurementNotFound(name)
+	}
+
+	// Remove underlying data, continuing past failed shards so that as much
+	// data as possible is removed.
+	seriesKeys := m.SeriesKeys()
+	var errs shardErrors
+	for _, sh := range s.databaseShards(database) {
+		if err := sh.DeleteMeasurement(m.Name, seriesKeys); err != nil {
+			errs = append(errs, NewShardError(sh.id, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	// Remove measurement from index.
+	db.DropMeasurement(m.Name)
+
+	return nil
+}
+
+// DropField removes a field of a measurement from every shard of a database,
+// for example after it was written with the wrong type. Series that have no
+// values left in any shard are dropped from the index, while series with
+// other fields are kept, and the measurement is dropped if no series are
+// left. Shards closed because of EngineOptions.MaxOpenShards are opened
+// first, and nothing is deleted if a shard was closed by CloseShard. Shards
+// are processed one at a time. If a shard fails, the others are still
+// processed and the index is left unchanged.
+func (s *Store) DropField(database, measurement, field string) error {
+	if s.EngineOptions.ReadOnly {
+		return ErrStoreReadOnly
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.closing:
+		return ErrStoreClosed
+	default:
+	}
+
+	db := s.databaseIndexes[database]
+	if db == nil {
+		return influxql.ErrDatabaseNotFound(database)
+	}
+	m := db.Measurement(measurement)
+	if m == nil {
+		return influxql.ErrMeasurementNotFound(measurement)
+	} else if !m.HasField(field) {
+		return ErrFieldNotFound
+	}
+
+	// Every shard must be open before anything is deleted, otherwise the
+	// values of a closed shard would come back once it is reopened.
+	shards := s.databaseShards(database)
+	engines := make([]Engine, len(shards))
+	if s.EngineOptions.MaxOpenShards > 0 {
+		defer s.evictShardsLocked()
+	}
+	for i, sh := range shards {
+		engine, err := s.openShardLocked(sh)
+		if err != nil {
+			return NewShardError(sh.id, err)
+		}
+		engines[i] = engine
+	}
+
+	seriesKeys := m.SeriesKeys()
+	var errs shardErrors
+	for _, sh := range shards {
+		if err := sh.DeleteField(m.Name, field, seriesKeys); err != nil {
+			errs = append(errs, NewShardError(sh.id, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	m.deleteFieldName(field)
+
+	// Drop the series whose only values were those of the field.
+	var empty []string
+	for _, key := range seriesKeys {
+		var found bool
+		for _, engine := range engines {
+			if _, _, found = engine.SeriesTimeRange(key); found {
+				break
+			}
+		}
+		if !found {
+			empty = append(empty, key)
+		}
+	}
+	db.DropSeries(empty)
+	if m.SeriesN() == 0 {
+		db.DropMeasurement(m.Name)
+	}
+
+	return nil
+}
+
+// ShardIDs returns a slice of all ShardIDs under management.
+func (s *Store) ShardIDs() []uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.shardIDs()
+}
+
+// OpenShardIDs returns the sorted IDs of the shards whose engines are open.
+// Only open shards hold file handles.
+func (s *Store) OpenShardIDs() []uint64 {
+	return s.shardIDsByState(true)
+}
+
+// ClosedShardIDs returns the sorted IDs of the shards that are in the store
+// but closed, for example by CloseShard. Shards that failed to open are not
+// included.
+func (s *Store) ClosedShardIDs() []uint64 {
+	return s.shardIDsByState(false)
+}
+
+// shardIDsByState returns the sorted IDs of the shards that are open, or
+// closed.
+func (s *Store) shardIDsByState(open bool) []uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := []uint64{}
+	for id, sh := range s.shards {
+		if sh.IsOpen() == open {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func (s *Store) shardIDs() []uint64 {
+	a := make([]uint64, 0, len(s.shards))
+	for shardID := range s.shards {
+		a = append(a, shardID)
+	}
+	return a
+}
+
+// shardsSlice returns an ordered list of shards.
+func (s *Store) shardsSlice() []*Shard {
+	a := make([]*Shard, 0, len(s.shards))
+	for _, sh := range s.shards {
+		a = append(a, sh)
+	}
+	sort.Sort(Shards(a))
+	return a
+}
+
+// ShardIDsByDatabase returns the sorted IDs of the shards of a database.
+func (s *Store) ShardIDsByDatabase(database string) []uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return shardIDsOf(s.databaseShards(database))
+}
+
+// ShardIDsByRetentionPolicy returns the sorted IDs of the shards of a
+// retention policy of a database.
+func (s *Store) ShardIDsByRetentionPolicy(database, retentionPolicy string) []uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return shardIDsOf(s.retentionPolicyShards(database, retentionPolicy))
+}
+
+// databaseShards returns the shards of a database ordered by ID. s.mu must
+// be held.
+func (s *Store) databaseShards(database string) []*Shard {
+	var a []*Shard
+	for _, sh := range s.shardsSlice() {
+		if sh.database == database {
+			a = append(a, sh)
+		}
+	}
+	return a
+}
+
+// retentionPolicyShards returns the shards of a retention policy of a
+// database ordered by ID. s.mu must be held.
+func (s *Store) retentionPolicyShards(database, retentionPolicy string) []*Shard {
+	var a []*Shard
+	for _, sh := range s.databaseShards(database) {
+		if sh.retentionPolicy == retentionPolicy {
+			a = append(a, sh)
+		}
+	}
+	return a
+}
+
+// shardIDsOf returns the IDs of shards.
+func shardIDsOf(shards []*Shard) []uint64 {
+	ids := make([]uint64, len(shards))
+	for i, sh := range shards {
+		ids[i] = sh.id
+	}
+	return ids
+}
+
+// DatabaseIndex returns the index for a database by its name.
+func (s *Store) DatabaseIndex(name string) *DatabaseIndex {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.databaseIndexes[name]
+}
+
+// Databases returns all the databases in the indexes
+func (s *Store) Databases() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	databases := make([]string, 0, len(s.databaseIndexes))
+	for db := range s.databaseIndexes {
+		databases = append(databases, db)
+	}
+	return databases
+}
+
+// DatabaseExists returns true if the store has an index for the database.
+func (s *Store) DatabaseExists(name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.databaseIndexes[name]
+	return ok
+}
+
+// RetentionPolicyExists returns true if the store has a shard in the
+// retention policy of the database.
+func (s *Store) RetentionPolicyExists(database, rp string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, sh := range s.shards {
+		if sh.database == database && sh.retentionPolicy == rp {
+			return true
+		}
+	}
+	return false
+}
+
+// RetentionPolicies returns the sorted names of the retention policies that
+// have shards of the database in the store. The list is empty for an unknown
+// database.
+func (s *Store) RetentionPolicies(database string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	select {
+	case <-s.closing:
+		return nil, ErrStoreClosed
+	default:
+	}
+
+	set := make(map[string]struct{})
+	for _, sh := range s.databaseShards(database) {
+		set[sh.retentionPolicy] = struct{}{}
+	}
+	rps := make([]string, 0, len(set))
+	for rp := range set {
+		rps = append(rps, rp)
+	}
+	sort.Strings(rps)
+	return rps, nil
+}
+
+// Measurement returns a measurement by name from the given database.
+func (s *Store) Measurement(database, name string) *Measurement {
+	s.mu.RLock()
+	db := s.databaseIndexes[database]
+	s.mu.RUnlock()
+	if db == nil {
+		return nil
+	}
+	return db.Measurement(name)
+}
+
+// HasMeasurement returns true if the database has a measurement with the
+// given name.
+func (s *Store) HasMeasurement(database, name string) bool {
+	s.mu.RLock()
+	db := s.databaseIndexes[database]
+	s.mu.RUnlock()
+	return db != nil && db.Measurement(name) != nil
+}
+
+// MeasurementsByTagFilter returns the sorted measurements of a database with
+// at least one series having the tag key set to tagValue. The tag index of
+// each measurement is used, so series are not scanned. No measurements are
+// returned if the database doesn't exist.
+func (s *Store) MeasurementsByTagFilter(database, tagKey, tagValue string) (Measurements, error) {
+	s.mu.RLock()
+	db := s.databaseIndexes[database]
+	s.mu.RUnlock()
+	if db == nil {
+		return Measurements{}, nil
+	}
+	return db.MeasurementsByTagValue(tagKey, tagValue), nil
+}
+
+// HasSeries returns true if the database has a series with the given key.
+func (s *Store) HasSeries(database, seriesKey string) bool {
+	s.mu.RLock()
+	db := s.databaseIndexes[database]
+	s.mu.RUnlock()
+	return db != nil && db.Series(seriesKey) != nil
+}
+
+// SeriesCardinality returns the number of series in a database. It is exact;
+// see EstimateSeriesCardinality for a cheaper estimate.
+func (s *Store) SeriesCardinality(database string) (int64, error) {
+	db := s.DatabaseIndex(database)
+	if db == nil {
+		return 0, influxql.ErrDatabaseNotFound(database)
+	}
+	return int64(db.SeriesN()), nil
+}
+
+// EstimateSeriesCardinality returns an estimate of the number of series in a
+// database from a HyperLogLog sketch kept by its index, for cheap polling of
+// large databases. The estimate is usually within a few percent of
+// SeriesCardinality, except that series dropped and created again are not
+// counted.
+func (s *Store) EstimateSeriesCardinality(database string) (int64, error) {
+	db := s.DatabaseIndex(database)
+	if db == nil {
+		return 0, influxql.ErrDatabaseNotFound(database)
+	}
+	return db.SeriesCardinalityEstimate(), nil
+}
+
+// InternStats returns how the tag keys and values of the series of all
+// databases share their strings. It is zero unless EngineOptions.InternTags
+// is set.
+func (s *Store) InternStats() InternStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var stats InternStats
+	for _, db := range s.databaseIndexes {
+		st := db.InternStats()
+		stats.Strings += st.Strings
+		stats.Bytes += st.Bytes
+		stats.Lookups += st.Lookups
+		stats.Hits += st.Hits
+	}
+	return stats
+}
+
+// MeasurementCardinality returns the number of series in a measurement.
+func (s *Store) MeasurementCardinality(database, measurement string) (int64, error) {
+	m, err := s.measurement(database, measurement)
+	if err != nil {
+		return 0, err
+	}
+	return int64(m.SeriesN()), nil
+}
+
+// SeriesIterator returns an iterator over every series of a database, by
+// measurement name and then in the order the series were created. Series
+// are read from the index as the iterator advances instead of being
+// collected up front, so series created during the iteration may or may not
+// be returned, and series dropped before they are reached are not.
+func (s *Store) SeriesIterator(database string) (SeriesIterator, error) {
+	db := s.DatabaseIndex(database)
+	if db == nil {
+		return nil, influxql.ErrDatabaseNotFound(database)
+	}
+	return db.seriesIterator(), nil
+}
+
+// SeriesKeys returns the sorted keys of the series of a measurement.
+func (s *Store) SeriesKeys(database, measurement string) ([]string, error) {
+	m, err := s.measurement(database, measurement)
+	if err != nil {
+		return nil, err
+	}
+	keys := m.SeriesKeys()
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// ForEachSeriesKey calls fn with the key of each series of a measurement, in
+// the order the series were indexed, until fn returns false. The keys are not
+// sorted or copied up front and the index is not locked while fn runs, so
+// series added or dropped during the walk may or may not be visited.
+func (s *Store) ForEachSeriesKey(database, measurement string, fn func(key string) bool) error {
+	m, err := s.measurement(database, measurement)
+	if err != nil {
+		return err
+	}
+
+	m.mu.RLock()
+	ids := make(SeriesIDs, len(m.seriesIDs))
+	copy(ids, m.seriesIDs)
+	m.mu.RUnlock()
+
+	for _, id := range ids {
+		ss := m.SeriesByID(id)
+		if ss == nil {
+			continue
+		}
+		if !fn(ss.Key) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// measurement returns a measurement of a database, or an error if either
+// doesn't exist.
+func (s *Store) measurement(database, name string) (*Measurement, error) {
+	db := s.DatabaseIndex(database)
+	if db == nil {
+		return nil, influxql.ErrDatabaseNotFound(database)
+	}
+	m := db.Measurement(name)
+	if m == nil {
+		return nil, influxql.ErrMeasurementNotFound(name)
+	}
+	return m, nil
+}
+
+// MeasurementNames returns the sorted names of the measurements in a database
+// matching re. All measurement names are returned if re is nil.
+func (s *Store) MeasurementNames(database string, re *regexp.Regexp) ([]string, error) {
+	db := s.DatabaseIndex(database)
+	if db == nil {
+		return nil, nil
+	}
+
+	var measurements Measurements
+	if re != nil {
+		measurements = db.MeasurementsByRegex(re)
+	} else {
+		db.mu.RLock()
+		measurements = db.Measurements()
+		db.mu.RUnlock()
+	}
+
+	names := make([]string, 0, len(measurements))
+	for _, m := range measurements {
+		names = append(names, m.Name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// DiskSize returns the size of all the shard files in bytes.  This size does not include the WAL size.
+// ShardDiskSize and TotalDiskSize should be preferred as they account for the WAL.
+func (s *Store) DiskSize() (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var size int64
+	for _, shard := range s.shardsSlice() {
+		sz, err := shard.DiskSize()
+		if err != nil {
+			return 0, err
+		}
+		size += sz
+	}
+	return size, nil
+}
+
+// DiskSizeByRetentionPolicy returns the size in bytes of the TSM files of a
+// database, keyed by retention policy name.
+func (s *Store) DiskSizeByRetentionPolicy(database string) (map[string]int64, error) {
+	return s.diskSizeByRetentionPolicy(database, false)
+}
+
+// DiskSizeByRetentionPolicyWithWAL returns the size in bytes of the TSM and WAL
+// files of a database, keyed by retention policy name.
+func (s *Store) DiskSizeByRetentionPolicyWithWAL(database string) (map[string]int64, error) {
+	return s.diskSizeByRetentionPolicy(database, true)
+}
+
+func (s *Store) diskSizeByRetentionPolicy(database string, includeWAL bool) (map[string]int64, error) {
+	s.mu.RLock()
+	if s.databaseIndexes[database] == nil {
+		s.mu.RUnlock()
+		return nil, influxql.ErrDatabaseNotFound(database)
+	}
+	shards := s.databaseShards(database)
+	s.mu.RUnlock()
+
+	sizes := make(map[string]int64)
+	for _, sh := range shards {
+		data, wal, err := sh.diskSizes()
+		if err != nil {
+			return nil, err
+		}
+		if includeWAL {
+			data += wal
+		}
+		sizes[sh.retentionPolicy] += data
+	}
+	return sizes, nil
+}
+
+// ShardDiskSize returns the size in bytes of the TSM and WAL files of a shard.
+func (s *Store) ShardDiskSize(id uint64) (tsm int64, wal int64, err error) {
+	sh := s.Shard(id)
+	if sh == nil {
+		return 0, 0, ErrShardNotFound
+	}
+	return sh.diskSizes()
+}
+
+// ShardInfo returns a description of a shard.
+func (s *Store) ShardInfo(id uint64) (*ShardInfo, error) {
+	sh := s.Shard(id)
+	if sh == nil {
+		return nil, ErrShardNotFound
+	}
+
+	info, err := sh.info()
+	if err != nil {
+		return nil, NewShardError(id, err)
+	}
+	return info, nil
+}
+
+// AllShardInfo returns a description of every shard, sorted by ID. Shards
+// that can't be described are logged and left out.
+func (s *Store) AllShardInfo() []*ShardInfo {
+	s.mu.RLock()
+	shards := s.shardsSlice()
+	s.mu.RUnlock()
+
+	a := make([]*ShardInfo, 0, len(shards))
+	for _, sh := range shards {
+		info, err := sh.info()
+		if err != nil {
+			s.Logger.Info("Failed to describe shard", logger.Shard(sh.id), zap.Error(err))
+			continue
+		}
+		a = append(a, info)
+	}
+	return a
+}
+
+// WALSize returns the total size in bytes of the WAL files of every open
+// shard.
+func (s *Store) WALSize() (int64, error) {
+	s.mu.RLock()
+	shards := s.shardsSlice()
+	s.mu.RUnlock()
+
+	var size int64
+	for _, sh := range shards {
+		sz, err := sh.walSize()
+		if err != nil {
+			return 0, NewShardError(sh.id, err)
+		}
+		size += sz
+	}
+	return size, nil
+}
+
+// ShardWALSize returns the size in bytes of the WAL files of a shard.
+func (s *Store) ShardWALSize(id uint64) (int64, error) {
+	sh := s.Shard(id)
+	if sh == nil {
+		return 0, ErrShardNotFound
+	}
+	return sh.walSize()
+}
+
+// TotalDiskSize returns the size in bytes of the TSM and WAL files of all shards.
+// The store is only locked while the shards are collected.
+func (s *Store) TotalDiskSize() (int64, error) {
+	s.mu.RLock()
+	shards := s.shardsSlice()
+	s.mu.RUnlock()
+
+	var size int64
+	for _, sh := range shards {
+		tsm, wal, err := sh.diskSizes()
+		if err != nil {
+			return 0, NewShardError(sh.id, err)
+		}
+		size += tsm + wal
+	}
+	return size, nil
+}
+
+// LockStats returns how the store lock has been used since the store was
+// opened. The stats are only recorded when EngineOptions.RecordLockStats is
+// set; otherwise they are all zero.
+func (s *Store) LockStats() LockStats {
+	return s.mu.stats()
+}
+
+// Statistics returns statistics for the store: one "database" statistic per
+// database with its series and measurement counts, one "shard" statistic per
+// open shard with its disk sizes, and a "store" statistic with the number of
+// shards and total disk sizes. The given tags are added to every statistic.
+//
+// The store lock is only held while the shards and indexes are collected;
+// disk sizes are computed afterwards so writes are not blocked by file
+// system access.
+func (s *Store) Statistics(tags map[string]string) []models.Statistic {
+	s.mu.RLock()
+	shards := s.shardsSlice()
+	failed := len(s.failedShards)
+	var evictions int64
+	if s.lru != nil {
+		evictions = s.lru.evictionN()
+	}
+	dbs := make(map[string]*DatabaseIndex, len(s.databaseIndexes))
+	for name, db := range s.databaseIndexes {
+		dbs[name] = db
+	}
+	s.mu.RUnlock()
+
+	var stats []models.Statistic
+
+	names := make([]string, 0, len(dbs))
+	for name := range dbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		nMeasurements, nSeries := dbs[name].MeasurementSeriesCounts()
+
+		stat := models.NewStatistic("database")
+		stat.Tags["database"] = name
+		stat.AddTags(tags)
+		stat.Values[statDatabaseSeries] = int64(nSeries)
+		stat.Values[statDatabaseMeasurements] = int64(nMeasurements)
+		stats = append(stats, stat)
+	}
+
+	var totalData, totalWAL, openEngines int64
+	for _, sh := range shards {
+		if sh.IsOpen() {
+			openEngines++
+		}
+
+		data, wal, err := sh.diskSizes()
+		if err != nil {
+			s.Logger.Info("Failed to read shard disk size", logger.Shard(sh.id), zap.Error(err))
+			continue
+		}
+		totalData += data
+		totalWAL += wal
+
+		stat := models.NewStatistic("shard")
+		stat.Tags["id"] = strconv.FormatUint(sh.id, 10)
+		stat.Tags["database"] = sh.database
+		stat.Tags["retentionPolicy"] = sh.retentionPolicy
+		stat.AddTags(tags)
+		stat.Values[statDiskBytes] = data
+		stat.Values[statWALDiskBytes] = wal
+		points, bytes := sh.WriteStats()
+		stat.Values[statPointsWrite] = int64(points)
+		stat.Values[statBytesWrite] = int64(bytes)
+		stats = append(stats, stat)
+	}
+
+	stat := models.NewStatistic("store")
+	stat.AddTags(tags)
+	stat.Values[statOpenShards] = int64(len(shards))
+	stat.Values[statFailedShards] = int64(failed)
+	stat.Values[statOpenEngines] = openEngines
+	stat.Values[statEvictions] = evictions
+	stat.Values[statDiskBytes] = totalData
+	stat.Values[statWALDiskBytes] = totalWAL
+	stats = append(stats, stat)
+
+	return stats
+}
+
+// Diagnostics returns a summary of the store for attaching to bug reports:
+// its path, the number of databases, shards and open shards, the disk and
+// WAL sizes of the shards, the series cardinality of each database, the
+// number of data directory entries skipped at open and the error of each
+// shard that failed to open. It can be displayed with
+// monitor.DiagnosticsFromMap. Shards whose size can't be read are left out
+// of the sizes.
+func (s *Store) Diagnostics() map[string]interface{} {
+	s.mu.RLock()
+	shards := s.shardsSlice()
+	skipped := s.skippedShards
+	failedIDs := make([]uint64, 0, len(s.failedShards))
+	for id := range s.failedShards {
+		failedIDs = append(failedIDs, id)
+	}
+	sort.Slice(failedIDs, func(i, j int) bool { return failedIDs[i] < failedIDs[j] })
+	failed := make([]string, len(failedIDs))
+	for i, id := range failedIDs {
+		failed[i] = fmt.Sprintf("%d: %v", id, s.failedShards[id].err)
+	}
+	cardinality := make(map[string]int64, len(s.databaseIndexes))
+	for name, db := range s.databaseIndexes {
+		cardinality[name] = int64(db.SeriesN())
+	}
+	s.mu.RUnlock()
+
+	var open int64
+	var totalData, totalWAL int64
+	for _, sh := range shards {
+		if sh.IsOpen() {
+			open++
+		}
+		data, wal, err := sh.diskSizes()
+		if err != nil {
+			s.Logger.Info("Failed to read shard disk size", logger.Shard(sh.id), zap.Error(err))
+			continue
+		}
+		totalData += data
+		totalWAL += wal
+	}
+
+	return map[string]interface{}{
+		"path":              s.path,
+		"databases":         int64(len(cardinality)),
+		"shards":            int64(len(shards)),
+		"openShards":        open,
+		statDiskBytes:       totalData,
+		statWALDiskBytes:    totalWAL,
+		"seriesCardinality": cardinality,
+		"skippedPaths":      int64(skipped),
+		"failedShards":      failed,
+	}
+}
+
+// BackupShard will get the shard and have the engine backup since the passed in time to the writer
+func (s *Store) BackupShard(id uint64, since time.Time, w io.Writer) error {
+	shard := s.Shard(id)
+	if shard == nil {
+		return fmt.Errorf("shard %d doesn't exist on this server", id)
+	}
+
+	path, err := relativePath(shardRoot(shard.path), shard.path)
+	if err != nil {
+		return err
+	}
+
+	engine, err := shard.openEngine()
+	if err != nil {
+		return err
+	}
+	return engine.Backup(w, path, since)
+}
+
+// ShardTombstones returns the deletions recorded in a shard's files that a
+// compaction has not purged yet. Each one still has to be applied when the
+// shard's data is read.
+func (s *Store) ShardTombstones(id uint64) ([]Tombstone, error) {
+	sh := s.Shard(id)
+	if sh == nil {
+		return nil, ErrShardNotFound
+	}
+	return sh.Tombstones()
+}
+
+// ShardCompactionStatus returns the compactions of a shard's files that are in
+// progress.
+func (s *Store) ShardCompactionStatus(id uint64) (CompactionStatus, error) {
+	sh := s.Shard(id)
+	if sh == nil {
+		return CompactionStatus{}, ErrShardNotFound
+	}
+	return sh.CompactionStatus()
+}
+
+// CompactingShardIDs returns the sorted IDs of the open shards that are
+// compacting their files, for example to wait for the store to settle before
+// taking a snapshot.
+func (s *Store) CompactingShardIDs() []uint64 {
+	s.mu.RLock()
+	shards := s.shardsSlice()
+	s.mu.RUnlock()
+
+	var ids []uint64
+	for _, sh := range shards {
+		if status, err := sh.CompactionStatus(); err == nil && status.Active {
+			ids = append(ids, sh.id)
+		}
+	}
+	return ids
+}
+
+// TombstoneCount returns the number of tombstones in a shard's files.
+func (s *Store) TombstoneCount(id uint64) (int, error) {
+	a, err := s.ShardTombstones(id)
+	if err != nil {
+		return 0, err
+	}
+	return len(a), nil
+}
+
+// Vacuum rewrites the files of shards with at least
+// EngineOptions.VacuumMinTombstones tombstones, purging the data that was
+// deleted from them, for example after dropping many series. Shards with
+// fewer tombstones are skipped. Files are read no faster than
+// EngineOptions.VacuumBytesPerSecond. The bytes reclaimed from each shard are
+// logged and added to its vacuumBytes statistic. Vacuum stops at the next
+// file when ctx is done.
+func (s *Store) Vacuum(ctx context.Context) error {
+	if s.EngineOptions.ReadOnly {
+		return ErrStoreReadOnly
+	}
+
+	s.mu.RLock()
+	select {
+	case <-s.closing:
+		s.mu.RUnlock()
+		return ErrStoreClosed
+	default:
+	}
+	shards := s.shardsSlice()
+	s.mu.RUnlock()
+
+	// Pace the rewrites so that each file is started no sooner than the
+	// previous one could have been read at the limit.
+	limit := s.Options().VacuumBytesPerSecond
+	var next time.Time
+	wait := func(size int64) error {
+		if d := time.Until(next); d > 0 {
+			t := time.NewTimer(d)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return ctx.Err()
+			case <-t.C:
+			}
+		} else if err := ctx.Err(); err != nil {
+			return err
+		}
+		if limit > 0 {
+			next = time.Now().Add(time.Duration(float64(size) / float64(limit) * float64(time.Second)))
+		}
+		return nil
+	}
+
+	min := s.Options().vacuumMinTombstones()
+	for _, sh := range shards {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		engine, err := sh.openEngine()
+		if err == ErrEngineClosed {
+			continue
+		} else if err != nil {
+			return NewShardError(sh.id, err)
+		}
+		tombstones, err := engine.Tombstones()
+		if err != nil {
+			return NewShardError(sh.id, err)
+		} else if len(tombstones) < min {
+			continue
+		}
+
+		reclaimed, err := engine.PurgeTombstones(wait)
+		if reclaimed != 0 {
+			sh.statMap.Add(statVacuumBytes, reclaimed)
+		}
+		if err != nil {
+			if err == ctx.Err() {
+				return err
+			}
+			return NewShardError(sh.id, err)
+		}
+		s.Logger.Info("Vacuumed shard",
+			logger.Shard(sh.id),
+			zap.Int("tombstones", len(tombstones)),
+			zap.Int64("reclaimed_bytes", reclaimed))
+	}
+	return nil
+}
+
+// ShardVerifyResult holds the result of verifying the files of a shard.
+type ShardVerifyResult struct {
+	TSMFiles    int // number of TSM files verified
+	WALSegments int // number of closed WAL segments verified
+
+	// GoodBlocks and BadBlocks count the TSM blocks and WAL entries that
+	// passed and failed verification.
+	GoodBlocks int
+	BadBlocks  int
+
+	// FirstBadFile is the path of the first file that failed verification and
+	// FirstError describes the failure. They are empty if no file failed.
+	FirstBadFile string
+	FirstError   error
+}
+
+// OK returns true if no file failed verification.
+func (r *ShardVerifyResult) OK() bool {
+	return r.FirstBadFile == ""
+}
+
+// VerifyShard checks the data files and closed WAL segments of a shard for
+// corruption. The shard can be written to while it is verified.
+func (s *Store) VerifyShard(id uint64) (*ShardVerifyResult, error) {
+	sh := s.Shard(id)
+	if sh == nil {
+		return nil, ErrShardNotFound
+	}
+	return sh.Verify()
+}
+
+// VerifyAll verifies every shard in the store, keyed by shard ID. A shard that
+// could not be verified has a result with FirstError set to the reason.
+func (s *Store) VerifyAll() map[uint64]*ShardVerifyResult {
+	results := make(map[uint64]*ShardVerifyResult)
+	s.ForEachShard(func(sh *Shard) error {
+		res, err := sh.Verify()
+		if err != nil {
+			res = &ShardVerifyResult{FirstBadFile: sh.path, FirstError: err}
+		}
+		results[sh.id] = res
+		return nil
+	})
+	return results
+}
+
+// ShardBackupManifest lists the files of a shard written by previous runs of
+// BackupShardIncremental.
+type ShardBackupManifest struct {
+	Files []ShardBackupFile `json:"files"`
+}
+
+// ShardBackupFile describes a file in a ShardBackupManifest.
+type ShardBackupFile struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Checksum uint32 `json:"checksum"`
+}
+
+// BackupShardIncremental writes a tar archive of the shard's files that are
+// not listed in manifest, or whose size or checksum changed, to w. The archive
+// is restored with RestoreShardIncremental, or with RestoreShard if it holds
+// every file. A nil or empty manifest backs up every file. The returned manifest lists all of the shard's current files and should
+// be passed to the next incremental backup; files removed by compactions since
+// the previous backup are no longer listed.
+func (s *Store) BackupShardIncremental(id uint64, manifest io.Reader, w io.Writer) ([]byte, error) {
+	shard := s.Shard(id)
+	if shard == nil {
+		return nil, fmt.Errorf("shard %d doesn't exist on this server", id)
+	}
+
+	path, err := relativePath(shardRoot(shard.path), shard.path)
+	if err != nil {
+		return nil, err
+	}
+
+	engine, err := shard.openEngine()
+	if err != nil {
+		return nil, err
+	}
+
+	prev := make(map[string]ShardBackupFile)
+	if manifest != nil {
+		var m ShardBackupManifest
+		if err := json.NewDecoder(manifest).Decode(&m); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("invalid backup manifest: %s", err)
+		}
+		for _, f := range m.Files {
+			prev[f.Name] = f
+		}
+	}
+
+	next := ShardBackupManifest{Files: []ShardBackupFile{}}
+	tw := tar.NewWriter(w)
+	if err := engine.BackupFiles(func(file string) error {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		checksum, err := fileChecksum(file)
+		if err != nil {
+			return err
+		}
+
+		f := ShardBackupFile{Name: filepath.Base(file), Size: fi.Size(), Checksum: checksum}
+		next.Files = append(next.Files, f)
+		if prev[f.Name] == f {
+			return nil
+		}
+		return writeFileToArchive(tw, file, filepath.Join(path, f.Name), fi)
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(next)
+}
+
+// fileChecksum returns the CRC-32 checksum of the file at path.
+func fileChecksum(path string) (uint32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	h := crc32.NewIEEE()
+	if _, err := io.Copy(h, f); err != nil {
+		return 0, err
+	}
+	return h.Sum32(), nil
+}
+
+// writeFileToArchive writes the file at path to tw under name.
+func writeFileToArchive(tw *tar.Writer, path, name string, fi os.FileInfo) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0666,
+		ModTime: fi.ModTime(),
+		Size:    fi.Size(),
+	}); err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, f, fi.Size())
+	return err
+}
+
+// DatabaseManifest lists the shards in an archive written by BackupDatabase.
+type DatabaseManifest struct {
+	Database string                  `json:"database"`
+	Shards   []DatabaseManifestShard `json:"shards"`
+}
+
+// DatabaseManifestShard describes a shard in a DatabaseManifest.
+type DatabaseManifestShard struct {
+	ID              uint64 `json:"id"`
+	RetentionPolicy string `json:"retentionPolicy"`
+}
+
+// BackupDatabase writes a tar archive of every shard of a database to w. Each
+// shard is snapshotted by its engine and its files modified since the passed
+// in time are written under the shard's relative path, as with BackupShard.
+// Shards without such files are skipped. The archive ends with a manifest
+// listing the shards it holds and can be restored with RestoreDatabase.
+func (s *Store) BackupDatabase(database string, since time.Time, w io.Writer) error {
+	s.mu.RLock()
+	if s.databaseIndexes[database] == nil {
+		s.mu.RUnlock()
+		return influxql.ErrDatabaseNotFound(database)
+	}
+	shards := s.databaseShards(database)
+	s.mu.RUnlock()
+
+	tw := tar.NewWriter(w)
+	manifest := DatabaseManifest{Database: database, Shards: []DatabaseManifestShard{}}
+	for _, sh := range shards {
+		path, err := relativePath(shardRoot(sh.path), sh.path)
+		if err != nil {
+			return err
+		}
+
+		n, err := backupShardTo(tw, sh, path, since)
+		if err != nil {
+			return NewShardError(sh.id, err)
+		} else if n == 0 {
+			continue
+		}
+		manifest.Shards = append(manifest.Shards, DatabaseManifestShard{ID: sh.id, RetentionPolicy: sh.retentionPolicy})
+	}
+
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    DatabaseManifestFile,
+		Mode:    0666,
+		ModTime: time.Now(),
+		Size:    int64(len(b)),
+	}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(b); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// backupShardTo copies the entries of the shard's backup archive into tw and
+// returns the number of entries copied.
+func backupShardTo(tw *tar.Writer, sh *Shard, path string, since time.Time) (int, error) {
+	pr, pw := io.Pipe()
+	errC := make(chan error, 1)
+	go func() {
+		engine, err := sh.openEngine()
+		if err == nil {
+			err = engine.Backup(pw, path, since)
+		}
+		pw.CloseWithError(err)
+		errC <- err
+	}()
+
+	var n int
+	tr := tar.NewReader(pr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			pr.CloseWithError(err)
+			<-errC
+			return 0, err
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			pr.CloseWithError(err)
+			<-errC
+			return 0, err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			pr.CloseWithError(err)
+			<-errC
+			return 0, err
+		}
+		n++
+	}
+
+	// Drain the end of the shard's archive so that the backup can finish.
+	if _, err := io.Copy(ioutil.Discard, pr); err != nil {
+		return 0, err
+	}
+	return n, <-errC
+}
+
+// FlushWAL writes the cache and WAL of the given shards to TSM files. All
+// shards are flushed when no IDs are passed. Every requested shard is flushed
+// even if others fail, and the errors of all failed shards are returned.
+func (s *Store) FlushWAL(shardIDs ...uint64) error {
+	if s.EngineOptions.ReadOnly {
+		return ErrStoreReadOnly
+	}
+
+	s.mu.RLock()
+	var errs shardErrors
+	var shards []*Shard
+	if len(shardIDs) == 0 {
+		shards = s.shardsSlice()
+	}
+	for _, id := range shardIDs {
+		sh, ok := s.shards[id]
+		if !ok {
+			errs = append(errs, NewShardError(id, ErrShardNotFound))
+			continue
+		}
+		shards = append(shards, sh)
+	}
+	s.mu.RUnlock()
+
+	// Flush without holding the store lock so shards can be created while
+	// large caches are written out.
+	for _, sh := range shards {
+		if err := sh.WriteSnapshot(); err != nil {
+			errs = append(errs, NewShardError(sh.id, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// MergeShards merges the data of the source shards into the destination shard
+// and deletes the sources. The shards must belong to the same database and
+// retention policy, and each field must have the same type in all of them.
+// Values of a series at the same time are deduplicated, with the last source
+// listed taking precedence over earlier ones and the destination. The data
+// is streamed into a new copy of the destination, which only replaces it once
+// every shard has been merged, so a failed merge leaves all of the shards as
+// they were. The shards refuse writes with ErrShardReadOnly during the merge.
+func (s *Store) MergeShards(destID uint64, srcIDs []uint64) error {
+	if s.EngineOptions.ReadOnly {
+		return ErrStoreReadOnly
+	}
+
+	dest := s.Shard(destID)
+	if dest == nil {
+		return ErrShardNotFound
+	}
+
+	shards := []*Shard{dest}
+	seen := map[uint64]struct{}{destID: {}}
+	for _, id := range srcIDs {
+		if id == destID {
+			return fmt.Errorf("shard %d is the destination of the merge", id)
+		} else if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+
+		sh := s.Shard(id)
+		if sh == nil {
+			return NewShardError(id, ErrShardNotFound)
+		} else if sh.database != dest.database || sh.retentionPolicy != dest.retentionPolicy {
+			return fmt.Errorf("shard %d belongs to %s.%s, not %s.%s", id, sh.database, sh.retentionPolicy, dest.database, dest.retentionPolicy)
+		}
+		shards = append(shards, sh)
+	}
+	if len(shards) == 1 {
+		return nil
+	} else if err := checkMergeFieldTypes(shards); err != nil {
+		return err
+	}
+
+	// Refuse writes while the shards are merged, cancel the queued async
+	// writes and wait for the writes already running, including async ones,
+	// which don't hold the store lock.
+	readOnly := make([]bool, len(shards))
+	for i, sh := range shards {
+		readOnly[i] = sh.ReadOnly()
+		sh.SetReadOnly(true)
+	}
+	defer func() {
+		for i, sh := range shards {
+			sh.SetReadOnly(readOnly[i])
+		}
+	}()
+	s.mu.Lock()
+	for _, sh := range shards {
+		s.cancelAsyncWrites(sh, ErrShardReadOnly)
+	}
+	s.mu.Unlock()
+	for _, sh := range shards {
+		sh.waitForWrites()
+	}
+
+	path, walPath := dest.path+".merge", dest.walPath+".merge"
+	if dest.walInline() {
+		walPath = filepath.Join(path, inlineWALDir)
+	}
+	if err := s.writeMergedShard(path, walPath, shards); err != nil {
+		os.RemoveAll(path)
+		os.RemoveAll(walPath)
+		return err
+	}
+
+	if err := s.replaceMergedShard(dest, path, walPath, readOnly[0]); err != nil {
+		os.RemoveAll(path)
+		os.RemoveAll(walPath)
+		return err
+	}
+	s.Logger.Info("Merged shards", logger.Shard(destID), zap.Int("sources", len(shards)-1))
+
+	// The data is in the destination now, so the sources can be deleted.
+	var errs shardErrors
+	var deleted []uint64
+	s.mu.Lock()
+	for _, sh := range shards[1:] {
+		if err := s.deleteShard(sh.id); err != nil {
+			errs = append(errs, NewShardError(sh.id, err))
+			continue
+		}
+		deleted = append(deleted, sh.id)
+	}
+	s.mu.Unlock()
+
+	s.notifyShardsDeleted(deleted)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// checkMergeFieldTypes returns an error if a field has different types in
+// the shards.
+func checkMergeFieldTypes(shards []*Shard) error {
+	type fieldType struct {
+		shardID uint64
+		typ     influxql.DataType
+	}
+	types := make(map[[2]string]fieldType)
+	for _, sh := range shards {
+		for _, name := range sh.measurementNames() {
+			for field, typ := range sh.fieldTypes(name) {
+				key := [2]string{name, field}
+				if prev, ok := types[key]; !ok {
+					types[key] = fieldType{shardID: sh.id, typ: typ}
+				} else if prev.typ != typ {
+					return fmt.Errorf("%w: %s.%s is %s in shard %d and %s in shard %d", ErrFieldTypeConflict, name, field, prev.typ, prev.shardID, typ, sh.id)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// writeMergedShard writes the data of the shards, in order, to a new shard
+// at path with the ID and engine of the first one. The points are read and
+// written in batches so that memory use does not grow with the shards.
+func (s *Store) writeMergedShard(path, walPath string, shards []*Shard) error {
+	dest := shards[0]
+
+	// Start from empty directories, in case an earlier merge was interrupted.
+	for _, dir := range []string{path, walPath} {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		} else if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dest.path, EngineFormatFile)); err == nil {
+		if err := linkOrCopyFile(filepath.Join(dest.path, EngineFormatFile), filepath.Join(path, EngineFormatFile)); err != nil {
+			return err
+		}
+	}
+
+	merged := NewShard(dest.id, dest.index, path, walPath, dest.options)
+	merged.WithLogger(s.baseLogger)
+	if err := merged.Open(); err != nil {
+		return err
+	}
+
+	err := func() error {
+		batch := make([]models.Point, 0, mergeBatchSize)
+		flush := func() error {
+			if len(batch) == 0 {
+				return nil
+			}
+			err := merged.WritePoints(batch)
+			batch = batch[:0]
+			return err
+		}
+
+		for _, sh := range shards {
+			for _, name := range sh.measurementNames() {
+				if err := sh.readPoints(name, math.MinInt64, math.MaxInt64, func(pt models.Point) error {
+					batch = append(batch, pt)
+					if len(batch) < mergeBatchSize {
+						return nil
+					}
+					return flush()
+				}); err != nil {
+					return NewShardError(sh.id, err)
+				}
+			}
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+
+		engine, err := merged.openEngine()
+		if err != nil {
+			return err
+		}
+		return engine.WriteSnapshot()
+	}()
+
+	if cerr := merged.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// replaceMergedShard swaps the files of dest for the merged shard at path and
+// reopens it. If the merged shard can't be opened, dest is restored.
+func (s *Store) replaceMergedShard(dest *Shard, path, walPath string, readOnly bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.closing:
+		return ErrStoreClosed
+	default:
+	}
+	if s.shards[dest.id] != dest {
+		return fmt.Errorf("shard %d was replaced during the merge", dest.id)
+	}
+
+	if err := dest.Close(); err != nil {
+		return NewShardError(dest.id, err)
+	}
+
+	// Move the directories of the old shard aside and put the merged ones in
+	// their place.
+	oldPath, oldWALPath := dest.path+".old", dest.walPath+".old"
+	moves := [][2]string{{dest.path, oldPath}, {path, dest.path}, {dest.walPath, oldWALPath}, {walPath, dest.walPath}}
+	if dest.walInline() {
+		// The WAL moves with the data directory.
+		oldWALPath = filepath.Join(oldPath, inlineWALDir)
+		moves = moves[:2]
+	}
+	var err error
+	var done int
+	for ; done < len(moves); done++ {
+		if err = os.Rename(moves[done][0], moves[done][1]); err != nil {
+			break
+		}
+	}
+
+	var sh *Shard
+	if err == nil {
+		sh = NewShard(dest.id, dest.index, dest.path, dest.walPath, dest.options)
+		sh.WithLogger(s.baseLogger)
+		if err = sh.Open(); err != nil {
+			sh.Close()
+		}
+	}
+	if err != nil {
+		// Undo the moves that were made, most recent first.
+		for i := done - 1; i >= 0; i-- {
+			if rerr := os.Rename(moves[i][1], moves[i][0]); rerr != nil {
+				s.Logger.Info("Failed to restore shard after merge", logger.Shard(dest.id), zap.Error(rerr))
+			}
+		}
+		if oerr := dest.Open(); oerr != nil {
+			s.Logger.Info("Failed to reopen shard after merge", logger.Shard(dest.id), zap.Error(oerr))
+		}
+		return NewShardError(dest.id, err)
+	}
+
+	sh.SetReadOnly(readOnly)
+	s.shards[dest.id] = sh
+	os.RemoveAll(oldPath)
+	os.RemoveAll(oldWALPath)
+	return nil
+}
+
+// ImportShard copies prebuilt TSM files into a shard, creating the shard if it
+// does not exist. Each file's header and index are validated and any file with
+// series data overlapping the data already in the shard is rejected. If the
+// shard was created for the import, it is deleted again when the import fails.
+// The shard is created as by CreateShard and the files are imported without
+// the store locked, so other shards can be used meanwhile.
+func (s *Store) ImportShard(database, retentionPolicy string, shardID uint64, tsmFiles []string) error {
+	if s.EngineOptions.ReadOnly {
+		return ErrStoreReadOnly
+	}
+	if err := validateDatabaseAndRetentionPolicy(database, retentionPolicy); err != nil {
+		return err
+	}
+	if err := s.checkDatabaseFilter(database); err != nil {
+		return err
+	}
+
+	opts := s.engineOptions(database)
+	sh, created, err := s.createShardOnce(database, retentionPolicy, shardID, opts, opts.EngineVersion != s.EngineOptions.EngineVersion)
+	if err != nil {
+		return err
+	} else if sh.database != database || sh.retentionPolicy != retentionPolicy {
+		return fmt.Errorf("shard %d already exists in %s.%s", shardID, sh.database, sh.retentionPolicy)
+	}
+
+	if !created {
+		if err := s.useShard(sh); err != nil {
+			return err
+		}
+		return sh.ImportFiles(tsmFiles)
+	}
+
+	if err := sh.ImportFiles(tsmFiles); err != nil {
+		s.mu.Lock()
+		if s.shards[shardID] == sh {
+			if err := s.deleteShard(shardID); err != nil {
+				s.Logger.Info("Failed to remove shard after import error", logger.Shard(shardID), zap.Error(err))
+			}
+		}
+		s.mu.Unlock()
+		return err
+	}
+
+	// Handlers are called once the import succeeded.
+	s.notifyShardCreated(shardID, database, retentionPolicy)
+	return nil
+}
+
+// RestoreShard reads a tar archive created by BackupShard and writes its files
+// into the shard's directory, creating the database, retention policy and
+// shard directories if needed. The shard is opened once the archive has been
+// written so it is immediately queryable. Restoring over an existing shard
+// returns an error unless force is set, in which case the shard is closed,
+// its data files and WAL are replaced by those of the archive and the shard
+// is reopened. OnShardCreated handlers are called if the shard is new.
+func (s *Store) RestoreShard(id uint64, r io.Reader, force bool) error {
+	return s.restoreShardArchive(id, r, force, true)
+}
+
+// RestoreShardIncremental restores an archive written by
+// BackupShardIncremental on top of the shard restored from the previous
+// backups. The archived files are written over those of the shard, and its
+// other files and WAL are kept. A shard that doesn't exist is created as by
+// RestoreShard.
+func (s *Store) RestoreShardIncremental(id uint64, r io.Reader) error {
+	return s.restoreShardArchive(id, r, true, false)
+}
+
+// restoreShardArchive restores a shard for RestoreShard and
+// RestoreShardIncremental. If clear is set, the files of an existing shard
+// are removed before the archived ones are moved into place.
+func (s *Store) restoreShardArchive(id uint64, r io.Reader, force, clear bool) error {
+	if s.EngineOptions.ReadOnly {
+		return ErrStoreReadOnly
+	}
+
+	sh, err := s.restoreShard(id, r, force, clear)
+	if err != nil {
+		return err
+	} else if sh != nil {
+		s.notifyShardCreated(sh.id, sh.database, sh.retentionPolicy)
+	}
+	return nil
+}
+
+// restoreShard restores a shard for restoreShardArchive and returns it if it
+// was created. The archive is read into temporary files without the store
+// locked, so that a slow reader doesn't block it; the store is locked to move
+// the files into place once the shard has been checked again.
+func (s *Store) restoreShard(id uint64, r io.Reader, force, clear bool) (*Shard, error) {
+	s.mu.Lock()
+	select {
+	case <-s.closing:
+		s.mu.Unlock()
+		return nil, ErrStoreClosed
+	default:
+	}
+
+	sh := s.shards[id]
+	if _, ok := s.creatingShards[id]; ok || (sh != nil && !force) {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("shard %d already exists on this server", id)
+	} else if _, ok := s.restoringShards[id]; ok {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("shard %d is already being restored", id)
+	}
+	s.restoringShards[id] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.restoringShards, id)
+		s.mu.Unlock()
+	}()
+
+	// Archive entries are named <database>/<retention>/<id>/<file>. An existing
+	// shard must match its current relative path, otherwise the path of the first
+	// entry decides where the shard is created.
+	var shardPath, dataPath string
+	if sh != nil {
+		path, err := relativePath(shardRoot(sh.path), sh.path)
+		if err != nil {
+			return nil, err
+		}
+		shardPath, dataPath = path, sh.path
+	}
+
+	// Remove any restored files that were not moved into place.
+	var files []string
+	defer func() {
+		for _, path := range files {
+			os.Remove(path + "." + restoreTempExtension)
+		}
+	}()
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		dir, name := filepath.Split(filepath.Clean(hdr.Name))
+		dir = filepath.Clean(dir)
+		if shardPath == "" {
+			parts := strings.Split(filepath.ToSlash(dir), "/")
+			if len(parts) != 3 || parts[0] == ".." || parts[1] == ".." || parts[2] != strconv.FormatUint(id, 10) {
+				return nil, fmt.Errorf("restore shard %d: unexpected archive entry: %s", id, hdr.Name)
+			} else if err := validateDatabaseAndRetentionPolicy(parts[0], parts[1]); err != nil {
+				return nil, fmt.Errorf("restore shard %d: %s", id, err)
+			} else if err := s.checkDatabaseFilter(parts[0]); err != nil {
+				return nil, err
+			}
+			shardPath = dir
+			dataPath, _ = s.shardPaths(parts[0], parts[1], id)
+		}
+		if dir != shardPath {
+			return nil, fmt.Errorf("restore shard %d: unexpected archive entry: %s", id, hdr.Name)
+		}
+
+		if err := os.MkdirAll(dataPath, 0700); err != nil {
+			return nil, err
+		}
+		path := filepath.Join(dataPath, name)
+		files = append(files, path)
+		if err := restoreShardFile(tr, path); err != nil {
+			return nil, err
+		}
+	}
+
+	if shardPath == "" {
+		return nil, fmt.Errorf("restore shard %d: backup archive is empty", id)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.closing:
+		return nil, ErrStoreClosed
+	default:
+	}
+
+	if cur := s.shards[id]; cur != sh {
+		if sh == nil {
+			return nil, fmt.Errorf("shard %d already exists on this server", id)
+		}
+		return nil, fmt.Errorf("restore shard %d: shard was replaced during the restore", id)
+	} else if _, ok := s.creatingShards[id]; ok {
+		return nil, fmt.Errorf("shard %d already exists on this server", id)
+	}
+
+	// Close the existing shard before any of its files are replaced. Its
+	// other files are removed when clearing, so that its WAL and files newer
+	// than the backup are not kept on top of the restored data.
+	if sh != nil {
+		if err := sh.Close(); err != nil {
+			return nil, err
+		}
+		s.lru.remove(sh)
+		if clear {
+			if err := clearRestoredShard(sh, files); err != nil {
+				return nil, NewShardError(id, err)
+			}
+		}
+	}
+
+	// Move the restored files into place now that the whole archive was read.
+	for len(files) > 0 {
+		if err := os.Rename(files[0]+"."+restoreTempExtension, files[0]); err != nil {
+			return nil, err
+		}
+		files = files[1:]
+	}
+
+	// Reopen a shard that was restored in place.
+	if sh != nil {
+		if err := sh.Open(); err != nil {
+			return nil, err
+		}
+		if s.EngineOptions.MaxOpenShards > 0 {
+			s.lru.reopened(sh)
+			s.evictShardsLocked()
+		}
+		return nil, nil
+	}
+	if err := s.openRestoredShard(id, dataPath); err != nil {
+		return nil, err
+	}
+	return s.shards[id], nil
+}
+
+// clearRestoredShard removes the files and WAL of a closed shard that is
+// being restored over, except its engine format file and the restored files,
+// which are staged under the paths of files with restoreTempExtension added.
+func clearRestoredShard(sh *Shard, files []string) error {
+	staged := make(map[string]struct{}, len(files))
+	for _, path := range files {
+		staged[path+"."+restoreTempExtension] = struct{}{}
+	}
+
+	fis, err := ioutil.ReadDir(sh.path)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		path := filepath.Join(sh.path, fi.Name())
+		if _, ok := staged[path]; ok || fi.Name() == EngineFormatFile {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+
+	if err := os.RemoveAll(sh.walPath); err != nil {
+		return err
+	}
+	return os.MkdirAll(sh.walPath, 0700)
+}
+
+// CopyShardTo copies a shard into dst, which must be another open store, and
+// opens it there. The shard's backup archive is streamed straight into dst's
+// RestoreShard, so nothing is written to disk besides the copy itself, and dst
+// is only locked once the whole archive has been read. The shard keeps its
+// ID, database and retention policy and is left in s.
+func (s *Store) CopyShardTo(id uint64, dst *Store) error {
+	if dst == s {
+		return fmt.Errorf("copy shard %d: destination is the source store", id)
+	} else if dst.EngineOptions.ReadOnly {
+		return ErrStoreReadOnly
+	} else if s.Shard(id) == nil {
+		return ErrShardNotFound
+	} else if dst.Shard(id) != nil {
+		// RestoreShard checks again once dst is locked.
+		return fmt.Errorf("shard %d already exists on the destination", id)
+	}
+
+	pr, pw := io.Pipe()
+	errC := make(chan error, 1)
+	go func() {
+		err := s.BackupShard(id, time.Time{}, pw)
+		pw.CloseWithError(err)
+		errC <- err
+	}()
+
+	err := dst.RestoreShard(id, pr, false)
+
+	// Unblock the backup if the restore stopped reading early.
+	pr.CloseWithError(err)
+	if berr := <-errC; berr != nil && err == nil {
+		return berr
+	}
+	return err
+}
+
+// ExportShard writes the values of a shard with timestamps between min and
+// max, inclusive, to w as line protocol, one measurement at a time. Pass
+// math.MinInt64 and math.MaxInt64 to export every value. Points are streamed
+// from the shard's engine, so memory use does not grow with the shard size.
+func (s *Store) ExportShard(id uint64, w io.Writer, min, max int64) error {
+	sh := s.Shard(id)
+	if sh == nil {
+		return ErrShardNotFound
+	}
+
+	bw := bufio.NewWriter(w)
+	if err := sh.exportLineProtocol(bw, sh.measurementNames(), min, max); err != nil {
+		return NewShardError(id, err)
+	}
+	return bw.Flush()
+}
+
+// ChecksumShard returns a checksum of the series and values of a shard, for
+// comparing replicas. Shards holding the same values have the same checksum
+// however their values are split across the cache and TSM files, and values
+// that were deleted are left out. The whole shard is read, so the cost grows
+// with its size.
+func (s *Store) ChecksumShard(id uint64) (uint64, error) {
+	sh := s.Shard(id)
+	if sh == nil {
+		return 0, ErrShardNotFound
+	}
+
+	sum, err := sh.checksum()
+	if err != nil {
+		return 0, NewShardError(id, err)
+	}
+	return sum, nil
+}
+
+// ExportMeasurement writes every value of a measurement to w as line
+// protocol. The database's shards are exported in ID order.
+func (s *Store) ExportMeasurement(database, measurement string, w io.Writer) error {
+	s.mu.RLock()
+	db := s.databaseIndexes[database]
+	shards := s.databaseShards(database)
+	s.mu.RUnlock()
+
+	if db == nil {
+		return influxql.ErrDatabaseNotFound(database)
+	} else if db.Measurement(measurement) == nil {
+		return influxql.ErrMeasurementNotFound(measurement)
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, sh := range shards {
+		if err := sh.exportLineProtocol(bw, []string{measurement}, math.MinInt64, math.MaxInt64); err != nil {
+			return NewShardError(sh.id, err)
+		}
+	}
+	return bw.Flush()
+}
+
+// openRestoredShard opens a new shard from the restored files at path and
+// adds it to the store. s.mu must be held.
+func (s *Store) openRestoredShard(id uint64, path string) error {
+	database, retentionPolicy := DecodeStorePath(path)
+
+	walPath := s.existingWALPath(path, database, retentionPolicy, id)
+	if err := os.MkdirAll(walPath, 0700); err != nil {
+		return err
+	}
+
+	// create the database index if it does not exist
+	db, ok := s.databaseIndexes[database]
+	if !ok {
+		db = s.newDatabaseIndex(database)
+		s.databaseIndexes[database] = db
+	}
+
+	shard := NewShard(id, db, path, walPath, s.engineOptions(database))
+	shard.WithLogger(s.baseLogger)
+
+	if err := shard.Open(); err != nil {
+		return err
+	}
+
+	s.addShard(shard)
+
+	return nil
+}
+
+// RestoreDatabase reads a tar archive created by BackupDatabase and restores
+// each shard listed in its manifest, as RestoreShard does for a single shard.
+// Shards that already exist on this server are skipped unless force is set,
+// in which case they are closed, their data files and WAL are replaced by
+// those of the archive and they are reopened. It returns an error without
+// restoring anything if the archive is for another database or if one of its
+// shard IDs is used by a shard of another retention policy or database. The
+// archive is read into temporary files without the store locked, and the
+// store is only locked to move them into place and open the shards.
+// OnShardCreated handlers are called for the new shards.
+func (s *Store) RestoreDatabase(database string, r io.Reader, force bool) error {
+	if s.EngineOptions.ReadOnly {
+		return ErrStoreReadOnly
+	}
+	if err := validateName("database", database); err != nil {
+		return err
+	}
+	if err := s.checkDatabaseFilter(database); err != nil {
+		return err
+	}
+
+	// Handlers are called once the store is unlocked.
+	var created []*Shard
+	defer func() {
+		for _, sh := range created {
+			s.notifyShardCreated(sh.id, sh.database, sh.retentionPolicy)
+		}
+	}()
+
+	var manifest *DatabaseManifest
+	shardPaths := make(map[uint64]string)
+	existing := make(map[uint64]*Shard)
+	files := make(map[uint64][]string)
+
+	// Remove any restored files that were not moved into place, and let
+	// other restores of the shards run.
+	defer func() {
+		for _, paths := range files {
+			for _, path := range paths {
+				os.Remove(path + "." + restoreTempExtension)
+			}
+		}
+		s.mu.Lock()
+		for id := range shardPaths {
+			delete(s.restoringShards, id)
+		}
+		s.mu.Unlock()
+	}()
+
+	// reserve marks a shard of the archive as being restored and returns the
+	// existing shard with its ID, if any.
+	reserve := func(id uint64, retentionPolicy string) (*Shard, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		select {
+		case <-s.closing:
+			return nil, ErrStoreClosed
+		default:
+		}
+
+		if _, ok := s.creatingShards[id]; ok {
+			return nil, fmt.Errorf("shard %d is being created", id)
+		} else if _, ok := s.restoringShards[id]; ok {
+			return nil, fmt.Errorf("shard %d is already being restored", id)
+		}
+		sh := s.shards[id]
+		if sh != nil && (sh.database != database || sh.retentionPolicy != retentionPolicy) {
+			return nil, fmt.Errorf("shard %d already exists in %s.%s", id, sh.database, sh.retentionPolicy)
+		}
+		s.restoringShards[id] = struct{}{}
+		return sh, nil
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if hdr.Name == DatabaseManifestFile {
+			manifest = &DatabaseManifest{}
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				return fmt.Errorf("restore database %s: invalid manifest: %s", database, err)
+			}
+			continue
+		}
+
+		// Entries are named <database>/<retention>/<id>/<file>.
+		dir, name := filepath.Split(filepath.Clean(hdr.Name))
+		dir = filepath.Clean(dir)
+		parts := strings.Split(filepath.ToSlash(dir), "/")
+		if len(parts) != 3 || parts[0] != database || validateName("retention policy", parts[1]) != nil {
+			return fmt.Errorf("restore database %s: unexpected archive entry: %s", database, hdr.Name)
+		}
+		id, err := strconv.ParseUint(parts[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("restore database %s: unexpected archive entry: %s", database, hdr.Name)
+		}
+		if path, ok := shardPaths[id]; ok && path != dir {
+			return fmt.Errorf("restore database %s: unexpected archive entry: %s", database, hdr.Name)
+		} else if !ok {
+			sh, err := reserve(id, parts[1])
+			if err != nil {
+				return err
+			}
+			shardPaths[id] = dir
+			if sh != nil {
+				existing[id] = sh
+			}
+		}
+
+		dataPath, _ := s.shardPaths(database, parts[1], id)
+		if sh := existing[id]; sh != nil {
+			if !force {
+				continue
+			}
+			dataPath = sh.path
+		}
+		if err := os.MkdirAll(dataPath, 0700); err != nil {
+			return err
+		}
+		path := filepath.Join(dataPath, name)
+		files[id] = append(files[id], path)
+		if err := restoreShardFile(tr, path); err != nil {
+			return err
+		}
+	}
+
+	if manifest == nil {
+		return fmt.Errorf("restore database %s: backup archive has no manifest", database)
+	} else if manifest.Database != database {
+		return fmt.Errorf("restore database %s: backup archive is for database %s", database, manifest.Database)
+	} else if len(manifest.Shards) != len(shardPaths) {
+		return fmt.Errorf("restore database %s: manifest does not match archive", database)
+	}
+	for _, sh := range manifest.Shards {
+		path, ok := shardPaths[sh.ID]
+		if !ok || path != filepath.Join(database, sh.RetentionPolicy, strconv.FormatUint(sh.ID, 10)) {
+			return fmt.Errorf("restore database %s: manifest does not match archive", database)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.closing:
+		return ErrStoreClosed
+	default:
+	}
+
+	// The shards may have been created, deleted or replaced while the
+	// archive was read.
+	for id := range shardPaths {
+		if _, ok := s.creatingShards[id]; ok || s.shards[id] != existing[id] {
+			return fmt.Errorf("restore database %s: shard %d changed during the restore", database, id)
+		}
+	}
+
+	// Close the existing shards and remove their files and WAL before the
+	// restored files are moved into place.
+	if force {
+		for id, sh := range existing {
+			if err := sh.Close(); err != nil {
+				return NewShardError(id, err)
+			}
+			s.lru.remove(sh)
+			if err := clearRestoredShard(sh, files[id]); err != nil {
+				return NewShardError(id, err)
+			}
+		}
+	}
+
+	// Move the restored files into place now that the whole archive was read.
+	for id, paths := range files {
+		for len(paths) > 0 {
+			if err := os.Rename(paths[0]+"."+restoreTempExtension, paths[0]); err != nil {
+				return err
+			}
+			paths = paths[1:]
+			files[id] = paths
+		}
+	}
+
+	if s.EngineOptions.MaxOpenShards > 0 {
+		defer s.evictShardsLocked()
+	}
+	for _, sh := range manifest.Shards {
+		if existing[sh.ID] != nil {
+			if !force {
+				s.Logger.Info("Skipped restoring existing shard", logger.Shard(sh.ID), logger.Database(database))
+				continue
+			}
+			if err := existing[sh.ID].Open(); err != nil {
+				return NewShardError(sh.ID, err)
+			}
+			if s.EngineOptions.MaxOpenShards > 0 {
+				s.lru.reopened(existing[sh.ID])
+			}
+			continue
+		}
+
+		path, _ := s.shardPaths(database, sh.RetentionPolicy, sh.ID)
+		if err := s.openRestoredShard(sh.ID, path); err != nil {
+			return NewShardError(sh.ID, err)
+		}
+		created = append(created, s.shards[sh.ID])
+	}
+	return nil
+}
+
+// SnapshotManifest lists the shards copied by Snapshot, by database.
+type SnapshotManifest struct {
+	Databases []DatabaseManifest `json:"databases"`
+}
+
+// Snapshot copies every shard of the store into destPath, laid out as
+// <db>/<rp>/<id>, so that the copy can be opened as a store of its own. The
+// cache of each shard is flushed first and the store is read locked
+// throughout, so the copy holds the data written before Snapshot was called.
+// Files are hard linked where possible and copied otherwise. A manifest
+// listing the shards is written last. destPath must not exist or be empty.
+func (s *Store) Snapshot(destPath string) error {
+	if fis, err := ioutil.ReadDir(destPath); err == nil && len(fis) > 0 {
+		return fmt.Errorf("snapshot: %s is not empty", destPath)
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	select {
+	case <-s.closing:
+		return ErrStoreClosed
+	default:
+	}
+
+	var manifest SnapshotManifest
+	dbs := make(map[string]int)
+	for _, sh := range s.shardsSlice() {
+		engine, err := sh.openEngine()
+		if err != nil {
+			return NewShardError(sh.id, err)
+		}
+		path, err := relativePath(shardRoot(sh.path), sh.path)
+		if err != nil {
+			return err
+		}
+		dir := filepath.Join(destPath, path)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+
+		// Keep the engine of shards that were created with a non-default one.
+		if _, err := os.Stat(filepath.Join(sh.path, EngineFormatFile)); err == nil {
+			if err := linkOrCopyFile(filepath.Join(sh.path, EngineFormatFile), filepath.Join(dir, EngineFormatFile)); err != nil {
+				return NewShardError(sh.id, err)
+			}
+		}
+
+		if err := engine.BackupFiles(func(file string) error {
+			return linkOrCopyFile(file, filepath.Join(dir, filepath.Base(file)))
+		}); err != nil {
+			return NewShardError(sh.id, err)
+		}
+
+		i, ok := dbs[sh.database]
+		if !ok {
+			i = len(manifest.Databases)
+			dbs[sh.database] = i
+			manifest.Databases = append(manifest.Databases, DatabaseManifest{Database: sh.database})
+		}
+		manifest.Databases[i].Shards = append(manifest.Databases[i].Shards, DatabaseManifestShard{ID: sh.id, RetentionPolicy: sh.retentionPolicy})
+	}
+
+	if err := os.MkdirAll(destPath, 0700); err != nil {
+		return err
+	}
+	buf, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(destPath, SnapshotManifestFile), buf, 0600)
+}
+
+// linkOrCopyFile hard links src to dst, or copies it if it can't be linked,
+// such as when dst is on another filesystem.
+func linkOrCopyFile(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+// restoreShardFile copies the current archive entry into a temporary file
+// next to path.
+func restoreShardFile(r io.Reader, path string) error {
+	f, err := os.OpenFile(path+"."+restoreTempExtension, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// ShardRelativePath will return the relative path to the shard. i.e. <database>/<retention>/<id>
+func (s *Store) ShardRelativePath(id uint64) (string, error) {
+	shard := s.Shard(id)
+	if shard == nil {
+		return "", fmt.Errorf("shard %d doesn't exist on this server", id)
+	}
+	return relativePath(shardRoot(shard.path), shard.path)
+}
+
+// ShardLastWrite returns the time of the last write to a shard. The boolean is
+// false if the shard doesn't exist on this server.
+func (s *Store) ShardLastWrite(id uint64) (time.Time, bool) {
+	sh := s.Shard(id)
+	if sh == nil {
+		return time.Time{}, false
+	}
+	return sh.LastWrite(), true
+}
+
+// IdleShards returns the IDs of all shards that have not been written to within d.
+func (s *Store) IdleShards(d time.Duration) []uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	cutoff := time.Now().Add(-d)
+	var a []uint64
+	for _, sh := range s.shardsSlice() {
+		if sh.LastWrite().Before(cutoff) {
+			a = append(a, sh.id)
+		}
+	}
+	return a
+}
+
+// DeleteSeries loops through the local shards and deletes the series data and metadata for the passed in series keys
+func (s *Store) DeleteSeries(database string, sources []influxql.Source, condition influxql.Expr) error {
+	return s.DeleteSeriesContext(context.Background(), database, sources, condition, nil)
+}
+
+// DeleteSeriesContext deletes series like DeleteSeries, one shard of the
+// database at a time in ID order. progress, if not nil, is called after each
+// shard with the number of shards done and the number to do. ctx is checked
+// before each shard; if it is cancelled ctx.Err() is returned and the shards
+// already done stay deleted, while the series are kept in the index until a
+// delete completes.
+func (s *Store) DeleteSeriesContext(ctx context.Context, database string, sources []influxql.Source, condition influxql.Expr, progress func(done, total int)) error {
+	if s.EngineOptions.ReadOnly {
+		return ErrStoreReadOnly
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Find the database.
+	db := s.databaseIndexes[database]
+	if db == nil {
+		return nil
+	}
+
+	seriesKeys, err := s.seriesKeysForDelete(db, sources, condition, "DROP SERIES")
+	if err != nil {
+		return err
+	}
+
+	shards := s.databaseShards(database)
+
+	// delete the raw series data
+	for i, sh := range shards {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := sh.DeleteSeries(seriesKeys); err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(i+1, len(shards))
+		}
+	}
+
+	// remove them from the index
+	db.DropSeries(seriesKeys)
+
+	return nil
+}
+
+// DeleteSeriesDryRun returns the sorted keys of the series DeleteSeries would
+// delete, without deleting anything. The series are matched exactly as
+// DeleteSeries matches them.
+func (s *Store) DeleteSeriesDryRun(database string, sources []influxql.Source, condition influxql.Expr) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Find the database.
+	db := s.databaseIndexes[database]
+	if db == nil {
+		return nil, nil
+	}
+
+	seriesKeys, err := s.seriesKeysForDelete(db, sources, condition, "DROP SERIES")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(seriesKeys)
+	return seriesKeys, nil
+}
+
+// DeleteSeriesBatched deletes the series matching sources and condition like
+// DeleteSeries, but at most batchSize series at a time. The series are listed
+// once, then each batch is deleted from the shards and the index while the
+// store is read locked, and the lock is released between batches so that
+// other operations are not blocked for the whole delete. If progress is not
+// nil, it is called after each batch with the number of series deleted so
+// far and the total. If a batch fails, the series of earlier batches stay
+// deleted and the index still holds every series that was not.
+func (s *Store) DeleteSeriesBatched(database string, sources []influxql.Source, condition influxql.Expr, batchSize int, progress func(deleted, total int)) error {
+	if s.EngineOptions.ReadOnly {
+		return ErrStoreReadOnly
+	}
+
+	if batchSize <= 0 {
+		return fmt.Errorf("invalid batch size: %d", batchSize)
+	}
+
+	seriesKeys, err := s.DeleteSeriesDryRun(database, sources, condition)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(seriesKeys); i += batchSize {
+		batch := seriesKeys[i:]
+		if len(batch) > batchSize {
+			batch = batch[:batchSize]
+		}
+		if err := s.deleteSeriesBatch(database, batch); err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(i+len(batch), len(seriesKeys))
+		}
+	}
+	return nil
+}
+
+// DropSeriesByMeasurementBatch deletes a measurement like DeleteMeasurement,
+// but first deletes its series batchSize at a time, so that a measurement
+// with very many series can be dropped without holding all of its keys in
+// memory or the store lock for the whole delete. progress, if not nil, is
+// called after each batch with the number of series deleted and the number
+// the measurement had. ctx is checked before each batch; if it is cancelled
+// the series deleted so far stay deleted and the measurement is kept. Series
+// written during the delete are removed along with the measurement.
+func (s *Store) DropSeriesByMeasurementBatch(ctx context.Context, database, name string, batchSize int, progress func(deleted, total int)) error {
+	if s.EngineOptions.ReadOnly {
+		return ErrStoreReadOnly
+	}
+
+	if batchSize <= 0 {
+		return fmt.Errorf("invalid batch size: %d", batchSize)
+	}
+
+	m, err := s.measurement(database, name)
+	if err != nil {
+		return err
+	}
+
+	// Only the series IDs are copied; keys are resolved one batch at a time.
+	m.mu.RLock()
+	ids := make(SeriesIDs, len(m.seriesIDs))
+	copy(ids, m.seriesIDs)
+	m.mu.RUnlock()
+
+	for i := 0; i < len(ids); i += batchSize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		batch := ids[i:]
+		if len(batch) > batchSize {
+			batch = batch[:batchSize]
+		}
+		keys := make([]string, 0, len(batch))
+		for _, id := range batch {
+			if ss := m.SeriesByID(id); ss != nil {
+				keys = append(keys, ss.Key)
+			}
+		}
+
+		if err := s.deleteSeriesBatch(database, keys); err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(i+len(batch), len(ids))
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.DeleteMeasurement(database, name)
+}
+
+// deleteSeriesBatch deletes the data of the series keys from every shard of
+// the database, then removes them from the index.
+func (s *Store) deleteSeriesBatch(database string, seriesKeys []string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	select {
+	case <-s.closing:
+		return ErrStoreClosed
+	default:
+	}
+
+	if err := s.deleteSeries(database, seriesKeys); err != nil {
+		return err
+	}
+	if db := s.databaseIndexes[database]; db != nil {
+		db.DropSeries(seriesKeys)
+	}
+	return nil
+}
+
+// DeleteSeriesRange deletes the values between min and max, inclusive, of the
+// series matching sources and condition. Values outside the range are kept, as
+// are the series themselves.
+func (s *Store) DeleteSeriesRange(database string, sources []influxql.Source, condition influxql.Expr, min, max int64) error {
+	if s.EngineOptions.ReadOnly {
+		return ErrStoreReadOnly
+	}
+
+	if min > max {
+		return fmt.Errorf("invalid time range: %d > %d", min, max)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Find the database.
+	db := s.databaseIndexes[database]
+	if db == nil {
+		return nil
+	}
+
+	seriesKeys, err := s.seriesKeysForDelete(db, sources, condition, "DELETE")
+	if err != nil {
+		return err
+	} else if len(seriesKeys) == 0 {
+		return nil
+	}
+
+	for _, sh := range s.databaseShards(database) {
+		if err := sh.DeleteSeriesRange(seriesKeys, min, max); err != nil {
+			return NewShardError(sh.id, err)
+		}
+	}
+	return nil
+}
+
+// TruncateShard deletes the values of every series in a shard with
+// timestamps after the given time, in nanoseconds, and keeps the earlier
+// values and the series. TSM files holding deleted values are rewritten by
+// the delete, and the cache is then snapshotted so that the WAL segments
+// holding them are removed. after must be within the time range of the
+// shard's data, so that a mistaken time can't empty the shard. Truncating a
+// shard without data does nothing.
+func (s *Store) TruncateShard(id uint64, after int64) error {
+	if s.EngineOptions.ReadOnly {
+		return ErrStoreReadOnly
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	select {
+	case <-s.closing:
+		return ErrStoreClosed
+	default:
+	}
+
+	sh, ok := s.shards[id]
+	if !ok {
+		return ErrShardNotFound
+	} else if sh.ReadOnly() {
+		return ErrShardReadOnly
+	}
+
+	engine, err := sh.openEngine()
+	if err != nil {
+		return NewShardError(id, err)
+	}
+	min, max, ok := engine.TimeRange()
+	if !ok {
+		return nil
+	} else if after < min || after > max {
+		return fmt.Errorf("truncate time %d is outside the time range of shard %d: %d to %d", after, id, min, max)
+	} else if after == max {
+		return nil
+	}
+
+	if err := sh.DeleteSeriesRange(sh.seriesKeys(), after+1, math.MaxInt64); err != nil {
+		return NewShardError(id, err)
+	} else if err := sh.WriteSnapshot(); err != nil {
+		return NewShardError(id, err)
+	}
+	return nil
+}
+
+// seriesKeysForDelete returns the keys of the series in db matching sources
+// and condition. The condition may only reference tags; stmt names the
+// statement in the error returned otherwise.
+func (s *Store) seriesKeysForDelete(db *DatabaseIndex, sources []influxql.Source, condition influxql.Expr, stmt string) ([]string, error) {
+	// Expand regex expressions in the FROM clause.
+	a, err := s.expandSources(sources)
+	if err != nil {
+		return nil, err
+	} else if sources != nil && len(sources) != 0 && len(a) == 0 {
+		return nil, nil
+	}
+	sources = a
+
+	measurements, err := measurementsFromSourcesOrDB(db, sources...)
+	if err != nil {
+		return nil, err
+	}
+
+	var seriesKeys []string
+	for _, m := range measurements {
+		var ids SeriesIDs
+		var filters FilterExprs
+		if condition != nil {
+			// Get series IDs that match the WHERE clause.
+			ids, filters, err = m.walkWhereForSeriesIds(condition)
+			if err != nil {
+				return nil, err
+			}
+
+			// Delete boolean literal true filter expressions.
+			// These are returned for `WHERE tagKey = 'tagVal'` type expressions and are okay.
+			filters.DeleteBoolLiteralTrues()
+
+			// Check for unsupported field filters.
+			// Any remaining filters means there were fields (e.g., `WHERE value = 1.2`).
+			if filters.Len() > 0 {
+				return nil, fmt.Errorf("%s doesn't support fields in WHERE clause", stmt)
+			}
+		} else {
+			// No WHERE clause so get all series IDs for this measurement.
+			ids = m.seriesIDs
+		}
+
+		for _, id := range ids {
+			seriesKeys = append(seriesKeys, m.seriesByID[id].Key)
+		}
+	}
+	return seriesKeys, nil
+}
+
+func (s *Store) deleteSeries(database string, seriesKeys []string) error {
+	if _, ok := s.databaseIndexes[database]; !ok {
+		return influxql.ErrDatabaseNotFound(database)
+	}
+
+	for _, sh := range s.databaseShards(database) {
+		if err := sh.DeleteSeries(seriesKeys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExpandSources expands regex sources and removes duplicates.
+// NOTE: sources must be normalized (db and rp set) before calling this function.
+func (s *Store) ExpandSources(sources influxql.Sources) (influxql.Sources, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.expandSources(sources)
+}
+
+func (s *Store) expandSources(sources influxql.Sources) (influxql.Sources, error) {
+	// Use a map as a set to prevent duplicates.
+	set := map[string]influxql.Source{}
+
+	// Iterate all sources, expanding regexes when they're found.
+	for _, source := range sources {
+		switch src := source.(type) {
+		case *influxql.Measurement:
+			// Add non-regex measurements directly to the set.
+			if src.Regex == nil {
+				set[src.String()] = src
+				continue
+			}
+
+			// Lookup the database.
+			db := s.databaseIndexes[src.Database]
+			if db == nil {
+				return nil, nil
+			}
+
+			// Only expand to the measurements held by the shards of the
+			// retention policy, if one is set.
+			var shards []*Shard
+			if src.RetentionPolicy != "" {
+				shards = s.retentionPolicyShards(src.Database, src.RetentionPolicy)
+			}
+
+			// Loop over matching measurements.
+			for _, m := range db.MeasurementsByRegex(src.Regex.Val) {
+				if src.RetentionPolicy != "" && !shardsHaveMeasurement(shards, m.Name) {
+					continue
+				}
+
+				other := &influxql.Measurement{
+					Database:        src.Database,
+					RetentionPolicy: src.RetentionPolicy,
+					Name:            m.Name,
+				}
+				set[other.String()] = other
+			}
+
+		default:
+			return nil, fmt.Errorf("expandSources: unsupported source type: %T", source)
+		}
+	}
+
+	// Convert set to sorted slice.
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Convert set to a list of Sources.
+	expanded := make(influxql.Sources, 0, len(set))
+	for _, name := range names {
+		expanded = append(expanded, set[name])
+	}
+
+	return expanded, nil
+}
+
+// shardsHaveMeasurement returns true if any of shards holds the measurement.
+func shardsHaveMeasurement(shards []*Shard, name string) bool {
+	for _, sh := range shards {
+		if sh.hasMeasurement(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteToShard writes a list of points to a shard identified by its ID.
+func (s *Store) WriteToShard(shardID uint64, points []models.Point) error {
+	return s.WriteToShardContext(context.Background(), shardID, points)
+}
+
+// RejectedPoint is a point that WriteToShardPartial did not write.
+type RejectedPoint struct {
+	Index int // position of the point in the write
+	Point models.Point
+	Err   error // why the point was rejected
+}
+
+// WriteToShardPartial writes the valid points of a batch to a shard and
+// returns the others instead of failing the whole write like WriteToShard.
+// Points are rejected if they are malformed, with ErrInvalidPoint, or if a
+// field conflicts with the type it already has, with a
+// FieldTypeConflictError. The store doesn't know retention periods, so
+// points outside them must be filtered by the caller. rejected is sorted by
+// index. err is only set if the write failed for the whole batch, in which
+// case nothing was written.
+//
+// If the shard deduplicates writes, see EngineOptions.DedupWrites, written
+// counts the points after duplicates are collapsed, so the number of points
+// that were collapsed into others is len(points) - written - len(rejected).
+// A rejected point that was collapsed is reported at the index of the last
+// of its duplicates.
+func (s *Store) WriteToShardPartial(shardID uint64, points []models.Point) (written int, rejected []RejectedPoint, err error) {
+	if s.EngineOptions.ReadOnly {
+		return 0, nil, ErrStoreReadOnly
+	}
+
+	sh := s.Shard(shardID)
+	if sh == nil {
+		return 0, nil, ErrShardNotFound
+	}
+
+	valid := make([]models.Point, 0, len(points))
+	index := make([]int, 0, len(points))
+	for i, p := range points {
+		if p.Name() == "" {
+			rejected = append(rejected, RejectedPoint{Index: i, Point: p, Err: fmt.Errorf("%w: missing measurement name", ErrInvalidPoint)})
+			continue
+		} else if len(p.Fields()) == 0 {
+			rejected = append(rejected, RejectedPoint{Index: i, Point: p, Err: fmt.Errorf("%w: no fields", ErrInvalidPoint)})
+			continue
+		}
+		valid = append(valid, p)
+		index = append(index, i)
+	}
+
+	// Collapse duplicates up front so that they are counted once.
+	if sh.options.DedupWrites {
+		deduped, positions, err := dedupPoints(valid)
+		if err != nil {
+			return 0, rejected, err
+		} else if positions != nil {
+			for i, pos := range positions {
+				positions[i] = index[pos]
+			}
+			valid, index = deduped, positions
+		}
+	}
+
+	// The shard validates a batch before writing any of it, so points with
+	// conflicting fields are removed one at a time until the rest is written.
+	for len(valid) > 0 {
+		err := s.WriteToShard(shardID, valid)
+		if err == nil {
+			written = len(valid)
+			break
+		}
+
+		var conflict FieldTypeConflictError
+		if !errors.As(err, &conflict) || conflict.Index < 0 || conflict.Index >= len(valid) {
+			return 0, rejected, err
+		}
+		i := conflict.Index
+		conflict.Index = index[i]
+		rejected = append(rejected, RejectedPoint{Index: index[i], Point: valid[i], Err: conflict})
+		valid = append(valid[:i], valid[i+1:]...)
+		index = append(index[:i], index[i+1:]...)
+	}
+
+	sort.Slice(rejected, func(i, j int) bool { return rejected[i].Index < rejected[j].Index })
+	return written, rejected, nil
+}
+
+// WriteToShardWithPrecision writes a list of points to a shard like
+// WriteToShard, after scaling their timestamps from the given precision to
+// nanoseconds. precision is one of "s", "ms", "us" or "ns"; the line protocol
+// forms "u" and "n" are accepted too. The timestamps are updated in place. No
+// point is changed or written if any timestamp would be out of range.
+func (s *Store) WriteToShardWithPrecision(shardID uint64, points []models.Point, precision string) error {
+	switch precision {
+	case "ns", "n":
+		return s.WriteToShard(shardID, points)
+	case "us":
+		precision = "u"
+	case "u", "ms", "s":
+	default:
+		return fmt.Errorf("invalid precision: %q", precision)
+	}
+
+	times := make([]time.Time, len(points))
+	for i, p := range points {
+		t, err := models.SafeCalcTime(p.UnixNano(), precision)
+		if err != nil {
+			return fmt.Errorf("point %d: %s", i, err)
+		}
+		times[i] = t
+	}
+	for i, p := range points {
+		p.SetTime(times[i])
+	}
+	return s.WriteToShard(shardID, points)
+}
+
+// TryWriteToShard writes a list of points to a shard like WriteToShard, but
+// returns ErrShardBusy immediately if the store or the shard's engine is
+// locked by another operation, or if the shard was closed because of
+// EngineOptions.MaxOpenShards. ErrShardBusy is retryable, so callers can
+// queue the points or drop them.
+func (s *Store) TryWriteToShard(shardID uint64, points []models.Point) error {
+	if s.EngineOptions.ReadOnly {
+		return ErrStoreReadOnly
+	}
+
+	if !s.mu.TryRLock() {
+		return ErrShardBusy
+	}
+	defer s.mu.RUnlock()
+
+	select {
+	case <-s.closing:
+		return ErrStoreClosed
+	default:
+	}
+
+	sh, ok := s.shards[shardID]
+	if !ok {
+		return ErrShardNotFound
+	}
+
+	// Reopening a shard closed by MaxOpenShards would have to wait.
+	if s.EngineOptions.MaxOpenShards > 0 && s.lru.touch(sh) {
+		return ErrShardBusy
+	}
+	return sh.TryWritePoints(points)
+}
+
+// ShardWriteStats returns the number of points and line protocol bytes
+// written to a shard since it was opened or last reset. It returns zero for
+// shards that do not exist.
+func (s *Store) ShardWriteStats(id uint64) (points, bytes uint64) {
+	sh := s.Shard(id)
+	if sh == nil {
+		return 0, 0
+	}
+	return sh.WriteStats()
+}
+
+// ResetShardWriteStats sets the write counters of a shard back to zero.
+func (s *Store) ResetShardWriteStats(id uint64) {
+	if sh := s.Shard(id); sh != nil {
+		sh.ResetWriteStats()
+	}
+}
+
+// ShardPointsWrittenSince returns the number of points written to a shard
+// after since, for example to compare how far a replica lags its primary.
+// Write times are held in memory with one second resolution for the last
+// WriteHistoryWindow, and ErrWriteHistoryUnavailable is returned for an
+// older since or one before the shard was opened.
+func (s *Store) ShardPointsWrittenSince(id uint64, since time.Time) (int64, error) {
+	sh := s.Shard(id)
+	if sh == nil {
+		return 0, ErrShardNotFound
+	}
+	return sh.PointsWrittenSince(since)
+}
+
+// ShardWriteSequence returns the number of points written to a shard since
+// it was opened. Unlike ShardWriteStats it is never reset, so two readings
+// can be subtracted to find the points written in between.
+func (s *Store) ShardWriteSequence(id uint64) (uint64, error) {
+	sh := s.Shard(id)
+	if sh == nil {
+		return 0, ErrShardNotFound
+	}
+	return sh.WriteSequence(), nil
+}
+
+// SetShardReadonly sets whether writes to a shard are refused with
+// ErrShardReadOnly, for example while it is copied to another node. The
+// shard stays open for reads and backups. The setting is held in memory only
+// and is cleared when the store is reopened.
+func (s *Store) SetShardReadonly(id uint64, ro bool) error {
+	sh := s.Shard(id)
+	if sh == nil {
+		return ErrShardNotFound
+	}
+	sh.SetReadOnly(ro)
+	return nil
+}
+
+// IsShardReadonly returns true if writes to a shard are refused. It returns
+// false for shards that do not exist.
+func (s *Store) IsShardReadonly(id uint64) bool {
+	sh := s.Shard(id)
+	return sh != nil && sh.ReadOnly()
+}
+
+// SetShardCacheSize changes the maximum number of bytes the cache of a shard
+// may consume, so that shards that are actively written to can be given more
+// memory than the rest. Zero means unlimited. Writes that would grow the
+// cache beyond the limit fail until it is snapshotted, and the shard can't
+// be reopened while its WAL holds more than the limit. The limit lasts until
+// the store is reopened; use CreateShardWithOptions to create a shard with
+// its own Config.CacheMaxMemorySize.
+func (s *Store) SetShardCacheSize(id uint64, bytes int) error {
+	if bytes < 0 {
+		return fmt.Errorf("invalid cache size %d", bytes)
+	}
+	sh := s.Shard(id)
+	if sh == nil {
+		return ErrShardNotFound
+	}
+	sh.SetCacheMaxSize(uint64(bytes))
+	return nil
+}
+
+// SetShardWALFsyncDelay changes how long writes to a shard may go without
+// being synced to disk, for example to speed up a bulk import into a shard
+// that can be rebuilt. Zero syncs every write before it is acknowledged. A
+// positive delay syncs at most once per delay, and writes acknowledged since
+// the last sync can be lost if the host crashes. A negative delay turns
+// syncing off entirely. The delay lasts until the store is reopened; use
+// CreateShardWithOptions to create a shard with its own Config.WALFsyncDelay.
+func (s *Store) SetShardWALFsyncDelay(id uint64, d time.Duration) error {
+	sh := s.Shard(id)
+	if sh == nil {
+		return ErrShardNotFound
 	}
+	sh.SetWALFsyncDelay(d)
+	return nil
+}
 
-	// Expand regex expressions in the FROM clause.
-	a, err := s.expandSources(sources)
-	if err != nil {
-		return err
-	} else if sources != nil && len(sources) != 0 && len(a) == 0 {
-		return nil
-	}
-	sources = a
+// ShardWriteErrors holds the errors of a write to several shards, keyed by
+// shard ID. Shards that are not in the map were written successfully.
+type ShardWriteErrors map[uint64]error
 
-	measurements, err := measurementsFromSourcesOrDB(db, sources...)
-	if err != nil {
-		return err
+func (e ShardWriteErrors) Error() string {
+	ids := make([]uint64, 0, len(e))
+	for id := range e {
+		ids = append(ids, id)
 	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
 
-	var seriesKeys []string
-	for _, m := range measurements {
-		var ids SeriesIDs
-		var filters FilterExprs
-		if condition != nil {
-			// Get series IDs that match the WHERE clause.
-			ids, filters, err = m.walkWhereForSeriesIds(condition)
-			if err != nil {
-				return err
-			}
+	msgs := make([]string, len(ids))
+	for i, id := range ids {
+		msgs[i] = NewShardError(id, e[id]).Error()
+	}
+	return strings.Join(msgs, "; ")
+}
 
-			// Delete boolean literal true filter expressions.
-			// These are returned for `WHERE tagKey = 'tagVal'` type expressions and are okay.
-			filters.DeleteBoolLiteralTrues()
+// WriteToShards writes points to several shards, keyed by shard ID. The
+// shards are written concurrently while the store is locked once for all of
+// them. If any write fails a ShardWriteErrors is returned so that the caller
+// can retry the failed shards.
+func (s *Store) WriteToShards(writes map[uint64][]models.Point) error {
+	if s.EngineOptions.ReadOnly {
+		return ErrStoreReadOnly
+	}
 
-			// Check for unsupported field filters.
-			// Any remaining filters means there were fields (e.g., `WHERE value = 1.2`).
-			if filters.Len() > 0 {
-				return errors.New("DROP SERIES doesn't support fields in WHERE clause")
-			}
-		} else {
-			// No WHERE clause so get all series IDs for this measurement.
-			ids = m.seriesIDs
-		}
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs = ShardWriteErrors{}
+	)
 
-		for _, id := range ids {
-			seriesKeys = append(seriesKeys, m.seriesByID[id].Key)
+	for id := range writes {
+		if err := s.useShardID(id); err == ErrStoreClosed {
+			return err
+		} else if err != nil {
+			errs[id] = err
 		}
 	}
 
-	// delete the raw series data
-	if err := s.deleteSeries(database, seriesKeys); err != nil {
-		return err
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	select {
+	case <-s.closing:
+		return ErrStoreClosed
+	default:
 	}
 
-	// remove them from the index
-	db.DropSeries(seriesKeys)
+	t := limiter.NewFixed(runtime.GOMAXPROCS(0))
+	for id, points := range writes {
+		sh, ok := s.shards[id]
+		if !ok {
+			errs[id] = ErrShardNotFound
+			continue
+		} else if _, ok := errs[id]; ok {
+			continue
+		}
 
-	return nil
-}
+		t.Take()
+		wg.Add(1)
+		go func(id uint64, sh *Shard, points []models.Point) {
+			defer wg.Done()
+			defer t.Release()
 
-func (s *Store) deleteSeries(database string, seriesKeys []string) error {
-	if _, ok := s.databaseIndexes[database]; !ok {
-		return influxql.ErrDatabaseNotFound(database)
+			if err := sh.WritePoints(points); err != nil {
+				mu.Lock()
+				errs[id] = err
+				mu.Unlock()
+			}
+		}(id, sh, points)
 	}
+	wg.Wait()
 
-	for _, sh := range s.shards {
-		if sh.database != database {
-			continue
-		}
-		if err := sh.DeleteSeries(seriesKeys); err != nil {
-			return err
-		}
+	if len(errs) > 0 {
+		return errs
 	}
 	return nil
 }
 
-// ExpandSources expands regex sources and removes duplicates.
-// NOTE: sources must be normalized (db and rp set) before calling this function.
-func (s *Store) ExpandSources(sources influxql.Sources) (influxql.Sources, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	return s.expandSources(sources)
+// asyncWrite is a write queued by WriteToShardAsync. err is set when the
+// write is cancelled, in which case done is called with it instead of
+// writing.
+type asyncWrite struct {
+	points []models.Point
+	done   func(error)
+	err    error
 }
 
-func (s *Store) expandSources(sources influxql.Sources) (influxql.Sources, error) {
-	// Use a map as a set to prevent duplicates.
-	set := map[string]influxql.Source{}
+// WriteToShardAsync queues a write of points to a shard and returns without
+// waiting for it. The writes of a shard are made in order by a background
+// goroutine, which calls done, if it is not nil, with the result of each.
+// If the shard already has EngineOptions.AsyncWriteQueueSize writes waiting,
+// ErrWriteQueueFull is returned so that the caller can slow down. When an
+// error is returned the write is not queued and done is not called. Close
+// waits for queued writes to finish. done runs without the store locked and
+// may call other Store methods, but not Close. Writes still queued when their
+// shard is deleted, closed, moved or merged are not made, and done is called
+// with ErrShardNotFound, ErrEngineClosed or ErrShardReadOnly.
+func (s *Store) WriteToShardAsync(shardID uint64, points []models.Point, done func(error)) error {
+	if s.EngineOptions.ReadOnly {
+		return ErrStoreReadOnly
+	}
+	if err := s.useShardID(shardID); err != nil {
+		return err
+	}
 
-	// Iterate all sources, expanding regexes when they're found.
-	for _, source := range sources {
-		switch src := source.(type) {
-		case *influxql.Measurement:
-			// Add non-regex measurements directly to the set.
-			if src.Regex == nil {
-				set[src.String()] = src
-				continue
-			}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-			// Lookup the database.
-			db := s.databaseIndexes[src.Database]
-			if db == nil {
-				return nil, nil
-			}
+	select {
+	case <-s.closing:
+		return ErrStoreClosed
+	default:
+	}
 
-			// Loop over matching measurements.
-			for _, m := range db.MeasurementsByRegex(src.Regex.Val) {
-				other := &influxql.Measurement{
-					Database:        src.Database,
-					RetentionPolicy: src.RetentionPolicy,
-					Name:            m.Name,
-				}
-				set[other.String()] = other
-			}
+	sh, ok := s.shards[shardID]
+	if !ok {
+		return ErrShardNotFound
+	}
 
-		default:
-			return nil, fmt.Errorf("expandSources: unsupported source type: %T", source)
-		}
+	s.asyncMu.Lock()
+	defer s.asyncMu.Unlock()
+
+	queue, running := s.asyncWrites[sh]
+	if len(queue) >= s.Options().asyncWriteQueueSize() {
+		return ErrWriteQueueFull
+	}
+	if s.asyncWrites == nil {
+		s.asyncWrites = make(map[*Shard][]asyncWrite)
 	}
+	s.asyncWrites[sh] = append(queue, asyncWrite{points: points, done: done})
 
-	// Convert set to sorted slice.
-	names := make([]string, 0, len(set))
-	for name := range set {
-		names = append(names, name)
+	// Close closes s.closing under the lock before waiting on wg, so it
+	// can't be waiting yet.
+	if !running {
+		s.wg.Add(1)
+		go s.writeAsync(sh)
 	}
-	sort.Strings(names)
+	return nil
+}
 
-	// Convert set to a list of Sources.
-	expanded := make(influxql.Sources, 0, len(set))
-	for _, name := range names {
-		expanded = append(expanded, set[name])
+// writeAsync makes the writes queued for sh until its queue is empty. It
+// writes to the shard directly, without locking the store, so that writes
+// and their done callbacks don't block on store operations.
+func (s *Store) writeAsync(sh *Shard) {
+	defer s.wg.Done()
+
+	for {
+		s.asyncMu.Lock()
+		queue := s.asyncWrites[sh]
+		if len(queue) == 0 {
+			delete(s.asyncWrites, sh)
+			s.asyncMu.Unlock()
+			return
+		}
+		w := queue[0]
+		queue[0] = asyncWrite{}
+		s.asyncWrites[sh] = queue[1:]
+		s.asyncMu.Unlock()
+
+		err := w.err
+		if err == nil {
+			err = sh.WritePoints(w.points)
+		}
+		if w.done != nil {
+			w.done(err)
+		}
 	}
+}
 
-	return expanded, nil
+// cancelAsyncWrites cancels the writes queued for sh with err, unless they
+// were already cancelled. The writer goroutine calls their done callbacks.
+// s.mu must be held for writing.
+func (s *Store) cancelAsyncWrites(sh *Shard, err error) {
+	s.asyncMu.Lock()
+	defer s.asyncMu.Unlock()
+	queue := s.asyncWrites[sh]
+	for i := range queue {
+		if queue[i].err == nil {
+			queue[i].err = err
+		}
+	}
 }
 
-// WriteToShard writes a list of points to a shard identified by its ID.
-func (s *Store) WriteToShard(shardID uint64, points []models.Point) error {
+// WriteToShardContext writes a list of points to a shard identified by its ID.
+// It returns ctx.Err() as soon as the context is done, even if the write is
+// still in progress. A write that was already handed to the shard is not
+// aborted and may still complete after the context is done.
+func (s *Store) WriteToShardContext(ctx context.Context, shardID uint64, points []models.Point) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if s.EngineOptions.ReadOnly {
+		return ErrStoreReadOnly
+	}
+	if err := s.useShardID(shardID); err != nil {
+		return err
+	}
+
 	s.mu.RLock()
-	defer s.mu.RUnlock()
 
 	select {
 	case <-s.closing:
+		s.mu.RUnlock()
 		return ErrStoreClosed
 	default:
 	}
 
 	sh, ok := s.shards[shardID]
 	if !ok {
+		s.mu.RUnlock()
 		return ErrShardNotFound
 	}
 
-	return sh.WritePoints(points)
+	// Write in place if the context can never be cancelled.
+	if ctx.Done() == nil {
+		defer s.mu.RUnlock()
+		return sh.WritePoints(points)
+	}
+
+	// Otherwise the store stays locked until the write finishes so that the
+	// shard can't be closed underneath it.
+	errC := make(chan error, 1)
+	go func() {
+		defer s.mu.RUnlock()
+		errC <- sh.WritePoints(points)
+	}()
+
+	select {
+	case err := <-errC:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (s *Store) ExecuteShowFieldKeysStatement(stmt *influxql.ShowFieldKeysStatement, database string) (models.Rows, error) {
 	// NOTE(benbjohnson):
 	// This function is temporarily moved here until reimplemented in the new query engine.
+	return s.executeShowFieldKeys(stmt, database, false)
+}
+
+// ExecuteShowFieldKeysWithTypes is like ExecuteShowFieldKeysStatement but
+// adds a fieldType column holding each field's data type. Types are taken
+// from the database's shards in ID order; a field with no type in any shard
+// is reported as "unknown".
+func (s *Store) ExecuteShowFieldKeysWithTypes(stmt *influxql.ShowFieldKeysStatement, database string) (models.Rows, error) {
+	return s.executeShowFieldKeys(stmt, database, true)
+}
 
+func (s *Store) executeShowFieldKeys(stmt *influxql.ShowFieldKeysStatement, database string, withTypes bool) (models.Rows, error) {
 	// Find the database.
 	db := s.DatabaseIndex(database)
 	if db == nil {
@@ -684,6 +5681,11 @@ func (s *Store) ExecuteShowFieldKeysStatement(stmt *influxql.ShowFieldKeysStatem
 		return nil, err
 	}
 
+	var shards []*Shard
+	if withTypes {
+		shards = s.Shards(s.ShardIDsByDatabase(database))
+	}
+
 	// Make result.
 	rows := make(models.Rows, 0, len(measurements))
 
@@ -695,6 +5697,21 @@ func (s *Store) ExecuteShowFieldKeysStatement(stmt *influxql.ShowFieldKeysStatem
 			Columns: []string{"fieldKey"},
 		}
 
+		// Collect the field types from every shard in the database. The
+		// first shard to define a field decides its type.
+		var types map[string]influxql.DataType
+		if withTypes {
+			r.Columns = append(r.Columns, "fieldType")
+			types = make(map[string]influxql.DataType)
+			for _, sh := range shards {
+				for name, typ := range sh.fieldTypes(m.Name) {
+					if _, ok := types[name]; !ok {
+						types[name] = typ
+					}
+				}
+			}
+		}
+
 		// Get a list of field names from the measurement then sort them.
 		names := m.FieldNames()
 		sort.Strings(names)
@@ -702,6 +5719,10 @@ func (s *Store) ExecuteShowFieldKeysStatement(stmt *influxql.ShowFieldKeysStatem
 		// Add the field names to the result row values.
 		for _, n := range names {
 			v := interface{}(n)
+			if withTypes {
+				r.Values = append(r.Values, []interface{}{v, types[n].String()})
+				continue
+			}
 			r.Values = append(r.Values, []interface{}{v})
 		}
 
@@ -712,9 +5733,149 @@ func (s *Store) ExecuteShowFieldKeysStatement(stmt *influxql.ShowFieldKeysStatem
 	return rows, nil
 }
 
+// ExecuteShowMeasurementsStatement returns a single "measurements" row with
+// the sorted names of the measurements matching the statement. WITH
+// MEASUREMENT matches names exactly or by regex and WHERE filters on tags.
+// LIMIT and OFFSET apply to the names. No row is returned if nothing matches.
+func (s *Store) ExecuteShowMeasurementsStatement(stmt *influxql.ShowMeasurementsStatement, database string) (models.Rows, error) {
+	// Check for time in WHERE clause (not supported).
+	if influxql.HasTimeExpr(stmt.Condition) {
+		return nil, errors.New("SHOW MEASUREMENTS doesn't support time in WHERE clause")
+	}
+
+	// Find the database.
+	db := s.DatabaseIndex(database)
+	if db == nil {
+		return nil, nil
+	}
+
+	// Get the measurements matching the WITH MEASUREMENT clause.
+	var measurements Measurements
+	switch src := stmt.Source.(type) {
+	case nil:
+		db.mu.RLock()
+		measurements = db.Measurements()
+		db.mu.RUnlock()
+	case *influxql.Measurement:
+		if src.Regex != nil {
+			measurements = db.MeasurementsByRegex(src.Regex.Val)
+		} else if m := db.Measurement(src.Name); m != nil {
+			measurements = Measurements{m}
+		}
+	default:
+		return nil, fmt.Errorf("invalid measurement source: %s", stmt.Source)
+	}
+	sort.Sort(measurements)
+
+	// Keep the measurements matching the WHERE clause.
+	if stmt.Condition != nil {
+		db.mu.RLock()
+		mms, ok, err := db.measurementsByExpr(stmt.Condition)
+		db.mu.RUnlock()
+		if err != nil {
+			return nil, err
+		} else if ok {
+			measurements = measurements.intersect(mms)
+		}
+	}
+
+	// Apply OFFSET and LIMIT.
+	if stmt.Offset >= len(measurements) {
+		return models.Rows{}, nil
+	}
+	measurements = measurements[stmt.Offset:]
+	if stmt.Limit > 0 && stmt.Limit < len(measurements) {
+		measurements = measurements[:stmt.Limit]
+	}
+
+	r := &models.Row{
+		Name:    "measurements",
+		Columns: []string{"name"},
+	}
+	for _, m := range measurements {
+		v := interface{}(m.Name)
+		r.Values = append(r.Values, []interface{}{v})
+	}
+	return models.Rows{r}, nil
+}
+
+// ExecuteShowTagKeysStatement returns a row of sorted tag keys for each
+// measurement matching the statement. LIMIT and OFFSET apply to the total
+// number of tag keys returned across all measurements.
+func (s *Store) ExecuteShowTagKeysStatement(stmt *influxql.ShowTagKeysStatement, database string) (models.Rows, error) {
+	// Check for time in WHERE clause (not supported).
+	if influxql.HasTimeExpr(stmt.Condition) {
+		return nil, errors.New("SHOW TAG KEYS doesn't support time in WHERE clause")
+	}
+
+	// Find the database.
+	db := s.DatabaseIndex(database)
+	if db == nil {
+		return nil, nil
+	}
+
+	// Expand regex expressions in the FROM clause.
+	sources, err := s.ExpandSources(stmt.Sources)
+	if err != nil {
+		return nil, err
+	}
+
+	measurements, err := measurementsFromSourcesOrDB(db, sources...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Make result.
+	rows := make(models.Rows, 0, len(measurements))
+
+	// Loop through measurements, adding a result row for each.
+	for _, m := range measurements {
+		var keys []string
+		if stmt.Condition != nil {
+			// Get series IDs that match the WHERE clause.
+			ids, _, err := m.walkWhereForSeriesIds(stmt.Condition)
+			if err != nil {
+				return nil, err
+			}
+
+			// Collect the tag keys of the matching series.
+			set := newStringSet()
+			for _, id := range ids {
+				if ss := m.SeriesByID(id); ss != nil {
+					for k := range ss.Tags {
+						set.add(k)
+					}
+				}
+			}
+			keys = set.list()
+			sort.Strings(keys)
+		} else {
+			keys = m.TagKeys()
+		}
+
+		// If no tag keys matched, then go to the next measurement.
+		if len(keys) == 0 {
+			continue
+		}
+
+		r := &models.Row{
+			Name:    m.Name,
+			Columns: []string{"tagKey"},
+		}
+		for _, k := range keys {
+			v := interface{}(k)
+			r.Values = append(r.Values, []interface{}{v})
+		}
+		rows = append(rows, r)
+	}
+
+	return s.filterShowSeriesResult(stmt.Limit, stmt.Offset, rows), nil
+}
+
 // filterShowSeriesResult will limit the number of series returned based on the limit and the offset.
 // Unlike limit and offset on SELECT statements, the limit and offset don't apply to the number of Rows, but
 // to the number of total Values returned, since each Value represents a unique series.
+// A limit of zero means the number of values is unlimited.
 func (e *Store) filterShowSeriesResult(limit, offset int, rows models.Rows) models.Rows {
 	var filteredSeries models.Rows
 	seriesCount := 0
@@ -723,7 +5884,7 @@ func (e *Store) filterShowSeriesResult(limit, offset int, rows models.Rows) mode
 
 		// filter the values
 		for _, v := range r.Values {
-			if seriesCount >= offset && seriesCount-offset < limit {
+			if seriesCount >= offset && (limit <= 0 || seriesCount-offset < limit) {
 				currentSeries = append(currentSeries, v)
 			}
 			seriesCount++
@@ -733,7 +5894,7 @@ func (e *Store) filterShowSeriesResult(limit, offset int, rows models.Rows) mode
 		if len(currentSeries) > 0 {
 			r.Values = currentSeries
 			filteredSeries = append(filteredSeries, r)
-			if seriesCount > limit+offset {
+			if limit > 0 && seriesCount > limit+offset {
 				return filteredSeries
 			}
 		}
@@ -792,7 +5953,21 @@ func (s *Store) ExecuteShowTagValuesStatement(stmt *influxql.ShowTagValuesStatem
 			ids = m.seriesIDs
 		}
 
-		for k, v := range m.tagValuesByKeyAndSeriesID(stmt.TagKeys, ids) {
+		// Resolve a tag key regex against the measurement's tag keys.
+		tagKeys := stmt.TagKeys
+		if stmt.TagKeyRegex != nil {
+			tagKeys = nil
+			for _, k := range m.TagKeys() {
+				if stmt.TagKeyRegex.Val.MatchString(k) {
+					tagKeys = append(tagKeys, k)
+				}
+			}
+			if len(tagKeys) == 0 {
+				continue
+			}
+		}
+
+		for k, v := range m.tagValuesByKeyAndSeriesID(tagKeys, ids) {
 			_, ok := tagValues[k]
 			if !ok {
 				tagValues[k] = v
@@ -819,15 +5994,32 @@ func (s *Store) ExecuteShowTagValuesStatement(stmt *influxql.ShowTagValuesStatem
 	}
 
 	sort.Sort(rows)
+
+	// Apply LIMIT and OFFSET to the tag values across all rows. A zero limit
+	// is unlimited, as with the other SHOW statements.
+	if stmt.Limit > 0 || stmt.Offset > 0 {
+		rows = s.filterShowSeriesResult(stmt.Limit, stmt.Offset, rows)
+	}
 	return rows, nil
 }
 
-// IsRetryable returns true if this error is temporary and could be retried
+// IsRetryable returns true if this error is temporary and could be retried.
+// Errors are matched through any wrapping, and field type conflicts that
+// only survive as a message are recognized by it.
 func IsRetryable(err error) bool {
 	if err == nil {
 		return true
 	}
 
+	if errors.Is(err, ErrFieldTypeConflict) || errors.Is(err, ErrShardReadOnly) {
+		return false
+	}
+	var limitErr ErrMaxSeriesLimitExceeded
+	if errors.As(err, &limitErr) {
+		return false
+	}
+
+	// Fall back to the message of errors that were not wrapped.
 	if strings.Contains(err.Error(), "field type conflict") {
 		return false
 	}
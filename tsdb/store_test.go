@@ -1,11 +1,24 @@
 package tsdb_test
 
 import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -13,7 +26,9 @@ import (
 	"github.com/freetsdb/freetsdb/services/influxql"
 	"github.com/freetsdb/freetsdb/models"
 	"github.com/freetsdb/freetsdb/pkg/deep"
+	"github.com/freetsdb/freetsdb/toml"
 	"github.com/freetsdb/freetsdb/tsdb"
+	"github.com/freetsdb/freetsdb/tsdb/engine/tsm1"
 )
 
 // Ensure the store can delete a retention policy and all shards under
@@ -46,8 +61,17 @@ func TestStore_DeleteRetentionPolicy(t *testing.T) {
 	}
 
 	// Deleting the rp0 retention policy does not return an error.
-	if err := s.DeleteRetentionPolicy("db0", "rp0"); err != nil {
+	if ok, err := s.DeleteRetentionPolicy("db0", "rp0"); err != nil {
 		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("expected retention policy to be deleted")
+	}
+
+	// Deleting it again is a no-op.
+	if ok, err := s.DeleteRetentionPolicy("db0", "rp0"); err != nil || ok {
+		t.Fatalf("unexpected result: %v, %v", ok, err)
+	} else if ok, err := s.DeleteRetentionPolicy("db1", "rp0"); err != nil || ok {
+		t.Fatalf("unexpected result: %v, %v", ok, err)
 	}
 
 	// It deletes the shards under that retention policy.
@@ -76,63 +100,4773 @@ func TestStore_DeleteRetentionPolicy(t *testing.T) {
 		t.Errorf("shard 3 does not exist")
 	}
 
-	// It does not delete other retention policy directories.
-	if got, exp := dirExists(filepath.Join(s.Path(), "db0", "rp1")), true; got != exp {
-		t.Error("directory does not exist, but should")
+	// It does not delete other retention policy directories.
+	if got, exp := dirExists(filepath.Join(s.Path(), "db0", "rp1")), true; got != exp {
+		t.Error("directory does not exist, but should")
+	}
+	if got, exp := dirExists(filepath.Join(s.EngineOptions.Config.WALDir, "db0", "rp1")), true; got != exp {
+		t.Error("directory does not exist, but should")
+	}
+}
+
+// Ensure the store can create a new shard.
+func TestStore_CreateShard(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	// Create a new shard and verify that it exists.
+	if err := s.CreateShard("db0", "rp0", 1); err != nil {
+		t.Fatal(err)
+	} else if sh := s.Shard(1); sh == nil {
+		t.Fatalf("expected shard")
+	} else if di := s.DatabaseIndex("db0"); di == nil {
+		t.Errorf("expected database index")
+	}
+
+	// Create another shard and verify that it exists.
+	if err := s.CreateShard("db0", "rp0", 2); err != nil {
+		t.Fatal(err)
+	} else if sh := s.Shard(2); sh == nil {
+		t.Fatalf("expected shard")
+	}
+
+	// Reopen shard and recheck.
+	if err := s.Reopen(); err != nil {
+		t.Fatal(err)
+	} else if sh := s.Shard(1); sh == nil {
+		t.Fatalf("expected shard(1)")
+	} else if sh = s.Shard(2); sh == nil {
+		t.Fatalf("expected shard(2)")
+	}
+}
+
+// Ensure the store can create a shard with its own engine and reopens it with
+// the same engine.
+func TestStore_CreateShardWithOptions(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	opts := s.EngineOptions
+	opts.EngineVersion = "tsm1-test"
+	if err := s.CreateShardWithOptions("db0", "rp0", 1, opts); err != nil {
+		t.Fatal(err)
+	} else if err := s.CreateShard("db0", "rp0", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	path1 := filepath.Join(s.Path(), "db0", "rp0", "1")
+	path2 := filepath.Join(s.Path(), "db0", "rp0", "2")
+	if n := testEngineOpens.count(path1); n != 1 {
+		t.Fatalf("unexpected test engine opens for shard 1: %d", n)
+	} else if n := testEngineOpens.count(path2); n != 0 {
+		t.Fatalf("unexpected test engine opens for shard 2: %d", n)
+	}
+
+	// Reopen the store and verify only shard 1 uses the test engine.
+	if err := s.Reopen(); err != nil {
+		t.Fatal(err)
+	} else if s.Shard(1) == nil || s.Shard(2) == nil {
+		t.Fatal("expected shards")
+	} else if n := testEngineOpens.count(path1); n != 2 {
+		t.Fatalf("unexpected test engine opens for shard 1: %d", n)
+	} else if n := testEngineOpens.count(path2); n != 0 {
+		t.Fatalf("unexpected test engine opens for shard 2: %d", n)
+	}
+
+	// Unknown engines are rejected.
+	opts.EngineVersion = "no-such-engine"
+	if err := s.CreateShardWithOptions("db0", "rp0", 3, opts); err == nil {
+		t.Fatal("expected error")
+	} else if s.Shard(3) != nil {
+		t.Fatal("unexpected shard")
+	}
+}
+
+// Ensure the shards of a database are opened with its engine options.
+func TestStore_SetDatabaseEngineOptions(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu value=1 0`)
+	s.MustCreateShardWithData("db1", "rp0", 2, `cpu value=1 0`)
+
+	// Reopen with options for db1.
+	if err := s.Store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s.Store = tsdb.NewStore(s.Path())
+	s.EngineOptions.Config.WALDir = filepath.Join(s.Path(), "wal")
+	opts := s.EngineOptions
+	opts.Config.CacheMaxMemorySize = 1 << 20
+	s.SetDatabaseEngineOptions("db1", opts)
+	opts.EngineVersion = "tsm1-test"
+	s.SetDatabaseEngineOptions("db2", opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	def := s.EngineOptions.Config.CacheMaxMemorySize
+	if n := s.Shard(1).CacheMaxSize(); n != def {
+		t.Fatalf("unexpected cache size of shard 1: %d", n)
+	} else if n := s.Shard(2).CacheMaxSize(); n != 1<<20 {
+		t.Fatalf("unexpected cache size of shard 2: %d", n)
+	}
+
+	// New shards use the options of their database too.
+	if err := s.CreateShard("db1", "rp0", 3); err != nil {
+		t.Fatal(err)
+	} else if n := s.Shard(3).CacheMaxSize(); n != 1<<20 {
+		t.Fatalf("unexpected cache size of shard 3: %d", n)
+	} else if err := s.CreateShard("db0", "rp0", 4); err != nil {
+		t.Fatal(err)
+	} else if n := s.Shard(4).CacheMaxSize(); n != def {
+		t.Fatalf("unexpected cache size of shard 4: %d", n)
+	}
+
+	// A database with its own engine records it in new shards.
+	if err := s.CreateShard("db2", "rp0", 5); err != nil {
+		t.Fatal(err)
+	} else if b, err := ioutil.ReadFile(filepath.Join(s.Path(), "db2", "rp0", "5", tsdb.EngineFormatFile)); err != nil || string(b) != "tsm1-test" {
+		t.Fatalf("unexpected engine file: %q, %v", b, err)
+	} else if n := testEngineOpens.count(filepath.Join(s.Path(), "db2", "rp0", "5")); n != 1 {
+		t.Fatalf("unexpected test engine opens: %d", n)
+	}
+}
+
+// Ensure database options can be set while shards are being created.
+func TestStore_SetDatabaseEngineOptions_Concurrent(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			opts := s.EngineOptions
+			opts.Config.CacheMaxMemorySize = uint64(i+1) << 20
+			s.SetDatabaseEngineOptions("db0", opts)
+		}
+	}()
+	for id := uint64(1); id <= 10; id++ {
+		if err := s.CreateShard("db0", "rp0", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+}
+
+// Ensure concurrent creates of a shard open it once without locking the store.
+func TestStore_CreateShard_Concurrent(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	opts := s.EngineOptions
+	opts.EngineVersion = "tsm1-slowopen"
+
+	errC := make(chan error, 3)
+	for i := 0; i < 2; i++ {
+		go func() { errC <- s.CreateShardWithOptions("db0", "rp0", 1, opts) }()
+	}
+	go func() { errC <- s.CreateShardWithOptions("db0", "rp0", 3, opts) }()
+
+	// Different shards are opened at the same time, and the store is usable
+	// while they are being opened.
+	<-slowOpenStarted
+	<-slowOpenStarted
+	if ids := s.ShardIDs(); len(ids) != 0 {
+		t.Fatalf("unexpected shards: %v", ids)
+	} else if err := s.CreateShard("db0", "rp0", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	close(slowOpenRelease)
+	for i := 0; i < 3; i++ {
+		if err := <-errC; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if s.Shard(1) == nil {
+		t.Fatal("expected shard(1)")
+	} else if s.Shard(3) == nil {
+		t.Fatal("expected shard(3)")
+	} else if n := len(slowOpenStarted); n != 0 {
+		t.Fatalf("unexpected shard opens: %d", n+1)
+	}
+}
+
+// Ensure shards can be created while other shards are being written to.
+func TestStore_CreateShard_Stress(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	const shards, writes = 8, 50
+	var wg sync.WaitGroup
+	errC := make(chan error, shards*2)
+	for i := 0; i < shards; i++ {
+		id := uint64(i + 1)
+		wg.Add(2)
+
+		// Create the shard and write to it.
+		go func() {
+			defer wg.Done()
+			if err := s.CreateShard("db0", "rp0", id); err != nil {
+				errC <- err
+				return
+			}
+			for j := 0; j < writes; j++ {
+				line := fmt.Sprintf("cpu,host=server%d value=%d %d", id, j, j)
+				if err := s.WriteToShard(id, mustParsePoints(line)); err != nil {
+					errC <- err
+					return
+				}
+			}
+		}()
+
+		// Create the same shard concurrently.
+		go func() {
+			defer wg.Done()
+			if err := s.CreateShard("db0", "rp0", id); err != nil {
+				errC <- err
+			}
+		}()
+	}
+
+	// Read from the store while it is being changed.
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			for _, id := range s.ShardIDs() {
+				s.Shard(id)
+			}
+			s.HasMeasurement("db0", "cpu")
+		}
+	}()
+
+	wg.Wait()
+	close(done)
+	close(errC)
+	for err := range errC {
+		t.Fatal(err)
+	}
+
+	if ids := s.ShardIDs(); len(ids) != shards {
+		t.Fatalf("unexpected shards: %v", ids)
+	} else if keys, err := s.SeriesKeys("db0", "cpu"); err != nil {
+		t.Fatal(err)
+	} else if len(keys) != shards {
+		t.Fatalf("unexpected series: %v", keys)
+	}
+}
+
+// Ensure the store can create a batch of shards ahead of time.
+func TestStore_PrecreateShards(t *testing.T) {
+	s := NewStore()
+	s.EngineOptions.RecordLockStats = true
+	s.EngineOptions.DisableMaintenance = true
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.CreateShard("db0", "rp0", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	var created []uint64
+	s.OnShardCreated(func(id uint64, database, rp string) {
+		created = append(created, id)
+	})
+
+	locks := s.LockStats().Locks
+	if err := s.PrecreateShards("db0", "rp0", []uint64{1, 2, 3, 3}); err != nil {
+		t.Fatal(err)
+	} else if n := s.LockStats().Locks - locks; n != 2 {
+		t.Fatalf("unexpected lock acquisitions: %d", n)
+	} else if !reflect.DeepEqual(created, []uint64{1, 3}) {
+		t.Fatalf("unexpected created shards: %v", created)
+	} else if ids := s.ShardIDs(); len(ids) != 3 {
+		t.Fatalf("unexpected shards: %v", ids)
+	}
+	for _, id := range []string{"1", "3"} {
+		if _, err := os.Stat(filepath.Join(s.Path(), "db0", "rp0", id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.MustWriteToShardString(3, `cpu,host=serverA value=1 0`)
+	if err := s.PrecreateShards("db0", "rp0", nil); err != nil {
+		t.Fatal(err)
+	} else if err := s.PrecreateShards("", "rp0", []uint64{4}); err == nil {
+		t.Fatal("expected error for invalid database name")
+	} else if s.Shard(4) != nil {
+		t.Fatal("unexpected shard 4")
+	}
+}
+
+// Ensure the store returns the shard it creates, or the one that exists.
+func TestStore_CreateShardAndGet(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	sh, err := s.CreateShardAndGet("db0", "rp0", 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if sh == nil || sh != s.Shard(1) {
+		t.Fatalf("unexpected shard: %v", sh)
+	} else if exp := filepath.Join(s.Path(), "db0", "rp0", "1"); sh.Path() != exp {
+		t.Fatalf("unexpected path: %s, exp %s", sh.Path(), exp)
+	} else if exp := filepath.Join(s.Path(), "wal", "db0", "rp0", "1"); sh.WALPath() != exp {
+		t.Fatalf("unexpected WAL path: %s, exp %s", sh.WALPath(), exp)
+	}
+
+	if other, err := s.CreateShardAndGet("db0", "rp0", 1); err != nil {
+		t.Fatal(err)
+	} else if other != sh {
+		t.Fatal("expected the existing shard")
+	}
+
+	if sh, err := s.CreateShardAndGet("", "rp0", 2); err == nil || sh != nil {
+		t.Fatalf("unexpected result: %v, %v", sh, err)
+	}
+}
+
+// Ensure the store can wait for a shard to be created.
+func TestStore_WaitForShard(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	if err := s.CreateShard("db0", "rp0", 1); err != nil {
+		t.Fatal(err)
+	} else if sh, err := s.WaitForShard(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	} else if sh != s.Shard(1) {
+		t.Fatal("unexpected shard")
+	}
+
+	type result struct {
+		sh  *tsdb.Shard
+		err error
+	}
+	resC := make(chan result, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			sh, err := s.WaitForShard(context.Background(), 2)
+			resC <- result{sh, err}
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case res := <-resC:
+		t.Fatalf("unexpected result before the shard was created: %v, %v", res.sh, res.err)
+	default:
+	}
+
+	if err := s.CreateShard("db0", "rp0", 2); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if res := <-resC; res.err != nil {
+			t.Fatal(res.err)
+		} else if res.sh != s.Shard(2) {
+			t.Fatal("unexpected shard")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := s.WaitForShard(ctx, 3); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Waiting stops when the store is closed.
+	go func() {
+		sh, err := s.WaitForShard(context.Background(), 3)
+		resC <- result{sh, err}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := s.Store.Close(); err != nil {
+		t.Fatal(err)
+	} else if res := <-resC; res.err != tsdb.ErrStoreClosed {
+		t.Fatalf("unexpected error: %v", res.err)
+	}
+}
+
+// Ensure the store reports which databases and retention policies exist.
+func TestStore_DatabaseExists(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	if err := s.CreateShard("db0", "rp0", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.DatabaseExists("db0") {
+		t.Fatal("expected db0 to exist")
+	} else if s.DatabaseExists("db1") {
+		t.Fatal("unexpected db1")
+	} else if !s.RetentionPolicyExists("db0", "rp0") {
+		t.Fatal("expected db0.rp0 to exist")
+	} else if s.RetentionPolicyExists("db0", "rp1") || s.RetentionPolicyExists("db1", "rp0") {
+		t.Fatal("unexpected retention policy")
+	}
+
+	if _, err := s.DeleteRetentionPolicy("db0", "rp0"); err != nil {
+		t.Fatal(err)
+	} else if s.RetentionPolicyExists("db0", "rp0") {
+		t.Fatal("unexpected db0.rp0 after delete")
+	} else if ok, err := s.DeleteDatabase("db0"); err != nil || !ok {
+		t.Fatalf("unexpected result: %v, %v", ok, err)
+	} else if s.DatabaseExists("db0") {
+		t.Fatal("unexpected db0 after delete")
+	} else if ok, err := s.DeleteDatabase("db0"); err != nil || ok {
+		t.Fatalf("unexpected result deleting db0 again: %v, %v", ok, err)
+	}
+}
+
+// Ensure the store lists the retention policies that have shards.
+func TestStore_RetentionPolicies(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	for i, rp := range []string{"rp1", "rp0", "rp1"} {
+		if err := s.CreateShard("db0", rp, uint64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.CreateShard("db1", "rp2", 3); err != nil {
+		t.Fatal(err)
+	}
+
+	if rps, err := s.RetentionPolicies("db0"); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(rps, []string{"rp0", "rp1"}) {
+		t.Fatalf("unexpected retention policies: %v", rps)
+	} else if rps, err := s.RetentionPolicies("no_db"); err != nil {
+		t.Fatal(err)
+	} else if rps == nil || len(rps) != 0 {
+		t.Fatalf("unexpected retention policies: %#v", rps)
+	}
+
+	if _, err := s.DeleteRetentionPolicy("db0", "rp0"); err != nil {
+		t.Fatal(err)
+	} else if rps, err := s.RetentionPolicies("db0"); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(rps, []string{"rp1"}) {
+		t.Fatalf("unexpected retention policies after delete: %v", rps)
+	}
+}
+
+// Ensure the store lists the shards of a database and retention policy.
+func TestStore_ShardIDsByDatabase(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	for _, sh := range []struct {
+		db, rp string
+		id     uint64
+	}{
+		{"db0", "rp1", 4}, {"db0", "rp0", 2}, {"db1", "rp0", 3}, {"db0", "rp1", 1},
+	} {
+		if err := s.CreateShard(sh.db, sh.rp, sh.id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if ids := s.ShardIDsByDatabase("db0"); !reflect.DeepEqual(ids, []uint64{1, 2, 4}) {
+		t.Fatalf("unexpected shards: %v", ids)
+	} else if ids := s.ShardIDsByRetentionPolicy("db0", "rp1"); !reflect.DeepEqual(ids, []uint64{1, 4}) {
+		t.Fatalf("unexpected shards: %v", ids)
+	} else if ids := s.ShardIDsByRetentionPolicy("db1", "rp1"); ids == nil || len(ids) != 0 {
+		t.Fatalf("unexpected shards: %#v", ids)
+	} else if ids := s.ShardIDsByDatabase("no_db"); ids == nil || len(ids) != 0 {
+		t.Fatalf("unexpected shards: %#v", ids)
+	}
+}
+
+// Ensure the store reports which measurements and series exist.
+func TestStore_HasMeasurement(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 0`)
+
+	if !s.HasMeasurement("db0", "cpu") {
+		t.Fatal("expected measurement cpu")
+	} else if s.HasMeasurement("db0", "mem") || s.HasMeasurement("db1", "cpu") {
+		t.Fatal("unexpected measurement")
+	} else if !s.HasSeries("db0", "cpu,host=serverA") {
+		t.Fatal("expected series")
+	} else if s.HasSeries("db0", "cpu,host=serverB") || s.HasSeries("db1", "cpu,host=serverA") {
+		t.Fatal("unexpected series")
+	}
+}
+
+// Ensure the store finds measurements by tag value.
+func TestStore_MeasurementsByTagFilter(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1,
+		`cpu,host=serverA,region=west value=1 0`,
+		`mem,host=serverA value=2 0`,
+		`mem,host=serverB value=3 0`,
+		`disk,region=west value=4 0`,
+	)
+
+	names := func(a tsdb.Measurements) []string {
+		names := []string{}
+		for _, m := range a {
+			names = append(names, m.Name)
+		}
+		return names
+	}
+
+	for _, tt := range []struct {
+		key, value string
+		exp        []string
+	}{
+		{key: "host", value: "serverA", exp: []string{"cpu", "mem"}},
+		{key: "host", value: "serverB", exp: []string{"mem"}},
+		{key: "region", value: "west", exp: []string{"cpu", "disk"}},
+		{key: "region", value: "east", exp: []string{}},
+		{key: "zone", value: "west", exp: []string{}},
+	} {
+		if a, err := s.MeasurementsByTagFilter("db0", tt.key, tt.value); err != nil {
+			t.Fatal(err)
+		} else if got := names(a); !reflect.DeepEqual(got, tt.exp) {
+			t.Fatalf("%s=%s: unexpected measurements: %v", tt.key, tt.value, got)
+		}
+	}
+
+	if a, err := s.MeasurementsByTagFilter("db1", "host", "serverA"); err != nil || len(a) != 0 {
+		t.Fatalf("unexpected result: %v, %v", a, err)
+	}
+}
+
+// Ensure the store stops waiting for shards that don't close in time.
+func TestStore_CloseWithTimeout(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	opts := s.EngineOptions
+	opts.EngineVersion = "tsm1-blocking"
+	if err := s.CreateShardWithOptions("db0", "rp0", 1, opts); err != nil {
+		t.Fatal(err)
+	}
+	defer close(blockingEngineRelease)
+
+	start := time.Now()
+	if err := s.CloseWithTimeout(100 * time.Millisecond); err != tsdb.ErrStoreCloseTimeout {
+		t.Fatalf("unexpected error: %v", err)
+	} else if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("close took too long: %s", elapsed)
+	}
+}
+
+// Ensure the store closes at most OpenLimit shards at once.
+func TestStore_Close_OpenLimit(t *testing.T) {
+	s := NewStore()
+	s.EngineOptions.OpenLimit = 2
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	opts := s.EngineOptions
+	opts.EngineVersion = "tsm1-countclose"
+	for id := uint64(1); id <= 6; id++ {
+		if err := s.CreateShardWithOptions("db0", "rp0", id, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Store.Close(); err != nil {
+		t.Fatal(err)
+	} else if n := atomic.LoadInt64(&closingEngines.max); n != 2 {
+		t.Fatalf("unexpected concurrent closes: %d", n)
+	}
+}
+
+// Ensure maintenance snapshots idle shards unless it is disabled.
+func TestStore_Maintenance(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	reopen := func(disable bool) {
+		if err := s.Store.Close(); err != nil {
+			t.Fatal(err)
+		}
+		s.Store = tsdb.NewStore(s.Path())
+		s.EngineOptions.Config.WALDir = filepath.Join(s.Path(), "wal")
+		s.EngineOptions.MaintenanceInterval = 10 * time.Millisecond
+		s.EngineOptions.DisableMaintenance = disable
+		if err := s.Open(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tsmFiles := func(id int) []string {
+		files, err := filepath.Glob(filepath.Join(s.Path(), "db0", "rp0", strconv.Itoa(id), "*.tsm"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return files
+	}
+
+	reopen(true)
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 0`)
+	time.Sleep(100 * time.Millisecond)
+	if files := tsmFiles(1); len(files) != 0 {
+		t.Fatalf("unexpected TSM files with maintenance disabled: %v", files)
+	}
+
+	reopen(false)
+	s.MustCreateShardWithData("db0", "rp0", 2, `cpu,host=serverB value=2 0`)
+	for start := time.Now(); len(tsmFiles(2)) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("timed out waiting for idle shard snapshot")
+		}
+	}
+
+	// Shard 1 was not written to since the store was opened.
+	if files := tsmFiles(1); len(files) != 0 {
+		t.Fatalf("unexpected TSM files for shard 1: %v", files)
+	}
+}
+
+// Ensure the store records lock stats only when asked to.
+func TestStore_LockStats(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 0`)
+	if stats := s.LockStats(); stats != (tsdb.LockStats{}) {
+		t.Fatalf("unexpected lock stats with recording disabled: %+v", stats)
+	}
+
+	if err := s.Store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s.Store = tsdb.NewStore(s.Path())
+	s.EngineOptions.Config.WALDir = filepath.Join(s.Path(), "wal")
+	s.EngineOptions.RecordLockStats = true
+	s.EngineOptions.DisableMaintenance = true
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	before := s.LockStats()
+	if before.Locks == 0 || before.LockHold.Total() != before.Locks {
+		t.Fatalf("unexpected lock stats after open: %+v", before)
+	}
+
+	s.MustWriteToShardString(1, `cpu,host=serverA value=2 10`)
+	if s.Shard(1) == nil {
+		t.Fatal("expected shard 1")
+	}
+	if err := s.CreateShard("db0", "rp0", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := s.LockStats()
+	if stats.RLocks <= before.RLocks {
+		t.Fatalf("read locks not recorded: before %d, after %d", before.RLocks, stats.RLocks)
+	} else if stats.Locks <= before.Locks {
+		t.Fatalf("write locks not recorded: before %d, after %d", before.Locks, stats.Locks)
+	} else if got := stats.RLockWait.Total(); got != stats.RLocks {
+		t.Fatalf("read lock wait histogram has %d entries, want %d", got, stats.RLocks)
+	} else if got := stats.LockWait.Total(); got != stats.Locks {
+		t.Fatalf("write lock wait histogram has %d entries, want %d", got, stats.Locks)
+	} else if got := stats.LockHold.Total(); got != stats.Locks {
+		t.Fatalf("write lock hold histogram has %d entries, want %d", got, stats.Locks)
+	}
+}
+
+// Ensure the store can create an empty database.
+func TestStore_CreateDatabase(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	if err := s.CreateDatabase("db0"); err != nil {
+		t.Fatal(err)
+	} else if !s.DatabaseExists("db0") {
+		t.Fatal("expected database to exist")
+	} else if _, err := os.Stat(filepath.Join(s.Path(), "db0")); err != nil {
+		t.Fatal(err)
+	} else if err := s.CreateDatabase("db0"); !errors.Is(err, tsdb.ErrDatabaseExists) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A database created by its first shard exists too.
+	if err := s.CreateShard("db1", "rp0", 1); err != nil {
+		t.Fatal(err)
+	} else if err := s.CreateDatabase("db1"); !errors.Is(err, tsdb.ErrDatabaseExists) {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := s.CreateDatabase("db/2"); err == nil {
+		t.Fatal("expected error for invalid name")
+	}
+
+	// The empty database is loaded when the store is reopened, and shards
+	// can be added to it.
+	if err := s.Reopen(); err != nil {
+		t.Fatal(err)
+	} else if !s.DatabaseExists("db0") {
+		t.Fatal("expected database to exist after reopen")
+	} else if err := s.CreateShard("db0", "rp0", 2); err != nil {
+		t.Fatal(err)
+	} else if sh := s.Shard(2); sh == nil || sh.Database() != "db0" {
+		t.Fatal("expected shard in database")
+	}
+}
+
+// Ensure the store can rename a database and keep its data.
+func TestStore_RenameDatabase(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 0`)
+	s.MustCreateShardWithData("db2", "rp0", 2, `mem,host=serverA value=1 0`)
+
+	// Renaming onto an existing database fails and leaves both untouched.
+	if err := s.RenameDatabase("db0", "db2"); err == nil {
+		t.Fatal("expected error")
+	} else if names, err := s.MeasurementNames("db0", nil); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(names, []string{"cpu"}) {
+		t.Fatalf("unexpected measurements: %v", names)
+	}
+
+	if err := s.RenameDatabase("db0", "db1"); err != nil {
+		t.Fatal(err)
+	} else if s.DatabaseIndex("db0") != nil {
+		t.Fatal("expected old database index to be removed")
+	} else if _, err := os.Stat(filepath.Join(s.Path(), "db0")); !os.IsNotExist(err) {
+		t.Fatalf("expected old data dir to be removed: %v", err)
+	} else if _, err := os.Stat(filepath.Join(s.EngineOptions.Config.WALDir, "db1", "rp0", "1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The shard and its data are available under the new name, also after
+	// a reopen.
+	for i := 0; i < 2; i++ {
+		if sh := s.Shard(1); sh == nil {
+			t.Fatal("expected shard")
+		} else if names, err := s.MeasurementNames("db1", nil); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(names, []string{"cpu"}) {
+			t.Fatalf("unexpected measurements: %v", names)
+		}
+		if err := s.Reopen(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.RenameDatabase("no_db", "db3"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// Ensure the store can move a shard to another retention policy.
+func TestStore_MoveShard(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 0`, `mem,host=serverA value=1 0`)
+	s.MustCreateShardWithData("db0", "rp0", 3, `cpu,host=serverB value=2 0`)
+	oldPath := filepath.Join(s.Path(), "db0", "rp0", "1")
+
+	// A dry run validates the move without touching the shard.
+	if err := s.MoveShardDryRun(1, "db1", "rp1"); err != nil {
+		t.Fatal(err)
+	} else if _, err := os.Stat(oldPath); err != nil {
+		t.Fatal(err)
+	} else if s.DatabaseIndex("db1") != nil {
+		t.Fatal("unexpected database index")
+	}
+
+	// Existing destination directories are never overwritten.
+	if err := os.MkdirAll(filepath.Join(s.Path(), "db2", "rp0", "1"), 0700); err != nil {
+		t.Fatal(err)
+	} else if err := s.MoveShardDryRun(1, "db2", "rp0"); err == nil {
+		t.Fatal("expected error")
+	} else if err := s.MoveShard(1, "db2", "rp0"); err == nil {
+		t.Fatal("expected error")
+	} else if s.Shard(1) == nil {
+		t.Fatal("expected shard")
+	}
+
+	if err := s.MoveShard(1, "db1", "rp1"); err != nil {
+		t.Fatal(err)
+	} else if _, err := os.Stat(oldPath); !os.IsNotExist(err) {
+		t.Fatalf("expected old data dir to be removed: %v", err)
+	}
+
+	// The shard and its data are available at the new location, also after a
+	// reopen.
+	for i := 0; i < 2; i++ {
+		if sh := s.Shard(1); sh == nil {
+			t.Fatal("expected shard")
+		} else if ids := s.ShardIDs(); len(ids) != 2 {
+			t.Fatalf("unexpected shards: %v", ids)
+		} else if names, err := s.MeasurementNames("db1", nil); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(names, []string{"cpu", "mem"}) {
+			t.Fatalf("unexpected measurements: %v", names)
+		}
+
+		// The moved series are no longer in the old database's index.
+		if names, err := s.MeasurementNames("db0", nil); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(names, []string{"cpu"}) {
+			t.Fatalf("unexpected measurements in db0: %v", names)
+		} else if db := s.DatabaseIndex("db0"); db.Series("cpu,host=serverA") != nil || db.Series("mem,host=serverA") != nil {
+			t.Fatal("unexpected moved series in db0")
+		} else if db.Series("cpu,host=serverB") == nil {
+			t.Fatal("expected series of shard 3 in db0")
+		}
+		if err := s.Reopen(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.MoveShard(2, "db1", "rp1"); err != tsdb.ErrShardNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure shards can keep their WAL inside their data directory.
+func TestStore_WALInline(t *testing.T) {
+	s := NewStore()
+	s.EngineOptions.WALInline = true
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 10`)
+	s.MustCreateShardWithData("db0", "rp1", 2, `cpu,host=serverA value=2 20`)
+	path := filepath.Join(s.Path(), "db0", "rp0", "1")
+	if sh := s.Shard(1); sh.Path() != path || sh.WALPath() != filepath.Join(path, "wal") {
+		t.Fatalf("unexpected shard paths: %s, %s", sh.Path(), sh.WALPath())
+	} else if _, err := os.Stat(filepath.Join(s.EngineOptions.Config.WALDir, "db0")); !os.IsNotExist(err) {
+		t.Fatalf("expected no separate WAL directory: %v", err)
+	}
+
+	export := func(id uint64) string {
+		t.Helper()
+		var buf bytes.Buffer
+		if err := s.ExportShard(id, &buf, math.MinInt64, math.MaxInt64); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	// Existing shards keep their layout when the option is turned off, and
+	// their WAL is reloaded.
+	if err := s.Reopen(); err != nil {
+		t.Fatal(err)
+	} else if sh := s.Shard(1); sh.WALPath() != filepath.Join(path, "wal") {
+		t.Fatalf("unexpected WAL path after reopen: %s", sh.WALPath())
+	} else if got, exp := export(1), "cpu,host=serverA value=1 10000000000\n"; got != exp {
+		t.Fatalf("unexpected export after reopen: %s", got)
+	}
+	if err := s.CreateShard("db0", "rp0", 3); err != nil {
+		t.Fatal(err)
+	} else if sh := s.Shard(3); sh.WALPath() != filepath.Join(s.EngineOptions.Config.WALDir, "db0", "rp0", "3") {
+		t.Fatalf("unexpected WAL path of new shard: %s", sh.WALPath())
+	}
+
+	// The WAL moves with the shard.
+	if err := s.MoveShard(1, "db1", "rp0"); err != nil {
+		t.Fatal(err)
+	}
+	path = filepath.Join(s.Path(), "db1", "rp0", "1")
+	if sh := s.Shard(1); sh.WALPath() != filepath.Join(path, "wal") {
+		t.Fatalf("unexpected WAL path after move: %s", sh.WALPath())
+	} else if got, exp := export(1), "cpu,host=serverA value=1 10000000000\n"; got != exp {
+		t.Fatalf("unexpected export after move: %s", got)
+	}
+
+	// Merging keeps the WAL inline.
+	s.EngineOptions.WALInline = true
+	s.MustCreateShardWithData("db1", "rp0", 4, `cpu,host=serverA value=4 40`)
+	if err := s.MergeShards(1, []uint64{4}); err != nil {
+		t.Fatal(err)
+	} else if sh := s.Shard(1); sh.WALPath() != filepath.Join(path, "wal") {
+		t.Fatalf("unexpected WAL path after merge: %s", sh.WALPath())
+	} else if got, exp := export(1), "cpu,host=serverA value=1 10000000000\ncpu,host=serverA value=4 40000000000\n"; got != exp {
+		t.Fatalf("unexpected export after merge: %s", got)
+	} else if _, err := os.Stat(path + ".old"); !os.IsNotExist(err) {
+		t.Fatalf("expected old shard directory to be removed: %v", err)
+	}
+
+	if ok, err := s.DeleteRetentionPolicy("db0", "rp1"); err != nil || !ok {
+		t.Fatalf("unexpected result: %v, %v", ok, err)
+	} else if _, err := os.Stat(filepath.Join(s.Path(), "db0", "rp1")); !os.IsNotExist(err) {
+		t.Fatalf("expected retention policy directory to be removed: %v", err)
+	}
+	if ok, err := s.DeleteShard(1); err != nil || !ok {
+		t.Fatalf("unexpected result: %v, %v", ok, err)
+	} else if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected shard directory to be removed: %v", err)
+	}
+}
+
+// Ensure the store can rename a measurement and merge it into an existing one.
+func TestStore_RenameMeasurement(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1,
+		`cpu,host=serverA value=1 0`,
+		`mem,host=serverA value=2 10`,
+		`mem,host=serverB value=3 20`,
+		`disk,host=serverA value=4 0`,
+	)
+	if err := s.FlushWAL(1); err != nil {
+		t.Fatal(err)
+	}
+	// Shard 2 only holds the measurement in its cache.
+	s.MustCreateShardWithData("db0", "rp0", 2, `cpu,host=serverC value=5 30`)
+
+	if err := s.RenameMeasurement("db0", "cpu", "mem"); err != nil {
+		t.Fatal(err)
+	} else if names, err := s.MeasurementNames("db0", nil); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(names, []string{"disk", "mem"}) {
+		t.Fatalf("unexpected measurement names: %v", names)
+	}
+
+	ics := influxql.IteratorCreators{s.Shard(1), s.Shard(2)}
+	itr, err := ics.CreateIterator(influxql.IteratorOptions{
+		Expr:       influxql.MustParseExpr(`value`),
+		Dimensions: []string{"host"},
+		Sources:    []influxql.Source{&influxql.Measurement{Name: "mem"}},
+		Ascending:  true,
+		StartTime:  influxql.MinTime,
+		EndTime:    influxql.MaxTime,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer itr.Close()
+	fitr := itr.(influxql.FloatIterator)
+
+	for i, exp := range []*influxql.FloatPoint{
+		{Name: "mem", Tags: ParseTags("host=serverA"), Time: time.Unix(0, 0).UnixNano(), Value: 1},
+		{Name: "mem", Tags: ParseTags("host=serverA"), Time: time.Unix(10, 0).UnixNano(), Value: 2},
+		{Name: "mem", Tags: ParseTags("host=serverB"), Time: time.Unix(20, 0).UnixNano(), Value: 3},
+		{Name: "mem", Tags: ParseTags("host=serverC"), Time: time.Unix(30, 0).UnixNano(), Value: 5},
+	} {
+		if p := fitr.Next(); !deep.Equal(p, exp) {
+			t.Fatalf("unexpected point(%d): %s", i, spew.Sdump(p))
+		}
+	}
+	if p := fitr.Next(); p != nil {
+		t.Fatalf("expected eof, got: %s", spew.Sdump(p))
+	}
+
+	// Fields of the same name must have the same type.
+	s.MustWriteToShardString(1, `cpu,host=serverA value=1i 40`)
+	if err := s.RenameMeasurement("db0", "cpu", "mem"); err == nil || !strings.Contains(err.Error(), "field type conflict") {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := s.RenameMeasurement("db0", "no_measurement", "mem"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// Ensure a failed rename leaves the measurement under its old name in every
+// shard.
+func TestStore_RenameMeasurement_Failed(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 0`)
+	if err := s.FlushWAL(1); err != nil {
+		t.Fatal(err)
+	}
+	opts := s.EngineOptions
+	opts.EngineVersion = "tsm1-failrename"
+	if err := s.CreateShardWithOptions("db0", "rp0", 2, opts); err != nil {
+		t.Fatal(err)
+	}
+	s.MustWriteToShardString(2, `cpu,host=serverB value=2 0`)
+
+	if err := s.RenameMeasurement("db0", "cpu", "mem"); err == nil || !strings.Contains(err.Error(), "rename failed") {
+		t.Fatalf("unexpected error: %v", err)
+	} else if names, err := s.MeasurementNames("db0", nil); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(names, []string{"cpu"}) {
+		t.Fatalf("unexpected measurement names: %v", names)
+	}
+
+	var buf bytes.Buffer
+	if err := s.ExportShard(1, &buf, math.MinInt64, math.MaxInt64); err != nil {
+		t.Fatal(err)
+	} else if got := buf.String(); got != "cpu,host=serverA value=1 0\n" {
+		t.Fatalf("unexpected export of shard 1: %s", got)
+	} else if tmp, err := filepath.Glob(filepath.Join(s.Shard(1).Path(), "*.tmp")); err != nil || len(tmp) != 0 {
+		t.Fatalf("unexpected temporary files: %v, %v", tmp, err)
+	}
+
+	// Writes to the shards are not blocked by the aborted rename.
+	s.MustWriteToShardString(1, `cpu,host=serverA value=3 10`)
+}
+
+// Ensure the store renames measurements with escaped characters in their name.
+func TestStore_RenameMeasurement_Escaped(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1,
+		`cpu\,x,host=serverA value=1 0`,
+		`cpu,host=serverB value=2 0`,
+	)
+	if err := s.FlushWAL(1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.RenameMeasurement("db0", "cpu,x", "mem"); err != nil {
+		t.Fatal(err)
+	} else if names, err := s.MeasurementNames("db0", nil); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(names, []string{"cpu", "mem"}) {
+		t.Fatalf("unexpected measurement names: %v", names)
+	}
+
+	var buf bytes.Buffer
+	if err := s.ExportShard(1, &buf, math.MinInt64, math.MaxInt64); err != nil {
+		t.Fatal(err)
+	} else if got, exp := buf.String(), "cpu,host=serverB value=2 0\nmem,host=serverA value=1 0\n"; got != exp {
+		t.Fatalf("unexpected export: %s", got)
+	}
+}
+
+// Ensure the store can rebuild a database index from the shards' data.
+func TestStore_RebuildIndex(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 0`)
+	s.MustCreateShardWithData("db0", "rp1", 2, `cpu,host=serverB value=2 0`, `mem,host=serverB value=3 0`)
+
+	// Drop series from the index without deleting their data.
+	s.DatabaseIndex("db0").DropSeries([]string{"cpu,host=serverA", "mem,host=serverB"})
+	if s.HasSeries("db0", "cpu,host=serverA") {
+		t.Fatal("unexpected series")
+	}
+
+	if err := s.RebuildIndex("db0"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"cpu,host=serverA", "cpu,host=serverB", "mem,host=serverB"} {
+		if !s.HasSeries("db0", key) {
+			t.Fatalf("expected series %s", key)
+		}
+	}
+	if n, err := s.SeriesCardinality("db0"); err != nil {
+		t.Fatal(err)
+	} else if n != 3 {
+		t.Fatalf("unexpected series cardinality: %d", n)
+	}
+
+	// Writes use the new index.
+	s.MustWriteToShardString(1, `disk,host=serverA value=4 10`)
+	if !s.HasMeasurement("db0", "disk") {
+		t.Fatal("expected measurement disk")
+	}
+
+	if err := s.RebuildIndex("db1"); err == nil || err.Error() != "database not found: db1" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure the store rejects database and retention policy names that would
+// escape the store directory.
+func TestStore_CreateShard_InvalidName(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	for _, tt := range []struct {
+		database, rp string
+	}{
+		{"../../etc", "rp0"},
+		{"db0", "../../etc"},
+		{"db0", "rp0/../.."},
+		{"db0/rp0", "rp0"},
+		{"..", "rp0"},
+		{"", "rp0"},
+		{"db0", ""},
+	} {
+		if err := s.CreateShard(tt.database, tt.rp, 1); err == nil {
+			t.Fatalf("CreateShard(%q, %q): expected error", tt.database, tt.rp)
+		} else if _, err := s.DeleteRetentionPolicy(tt.database, tt.rp); err == nil {
+			t.Fatalf("DeleteRetentionPolicy(%q, %q): expected error", tt.database, tt.rp)
+		}
+	}
+
+	for _, name := range []string{"", "..", "../../etc", "db0/rp0"} {
+		if _, err := s.DeleteDatabase(name); err == nil {
+			t.Fatalf("DeleteDatabase(%q): expected error", name)
+		}
+	}
+
+	if s.Shard(1) != nil {
+		t.Fatal("unexpected shard")
+	} else if fis, err := ioutil.ReadDir(s.Path()); err != nil {
+		t.Fatal(err)
+	} else if len(fis) != 0 {
+		t.Fatalf("unexpected files in store: %v", fis)
+	}
+}
+
+// Ensure a measurement stays in the index until it is deleted from every shard.
+func TestStore_DeleteMeasurement_ShardError(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 0`)
+
+	opts := s.EngineOptions
+	opts.EngineVersion = "tsm1-faildelete"
+	if err := s.CreateShardWithOptions("db0", "rp0", 2, opts); err != nil {
+		t.Fatal(err)
+	}
+	s.MustWriteToShardString(2, `cpu,host=serverB value=2 0`)
+
+	if err := s.DeleteMeasurement("db0", "cpu"); err == nil {
+		t.Fatal("expected error")
+	} else if !strings.Contains(err.Error(), "[shard 2]") || strings.Contains(err.Error(), "[shard 1]") {
+		t.Fatalf("unexpected error: %s", err)
+	} else if s.DatabaseIndex("db0").Measurement("cpu") == nil {
+		t.Fatal("expected measurement to remain in the index")
+	}
+}
+
+// Ensure the store can drop a field from a measurement and keeps its other
+// fields.
+func TestStore_DropField(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1,
+		`cpu,host=serverA value=1,bad=2 10`,
+		`cpu,host=serverB bad=3 10`,
+		`mem,host=serverA bad=4 10`,
+	)
+	s.MustCreateShardWithData("db0", "rp0", 2,
+		`cpu,host=serverA value=5 20`,
+		`cpu,host=serverC bad=6 20`,
+	)
+
+	// Shard 1 is dropped from through its TSM files and shard 2 through its
+	// cache.
+	if err := s.FlushWAL(1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.DropField("db0", "cpu", "bad"); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		t.Helper()
+		var buf bytes.Buffer
+		if err := s.ExportShard(1, &buf, math.MinInt64, math.MaxInt64); err != nil {
+			t.Fatal(err)
+		} else if exp := "cpu,host=serverA value=1 10000000000\n" +
+			"mem,host=serverA bad=4 10000000000\n"; buf.String() != exp {
+			t.Fatalf("unexpected export:\n%s\nexp:\n%s", buf.String(), exp)
+		}
+		buf.Reset()
+		if err := s.ExportShard(2, &buf, math.MinInt64, math.MaxInt64); err != nil {
+			t.Fatal(err)
+		} else if exp := "cpu,host=serverA value=5 20000000000\n"; buf.String() != exp {
+			t.Fatalf("unexpected export:\n%s\nexp:\n%s", buf.String(), exp)
+		}
+
+		if m := s.Measurement("db0", "cpu"); m == nil || m.HasField("bad") || !m.HasField("value") {
+			t.Fatal("unexpected cpu fields")
+		} else if m := s.Measurement("db0", "mem"); m == nil || !m.HasField("bad") {
+			t.Fatal("unexpected mem fields")
+		} else if !s.HasSeries("db0", "cpu,host=serverA") {
+			t.Fatal("expected series with other fields to remain")
+		} else if s.HasSeries("db0", "cpu,host=serverB") || s.HasSeries("db0", "cpu,host=serverC") {
+			t.Fatal("expected series with only the field to be dropped")
+		}
+	}
+	check()
+	if err := s.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	check()
+
+	// The field can be written again with another type.
+	s.MustWriteToShardString(2, `cpu,host=serverA bad="fixed" 30`)
+
+	if err := s.DropField("db0", "cpu", "missing"); err != tsdb.ErrFieldNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := s.DropField("db0", "disk", "bad"); err == nil {
+		t.Fatal("expected error for a missing measurement")
+	} else if err := s.DropField("no_db", "cpu", "bad"); err == nil {
+		t.Fatal("expected error for a missing database")
+	}
+
+	// A measurement without series left is dropped.
+	if err := s.DropField("db0", "mem", "bad"); err != nil {
+		t.Fatal(err)
+	} else if s.Measurement("db0", "mem") != nil {
+		t.Fatal("expected measurement to be dropped")
+	}
+}
+
+// Ensure a field is not dropped while a shard is closed, and that shards
+// closed because of MaxOpenShards are opened to drop it.
+func TestStore_DropField_ClosedShard(t *testing.T) {
+	s := NewStore()
+	s.EngineOptions.MaxOpenShards = 2
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for id := 1; id <= 3; id++ {
+		s.MustCreateShardWithData("db0", "rp0", id, fmt.Sprintf(`cpu,host=server%d value=1,bad=1i %d`, id, id))
+	}
+	export := func(id uint64) string {
+		var buf bytes.Buffer
+		if err := s.ExportShard(id, &buf, math.MinInt64, math.MaxInt64); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	if err := s.CloseShard(3); err != nil {
+		t.Fatal(err)
+	} else if err := s.DropField("db0", "cpu", "bad"); err == nil {
+		t.Fatal("expected error")
+	} else if m := s.Measurement("db0", "cpu"); !m.HasField("bad") {
+		t.Fatal("expected field to remain")
+	} else if got := export(2); !strings.Contains(got, "bad=1i") {
+		t.Fatalf("unexpected export of shard 2: %s", got)
+	}
+
+	// Shard 1 was closed when shard 3 was created.
+	if err := s.OpenShard(3); err != nil {
+		t.Fatal(err)
+	} else if ids := s.OpenShardIDs(); !reflect.DeepEqual(ids, []uint64{2, 3}) {
+		t.Fatalf("unexpected open shards: %v", ids)
+	} else if err := s.DropField("db0", "cpu", "bad"); err != nil {
+		t.Fatal(err)
+	} else if m := s.Measurement("db0", "cpu"); m.HasField("bad") {
+		t.Fatal("expected field to be dropped")
+	} else if ids := s.OpenShardIDs(); len(ids) != 2 {
+		t.Fatalf("unexpected open shards: %v", ids)
+	}
+	for id := uint64(1); id <= 3; id++ {
+		if got, exp := export(id), fmt.Sprintf("cpu,host=server%d value=1 %d000000000\n", id, id); got != exp {
+			t.Fatalf("unexpected export of shard %d: %s", id, got)
+		}
+	}
+}
+
+// Ensure the store deletes every shard it can and keeps the database when a
+// shard fails to close.
+func TestStore_DeleteDatabase_ShardError(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 0`)
+
+	opts := s.EngineOptions
+	opts.EngineVersion = "tsm1-failclose"
+	if err := s.CreateShardWithOptions("db0", "rp0", 2, opts); err != nil {
+		t.Fatal(err)
+	}
+	s.MustCreateShardWithData("db0", "rp0", 3, `cpu,host=serverB value=2 0`)
+
+	if _, err := s.DeleteDatabase("db0"); err == nil {
+		t.Fatal("expected error")
+	} else if !strings.Contains(err.Error(), "shards 2 remain") || !strings.Contains(err.Error(), "[shard 2] close failed") {
+		t.Fatalf("unexpected error: %s", err)
+	} else if s.Shard(1) != nil || s.Shard(3) != nil {
+		t.Fatal("expected shards 1 and 3 to be deleted")
+	} else if s.Shard(2) == nil {
+		t.Fatal("expected shard 2 to remain")
+	} else if s.DatabaseIndex("db0") == nil {
+		t.Fatal("expected database index to remain")
+	} else if _, err := os.Stat(filepath.Join(s.Path(), "db0", "rp0", "2")); err != nil {
+		t.Fatalf("expected shard 2 directory to remain: %v", err)
+	}
+}
+
+// Ensure the store can delete an existing shard.
+func TestStore_DeleteShard(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	// Create a new shard and verify that it exists.
+	if err := s.CreateShard("db0", "rp0", 1); err != nil {
+		t.Fatal(err)
+	} else if sh := s.Shard(1); sh == nil {
+		t.Fatalf("expected shard")
+	}
+
+	// Reopen shard and recheck.
+	if err := s.Reopen(); err != nil {
+		t.Fatal(err)
+	} else if sh := s.Shard(1); sh == nil {
+		t.Fatalf("shard exists")
+	}
+}
+
+// Ensure a shard backup can be restored into another store.
+func TestStore_BackupRestoreShard(t *testing.T) {
+	s0, s1 := MustOpenStore(), MustOpenStore()
+	defer s0.Close()
+	defer s1.Close()
+
+	s0.MustCreateShardWithData("db0", "rp0", 100,
+		`cpu,host=serverA value=1 0`,
+		`cpu,host=serverB value=2 10`,
+	)
+
+	// Backup shard to a buffer.
+	var buf bytes.Buffer
+	if err := s0.BackupShard(100, time.Time{}, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var created []uint64
+	s1.OnShardCreated(func(id uint64, database, rp string) { created = append(created, id) })
+
+	// Restore the shard to the other store.
+	if err := s1.RestoreShard(100, bytes.NewReader(buf.Bytes()), false); err != nil {
+		t.Fatal(err)
+	} else if sh := s1.Shard(100); sh == nil {
+		t.Fatal("expected shard")
+	} else if m := s1.Measurement("db0", "cpu"); m == nil {
+		t.Fatal("expected measurement")
+	} else if got, exp := len(m.SeriesKeys()), 2; got != exp {
+		t.Fatalf("unexpected series count: got %d, exp %d", got, exp)
+	}
+
+	if !reflect.DeepEqual(created, []uint64{100}) {
+		t.Fatalf("unexpected created shards: %v", created)
+	}
+
+	// Restoring over an open shard requires force, and replaces the data
+	// written since the backup, whether in TSM files or in the WAL.
+	export := func(s *Store) string {
+		var out bytes.Buffer
+		if err := s.ExportShard(100, &out, math.MinInt64, math.MaxInt64); err != nil {
+			t.Fatal(err)
+		}
+		return out.String()
+	}
+	s1.MustWriteToShardString(100, `cpu,host=serverC value=3 20`)
+	if err := s1.FlushWAL(100); err != nil {
+		t.Fatal(err)
+	}
+	s1.MustWriteToShardString(100, `cpu,host=serverD value=4 30`)
+	if err := s1.RestoreShard(100, bytes.NewReader(buf.Bytes()), false); err == nil {
+		t.Fatal("expected error")
+	} else if err := s1.RestoreShard(100, bytes.NewReader(buf.Bytes()), true); err != nil {
+		t.Fatal(err)
+	} else if got, exp := export(s1), export(s0); got != exp {
+		t.Fatalf("unexpected restored data:\n%s\nexp:\n%s", got, exp)
+	} else if len(created) != 1 {
+		t.Fatalf("unexpected created shards: %v", created)
+	}
+
+	// Restored shard should survive a reopen.
+	if err := s1.Reopen(); err != nil {
+		t.Fatal(err)
+	} else if sh := s1.Shard(100); sh == nil {
+		t.Fatal("expected shard after reopen")
+	} else if got, exp := export(s1), export(s0); got != exp {
+		t.Fatalf("unexpected data after reopen:\n%s\nexp:\n%s", got, exp)
+	}
+}
+
+// Ensure a failed restore leaves no files behind and that archives naming
+// invalid or excluded databases are refused.
+func TestStore_RestoreShard_Invalid(t *testing.T) {
+	s0, s1 := MustOpenStore(), MustOpenStore()
+	defer s0.Close()
+	defer s1.Close()
+
+	s0.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 0`)
+	var buf bytes.Buffer
+	if err := s0.BackupShard(1, time.Time{}, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// rewrite copies the archive, renaming its entries with fn and adding
+	// the extra entries.
+	rewrite := func(fn func(name string) string, extra ...string) []byte {
+		var out bytes.Buffer
+		tw := tar.NewWriter(&out)
+		tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			hdr.Name = fn(hdr.Name)
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			} else if _, err := io.Copy(tw, tr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, name := range extra {
+			if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return out.Bytes()
+	}
+	same := func(name string) string { return name }
+
+	if err := s1.RestoreShard(1, bytes.NewReader(rewrite(same, "db0/rp0/2/000000001-000000001.tsm")), false); err == nil {
+		t.Fatal("expected error")
+	} else if matches, err := filepath.Glob(filepath.Join(s1.Path(), "db0", "rp0", "1", "*")); err != nil {
+		t.Fatal(err)
+	} else if len(matches) != 0 {
+		t.Fatalf("unexpected files left behind: %v", matches)
+	} else if s1.Shard(1) != nil {
+		t.Fatal("unexpected shard")
+	}
+
+	invalid := func(name string) string { return strings.Replace(name, "db0/", "db..0/", 1) }
+	if err := s1.RestoreShard(1, bytes.NewReader(rewrite(invalid)), false); err == nil || !strings.Contains(err.Error(), "invalid database name") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	s2 := NewStore()
+	s2.EngineOptions.DatabaseFilter = []string{"db1"}
+	if err := s2.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	if err := s2.RestoreShard(1, bytes.NewReader(buf.Bytes()), false); err == nil {
+		t.Fatal("expected error")
+	} else if _, err := os.Stat(filepath.Join(s2.Path(), "db0")); !os.IsNotExist(err) {
+		t.Fatalf("unexpected database directory: %v", err)
+	}
+}
+
+// Ensure incremental shard backups only contain files changed since the
+// previous backup and can be restored in order.
+func TestStore_BackupShardIncremental(t *testing.T) {
+	s0, s1 := MustOpenStore(), MustOpenStore()
+	defer s0.Close()
+	defer s1.Close()
+
+	s0.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 0`)
+
+	var full bytes.Buffer
+	manifest, err := s0.BackupShardIncremental(1, nil, &full)
+	if err != nil {
+		t.Fatal(err)
+	} else if names := mustArchiveNames(full.Bytes()); len(names) != 1 {
+		t.Fatalf("unexpected archive entries: %v", names)
+	}
+
+	// Nothing changed since the previous backup.
+	var buf bytes.Buffer
+	if m, err := s0.BackupShardIncremental(1, bytes.NewReader(manifest), &buf); err != nil {
+		t.Fatal(err)
+	} else if names := mustArchiveNames(buf.Bytes()); len(names) != 0 {
+		t.Fatalf("unexpected archive entries: %v", names)
+	} else if !bytes.Equal(m, manifest) {
+		t.Fatalf("unexpected manifest: %s", m)
+	}
+
+	// Only the new file is written after more data arrives.
+	s0.MustWriteToShardString(1, `mem,host=serverA value=2 0`)
+	var incr bytes.Buffer
+	if m, err := s0.BackupShardIncremental(1, bytes.NewReader(manifest), &incr); err != nil {
+		t.Fatal(err)
+	} else if names := mustArchiveNames(incr.Bytes()); len(names) != 1 || reflect.DeepEqual(names, mustArchiveNames(full.Bytes())) {
+		t.Fatalf("unexpected archive entries: %v", names)
+	} else if bytes.Equal(m, manifest) {
+		t.Fatal("expected manifest to change")
+	}
+
+	if err := s1.RestoreShard(1, bytes.NewReader(full.Bytes()), false); err != nil {
+		t.Fatal(err)
+	} else if err := s1.RestoreShardIncremental(1, bytes.NewReader(incr.Bytes())); err != nil {
+		t.Fatal(err)
+	} else if names, err := s1.MeasurementNames("db0", nil); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(names, []string{"cpu", "mem"}) {
+		t.Fatalf("unexpected measurement names: %v", names)
+	}
+}
+
+// Ensure a shard can be copied into another store.
+func TestStore_CopyShardTo(t *testing.T) {
+	s0, s1 := MustOpenStore(), MustOpenStore()
+	defer s0.Close()
+	defer s1.Close()
+
+	s0.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 0`, `cpu,host=serverB value=2 10`)
+
+	if err := s0.CopyShardTo(1, s1.Store); err != nil {
+		t.Fatal(err)
+	} else if sh := s1.Shard(1); sh == nil || sh.Database() != "db0" || sh.RetentionPolicy() != "rp0" {
+		t.Fatalf("unexpected shard: %v", sh)
+	} else if s0.Shard(1) == nil {
+		t.Fatal("expected source shard to remain")
+	} else if keys, err := s1.SeriesKeys("db0", "cpu"); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(keys, []string{"cpu,host=serverA", "cpu,host=serverB"}) {
+		t.Fatalf("unexpected series keys: %v", keys)
+	}
+
+	if err := s0.CopyShardTo(1, s1.Store); err == nil || err.Error() != "shard 1 already exists on the destination" {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := s0.CopyShardTo(2, s1.Store); err != tsdb.ErrShardNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := s0.CopyShardTo(1, s0.Store); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// Ensure the store isn't locked while a restored archive is being read, and
+// that the shard is checked again before it is restored.
+func TestStore_RestoreShard_Unlocked(t *testing.T) {
+	s0, s1 := MustOpenStore(), MustOpenStore()
+	defer s0.Close()
+	defer s1.Close()
+
+	s0.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 0`)
+	var buf bytes.Buffer
+	if err := s0.BackupShard(1, time.Time{}, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// restore starts restoring shard 1 from an archive that is only read up
+	// to its first header, and returns a function finishing the archive.
+	restore := func() (finish func() error) {
+		pr, pw := io.Pipe()
+		errC := make(chan error, 1)
+		go func() { errC <- s1.RestoreShard(1, pr, false) }()
+		if _, err := pw.Write(buf.Bytes()[:512]); err != nil {
+			t.Fatal(err)
+		}
+		return func() error {
+			pw.Write(buf.Bytes()[512:])
+			pw.Close()
+			return <-errC
+		}
+	}
+
+	finish := restore()
+	if err := s1.CreateShard("db1", "rp0", 2); err != nil {
+		t.Fatal(err)
+	} else if err := s1.RestoreShard(1, bytes.NewReader(buf.Bytes()), false); err == nil || err.Error() != "shard 1 is already being restored" {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := finish(); err != nil {
+		t.Fatal(err)
+	} else if keys, err := s1.SeriesKeys("db0", "cpu"); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(keys, []string{"cpu,host=serverA"}) {
+		t.Fatalf("unexpected series keys: %v", keys)
+	}
+
+	// A shard created while the archive is read is not restored over.
+	if _, err := s1.DeleteShard(1); err != nil {
+		t.Fatal(err)
+	}
+	finish = restore()
+	if err := s1.CreateShard("db0", "rp0", 1); err != nil {
+		t.Fatal(err)
+	} else if err := finish(); err == nil || err.Error() != "shard 1 already exists on this server" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	buf.Reset()
+	if err := s1.ExportShard(1, &buf, math.MinInt64, math.MaxInt64); err != nil {
+		t.Fatal(err)
+	} else if buf.Len() != 0 {
+		t.Fatalf("unexpected export: %s", buf.String())
+	} else if tmp, err := filepath.Glob(filepath.Join(s1.Shard(1).Path(), "*.tmp")); err != nil || len(tmp) != 0 {
+		t.Fatalf("unexpected temporary files: %v, %v", tmp, err)
+	}
+}
+
+// Ensure the store can merge shards into one.
+func TestStore_MergeShards(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 10`, `cpu,host=serverA value=2 20`)
+	s.MustCreateShardWithData("db0", "rp0", 2, `cpu,host=serverA value=3 20`, `mem,host=serverA free=1i 20`)
+	s.MustCreateShardWithData("db0", "rp0", 3, `cpu,host=serverB value=4 30`)
+	s.MustCreateShardWithData("db0", "rp0", 4, `cpu,host=serverC value="x" 40`)
+	s.MustCreateShardWithData("db0", "rp1", 5, `cpu,host=serverA value=5 50`)
+
+	var deleted []uint64
+	s.OnShardDeleted(func(id uint64) { deleted = append(deleted, id) })
+
+	export := func(id uint64) string {
+		var buf bytes.Buffer
+		if err := s.ExportShard(id, &buf, math.MinInt64, math.MaxInt64); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+	before := export(1)
+
+	// Nothing changes when the merge is refused.
+	if err := s.MergeShards(1, []uint64{2, 4}); !errors.Is(err, tsdb.ErrFieldTypeConflict) {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := s.MergeShards(1, []uint64{5}); err == nil {
+		t.Fatal("expected error merging another retention policy")
+	} else if err := s.MergeShards(1, []uint64{1}); err == nil {
+		t.Fatal("expected error merging a shard into itself")
+	} else if err := s.MergeShards(1, []uint64{6}); !errors.Is(err, tsdb.ErrShardNotFound) {
+		t.Fatalf("unexpected error: %v", err)
+	} else if got := export(1); got != before {
+		t.Fatalf("unexpected shard data after refused merge: %s", got)
+	} else if ids := s.ShardIDs(); len(ids) != 5 {
+		t.Fatalf("unexpected shards: %v", ids)
+	}
+
+	if err := s.MergeShards(1, []uint64{2, 3}); err != nil {
+		t.Fatal(err)
+	} else if exp := "cpu,host=serverA value=1 10000000000\n" +
+		"cpu,host=serverA value=3 20000000000\n" +
+		"cpu,host=serverB value=4 30000000000\n" +
+		"mem,host=serverA free=1i 20000000000\n"; export(1) != exp {
+		t.Fatalf("unexpected merged data:\n%s\nexp:\n%s", export(1), exp)
+	} else if s.Shard(2) != nil || s.Shard(3) != nil {
+		t.Fatal("expected sources to be deleted")
+	} else if sort.Slice(deleted, func(i, j int) bool { return deleted[i] < deleted[j] }); !reflect.DeepEqual(deleted, []uint64{2, 3}) {
+		t.Fatalf("unexpected deleted shards: %v", deleted)
+	} else if s.IsShardReadonly(1) {
+		t.Fatal("unexpected read-only destination")
+	}
+	for _, dir := range []string{"2", "3", "1.merge", "1.old"} {
+		if _, err := os.Stat(filepath.Join(s.Path(), "db0", "rp0", dir)); !os.IsNotExist(err) {
+			t.Fatalf("unexpected directory %s: %v", dir, err)
+		}
+	}
+
+	// The merged shard accepts writes and keeps its data when reopened.
+	s.MustWriteToShardString(1, `cpu,host=serverA value=6 60`)
+	if err := s.Reopen(); err != nil {
+		t.Fatal(err)
+	} else if exp := "cpu,host=serverA value=1 10000000000\n" +
+		"cpu,host=serverA value=3 20000000000\n" +
+		"cpu,host=serverA value=6 60000000000\n" +
+		"cpu,host=serverB value=4 30000000000\n" +
+		"mem,host=serverA free=1i 20000000000\n"; export(1) != exp {
+		t.Fatalf("unexpected data after reopen:\n%s\nexp:\n%s", export(1), exp)
+	}
+}
+
+// Ensure async writes queued for merged shards are cancelled rather than
+// written to a source shard after it was copied.
+func TestStore_MergeShards_AsyncWrites(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 0`)
+	if err := s.CreateShard("db0", "rp0", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	started, release := make(chan error), make(chan struct{})
+	if err := s.WriteToShardAsync(2, mustParsePoints(`cpu,host=serverB value=2 10`), func(err error) {
+		started <- err
+		<-release
+	}); err != nil {
+		t.Fatal(err)
+	} else if err := <-started; err != nil {
+		t.Fatal(err)
+	}
+	errC := make(chan error, 1)
+	if err := s.WriteToShardAsync(2, mustParsePoints(`cpu,host=serverB value=3 20`), func(err error) { errC <- err }); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.MergeShards(1, []uint64{2}); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	if err := <-errC; err != tsdb.ErrShardReadOnly {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := s.ExportShard(1, &buf, math.MinInt64, math.MaxInt64); err != nil {
+		t.Fatal(err)
+	} else if exp := "cpu,host=serverA value=1 0\ncpu,host=serverB value=2 10000000000\n"; buf.String() != exp {
+		t.Fatalf("unexpected export:\n%s", buf.String())
+	}
+}
+
+// Ensure the store exports shards and measurements as line protocol.
+func TestStore_ExportShard(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1,
+		`cpu,host=serverA,region=west value=1,count=2i 10`,
+		`cpu,host=serverB value=2,ok=true 20`,
+		`mem,host=serverA free=3i,state="idle" 10`,
+	)
+	s.MustCreateShardWithData("db0", "rp0", 2, `cpu,host=serverA value=3 30`)
+	s.MustCreateShardWithData("db1", "rp0", 3, `cpu,host=serverA value=4 30`)
+
+	var buf bytes.Buffer
+	if err := s.ExportShard(1, &buf, math.MinInt64, math.MaxInt64); err != nil {
+		t.Fatal(err)
+	} else if exp := "cpu,host=serverA,region=west count=2i,value=1 10000000000\n" +
+		"cpu,host=serverB ok=true,value=2 20000000000\n" +
+		"mem,host=serverA free=3i,state=\"idle\" 10000000000\n"; buf.String() != exp {
+		t.Fatalf("unexpected export:\n%s\nexp:\n%s", buf.String(), exp)
+	}
+
+	// Exported line protocol can be written back.
+	if _, err := models.ParsePointsString(buf.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	buf.Reset()
+	if err := s.ExportShard(1, &buf, 15*int64(time.Second), math.MaxInt64); err != nil {
+		t.Fatal(err)
+	} else if exp := "cpu,host=serverB ok=true,value=2 20000000000\n"; buf.String() != exp {
+		t.Fatalf("unexpected export:\n%s\nexp:\n%s", buf.String(), exp)
+	} else if err := s.ExportShard(4, &buf, math.MinInt64, math.MaxInt64); err != tsdb.ErrShardNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	buf.Reset()
+	if err := s.ExportMeasurement("db0", "cpu", &buf); err != nil {
+		t.Fatal(err)
+	} else if exp := "cpu,host=serverA,region=west count=2i,value=1 10000000000\n" +
+		"cpu,host=serverB ok=true,value=2 20000000000\n" +
+		"cpu,host=serverA value=3 30000000000\n"; buf.String() != exp {
+		t.Fatalf("unexpected export:\n%s\nexp:\n%s", buf.String(), exp)
+	}
+
+	if err := s.ExportMeasurement("db2", "cpu", &buf); err == nil || err.Error() != "database not found: db2" {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := s.ExportMeasurement("db0", "disk", &buf); err == nil || err.Error() != "measurement not found: disk" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure shards with the same values have the same checksum however the
+// values are stored.
+func TestStore_ChecksumShard(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1,
+		`cpu,host=serverA value=1 0`,
+		`cpu,host=serverB value=2,count=3i 10`,
+	)
+	if err := s.FlushWAL(1); err != nil {
+		t.Fatal(err)
+	}
+	s.MustWriteToShardString(1, `mem,host=serverA free=4i 20`)
+
+	s.MustCreateShardWithData("db0", "rp0", 2, `mem,host=serverA free=4i 20`)
+	s.MustWriteToShardString(2, `cpu,host=serverB count=3i 10`)
+	if err := s.FlushWAL(2); err != nil {
+		t.Fatal(err)
+	}
+	s.MustWriteToShardString(2, `cpu,host=serverB value=2 10`, `cpu,host=serverA value=1 0`)
+
+	sum1, err := s.ChecksumShard(1)
+	if err != nil {
+		t.Fatal(err)
+	} else if sum1 == 0 {
+		t.Fatal("expected non-zero checksum")
+	} else if sum2, err := s.ChecksumShard(2); err != nil {
+		t.Fatal(err)
+	} else if sum2 != sum1 {
+		t.Fatalf("checksums differ: %d, %d", sum1, sum2)
+	}
+
+	s.MustWriteToShardString(2, `cpu,host=serverC value=5 30`)
+	if sum2, err := s.ChecksumShard(2); err != nil {
+		t.Fatal(err)
+	} else if sum2 == sum1 {
+		t.Fatal("expected checksums to differ")
+	}
+
+	// Deleted values are left out.
+	cond := influxql.MustParseExpr(`host = 'serverC'`)
+	sources := []influxql.Source{&influxql.Measurement{Database: "db0", RetentionPolicy: "rp0", Name: "cpu"}}
+	if err := s.DeleteSeriesRange("db0", sources, cond, math.MinInt64, math.MaxInt64); err != nil {
+		t.Fatal(err)
+	} else if sum2, err := s.ChecksumShard(2); err != nil {
+		t.Fatal(err)
+	} else if sum2 != sum1 {
+		t.Fatalf("checksums differ after delete: %d, %d", sum1, sum2)
+	}
+
+	if err := s.CreateShard("db0", "rp0", 3); err != nil {
+		t.Fatal(err)
+	} else if sum, err := s.ChecksumShard(3); err != nil || sum != 0 {
+		t.Fatalf("unexpected checksum of empty shard: %d, %v", sum, err)
+	} else if _, err := s.ChecksumShard(4); err != tsdb.ErrShardNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure a database backup can be restored into another store.
+func TestStore_BackupRestoreDatabase(t *testing.T) {
+	s0, s1 := MustOpenStore(), MustOpenStore()
+	defer s0.Close()
+	defer s1.Close()
+
+	s0.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 0`)
+	s0.MustCreateShardWithData("db0", "rp1", 2, `mem,host=serverB value=2 0`)
+	s0.MustCreateShardWithData("db1", "rp0", 3, `disk,host=serverC value=3 0`)
+
+	var buf bytes.Buffer
+	if err := s0.BackupDatabase("db0", time.Time{}, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// The manifest lists the shards of the database only.
+	var manifest tsdb.DatabaseManifest
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		} else if hdr.Name == tsdb.DatabaseManifestFile {
+			if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+				t.Fatal(err)
+			}
+		} else if !strings.HasPrefix(hdr.Name, "db0"+string(filepath.Separator)) {
+			t.Fatalf("unexpected archive entry: %s", hdr.Name)
+		}
+	}
+	if exp := (tsdb.DatabaseManifest{Database: "db0", Shards: []tsdb.DatabaseManifestShard{
+		{ID: 1, RetentionPolicy: "rp0"},
+		{ID: 2, RetentionPolicy: "rp1"},
+	}}); !reflect.DeepEqual(manifest, exp) {
+		t.Fatalf("unexpected manifest: %+v", manifest)
+	}
+
+	var created []uint64
+	s1.OnShardCreated(func(id uint64, database, rp string) { created = append(created, id) })
+
+	if err := s1.RestoreDatabase("db1", bytes.NewReader(buf.Bytes()), false); err == nil {
+		t.Fatal("expected database mismatch error")
+	} else if err := s1.RestoreDatabase("db0", bytes.NewReader(buf.Bytes()), false); err != nil {
+		t.Fatal(err)
+	} else if s1.Shard(1) == nil || s1.Shard(2) == nil || s1.Shard(3) != nil {
+		t.Fatalf("unexpected shards: %v", s1.ShardIDs())
+	} else if !reflect.DeepEqual(created, []uint64{1, 2}) {
+		t.Fatalf("unexpected created shards: %v", created)
+	} else if names, err := s1.MeasurementNames("db0", nil); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(names, []string{"cpu", "mem"}) {
+		t.Fatalf("unexpected measurement names: %v", names)
+	}
+
+	// Existing shards are skipped unless the restore is forced.
+	s0.MustWriteToShardString(1, `cpu,host=serverA value=4 100`)
+	buf.Reset()
+	if err := s0.BackupDatabase("db0", time.Time{}, &buf); err != nil {
+		t.Fatal(err)
+	} else if err := s1.RestoreDatabase("db0", bytes.NewReader(buf.Bytes()), false); err != nil {
+		t.Fatal(err)
+	} else if _, max, ok := s1.Shard(1).TimeRange(); !ok || !max.Equal(time.Unix(0, 0)) {
+		t.Fatalf("unexpected time range: %s, %v", max, ok)
+	} else if err := s1.RestoreDatabase("db0", bytes.NewReader(buf.Bytes()), true); err != nil {
+		t.Fatal(err)
+	} else if _, max, ok := s1.Shard(1).TimeRange(); !ok || !max.Equal(time.Unix(100, 0)) {
+		t.Fatalf("unexpected time range after forced restore: %s, %v", max, ok)
+	}
+
+	// A forced restore replaces the WAL of existing shards, so that writes
+	// newer than the backup are not replayed over the restored data.
+	export := func(s *Store, id uint64) string {
+		var buf bytes.Buffer
+		if err := s.ExportShard(id, &buf, math.MinInt64, math.MaxInt64); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+	s1.MustWriteToShardString(1, `cpu,host=serverD value=9 200`)
+	if err := s1.RestoreDatabase("db0", bytes.NewReader(buf.Bytes()), true); err != nil {
+		t.Fatal(err)
+	} else if got, exp := export(s1, 1), export(s0, 1); got != exp {
+		t.Fatalf("unexpected export after forced restore:\n%s\nexp:\n%s", got, exp)
+	} else if err := s1.Reopen(); err != nil {
+		t.Fatal(err)
+	} else if got, exp := export(s1, 1), export(s0, 1); got != exp {
+		t.Fatalf("unexpected export after reopen:\n%s\nexp:\n%s", got, exp)
+	} else if len(created) != 2 {
+		t.Fatalf("unexpected created shards: %v", created)
+	}
+
+	// Shard IDs used by another database are never restored over.
+	s2 := MustOpenStore()
+	defer s2.Close()
+	if err := s2.CreateShard("db1", "rp0", 1); err != nil {
+		t.Fatal(err)
+	} else if err := s2.RestoreDatabase("db0", bytes.NewReader(buf.Bytes()), true); err == nil {
+		t.Fatal("expected error")
+	} else if s2.Shard(2) != nil {
+		t.Fatal("unexpected shard")
+	}
+
+	// Shards without changes since the given time are skipped.
+	buf.Reset()
+	if err := s0.BackupDatabase("db0", time.Now().Add(time.Hour), &buf); err != nil {
+		t.Fatal(err)
+	} else if sh := s0.Shard(1); sh == nil {
+		t.Fatal("expected shard")
+	}
+	tr = tar.NewReader(bytes.NewReader(buf.Bytes()))
+	if hdr, err := tr.Next(); err != nil {
+		t.Fatal(err)
+	} else if hdr.Name != tsdb.DatabaseManifestFile {
+		t.Fatalf("unexpected archive entry: %s", hdr.Name)
+	} else if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		t.Fatal(err)
+	} else if len(manifest.Shards) != 0 {
+		t.Fatalf("unexpected manifest shards: %+v", manifest.Shards)
+	}
+}
+
+// Ensure the store isn't locked while a restored database archive is being
+// read, and that its shards are checked again before they are restored.
+func TestStore_RestoreDatabase_Unlocked(t *testing.T) {
+	s0, s1 := MustOpenStore(), MustOpenStore()
+	defer s0.Close()
+	defer s1.Close()
+
+	s0.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 0`)
+	var buf bytes.Buffer
+	if err := s0.BackupDatabase("db0", time.Time{}, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Find the offset of the first byte of the first shard file.
+	r := bytes.NewReader(buf.Bytes())
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatal(err)
+		} else if hdr.Name != tsdb.DatabaseManifestFile && hdr.Size > 0 {
+			break
+		}
+	}
+	n := len(buf.Bytes()) - r.Len() + 1
+
+	// restore starts restoring the archive, which is only read up to the
+	// first byte of a shard file, and returns a function finishing the
+	// archive.
+	restore := func() (finish func() error) {
+		pr, pw := io.Pipe()
+		errC := make(chan error, 1)
+		go func() { errC <- s1.RestoreDatabase("db0", pr, false) }()
+		if _, err := pw.Write(buf.Bytes()[:n]); err != nil {
+			t.Fatal(err)
+		}
+		return func() error {
+			pw.Write(buf.Bytes()[n:])
+			pw.Close()
+			return <-errC
+		}
+	}
+
+	// Shard 1 is created while the archive is read.
+	finish := restore()
+	if err := s1.CreateShard("db1", "rp0", 2); err != nil {
+		t.Fatal(err)
+	} else if err := s1.CreateShard("db0", "rp0", 1); err != nil {
+		t.Fatal(err)
+	} else if err := finish(); err == nil || !strings.Contains(err.Error(), "shard 1 changed during the restore") {
+		t.Fatalf("unexpected error: %v", err)
+	} else if tmp, err := filepath.Glob(filepath.Join(s1.Shard(1).Path(), "*.tmp")); err != nil || len(tmp) != 0 {
+		t.Fatalf("unexpected temporary files: %v, %v", tmp, err)
+	}
+
+	if _, err := s1.DeleteShard(1); err != nil {
+		t.Fatal(err)
+	}
+	finish = restore()
+	if err := s1.RestoreDatabase("db0", bytes.NewReader(buf.Bytes()), false); err == nil || err.Error() != "shard 1 is already being restored" {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := finish(); err != nil {
+		t.Fatal(err)
+	} else if keys, err := s1.SeriesKeys("db0", "cpu"); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(keys, []string{"cpu,host=serverA"}) {
+		t.Fatalf("unexpected series keys: %v", keys)
+	}
+}
+
+// Ensure the store reports database, shard and store statistics.
+func TestStore_Statistics(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1,
+		`cpu,host=serverA value=1 0`,
+		`cpu,host=serverB value=2 0`,
+		`mem,host=serverA value=3 0`,
+	)
+
+	stats := s.Statistics(map[string]string{"node": "n1"})
+	if len(stats) != 3 {
+		t.Fatalf("unexpected statistics: %s", spew.Sdump(stats))
+	}
+	for _, stat := range stats {
+		if stat.Tags["node"] != "n1" {
+			t.Fatalf("%s: missing tags: %v", stat.Name, stat.Tags)
+		}
+	}
+
+	if stat := stats[0]; stat.Name != "database" || stat.Tags["database"] != "db0" {
+		t.Fatalf("unexpected database statistic: %s", spew.Sdump(stat))
+	} else if v := stat.Values["numSeries"]; v != int64(3) {
+		t.Fatalf("unexpected series count: %v", v)
+	} else if v := stat.Values["numMeasurements"]; v != int64(2) {
+		t.Fatalf("unexpected measurement count: %v", v)
+	}
+
+	if stat := stats[1]; stat.Name != "shard" || stat.Tags["id"] != "1" || stat.Tags["retentionPolicy"] != "rp0" {
+		t.Fatalf("unexpected shard statistic: %s", spew.Sdump(stat))
+	} else if v := stat.Values["walDiskBytes"].(int64); v <= 0 {
+		t.Fatalf("unexpected wal size: %d", v)
+	}
+
+	if stat := stats[2]; stat.Name != "store" {
+		t.Fatalf("unexpected store statistic: %s", spew.Sdump(stat))
+	} else if v := stat.Values["numShards"]; v != int64(1) {
+		t.Fatalf("unexpected shard count: %v", v)
+	} else if v := stat.Values["walDiskBytes"]; v != stats[1].Values["walDiskBytes"] {
+		t.Fatalf("unexpected total wal size: %v", v)
+	}
+}
+
+// Ensure the store can flush shard caches to TSM files.
+func TestStore_FlushWAL(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 0`)
+	s.MustCreateShardWithData("db0", "rp0", 2, `cpu,host=serverB value=2 0`)
+
+	if err := s.FlushWAL(); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"1", "2"} {
+		if files, err := filepath.Glob(filepath.Join(s.Path(), "db0", "rp0", id, "*.tsm")); err != nil {
+			t.Fatal(err)
+		} else if len(files) != 1 {
+			t.Fatalf("shard %s: unexpected tsm files: %v", id, files)
+		}
+	}
+
+	// Unknown shards are reported, the others are still flushed.
+	if err := s.FlushWAL(1, 3); err == nil || !strings.Contains(err.Error(), "[shard 3]") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure the store reports shard sizes including the WAL.
+func TestStore_ShardDiskSize(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 0`)
+
+	// Unflushed points only occupy the WAL.
+	if tsm, wal, err := s.ShardDiskSize(1); err != nil {
+		t.Fatal(err)
+	} else if tsm != 0 || wal == 0 {
+		t.Fatalf("unexpected sizes: tsm=%d, wal=%d", tsm, wal)
+	}
+
+	if err := s.FlushWAL(1); err != nil {
+		t.Fatal(err)
+	}
+
+	tsm, wal, err := s.ShardDiskSize(1)
+	if err != nil {
+		t.Fatal(err)
+	} else if tsm == 0 {
+		t.Fatal("expected tsm size")
+	} else if total, err := s.TotalDiskSize(); err != nil {
+		t.Fatal(err)
+	} else if total != tsm+wal {
+		t.Fatalf("unexpected total size: got %d, exp %d", total, tsm+wal)
+	}
+
+	if _, _, err := s.ShardDiskSize(2); err != tsdb.ErrShardNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure the store detects corrupt blocks in a shard's TSM files.
+func TestStore_VerifyShard(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 0`)
+	if err := s.FlushWAL(1); err != nil {
+		t.Fatal(err)
+	}
+
+	if res, err := s.VerifyShard(1); err != nil {
+		t.Fatal(err)
+	} else if !res.OK() || res.TSMFiles != 1 || res.GoodBlocks != 1 || res.BadBlocks != 0 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+
+	// Corrupt the data of the first block, after the file header and the
+	// block checksum.
+	files, err := filepath.Glob(filepath.Join(s.Path(), "db0", "rp0", "1", "*.tsm"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("unexpected files: %v, %v", files, err)
+	}
+	f, err := os.OpenFile(files[0], os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0xff, 0xff}, 10); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if res := s.VerifyAll()[1]; res == nil {
+		t.Fatal("expected result")
+	} else if res.OK() || res.GoodBlocks != 0 || res.BadBlocks != 1 || res.FirstBadFile != files[0] {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+
+	if _, err := s.VerifyShard(2); err != tsdb.ErrShardNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure the store reports disk usage per retention policy.
+func TestStore_DiskSizeByRetentionPolicy(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 0`)
+	s.MustCreateShardWithData("db0", "rp1", 2, `cpu,host=serverB value=2 0`)
+	if err := s.FlushWAL(1); err != nil {
+		t.Fatal(err)
+	}
+
+	data1, wal1, err := s.ShardDiskSize(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data2, wal2, err := s.ShardDiskSize(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sizes, err := s.DiskSizeByRetentionPolicy("db0"); err != nil {
+		t.Fatal(err)
+	} else if exp := map[string]int64{"rp0": data1, "rp1": data2}; !reflect.DeepEqual(sizes, exp) {
+		t.Fatalf("unexpected sizes: got %v, exp %v", sizes, exp)
+	}
+
+	if sizes, err := s.DiskSizeByRetentionPolicyWithWAL("db0"); err != nil {
+		t.Fatal(err)
+	} else if exp := map[string]int64{"rp0": data1 + wal1, "rp1": data2 + wal2}; !reflect.DeepEqual(sizes, exp) {
+		t.Fatalf("unexpected sizes: got %v, exp %v", sizes, exp)
+	}
+
+	if _, err := s.DiskSizeByRetentionPolicy("db1"); err == nil || err.Error() != "database not found: db1" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure the store reports the size of the WAL of each shard.
+func TestStore_WALSize(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 0`)
+	s.MustCreateShardWithData("db0", "rp1", 2, `cpu,host=serverB value=2 0`)
+
+	_, wal1, err := s.ShardDiskSize(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, wal2, err := s.ShardDiskSize(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sz, err := s.ShardWALSize(1); err != nil {
+		t.Fatal(err)
+	} else if sz != wal1 || sz == 0 {
+		t.Fatalf("unexpected shard WAL size: %d", sz)
+	} else if sz, err := s.WALSize(); err != nil {
+		t.Fatal(err)
+	} else if sz != wal1+wal2 {
+		t.Fatalf("unexpected WAL size: got %d, exp %d", sz, wal1+wal2)
+	}
+
+	// A missing WAL directory has no size.
+	if err := os.RemoveAll(filepath.Join(s.Path(), "wal", "db0", "rp1")); err != nil {
+		t.Fatal(err)
+	} else if sz, err := s.ShardWALSize(2); err != nil || sz != 0 {
+		t.Fatalf("unexpected result: %d, %v", sz, err)
+	}
+
+	if _, err := s.ShardWALSize(3); err != tsdb.ErrShardNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure a single shard can be closed and reopened while the store is open.
+func TestStore_CloseShard(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 0`)
+
+	if err := s.CloseShard(1); err != nil {
+		t.Fatal(err)
+	} else if s.Shard(1) == nil {
+		t.Fatal("expected closed shard to remain in the store")
+	}
+
+	if err := s.WriteToShard(1, mustParsePoints(`cpu,host=serverB value=2 10`)); err != tsdb.ErrEngineClosed {
+		t.Fatalf("unexpected error: %v", err)
+	} else if _, err := s.Shard(1).SeriesCount(); err != tsdb.ErrEngineClosed {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := s.OpenShard(1); err != nil {
+		t.Fatal(err)
+	} else if err := s.OpenShard(1); err != nil {
+		t.Fatal(err)
+	}
+	s.MustWriteToShardString(1, `cpu,host=serverB value=2 10`)
+	if min, max, ok := s.Shard(1).TimeRange(); !ok || !min.Equal(time.Unix(0, 0)) || !max.Equal(time.Unix(10, 0)) {
+		t.Fatalf("unexpected time range: %s, %s, %v", min, max, ok)
+	}
+
+	if err := s.CloseShard(2); err != tsdb.ErrShardNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := s.OpenShard(2); err != tsdb.ErrShardNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure the store lists open and closed shards separately.
+func TestStore_OpenShardIDs(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	for _, id := range []uint64{3, 1, 2} {
+		if err := s.CreateShard("db0", "rp0", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.CloseShard(2); err != nil {
+		t.Fatal(err)
+	}
+
+	if ids := s.OpenShardIDs(); !reflect.DeepEqual(ids, []uint64{1, 3}) {
+		t.Fatalf("unexpected open shards: %v", ids)
+	} else if ids := s.ClosedShardIDs(); !reflect.DeepEqual(ids, []uint64{2}) {
+		t.Fatalf("unexpected closed shards: %v", ids)
+	}
+
+	if err := s.OpenShard(2); err != nil {
+		t.Fatal(err)
+	} else if ids := s.OpenShardIDs(); !reflect.DeepEqual(ids, []uint64{1, 2, 3}) {
+		t.Fatalf("unexpected open shards: %v", ids)
+	} else if ids := s.ClosedShardIDs(); len(ids) != 0 {
+		t.Fatalf("unexpected closed shards: %v", ids)
+	}
+}
+
+// Ensure the store closes the least recently used shards beyond MaxOpenShards
+// and opens them again when they are used.
+func TestStore_MaxOpenShards(t *testing.T) {
+	s := NewStore()
+	s.EngineOptions.MaxOpenShards = 2
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for id := 1; id <= 3; id++ {
+		s.MustCreateShardWithData("db0", "rp0", id, fmt.Sprintf(`cpu,host=serverA value=%d 10`, id))
+	}
+	if ids := s.OpenShardIDs(); !reflect.DeepEqual(ids, []uint64{2, 3}) {
+		t.Fatalf("unexpected open shards: %v", ids)
+	}
+
+	// Writing to a closed shard opens it and closes the least recently used.
+	s.MustWriteToShardString(1, `cpu,host=serverB value=4 20`)
+	if ids := s.OpenShardIDs(); !reflect.DeepEqual(ids, []uint64{1, 3}) {
+		t.Fatalf("unexpected open shards: %v", ids)
+	} else if err := s.TryWriteToShard(2, mustParsePoints(`cpu,host=serverB value=5 20`)); err != tsdb.ErrShardBusy {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if sh := s.Shard(2); sh == nil || !sh.IsOpen() {
+		t.Fatal("expected shard 2 to be opened")
+	} else if ids := s.OpenShardIDs(); !reflect.DeepEqual(ids, []uint64{1, 2}) {
+		t.Fatalf("unexpected open shards: %v", ids)
+	}
+
+	var buf bytes.Buffer
+	if err := s.ExportShard(1, &buf, math.MinInt64, math.MaxInt64); err != nil {
+		t.Fatal(err)
+	} else if exp := "cpu,host=serverA value=1 10000000000\ncpu,host=serverB value=4 20000000000\n"; buf.String() != exp {
+		t.Fatalf("unexpected export:\n%s", buf.String())
+	}
+
+	stats := s.Statistics(nil)
+	if stat := stats[len(stats)-1]; stat.Name != "store" {
+		t.Fatalf("unexpected store statistic: %s", spew.Sdump(stat))
+	} else if v := stat.Values["numShards"]; v != int64(3) {
+		t.Fatalf("unexpected shard count: %v", v)
+	} else if v := stat.Values["numOpenEngines"]; v != int64(2) {
+		t.Fatalf("unexpected open engine count: %v", v)
+	} else if v := stat.Values["shardEvictions"]; v != int64(3) {
+		t.Fatalf("unexpected eviction count: %v", v)
+	}
+
+	// Shards loaded when the store opens are limited too, keeping the newest.
+	if err := s.Store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s.Store = tsdb.NewStore(s.Path())
+	s.EngineOptions.Config.WALDir = filepath.Join(s.Path(), "wal")
+	s.EngineOptions.MaxOpenShards = 2
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	} else if ids := s.OpenShardIDs(); !reflect.DeepEqual(ids, []uint64{2, 3}) {
+		t.Fatalf("unexpected open shards after reopen: %v", ids)
+	}
+}
+
+// Ensure the store opens shards and databases added to the data directory
+// while it is running.
+func TestStore_Reload(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 0`)
+	sh1 := s.Shard(1)
+
+	var created []uint64
+	s.OnShardCreated(func(id uint64, database, rp string) { created = append(created, id) })
+
+	// Write shards with another store and move them into place.
+	other := MustOpenStore()
+	defer os.RemoveAll(other.Path())
+	other.MustCreateShardWithData("db0", "rp0", 2, `cpu,host=serverB value=2 0`)
+	other.MustCreateShardWithData("db1", "rp0", 3, `mem,host=serverC value=3 0`)
+	if err := other.Store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{
+		filepath.Join("db0", "rp0", "2"),
+		filepath.Join("wal", "db0", "rp0", "2"),
+		"db1",
+		filepath.Join("wal", "db1"),
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(s.Path(), dir)), 0777); err != nil {
+			t.Fatal(err)
+		} else if err := os.Rename(filepath.Join(other.Path(), dir), filepath.Join(s.Path(), dir)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(s.Path(), "db2"), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	} else if ids := s.OpenShardIDs(); !reflect.DeepEqual(ids, []uint64{1, 2, 3}) {
+		t.Fatalf("unexpected shards: %v", ids)
+	} else if s.Shard(1) != sh1 {
+		t.Fatal("expected open shard to be kept")
+	} else if !reflect.DeepEqual(created, []uint64{2, 3}) {
+		t.Fatalf("unexpected created shards: %v", created)
+	} else if s.DatabaseIndex("db2") == nil {
+		t.Fatal("expected index for new database")
+	} else if !s.HasSeries("db0", "cpu,host=serverB") || !s.HasSeries("db1", "mem,host=serverC") {
+		t.Fatal("expected series of reloaded shards")
+	}
+
+	var buf bytes.Buffer
+	if err := s.ExportShard(3, &buf, math.MinInt64, math.MaxInt64); err != nil {
+		t.Fatal(err)
+	} else if exp := "mem,host=serverC value=3 0\n"; buf.String() != exp {
+		t.Fatalf("unexpected export: %q", buf.String())
+	}
+
+	// Reloading again finds nothing new.
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	} else if len(created) != 2 {
+		t.Fatalf("unexpected created shards: %v", created)
+	}
+}
+
+// Ensure a read-only shard refuses writes but can still be read and backed up.
+func TestStore_SetShardReadonly(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 0`)
+	if s.IsShardReadonly(1) {
+		t.Fatal("unexpected read-only shard")
+	}
+
+	if err := s.SetShardReadonly(1, true); err != nil {
+		t.Fatal(err)
+	} else if !s.IsShardReadonly(1) {
+		t.Fatal("expected read-only shard")
+	} else if err := s.SetShardReadonly(2, true); err != tsdb.ErrShardNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	} else if s.IsShardReadonly(2) {
+		t.Fatal("unexpected read-only missing shard")
+	}
+
+	err := s.WriteToShard(1, mustParsePoints(`cpu,host=serverB value=2 10`))
+	if err != tsdb.ErrShardReadOnly {
+		t.Fatalf("unexpected error: %v", err)
+	} else if tsdb.IsRetryable(err) {
+		t.Fatal("expected non-retryable error")
+	} else if err := s.TryWriteToShard(1, mustParsePoints(`cpu,host=serverB value=2 10`)); err != tsdb.ErrShardReadOnly {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if keys, err := s.SeriesKeys("db0", "cpu"); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(keys, []string{"cpu,host=serverA"}) {
+		t.Fatalf("unexpected series: %v", keys)
+	} else if err := s.BackupShard(1, time.Time{}, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.SetShardReadonly(1, false); err != nil {
+		t.Fatal(err)
+	}
+	s.MustWriteToShardString(1, `cpu,host=serverB value=2 10`)
+
+	// The flag is not kept when the store is reopened.
+	if err := s.SetShardReadonly(1, true); err != nil {
+		t.Fatal(err)
+	} else if err := s.Reopen(); err != nil {
+		t.Fatal(err)
+	} else if s.IsShardReadonly(1) {
+		t.Fatal("unexpected read-only shard after reopen")
+	}
+}
+
+// Ensure the cache size of a shard can be changed without affecting others.
+func TestStore_SetShardCacheSize(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	opts := s.EngineOptions
+	opts.Config.CacheMaxMemorySize = 1
+	if err := s.CreateShardWithOptions("db0", "rp0", 1, opts); err != nil {
+		t.Fatal(err)
+	} else if err := s.CreateShard("db0", "rp0", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(id uint64) error {
+		return s.WriteToShard(id, []models.Point{models.MustNewPoint("cpu", nil, map[string]interface{}{"value": 1.0}, time.Unix(0, 0))})
+	}
+	if err := write(1); !errors.Is(err, tsm1.ErrCacheMemoryExceeded) {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := write(2); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.SetShardCacheSize(1, 0); err != nil {
+		t.Fatal(err)
+	} else if err := write(1); err != nil {
+		t.Fatal(err)
+	}
+
+	// The limit is kept when the shard is reopened. The cache is snapshotted
+	// first so that the WAL fits in it when it is reloaded.
+	if err := s.SetShardCacheSize(2, 1); err != nil {
+		t.Fatal(err)
+	} else if err := s.Shard(2).WriteSnapshot(); err != nil {
+		t.Fatal(err)
+	} else if err := s.CloseShard(2); err != nil {
+		t.Fatal(err)
+	} else if err := s.OpenShard(2); err != nil {
+		t.Fatal(err)
+	} else if n := s.Shard(2).CacheMaxSize(); n != 1 {
+		t.Fatalf("unexpected cache size: %d", n)
+	} else if err := write(2); !errors.Is(err, tsm1.ErrCacheMemoryExceeded) {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := write(1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.SetShardCacheSize(1, -1); err == nil {
+		t.Fatal("expected error for negative cache size")
+	} else if err := s.SetShardCacheSize(3, 1); err != tsdb.ErrShardNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestStore_SetShardWALFsyncDelay(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	opts := s.EngineOptions
+	opts.Config.WALFsyncDelay = toml.Duration(-1)
+	if err := s.CreateShardWithOptions("db0", "rp0", 1, opts); err != nil {
+		t.Fatal(err)
+	} else if err := s.CreateShard("db0", "rp0", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if d := s.Shard(1).WALFsyncDelay(); d != -1 {
+		t.Fatalf("unexpected fsync delay: %v", d)
+	} else if d := s.Shard(2).WALFsyncDelay(); d != 0 {
+		t.Fatalf("unexpected fsync delay: %v", d)
+	}
+
+	// The delay is kept when the shard is reopened.
+	if err := s.SetShardWALFsyncDelay(2, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	} else if err := s.CloseShard(2); err != nil {
+		t.Fatal(err)
+	} else if err := s.OpenShard(2); err != nil {
+		t.Fatal(err)
+	} else if d := s.Shard(2).WALFsyncDelay(); d != 10*time.Millisecond {
+		t.Fatalf("unexpected fsync delay: %v", d)
+	}
+
+	for _, id := range []uint64{1, 2} {
+		if err := s.WriteToShard(id, mustParsePoints(`cpu,host=serverA value=1 10`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.SetShardWALFsyncDelay(3, 0); err != tsdb.ErrShardNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Reopening the store goes back to the store's setting, and the writes
+	// are loaded from the WAL.
+	if err := s.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []uint64{1, 2} {
+		if d := s.Shard(id).WALFsyncDelay(); d != 0 {
+			t.Fatalf("shard %d: unexpected fsync delay after reopen: %v", id, d)
+		}
+		var buf bytes.Buffer
+		if err := s.ExportShard(id, &buf, math.MinInt64, math.MaxInt64); err != nil {
+			t.Fatal(err)
+		} else if exp := "cpu,host=serverA value=1 10000000000\n"; buf.String() != exp {
+			t.Fatalf("shard %d: unexpected export: %s", id, buf.String())
+		}
+	}
+}
+
+// Ensure the store applies new engine options to open and future shards and
+// ignores those that can't change while it is open.
+func TestStore_SetEngineOptions(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	for _, id := range []uint64{1, 2} {
+		if err := s.CreateShard("db0", "rp0", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.SetShardCacheSize(2, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := s.EngineOptions
+	opts.Config.CacheMaxMemorySize = 1
+	opts.Config.WALFsyncDelay = toml.Duration(time.Second)
+	opts.DedupWrites = true
+	opts.ReadOnly = true
+	opts.WALInline = true
+	opts.MaxOpenShards = 3
+	if err := s.SetEngineOptions(opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := s.Shard(1).CacheMaxSize(); n != 1 {
+		t.Fatalf("unexpected cache size: %d", n)
+	} else if n := s.Shard(2).CacheMaxSize(); n != 5 {
+		t.Fatalf("unexpected cache size of shard with its own limit: %d", n)
+	} else if d := s.Shard(2).WALFsyncDelay(); d != time.Second {
+		t.Fatalf("unexpected fsync delay: %s", d)
+	} else if err := s.WriteToShard(1, mustParsePoints(`cpu value=1 0`)); !errors.Is(err, tsm1.ErrCacheMemoryExceeded) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got := s.Options(); !got.DedupWrites {
+		t.Fatal("expected DedupWrites to be set")
+	} else if got.ReadOnly || got.WALInline || got.MaxOpenShards != 0 {
+		t.Fatalf("unexpected fixed options: %+v", got)
+	} else if s.EngineOptions.DedupWrites {
+		t.Fatal("expected EngineOptions to be unchanged")
+	}
+
+	if err := s.CreateShard("db0", "rp0", 3); err != nil {
+		t.Fatal(err)
+	} else if n := s.Shard(3).CacheMaxSize(); n != 1 {
+		t.Fatalf("unexpected cache size of new shard: %d", n)
+	}
+
+	if err := s.Store.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := s.SetEngineOptions(opts); err != tsdb.ErrStoreClosed {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure engine options can be changed while the store is in use.
+func TestStore_SetEngineOptions_Concurrent(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	if err := s.CreateShard("db0", "rp0", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		opts := s.Options()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			opts.AsyncWriteQueueSize = i%10 + 1
+			opts.VacuumBytesPerSecond = int64(i%10) << 20
+			opts.Config.CacheMaxMemorySize = uint64(i%10+1) << 20
+			if err := s.SetEngineOptions(opts); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	var writes sync.WaitGroup
+	for id := uint64(2); id <= 10; id++ {
+		if err := s.CreateShard("db0", "rp0", id); err != nil {
+			t.Fatal(err)
+		}
+		writes.Add(1)
+		if err := s.WriteToShardAsync(1, mustParsePoints(fmt.Sprintf(`cpu value=%d %d`, id, id)), func(error) { writes.Done() }); err == tsdb.ErrWriteQueueFull {
+			writes.Done()
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Vacuum(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writes.Wait()
+	close(done)
+	wg.Wait()
+}
+
+// Ensure the store describes its shards.
+func TestStore_ShardInfo(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 10`, `cpu,host=serverB value=2 20`)
+	if err := s.CreateShard("db0", "rp1", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	tsm, wal, err := s.ShardDiskSize(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sec := int64(time.Second)
+	exp := &tsdb.ShardInfo{
+		ID:              1,
+		Database:        "db0",
+		RetentionPolicy: "rp0",
+		Path:            filepath.Join(s.Path(), "db0", "rp0", "1"),
+		WALPath:         filepath.Join(s.Path(), "wal", "db0", "rp0", "1"),
+		DiskSize:        tsm + wal,
+		SeriesCount:     2,
+		MinTime:         10 * sec,
+		MaxTime:         20 * sec,
+		HasData:         true,
+	}
+	if info, err := s.ShardInfo(1); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(info, exp) {
+		t.Fatalf("unexpected shard info: %+v", info)
+	}
+
+	if a := s.AllShardInfo(); len(a) != 2 {
+		t.Fatalf("unexpected shard info count: %d", len(a))
+	} else if !reflect.DeepEqual(a[0], exp) {
+		t.Fatalf("unexpected shard info: %+v", a[0])
+	} else if a[1].ID != 2 || a[1].RetentionPolicy != "rp1" || a[1].SeriesCount != 0 || a[1].HasData {
+		t.Fatalf("unexpected shard info: %+v", a[1])
+	}
+
+	if _, err := s.ShardInfo(3); err != tsdb.ErrShardNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure the store tracks the last write of each shard.
+func TestStore_ShardLastWrite(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	if err := s.CreateShard("db0", "rp0", 1); err != nil {
+		t.Fatal(err)
+	} else if lw, ok := s.ShardLastWrite(1); !ok {
+		t.Fatal("expected shard")
+	} else if !lw.IsZero() {
+		t.Fatalf("unexpected last write: %s", lw)
+	} else if ids := s.IdleShards(time.Hour); !reflect.DeepEqual(ids, []uint64{1}) {
+		t.Fatalf("unexpected idle shards: %v", ids)
+	}
+
+	now := time.Now()
+	s.MustCreateShardWithData("db0", "rp0", 2, `cpu,host=serverA value=1 0`)
+	if lw, ok := s.ShardLastWrite(2); !ok || lw.Before(now) {
+		t.Fatalf("unexpected last write: %s", lw)
+	} else if ids := s.IdleShards(time.Hour); !reflect.DeepEqual(ids, []uint64{1}) {
+		t.Fatalf("unexpected idle shards: %v", ids)
+	}
+
+	// The last write is restored from file modification times.
+	if err := s.Reopen(); err != nil {
+		t.Fatal(err)
+	} else if lw, _ := s.ShardLastWrite(2); lw.IsZero() || time.Since(lw) > time.Hour {
+		t.Fatalf("unexpected last write after reopen: %s", lw)
+	} else if _, ok := s.ShardLastWrite(3); ok {
+		t.Fatal("unexpected shard")
+	}
+}
+
+// Ensure the store can list measurement names.
+func TestStore_MeasurementNames(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1,
+		`mem,host=serverA value=1 0`,
+		`cpu,host=serverA value=1 0`,
+		`disk,host=serverA value=1 0`,
+	)
+
+	if names, err := s.MeasurementNames("db0", nil); err != nil {
+		t.Fatal(err)
+	} else if exp := []string{"cpu", "disk", "mem"}; !reflect.DeepEqual(names, exp) {
+		t.Fatalf("unexpected names: %v", names)
+	}
+
+	if names, err := s.MeasurementNames("db0", regexp.MustCompile(`^(cpu|mem)$`)); err != nil {
+		t.Fatal(err)
+	} else if exp := []string{"cpu", "mem"}; !reflect.DeepEqual(names, exp) {
+		t.Fatalf("unexpected names: %v", names)
+	}
+
+	if names, err := s.MeasurementNames("db1", nil); err != nil || names != nil {
+		t.Fatalf("unexpected result: %v, %v", names, err)
+	}
+}
+
+// Ensure the store lists the series keys of a measurement.
+func TestStore_SeriesKeys(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1,
+		`cpu,host=serverB value=1 0`,
+		`cpu,host=serverA value=2 0`,
+		`cpu,host=serverC value=3 0`,
+		`mem,host=serverA value=4 0`,
+	)
+
+	exp := []string{"cpu,host=serverA", "cpu,host=serverB", "cpu,host=serverC"}
+	if keys, err := s.SeriesKeys("db0", "cpu"); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(keys, exp) {
+		t.Fatalf("unexpected series keys: %v", keys)
+	}
+
+	var keys []string
+	if err := s.ForEachSeriesKey("db0", "cpu", func(key string) bool {
+		keys = append(keys, key)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	} else if sort.Strings(keys); !reflect.DeepEqual(keys, exp) {
+		t.Fatalf("unexpected series keys: %v", keys)
+	}
+
+	// The walk stops when fn returns false.
+	n := 0
+	if err := s.ForEachSeriesKey("db0", "cpu", func(key string) bool {
+		n++
+		return n < 2
+	}); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatalf("unexpected calls: %d", n)
+	}
+
+	if _, err := s.SeriesKeys("db0", "disk"); err == nil || err.Error() != "measurement not found: disk" {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := s.ForEachSeriesKey("db1", "cpu", func(string) bool { return true }); err == nil || err.Error() != "database not found: db1" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure the store can iterate over the series of a database.
+func TestStore_SeriesIterator(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1,
+		`mem,host=serverA value=1 0`,
+		`cpu,host=serverB value=1 0`,
+		`cpu,host=serverA value=1 0`,
+	)
+	s.MustCreateShardWithData("db0", "rp0", 2, `cpu,host=serverC value=1 10`, `disk,host=serverA value=1 10`)
+
+	itr, err := s.SeriesIterator("db0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Series dropped before they are reached are skipped.
+	var got []string
+	if name, key, ok := itr.Next(); !ok || name != "cpu" || key != "cpu,host=serverB" {
+		t.Fatalf("unexpected first series: %s, %s, %v", name, key, ok)
+	} else if err := s.DeleteSeries("db0", nil, influxql.MustParseExpr(`host = 'serverC'`)); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		name, key, ok := itr.Next()
+		if !ok {
+			break
+		}
+		got = append(got, name+" "+key)
+	}
+	if exp := []string{"cpu cpu,host=serverA", "disk disk,host=serverA", "mem mem,host=serverA"}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected series: %v", got)
+	} else if _, _, ok := itr.Next(); ok {
+		t.Fatal("expected iterator to stay done")
+	}
+
+	if _, err := s.SeriesIterator("db1"); err == nil || err.Error() != influxql.ErrDatabaseNotFound("db1").Error() {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure regex sources only expand to measurements of their retention policy.
+func TestStore_ExpandSources_RetentionPolicy(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 0`, `mem,host=serverA value=1 0`)
+	s.MustCreateShardWithData("db0", "rp1", 2, `cpu,host=serverB value=2 0`, `disk,host=serverB value=2 0`)
+
+	for _, tt := range []struct {
+		rp  string
+		exp []string
+	}{
+		{rp: "rp0", exp: []string{"cpu", "mem"}},
+		{rp: "rp1", exp: []string{"cpu", "disk"}},
+		{rp: "rp2", exp: []string{}},
+		{rp: "", exp: []string{"cpu", "disk", "mem"}},
+	} {
+		sources, err := s.ExpandSources(influxql.Sources{&influxql.Measurement{
+			Database:        "db0",
+			RetentionPolicy: tt.rp,
+			Regex:           &influxql.RegexLiteral{Val: regexp.MustCompile(`.*`)},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names := []string{}
+		for _, src := range sources {
+			m := src.(*influxql.Measurement)
+			if m.RetentionPolicy != tt.rp {
+				t.Fatalf("unexpected retention policy: %s", m.RetentionPolicy)
+			}
+			names = append(names, m.Name)
+		}
+		if !reflect.DeepEqual(names, tt.exp) {
+			t.Fatalf("%q: unexpected measurements: %v", tt.rp, names)
+		}
+	}
+}
+
+// Ensure the store can write to several shards at once and reports the
+// shards that failed.
+func TestStore_WriteToShards(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	if err := s.CreateShard("db0", "rp0", 1); err != nil {
+		t.Fatal(err)
+	} else if err := s.CreateShard("db0", "rp0", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	writes := map[uint64][]models.Point{
+		1: mustParsePoints(`cpu,host=serverA value=1 0`),
+		2: mustParsePoints(`cpu,host=serverB value=2 0`),
+	}
+	if err := s.WriteToShards(writes); err != nil {
+		t.Fatal(err)
+	} else if n, err := s.SeriesCardinality("db0"); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatalf("unexpected series cardinality: %d", n)
+	}
+
+	// A missing shard fails on its own and the other shards are written.
+	writes = map[uint64][]models.Point{
+		1: mustParsePoints(`cpu,host=serverC value=3 0`),
+		3: mustParsePoints(`cpu,host=serverD value=4 0`),
+	}
+	err := s.WriteToShards(writes)
+	errs, ok := err.(tsdb.ShardWriteErrors)
+	if !ok {
+		t.Fatalf("unexpected error: %v", err)
+	} else if len(errs) != 1 || errs[3] != tsdb.ErrShardNotFound {
+		t.Fatalf("unexpected errors: %v", errs)
+	} else if !tsdb.IsRetryable(errs[3]) {
+		t.Fatal("expected retryable error")
+	} else if n, err := s.SeriesCardinality("db0"); err != nil {
+		t.Fatal(err)
+	} else if n != 3 {
+		t.Fatalf("unexpected series cardinality: %d", n)
+	}
+}
+
+// Ensure a field type conflict reports the offending point.
+func TestStore_WriteToShard_FieldTypeConflict(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 0`)
+
+	// Conflict with a field already in the shard.
+	err := s.WriteToShard(1, mustParsePoints(`cpu,host=serverA value=2 10`+"\n"+`cpu,host=serverB value="x" 10`))
+	if e, ok := err.(tsdb.FieldTypeConflictError); !ok {
+		t.Fatalf("unexpected error: %v", err)
+	} else if e.Index != 1 || e.SeriesKey != "cpu,host=serverB" || e.Field != "value" || e.Type != influxql.Float {
+		t.Fatalf("unexpected error: %#v", e)
+	} else if tsdb.IsRetryable(err) {
+		t.Fatal("expected non-retryable error")
+	}
+
+	// Conflict between the points of one write on a new field.
+	err = s.WriteToShard(1, mustParsePoints(`mem,host=serverA free=1i 10`+"\n"+`mem,host=serverA free=2i 20`+"\n"+`mem,host=serverB free=true 20`))
+	if e, ok := err.(tsdb.FieldTypeConflictError); !ok {
+		t.Fatalf("unexpected error: %v", err)
+	} else if e.Index != 2 || e.SeriesKey != "mem,host=serverB" || e.Type != influxql.Integer {
+		t.Fatalf("unexpected error: %#v", e)
+	}
+
+	// Dropping the offending point lets the rest be written.
+	s.MustWriteToShardString(1, `cpu,host=serverA value=2 10`)
+}
+
+// Ensure retryability is decided by error type through any wrapping.
+func TestIsRetryable(t *testing.T) {
+	for _, tt := range []struct {
+		err error
+		exp bool
+	}{
+		{err: nil, exp: true},
+		{err: tsdb.ErrShardNotFound, exp: true},
+		{err: errors.New("write failed"), exp: true},
+		{err: tsdb.ErrFieldTypeConflict, exp: false},
+		{err: tsdb.FieldTypeConflictError{Field: "value"}, exp: false},
+		{err: fmt.Errorf("engine: %w", tsdb.ErrFieldTypeConflict), exp: false},
+		{err: tsdb.NewShardError(1, tsdb.ErrMaxSeriesLimitExceeded{Database: "db0"}), exp: false},
+		{err: errors.New("field type conflict: legacy"), exp: false},
+		{err: tsdb.NewShardError(1, tsdb.ErrShardReadOnly), exp: false},
+	} {
+		if got := tsdb.IsRetryable(tt.err); got != tt.exp {
+			t.Errorf("%v: got %v, exp %v", tt.err, got, tt.exp)
+		}
+	}
+}
+
+// Ensure writes that would create too many series in a database are rejected
+// while existing series can still be written.
+func TestStore_MaxSeriesPerDatabase(t *testing.T) {
+	s := NewStore()
+	s.EngineOptions.MaxSeriesPerDatabase = 2
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.CreateShard("db0", "rp0", 1); err != nil {
+		t.Fatal(err)
+	} else if err := s.CreateShard("db0", "rp0", 2); err != nil {
+		t.Fatal(err)
+	}
+	s.MustWriteToShardString(1, `cpu,host=serverA value=1 0`, `cpu,host=serverB value=2 0`)
+
+	// The limit applies to the database, across shards.
+	err := s.WriteToShard(2, mustParsePoints(`cpu,host=serverA value=3 10`+"\n"+`cpu,host=serverC value=4 10`))
+	if e, ok := err.(tsdb.ErrMaxSeriesLimitExceeded); !ok {
+		t.Fatalf("unexpected error: %v", err)
+	} else if e.Database != "db0" || e.Series != 2 || e.Limit != 2 {
+		t.Fatalf("unexpected error: %#v", e)
+	} else if tsdb.IsRetryable(err) {
+		t.Fatal("expected non-retryable error")
+	}
+
+	// Series that exist keep accepting writes.
+	s.MustWriteToShardString(2, `cpu,host=serverA value=5 20`)
+	s.MustWriteToShardString(1, `cpu,host=serverB value=6 20`)
+	if n, err := s.SeriesCardinality("db0"); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatalf("unexpected series cardinality: %d", n)
+	}
+}
+
+// Ensure the store scales timestamps written with a precision.
+func TestStore_WriteToShardWithPrecision(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	if err := s.CreateShard("db0", "rp0", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		precision string
+		ts        int64
+	}{
+		{precision: "s", ts: 10},
+		{precision: "ms", ts: 20000},
+		{precision: "us", ts: 30000000},
+		{precision: "u", ts: 40000000},
+		{precision: "ns", ts: 50000000000},
+		{precision: "n", ts: 60000000000},
+	} {
+		points := []models.Point{models.MustNewPoint("cpu", map[string]string{"host": "serverA"}, map[string]interface{}{"value": 1.0}, time.Unix(0, tt.ts))}
+		if err := s.WriteToShardWithPrecision(1, points, tt.precision); err != nil {
+			t.Fatalf("%s: %s", tt.precision, err)
+		}
+	}
+	if min, max, err := s.ShardTimeRange(1); err != nil {
+		t.Fatal(err)
+	} else if min != 10*int64(time.Second) || max != 60*int64(time.Second) {
+		t.Fatalf("unexpected time range: %d, %d", min, max)
+	}
+
+	points := mustParsePoints(`cpu,host=serverA value=1 100`)
+	if err := s.WriteToShardWithPrecision(1, points, "m"); err == nil || err.Error() != `invalid precision: "m"` {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := s.WriteToShardWithPrecision(1, points, "s"); err == nil {
+		t.Fatal("expected out of range error")
+	} else if !points[0].Time().Equal(time.Unix(100, 0)) {
+		t.Fatalf("unexpected time after failed write: %s", points[0].Time())
+	}
+}
+
+// Ensure the store writes the valid points of a batch and returns the others.
+func TestStore_WriteToShardPartial(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 0`)
+
+	noName, err := models.NewPoint("", models.Tags{"host": "serverA"}, models.Fields{"value": 1.0}, time.Unix(10, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	points := mustParsePoints("cpu,host=serverA value=2 10\n" +
+		"cpu,host=serverB value=\"x\" 10\n" +
+		"mem,host=serverA free=1i 10\n" +
+		"mem,host=serverB free=2 10")
+	points = append(points[:2], append([]models.Point{noName}, points[2:]...)...)
+
+	written, rejected, err := s.WriteToShardPartial(1, points)
+	if err != nil {
+		t.Fatal(err)
+	} else if written != 2 {
+		t.Fatalf("unexpected points written: %d", written)
+	} else if len(rejected) != 3 {
+		t.Fatalf("unexpected rejected points: %v", rejected)
+	}
+
+	if r := rejected[0]; r.Index != 1 || !errors.Is(r.Err, tsdb.ErrFieldTypeConflict) {
+		t.Fatalf("unexpected rejection: %d, %v", r.Index, r.Err)
+	} else if e := r.Err.(tsdb.FieldTypeConflictError); e.Index != 1 || e.Field != "value" {
+		t.Fatalf("unexpected conflict: %#v", e)
+	} else if r := rejected[1]; r.Index != 2 || !errors.Is(r.Err, tsdb.ErrInvalidPoint) || r.Point != noName {
+		t.Fatalf("unexpected rejection: %d, %v", r.Index, r.Err)
+	} else if r := rejected[2]; r.Index != 4 || !errors.Is(r.Err, tsdb.ErrFieldTypeConflict) {
+		t.Fatalf("unexpected rejection: %d, %v", r.Index, r.Err)
+	}
+
+	if !s.HasSeries("db0", "mem,host=serverA") || s.HasSeries("db0", "mem,host=serverB") || s.HasSeries("db0", "cpu,host=serverB") {
+		t.Fatal("unexpected series after partial write")
+	}
+
+	// Errors for the whole batch are returned as they are.
+	if _, _, err := s.WriteToShardPartial(2, points[:1]); err != tsdb.ErrShardNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure duplicate points in a write are collapsed when the shard dedups writes.
+func TestStore_WriteToShard_DedupWrites(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	opts := s.EngineOptions
+	opts.DedupWrites = true
+	if err := s.CreateShardWithOptions("db0", "rp0", 1, opts); err != nil {
+		t.Fatal(err)
+	} else if err := s.CreateShard("db0", "rp0", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	data := "cpu,host=A value=1,idle=5 0\ncpu,host=B value=3 0\ncpu,host=A value=2 0\nmem,host=A used=1i 0\nmem,host=A used=2 0"
+	if err := s.WriteToShard(1, mustParsePoints(data)); err != nil {
+		t.Fatal(err)
+	} else if points, _ := s.ShardWriteStats(1); points != 3 {
+		t.Fatalf("unexpected points written: %d", points)
+	}
+
+	var buf bytes.Buffer
+	if err := s.ExportShard(1, &buf, math.MinInt64, math.MaxInt64); err != nil {
+		t.Fatal(err)
+	} else if exp := "cpu,host=A idle=5,value=2 0\ncpu,host=B value=3 0\nmem,host=A used=2 0\n"; buf.String() != exp {
+		t.Fatalf("unexpected export:\n%s", buf.String())
+	}
+
+	// Shards without the option keep failing on the type change.
+	if err := s.WriteToShard(2, mustParsePoints(data)); !errors.Is(err, tsdb.ErrFieldTypeConflict) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Conflicts are reported at their position in the write.
+	var conflict tsdb.FieldTypeConflictError
+	if err := s.WriteToShard(1, mustParsePoints("cpu,host=C value=1 0\ncpu,host=C value=2 0\ncpu,host=D value=\"x\" 0")); !errors.As(err, &conflict) {
+		t.Fatalf("unexpected error: %v", err)
+	} else if conflict.Index != 2 {
+		t.Fatalf("unexpected conflict index: %d", conflict.Index)
+	}
+
+	written, rejected, err := s.WriteToShardPartial(1, mustParsePoints("cpu,host=E value=1 0\ncpu,host=E value=2 0\ncpu,host=F value=\"x\" 0"))
+	if err != nil {
+		t.Fatal(err)
+	} else if written != 1 {
+		t.Fatalf("unexpected written: %d", written)
+	} else if len(rejected) != 1 || rejected[0].Index != 2 {
+		t.Fatalf("unexpected rejected: %v", rejected)
+	}
+}
+
+// Ensure the store can write without waiting on a busy shard.
+func TestStore_TryWriteToShard(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	if err := s.CreateShard("db0", "rp0", 1); err != nil {
+		t.Fatal(err)
+	}
+	opts := s.EngineOptions
+	opts.EngineVersion = "tsm1-busy"
+	if err := s.CreateShardWithOptions("db0", "rp0", 2, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.TryWriteToShard(1, mustParsePoints(`cpu,host=serverA value=1 0`)); err != nil {
+		t.Fatal(err)
+	} else if n, err := s.SeriesCardinality("db0"); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatalf("unexpected series cardinality: %d", n)
+	}
+
+	if err := s.TryWriteToShard(2, mustParsePoints(`cpu,host=serverA value=2 10`)); err != tsdb.ErrShardBusy {
+		t.Fatalf("unexpected error: %v", err)
+	} else if !tsdb.IsRetryable(err) {
+		t.Fatal("expected retryable error")
+	}
+
+	// The blocking write path is unaffected.
+	if err := s.WriteToShard(2, mustParsePoints(`cpu,host=serverA value=2 10`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.TryWriteToShard(3, mustParsePoints(`cpu,host=serverA value=3 20`)); err != tsdb.ErrShardNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure the store counts the points and bytes written to each shard.
+func TestStore_ShardWriteStats(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	if err := s.CreateShard("db0", "rp0", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	points := mustParsePoints("cpu,host=serverA value=1 0\ncpu,host=serverB value=2 10")
+	if err := s.WriteToShard(1, points); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := uint64(points[0].StringSize() + points[1].StringSize())
+	if n, b := s.ShardWriteStats(1); n != 2 || b != exp {
+		t.Fatalf("unexpected write stats: points=%d bytes=%d", n, b)
+	}
+
+	s.ResetShardWriteStats(1)
+	if n, b := s.ShardWriteStats(1); n != 0 || b != 0 {
+		t.Fatalf("unexpected write stats after reset: points=%d bytes=%d", n, b)
+	} else if n, b := s.ShardWriteStats(2); n != 0 || b != 0 {
+		t.Fatalf("unexpected write stats for missing shard: points=%d bytes=%d", n, b)
+	}
+}
+
+func TestStore_ShardPointsWrittenSince(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	start := time.Now()
+	if err := s.CreateShard("db0", "rp0", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Write times have one second resolution, so step over second boundaries
+	// between the writes and the reading.
+	nextSecond := func() time.Time {
+		now := time.Now()
+		time.Sleep(now.Truncate(time.Second).Add(time.Second + 10*time.Millisecond).Sub(now))
+		return time.Now()
+	}
+
+	if err := s.WriteToShard(1, mustParsePoints("cpu,host=serverA value=1 0\ncpu,host=serverB value=2 10")); err != nil {
+		t.Fatal(err)
+	}
+	mid := nextSecond()
+	nextSecond()
+	if err := s.WriteToShard(1, mustParsePoints("cpu,host=serverA value=3 20\ncpu,host=serverB value=4 30\ncpu,host=serverC value=5 40")); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := s.ShardPointsWrittenSince(1, mid); err != nil {
+		t.Fatal(err)
+	} else if n != 3 {
+		t.Fatalf("unexpected points written since %s: %d", mid, n)
+	}
+	if n, err := s.ShardPointsWrittenSince(1, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatalf("unexpected points written in the future: %d", n)
+	}
+	if _, err := s.ShardPointsWrittenSince(1, start.Add(-time.Minute)); err != tsdb.ErrWriteHistoryUnavailable {
+		t.Fatalf("unexpected error: %v", err)
+	} else if _, err := s.ShardPointsWrittenSince(2, mid); err != tsdb.ErrShardNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The sequence isn't reset with the write stats.
+	s.ResetShardWriteStats(1)
+	if seq, err := s.ShardWriteSequence(1); err != nil {
+		t.Fatal(err)
+	} else if seq != 5 {
+		t.Fatalf("unexpected write sequence: %d", seq)
+	} else if _, err := s.ShardWriteSequence(2); err != tsdb.ErrShardNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure the store can be opened with only some of its databases.
+func TestStore_DatabaseFilter(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 0`)
+	s.MustCreateShardWithData("db1", "rp0", 2, `mem,host=serverA value=1 0`)
+
+	if err := s.Store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s.Store = tsdb.NewStore(s.Path())
+	s.EngineOptions.Config.WALDir = filepath.Join(s.Path(), "wal")
+	s.EngineOptions.DatabaseFilter = []string{"db0"}
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	if dbs := s.Databases(); !reflect.DeepEqual(dbs, []string{"db0"}) {
+		t.Fatalf("unexpected databases: %v", dbs)
+	} else if s.Shard(1) == nil {
+		t.Fatal("expected shard 1 to be loaded")
+	} else if err := s.WriteToShard(2, mustParsePoints(`mem,host=serverA value=2 10`)); err != tsdb.ErrShardNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The excluded database can't be changed and stays on disk.
+	if _, err := s.DeleteDatabase("db1"); err == nil {
+		t.Fatal("expected error")
+	} else if err := s.CreateShard("db1", "rp0", 3); err == nil {
+		t.Fatal("expected error")
+	} else if _, err := os.Stat(filepath.Join(s.Path(), "db1", "rp0", "2")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure a snapshot of the store can be opened as a new store.
+func TestStore_Snapshot(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 0`)
+	s.MustCreateShardWithData("db0", "rp1", 2, `cpu,host=serverB value=2 0`)
+	s.MustCreateShardWithData("db1", "rp0", 3, `mem,host=serverA value=3 0`)
+
+	dir, err := ioutil.TempDir("", "freetsdb-tsdb-snapshot-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dest := filepath.Join(dir, "data")
+
+	if err := s.Snapshot(dest); err != nil {
+		t.Fatal(err)
+	} else if err := s.Snapshot(dest); err == nil {
+		t.Fatal("expected error for a non-empty destination")
+	}
+
+	// Writes after the snapshot are not in the copy.
+	s.MustWriteToShardString(1, `cpu,host=serverC value=4 10`)
+
+	buf, err := ioutil.ReadFile(filepath.Join(dest, tsdb.SnapshotManifestFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest tsdb.SnapshotManifest
+	if err := json.Unmarshal(buf, &manifest); err != nil {
+		t.Fatal(err)
+	} else if got, exp := manifest, (tsdb.SnapshotManifest{Databases: []tsdb.DatabaseManifest{
+		{Database: "db0", Shards: []tsdb.DatabaseManifestShard{{ID: 1, RetentionPolicy: "rp0"}, {ID: 2, RetentionPolicy: "rp1"}}},
+		{Database: "db1", Shards: []tsdb.DatabaseManifestShard{{ID: 3, RetentionPolicy: "rp0"}}},
+	}}); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected manifest: %#v", got)
+	}
+
+	other := tsdb.NewStore(dest)
+	other.EngineOptions.Config.WALDir = filepath.Join(dir, "wal")
+	if err := other.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	if ids := other.ShardIDs(); len(ids) != 3 {
+		t.Fatalf("unexpected shards: %v", ids)
+	} else if n, err := other.SeriesCardinality("db0"); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatalf("unexpected db0 series cardinality: %d", n)
+	} else if names, err := other.MeasurementNames("db1", nil); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(names, []string{"mem"}) {
+		t.Fatalf("unexpected db1 measurements: %v", names)
+	}
+}
+
+// Ensure the store places and finds shards with a custom path layout.
+func TestStore_ShardPathFunc(t *testing.T) {
+	disk2, err := ioutil.TempDir("", "freetsdb-tsdb-disk2-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(disk2)
+
+	// Odd shards are placed on the second disk.
+	s := NewStore()
+	defer s.Close()
+	setOptions := func() {
+		s.EngineOptions.ShardPathFunc = func(db, rp string, id uint64) (string, string) {
+			root := s.Path()
+			if id%2 == 1 {
+				root = disk2
+			}
+			name := strconv.FormatUint(id, 10)
+			return filepath.Join(root, db, rp, name), filepath.Join(s.Path(), "wal", db, rp, name)
+		}
+		s.EngineOptions.ShardRootsFunc = func() []string { return []string{disk2} }
+	}
+	setOptions()
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 0`)
+	s.MustCreateShardWithData("db0", "rp0", 2, `mem,host=serverA value=1 0`)
+	if exp := filepath.Join(disk2, "db0", "rp0", "1"); s.Shard(1).Path() != exp {
+		t.Fatalf("unexpected shard path: %s", s.Shard(1).Path())
+	} else if exp := filepath.Join(s.Path(), "db0", "rp0", "2"); s.Shard(2).Path() != exp {
+		t.Fatalf("unexpected shard path: %s", s.Shard(2).Path())
+	} else if path, err := s.ShardRelativePath(1); err != nil || path != filepath.Join("db0", "rp0", "1") {
+		t.Fatalf("unexpected relative path: %s, %v", path, err)
+	}
+
+	// Both shards are found again when the store is reopened.
+	if err := s.Store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s.Store = tsdb.NewStore(s.Path())
+	s.EngineOptions.Config.WALDir = filepath.Join(s.Path(), "wal")
+	setOptions()
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	} else if s.Shard(1) == nil || s.Shard(2) == nil {
+		t.Fatalf("unexpected shards: %v", s.ShardIDs())
+	} else if names, err := s.MeasurementNames("db0", nil); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(names, []string{"cpu", "mem"}) {
+		t.Fatalf("unexpected measurements: %v", names)
+	}
+
+	// Moved shards stay on their disk.
+	if err := s.MoveShard(1, "db0", "rp1"); err != nil {
+		t.Fatal(err)
+	} else if exp := filepath.Join(disk2, "db0", "rp1", "1"); s.Shard(1).Path() != exp {
+		t.Fatalf("unexpected shard path: %s", s.Shard(1).Path())
+	}
+
+	if _, err := s.DeleteDatabase("db0"); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{filepath.Join(disk2, "db0"), filepath.Join(s.Path(), "db0")} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be removed: %v", path, err)
+		}
+	}
+}
+
+// Ensure the store counts the entries it skips when loading shards.
+func TestStore_SkippedShardsN(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 0`)
+
+	// The test store keeps its WAL under the data directory, which is
+	// loaded like a database, so only count what the junk adds.
+	if err := s.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	n0 := s.SkippedShardsN()
+
+	// Leave junk at each level of the data directory.
+	for _, path := range []string{
+		filepath.Join(s.Path(), "junk"),
+		filepath.Join(s.Path(), "db0", "junk"),
+	} {
+		if err := ioutil.WriteFile(path, []byte("junk"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(s.Path(), "db0", "rp0", "backup"), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Reopen(); err != nil {
+		t.Fatal(err)
+	} else if n := s.SkippedShardsN() - n0; n != 3 {
+		t.Fatalf("unexpected skipped shards: %d", n)
+	} else if s.Shard(1) == nil {
+		t.Fatal("expected shard 1 to be loaded")
+	}
+}
+
+// Ensure the store selects shards by the time range of their data.
+func TestStore_ShardsForTimeRange(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 10`, `cpu,host=serverA value=2 20`)
+	s.MustCreateShardWithData("db0", "rp0", 2, `cpu,host=serverA value=3 30`)
+	s.MustCreateShardWithData("db0", "rp1", 3, `cpu,host=serverA value=4 10`)
+	if err := s.CreateShard("db0", "rp0", 4); err != nil {
+		t.Fatal(err)
+	}
+
+	sec := int64(time.Second)
+	ids := func(a []*tsdb.Shard) []uint64 {
+		var ids []uint64
+		for _, sh := range a {
+			ids = append(ids, sh.ID())
+		}
+		return ids
+	}
+	test := func(min, max int64, exp []uint64) {
+		t.Helper()
+		if got := ids(s.ShardsForTimeRange("db0", "rp0", min*sec, max*sec)); !reflect.DeepEqual(got, exp) {
+			t.Fatalf("[%d, %d]: unexpected shards: %v, exp %v", min, max, got, exp)
+		}
+	}
+	test(0, 100, []uint64{1, 2})
+	test(0, 5, nil)
+	test(20, 25, []uint64{1})
+	test(25, 30, []uint64{2})
+
+	// Writes widen the cached range.
+	s.MustWriteToShardString(2, `cpu,host=serverA value=5 0`)
+	test(0, 5, []uint64{2})
+
+	// The range is loaded again when the store is reopened.
+	if err := s.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	test(0, 5, []uint64{2})
+	test(11, 19, []uint64{1, 2})
+	test(31, 100, nil)
+}
+
+func TestStore_ShardsOrderedByTime(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 30`)
+	if err := s.CreateShard("db0", "rp0", 2); err != nil {
+		t.Fatal(err)
+	}
+	s.MustCreateShardWithData("db0", "rp0", 3, `cpu,host=serverA value=2 10`, `cpu,host=serverA value=3 40`)
+	s.MustCreateShardWithData("db0", "rp0", 4, `cpu,host=serverA value=4 10`, `cpu,host=serverA value=5 20`)
+	s.MustCreateShardWithData("db0", "rp0", 5, `cpu,host=serverA value=6 10`, `cpu,host=serverA value=5 20`)
+	s.MustCreateShardWithData("db0", "rp1", 6, `cpu,host=serverA value=7 0`)
+
+	ids := func(a []*tsdb.Shard) []uint64 {
+		var ids []uint64
+		for _, sh := range a {
+			ids = append(ids, sh.ID())
+		}
+		return ids
+	}
+	if a, err := s.ShardsOrderedByTime("db0", "rp0"); err != nil {
+		t.Fatal(err)
+	} else if got, exp := ids(a), []uint64{4, 5, 3, 1, 2}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected shards: %v, exp %v", got, exp)
+	}
+
+	// Writes move a shard by its cached range.
+	s.MustWriteToShardString(1, `cpu,host=serverA value=8 0`)
+	if a, err := s.ShardsOrderedByTime("db0", "rp0"); err != nil {
+		t.Fatal(err)
+	} else if got, exp := ids(a), []uint64{1, 4, 5, 3, 2}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected shards after write: %v, exp %v", got, exp)
+	}
+
+	if a, err := s.ShardsOrderedByTime("db0", "no_rp"); err != nil || len(a) != 0 {
+		t.Fatalf("unexpected result: %v, %v", ids(a), err)
+	} else if _, err := s.ShardsOrderedByTime("no_db", "rp0"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// Ensure the store reports the time range of a shard.
+func TestStore_ShardTimeRange(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	if err := s.CreateShard("db0", "rp0", 1); err != nil {
+		t.Fatal(err)
+	} else if _, _, err := s.ShardTimeRange(1); err != tsdb.ErrShardEmpty {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	sec := int64(time.Second)
+	s.MustWriteToShardString(1, `cpu,host=serverA value=1 20`, `cpu,host=serverA value=2 10`)
+	if min, max, err := s.ShardTimeRange(1); err != nil {
+		t.Fatal(err)
+	} else if min != 10*sec || max != 20*sec {
+		t.Fatalf("unexpected time range: %d, %d", min, max)
+	}
+
+	// The range is loaded from the shard's files when the store is reopened.
+	s.MustWriteToShardString(1, `cpu,host=serverB value=3 30`)
+	if err := s.Reopen(); err != nil {
+		t.Fatal(err)
+	} else if min, max, err := s.ShardTimeRange(1); err != nil {
+		t.Fatal(err)
+	} else if min != 10*sec || max != 30*sec {
+		t.Fatalf("unexpected time range after reopen: %d, %d", min, max)
+	}
+
+	if _, _, err := s.ShardTimeRange(2); err != tsdb.ErrShardNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure the store reports the time range of a series across shards.
+func TestStore_SeriesTimeRange(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	sec := int64(time.Second)
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 20`, `cpu,host=serverB value=1 5`)
+	s.MustCreateShardWithData("db0", "rp0", 2, `cpu,host=serverA idle=2 40`, `cpu,host=serverA value=3 30`)
+	s.MustCreateShardWithData("db1", "rp0", 3, `cpu,host=serverA value=1 100`)
+
+	// Shard 1 is read through its TSM files and shard 2 through its cache.
+	if err := s.FlushWAL(1); err != nil {
+		t.Fatal(err)
+	}
+
+	if first, last, err := s.SeriesTimeRange("db0", "cpu,host=serverA"); err != nil {
+		t.Fatal(err)
+	} else if first != 20*sec || last != 40*sec {
+		t.Fatalf("unexpected time range: %d, %d", first, last)
+	}
+
+	cond := influxql.MustParseExpr(`host = 'serverA'`)
+	sources := []influxql.Source{&influxql.Measurement{Database: "db0", RetentionPolicy: "rp0", Name: "cpu"}}
+	if err := s.DeleteSeriesRange("db0", sources, cond, 15*sec, 25*sec); err != nil {
+		t.Fatal(err)
+	} else if first, last, err := s.SeriesTimeRange("db0", "cpu,host=serverA"); err != nil {
+		t.Fatal(err)
+	} else if first != 30*sec || last != 40*sec {
+		t.Fatalf("unexpected time range after delete: %d, %d", first, last)
+	}
+
+	if _, _, err := s.SeriesTimeRange("db0", "cpu,host=serverC"); err != tsdb.ErrSeriesEmpty {
+		t.Fatalf("unexpected error: %v", err)
+	} else if _, _, err := s.SeriesTimeRange("no_db", "cpu,host=serverA"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// Ensure the store deletes shards whose data is older than the retention
+// period.
+func TestStore_EnforceRetention(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	now := time.Now().Unix()
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 0`)
+	s.MustCreateShardWithData("db0", "rp0", 2, fmt.Sprintf(`cpu,host=serverA value=1 %d`, now))
+	s.MustCreateShardWithData("db0", "rp0", 3, `cpu,host=serverB value=1 0`)
+	s.MustCreateShardWithData("db0", "rp1", 4, `cpu,host=serverA value=1 0`)
+	if err := s.CreateShard("db0", "rp0", 5); err != nil {
+		t.Fatal(err)
+	}
+
+	// Shard 1 is checked through its TSM files and shard 3 through its cache.
+	if err := s.FlushWAL(1); err != nil {
+		t.Fatal(err)
+	}
+
+	if ids, err := s.EnforceRetention("db0", "rp0", 24*time.Hour); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(ids, []uint64{1, 3}) {
+		t.Fatalf("unexpected deleted shards: %v", ids)
+	} else if got := s.ShardIDs(); len(got) != 3 || s.Shard(2) == nil || s.Shard(4) == nil || s.Shard(5) == nil {
+		t.Fatalf("unexpected shards: %v", got)
+	}
+
+	// A zero duration keeps everything.
+	if ids, err := s.EnforceRetention("db0", "rp1", 0); err != nil || ids != nil {
+		t.Fatalf("unexpected result: %v, %v", ids, err)
+	}
+}
+
+// Ensure the store can iterate its shards without being locked.
+func TestStore_ForEachShard(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	for _, id := range []uint64{2, 1} {
+		if err := s.CreateShard("db0", "rp0", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The callback can modify the store.
+	var ids []uint64
+	if err := s.ForEachShard(func(sh *tsdb.Shard) error {
+		ids = append(ids, sh.ID())
+		return s.CreateShard("db0", "rp0", sh.ID()+10)
+	}); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(ids, []uint64{1, 2}) {
+		t.Fatalf("unexpected shards: %v", ids)
+	} else if n := s.ShardN(); n != 4 {
+		t.Fatalf("unexpected shard count: %d", n)
+	}
+
+	// Iteration stops at the first error.
+	ids = nil
+	if err := s.ForEachShard(func(sh *tsdb.Shard) error {
+		ids = append(ids, sh.ID())
+		return errors.New("stop")
+	}); err == nil || err.Error() != "stop" {
+		t.Fatalf("unexpected error: %v", err)
+	} else if len(ids) != 1 {
+		t.Fatalf("unexpected shards: %v", ids)
+	}
+}
+
+// Ensure shard handlers are called after shards are created and deleted.
+func TestStore_ShardHooks(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	var created []string
+	var deleted []uint64
+	for i := 0; i < 2; i++ {
+		s.OnShardCreated(func(id uint64, database, rp string) {
+			// The store must not be locked while handlers run.
+			if s.Shard(id) == nil {
+				t.Errorf("shard %d not found in handler", id)
+			}
+			created = append(created, fmt.Sprintf("%d/%s/%s", id, database, rp))
+		})
+		s.OnShardDeleted(func(id uint64) {
+			if s.Shard(id) != nil {
+				t.Errorf("shard %d still open in handler", id)
+			}
+			deleted = append(deleted, id)
+		})
+	}
+
+	if err := s.CreateShard("db0", "rp0", 1); err != nil {
+		t.Fatal(err)
+	} else if err := s.CreateShard("db0", "rp0", 1); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(created, []string{"1/db0/rp0", "1/db0/rp0"}) {
+		t.Fatalf("unexpected created shards: %v", created)
+	}
+
+	if ok, err := s.DeleteShard(1); err != nil || !ok {
+		t.Fatalf("unexpected result: %v, %v", ok, err)
+	} else if ok, err := s.DeleteShard(1); err != nil || ok {
+		t.Fatalf("unexpected result: %v, %v", ok, err)
+	} else if !reflect.DeepEqual(deleted, []uint64{1, 1}) {
+		t.Fatalf("unexpected deleted shards: %v", deleted)
+	}
+}
+
+// Ensure the store can import prebuilt TSM files into a shard.
+func TestStore_ImportShard(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "freetsdb-tsdb-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "import.tsm")
+	mustWriteTSM(path, map[string][]tsm1.Value{
+		"cpu,host=serverA#!~#value": {tsm1.NewValue(0, 1.0), tsm1.NewValue(10, 2.0)},
+	})
+
+	if err := s.ImportShard("db0", "rp0", 1, []string{path}); err != nil {
+		t.Fatal(err)
+	} else if names, err := s.MeasurementNames("db0", nil); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(names, []string{"cpu"}) {
+		t.Fatalf("unexpected measurement names: %v", names)
+	}
+
+	if files, err := filepath.Glob(filepath.Join(s.Path(), "db0", "rp0", "1", "*.tsm")); err != nil {
+		t.Fatal(err)
+	} else if len(files) != 1 {
+		t.Fatalf("unexpected files: %v", files)
+	}
+
+	// Importing the same data again overlaps the existing series.
+	if err := s.ImportShard("db0", "rp0", 1, []string{path}); err == nil {
+		t.Fatal("expected overlap error")
+	} else if files, _ := filepath.Glob(filepath.Join(s.Path(), "db0", "rp0", "1", "*.tsm")); len(files) != 1 {
+		t.Fatalf("unexpected files: %v", files)
+	}
+
+	// An invalid file is rejected and the new shard is removed.
+	invalid := filepath.Join(dir, "invalid.tsm")
+	if err := ioutil.WriteFile(invalid, []byte("not a tsm file"), 0666); err != nil {
+		t.Fatal(err)
+	} else if err := s.ImportShard("db0", "rp0", 2, []string{invalid}); err == nil {
+		t.Fatal("expected invalid file error")
+	} else if s.Shard(2) != nil {
+		t.Fatal("expected shard to be removed")
+	} else if _, err := os.Stat(filepath.Join(s.Path(), "db0", "rp0", "2")); !os.IsNotExist(err) {
+		t.Fatalf("expected shard directory to be removed: %v", err)
+	}
+}
+
+// Ensure a read-only store can be opened and read without modifying the files.
+func TestStore_Open_ReadOnly(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 0`)
+	if err := s.FlushWAL(); err != nil {
+		t.Fatal(err)
+	}
+	s.MustWriteToShardString(1, `mem,host=serverA value=1 0`)
+	if err := s.Store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	before := mustListFiles(s.Path())
+
+	s.Store = tsdb.NewStore(s.Path())
+	s.EngineOptions.Config.WALDir = filepath.Join(s.Path(), "wal")
+	s.EngineOptions.ReadOnly = true
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only data flushed to TSM files is loaded.
+	if s.Shard(1) == nil {
+		t.Fatal("expected shard")
+	} else if names, err := s.MeasurementNames("db0", nil); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(names, []string{"cpu"}) {
+		t.Fatalf("unexpected measurements: %v", names)
+	}
+
+	if err := s.WriteToShard(1, nil); err != tsdb.ErrStoreReadOnly {
+		t.Fatalf("unexpected write error: %v", err)
+	} else if err := s.CreateShard("db0", "rp0", 2); err != tsdb.ErrStoreReadOnly {
+		t.Fatalf("unexpected create error: %v", err)
+	} else if _, err := s.DeleteShard(1); err != tsdb.ErrStoreReadOnly {
+		t.Fatalf("unexpected delete error: %v", err)
+	}
+
+	if err := s.Store.Close(); err != nil {
+		t.Fatal(err)
+	} else if after := mustListFiles(s.Path()); !reflect.DeepEqual(before, after) {
+		t.Fatalf("files changed:\nbefore: %v\nafter:  %v", before, after)
+	}
+}
+
+// Ensure the store lists the tombstones left by deleted series.
+func TestStore_ShardTombstones(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1,
+		`cpu,host=serverA value=1 10`,
+		`cpu,host=serverA value=2 20`,
+		`cpu,host=serverB value=3 30`,
+	)
+	if err := s.FlushWAL(1); err != nil {
+		t.Fatal(err)
+	} else if n, err := s.TombstoneCount(1); err != nil || n != 0 {
+		t.Fatalf("unexpected result: %d, %v", n, err)
+	}
+
+	if err := s.DeleteSeries("db0", nil, influxql.MustParseExpr(`host = 'serverA'`)); err != nil {
+		t.Fatal(err)
+	}
+
+	sec := int64(time.Second)
+	if a, err := s.ShardTombstones(1); err != nil {
+		t.Fatal(err)
+	} else if exp := []tsdb.Tombstone{{Key: "cpu,host=serverA#!~#value", Min: 10 * sec, Max: 30 * sec}}; !reflect.DeepEqual(a, exp) {
+		t.Fatalf("unexpected tombstones: %v", a)
+	} else if n, err := s.TombstoneCount(1); err != nil || n != 1 {
+		t.Fatalf("unexpected result: %d, %v", n, err)
+	}
+
+	if _, err := s.ShardTombstones(2); err != tsdb.ErrShardNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure the store reports the compactions of its shards.
+func TestStore_ShardCompactionStatus(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 0`)
+	if err := s.FlushWAL(1); err != nil {
+		t.Fatal(err)
+	}
+
+	if status, err := s.ShardCompactionStatus(1); err != nil {
+		t.Fatal(err)
+	} else if status != (tsdb.CompactionStatus{}) {
+		t.Fatalf("unexpected status of an idle shard: %+v", status)
+	} else if ids := s.CompactingShardIDs(); len(ids) != 0 {
+		t.Fatalf("unexpected compacting shards: %v", ids)
+	}
+
+	if _, err := s.ShardCompactionStatus(2); err != tsdb.ErrShardNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure the store purges deleted data from shards with enough tombstones.
+func TestStore_Vacuum(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	s.EngineOptions.VacuumMinTombstones = 2
+
+	s.MustCreateShardWithData("db0", "rp0", 1,
+		`cpu,host=serverA value=1 10`,
+		`cpu,host=serverB value=2 20`,
+		`cpu,host=serverC value=3 30`,
+	)
+	s.MustCreateShardWithData("db1", "rp0", 2,
+		`cpu,host=serverA value=4 10`,
+		`cpu,host=serverC value=5 30`,
+	)
+	for _, id := range []uint64{1, 2} {
+		if err := s.FlushWAL(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.DeleteSeries("db0", nil, influxql.MustParseExpr(`host = 'serverA' OR host = 'serverB'`)); err != nil {
+		t.Fatal(err)
+	} else if err := s.DeleteSeries("db1", nil, influxql.MustParseExpr(`host = 'serverA'`)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.Vacuum(ctx); err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	} else if n, err := s.TombstoneCount(1); err != nil || n != 2 {
+		t.Fatalf("unexpected tombstone count: %d, %v", n, err)
+	}
+
+	if err := s.Vacuum(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Shard 2 has too few tombstones to be vacuumed.
+	if n, err := s.TombstoneCount(1); err != nil || n != 0 {
+		t.Fatalf("unexpected tombstone count: %d, %v", n, err)
+	} else if n, err := s.TombstoneCount(2); err != nil || n != 1 {
+		t.Fatalf("unexpected tombstone count: %d, %v", n, err)
+	}
+
+	var buf bytes.Buffer
+	if err := s.ExportShard(1, &buf, math.MinInt64, math.MaxInt64); err != nil {
+		t.Fatal(err)
+	} else if exp := "cpu,host=serverC value=3 30000000000\n"; buf.String() != exp {
+		t.Fatalf("unexpected export:\n%s\nexp:\n%s", buf.String(), exp)
+	}
+
+	// The purged data stays gone when the store is reopened.
+	if err := s.Reopen(); err != nil {
+		t.Fatal(err)
+	} else if n, err := s.TombstoneCount(1); err != nil || n != 0 {
+		t.Fatalf("unexpected tombstone count after reopen: %d, %v", n, err)
+	}
+	buf.Reset()
+	if err := s.ExportShard(1, &buf, math.MinInt64, math.MaxInt64); err != nil {
+		t.Fatal(err)
+	} else if exp := "cpu,host=serverC value=3 30000000000\n"; buf.String() != exp {
+		t.Fatalf("unexpected export after reopen:\n%s\nexp:\n%s", buf.String(), exp)
+	}
+}
+
+// Ensure the store can preview the series DROP SERIES would delete.
+func TestStore_DeleteSeriesDryRun(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1,
+		`cpu,host=serverA value=1 0`,
+		`cpu,host=serverB value=2 0`,
+		`mem,host=serverA value=3 0`,
+	)
+
+	cond := influxql.MustParseExpr(`host = 'serverA'`)
+	if keys, err := s.DeleteSeriesDryRun("db0", nil, cond); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(keys, []string{"cpu,host=serverA", "mem,host=serverA"}) {
+		t.Fatalf("unexpected series keys: %v", keys)
+	} else if n, err := s.SeriesCardinality("db0"); err != nil {
+		t.Fatal(err)
+	} else if n != 3 {
+		t.Fatalf("unexpected series cardinality: %d", n)
+	}
+
+	sources := []influxql.Source{&influxql.Measurement{Database: "db0", RetentionPolicy: "rp0", Name: "cpu"}}
+	if keys, err := s.DeleteSeriesDryRun("db0", sources, nil); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(keys, []string{"cpu,host=serverA", "cpu,host=serverB"}) {
+		t.Fatalf("unexpected series keys: %v", keys)
+	}
+
+	if _, err := s.DeleteSeriesDryRun("db0", nil, influxql.MustParseExpr(`value = 1`)); err == nil {
+		t.Fatal("expected error")
+	} else if keys, err := s.DeleteSeriesDryRun("db1", nil, cond); err != nil || keys != nil {
+		t.Fatalf("unexpected result: %v, %v", keys, err)
+	}
+
+	// The real delete removes the previewed series.
+	if err := s.DeleteSeries("db0", nil, cond); err != nil {
+		t.Fatal(err)
+	} else if n, err := s.SeriesCardinality("db0"); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatalf("unexpected series cardinality: %d", n)
+	}
+}
+
+// Ensure the store can delete series in batches.
+func TestStore_DeleteSeriesBatched(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1,
+		`cpu,host=serverA value=1 0`,
+		`cpu,host=serverB value=2 0`,
+		`cpu,host=serverC value=3 0`,
+		`mem,host=serverA value=4 0`,
+		`mem,host=serverB value=5 0`,
+	)
+	s.MustCreateShardWithData("db0", "rp1", 2, `cpu,host=serverA value=6 0`)
+
+	var calls [][2]int
+	progress := func(deleted, total int) { calls = append(calls, [2]int{deleted, total}) }
+	sources := []influxql.Source{&influxql.Measurement{Database: "db0", RetentionPolicy: "rp0", Name: "cpu"}}
+	if err := s.DeleteSeriesBatched("db0", sources, nil, 2, progress); err != nil {
+		t.Fatal(err)
+	} else if exp := [][2]int{{2, 3}, {3, 3}}; !reflect.DeepEqual(calls, exp) {
+		t.Fatalf("unexpected progress: %v", calls)
+	} else if s.HasSeries("db0", "cpu,host=serverA") {
+		t.Fatal("unexpected series")
+	} else if n, err := s.SeriesCardinality("db0"); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatalf("unexpected series cardinality: %d", n)
+	}
+
+	if err := s.DeleteSeriesBatched("db0", nil, nil, 0, nil); err == nil {
+		t.Fatal("expected error")
+	} else if err := s.DeleteSeriesBatched("db1", nil, nil, 1, nil); err != nil {
+		t.Fatal(err)
+	} else if err := s.DeleteSeriesBatched("db0", nil, influxql.MustParseExpr(`host = 'serverA'`), 1, nil); err != nil {
+		t.Fatal(err)
+	} else if s.HasSeries("db0", "mem,host=serverA") || !s.HasSeries("db0", "mem,host=serverB") {
+		t.Fatal("unexpected series after delete")
+	}
+}
+
+// Ensure the store reports progress while deleting series and can be cancelled.
+func TestStore_DeleteSeriesContext(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	for id := 1; id <= 3; id++ {
+		s.MustCreateShardWithData("db0", "rp0", id, fmt.Sprintf(`cpu,host=serverA value=%d %d`, id, id), `cpu,host=serverB value=1 0`)
+	}
+	s.MustCreateShardWithData("db1", "rp0", 4, `cpu,host=serverA value=1 0`)
+
+	cond := influxql.MustParseExpr(`host = 'serverA'`)
+	export := func(id uint64) string {
+		var buf bytes.Buffer
+		if err := s.ExportShard(id, &buf, math.MinInt64, math.MaxInt64); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	// Cancel after the first shard.
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls [][2]int
+	progress := func(done, total int) {
+		calls = append(calls, [2]int{done, total})
+		cancel()
+	}
+	if err := s.DeleteSeriesContext(ctx, "db0", nil, cond, progress); err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	} else if exp := [][2]int{{1, 3}}; !reflect.DeepEqual(calls, exp) {
+		t.Fatalf("unexpected progress: %v", calls)
+	} else if strings.Contains(export(1), "serverA") {
+		t.Fatalf("unexpected data in shard 1: %s", export(1))
+	} else if !strings.Contains(export(2), "serverA") {
+		t.Fatalf("expected data in shard 2: %s", export(2))
+	} else if !s.HasSeries("db0", "cpu,host=serverA") {
+		t.Fatal("expected series to stay in the index")
+	}
+
+	calls = nil
+	progress = func(done, total int) { calls = append(calls, [2]int{done, total}) }
+	if err := s.DeleteSeriesContext(context.Background(), "db0", nil, cond, progress); err != nil {
+		t.Fatal(err)
+	} else if exp := [][2]int{{1, 3}, {2, 3}, {3, 3}}; !reflect.DeepEqual(calls, exp) {
+		t.Fatalf("unexpected progress: %v", calls)
+	} else if s.HasSeries("db0", "cpu,host=serverA") || !s.HasSeries("db0", "cpu,host=serverB") {
+		t.Fatal("unexpected series after delete")
+	} else if strings.Contains(export(3), "serverA") {
+		t.Fatalf("unexpected data in shard 3: %s", export(3))
+	} else if !s.HasSeries("db1", "cpu,host=serverA") {
+		t.Fatal("expected series in other database")
+	}
+}
+
+// Ensure the store can drop a measurement in batches of series.
+func TestStore_DropSeriesByMeasurementBatch(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1,
+		`cpu,host=serverA value=1 0`,
+		`cpu,host=serverB value=2 0`,
+		`cpu,host=serverC value=3 0`,
+		`cpu,host=serverD value=4 0`,
+		`cpu,host=serverE value=5 0`,
+		`mem,host=serverA value=6 0`,
+	)
+
+	// Cancelling stops before the next batch and keeps the measurement.
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls [][2]int
+	progress := func(deleted, total int) {
+		calls = append(calls, [2]int{deleted, total})
+		cancel()
+	}
+	if err := s.DropSeriesByMeasurementBatch(ctx, "db0", "cpu", 2, progress); err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	} else if exp := [][2]int{{2, 5}}; !reflect.DeepEqual(calls, exp) {
+		t.Fatalf("unexpected progress: %v", calls)
+	} else if keys, err := s.SeriesKeys("db0", "cpu"); err != nil {
+		t.Fatal(err)
+	} else if len(keys) != 3 {
+		t.Fatalf("unexpected series: %v", keys)
+	}
+
+	calls = nil
+	progress = func(deleted, total int) { calls = append(calls, [2]int{deleted, total}) }
+	if err := s.DropSeriesByMeasurementBatch(context.Background(), "db0", "cpu", 2, progress); err != nil {
+		t.Fatal(err)
+	} else if exp := [][2]int{{2, 3}, {3, 3}}; !reflect.DeepEqual(calls, exp) {
+		t.Fatalf("unexpected progress: %v", calls)
+	} else if s.HasMeasurement("db0", "cpu") {
+		t.Fatal("unexpected measurement")
+	} else if !s.HasSeries("db0", "mem,host=serverA") {
+		t.Fatal("expected mem series")
+	}
+
+	// The data is gone from the shard too.
+	var buf bytes.Buffer
+	if err := s.ExportShard(1, &buf, math.MinInt64, math.MaxInt64); err != nil {
+		t.Fatal(err)
+	} else if exp := "mem,host=serverA value=6 0\n"; buf.String() != exp {
+		t.Fatalf("unexpected shard data: %q", buf.String())
+	}
+
+	if err := s.DropSeriesByMeasurementBatch(context.Background(), "db0", "mem", 0, nil); err == nil {
+		t.Fatal("expected error for invalid batch size")
+	} else if err := s.DropSeriesByMeasurementBatch(context.Background(), "db0", "cpu", 1, nil); err == nil || err.Error() != "measurement not found: cpu" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure the store can delete a time range of series and keeps the series.
+func TestStore_DeleteSeriesRange(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1,
+		`cpu,host=serverA value=1 0`,
+		`cpu,host=serverA value=2 10`,
+		`cpu,host=serverB value=3 10`,
+	)
+
+	cond := influxql.MustParseExpr(`host = 'serverA'`)
+	sources := []influxql.Source{&influxql.Measurement{Database: "db0", RetentionPolicy: "rp0", Name: "cpu"}}
+	if err := s.DeleteSeriesRange("db0", sources, cond, 5*int64(time.Second), 15*int64(time.Second)); err != nil {
+		t.Fatal(err)
+	} else if n, err := s.SeriesCardinality("db0"); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatalf("unexpected series cardinality: %d", n)
+	}
+
+	if err := s.DeleteSeriesRange("db0", sources, cond, 10, 5); err == nil {
+		t.Fatal("expected error")
+	} else if err := s.DeleteSeriesRange("db0", sources, influxql.MustParseExpr(`value = 1`), 0, 5); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// Ensure a shard can be truncated after a time, keeping its series.
+func TestStore_TruncateShard(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1,
+		`cpu,host=serverA value=1 0`,
+		`cpu,host=serverA value=2 10`,
+		`cpu,host=serverB value=3 20`,
+		`mem,host=serverA value=4 30`,
+	)
+	s.MustCreateShardWithData("db0", "rp0", 2, `cpu,host=serverA value=5 40`)
+	if err := s.Shard(1).WriteSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	s.MustWriteToShardString(1, `cpu,host=serverB value=6 25`)
+
+	export := func(id uint64) string {
+		var buf bytes.Buffer
+		if err := s.ExportShard(id, &buf, math.MinInt64, math.MaxInt64); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	if err := s.TruncateShard(1, 10000000000); err != nil {
+		t.Fatal(err)
+	} else if exp := "cpu,host=serverA value=1 0\ncpu,host=serverA value=2 10000000000\n"; export(1) != exp {
+		t.Fatalf("unexpected shard 1 data:\n%s", export(1))
+	} else if !s.HasSeries("db0", "cpu,host=serverB") || !s.HasSeries("db0", "mem,host=serverA") {
+		t.Fatal("expected series to be kept")
+	} else if exp := "cpu,host=serverA value=5 40000000000\n"; export(2) != exp {
+		t.Fatalf("unexpected shard 2 data:\n%s", export(2))
+	}
+
+	// The values stay deleted once the WAL is reloaded.
+	if err := s.Reopen(); err != nil {
+		t.Fatal(err)
+	} else if exp := "cpu,host=serverA value=1 0\ncpu,host=serverA value=2 10000000000\n"; export(1) != exp {
+		t.Fatalf("unexpected shard 1 data after reopen:\n%s", export(1))
+	}
+
+	if err := s.TruncateShard(1, -1); err == nil {
+		t.Fatal("expected error for time before the shard's data")
+	} else if err := s.TruncateShard(1, 20000000000); err == nil {
+		t.Fatal("expected error for time after the shard's data")
+	} else if err := s.TruncateShard(3, 0); err != tsdb.ErrShardNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure the store reports series cardinality per database and measurement.
+func TestStore_SeriesCardinality(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1,
+		`cpu,host=serverA value=1 0`,
+		`cpu,host=serverB value=2 0`,
+		`cpu,host=serverB value=3 10`,
+		`mem,host=serverA value=4 0`,
+	)
+
+	if n, err := s.SeriesCardinality("db0"); err != nil {
+		t.Fatal(err)
+	} else if n != 3 {
+		t.Fatalf("unexpected series cardinality: %d", n)
+	}
+	if n, err := s.MeasurementCardinality("db0", "cpu"); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatalf("unexpected cpu cardinality: %d", n)
+	}
+
+	if _, err := s.SeriesCardinality("no_db"); err == nil {
+		t.Fatal("expected error")
+	} else if _, err := s.MeasurementCardinality("db0", "disk"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestStore_EstimateSeriesCardinality(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	lines := make([]string, 1000)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("cpu,host=h%d value=1 0", i)
+	}
+	s.MustCreateShardWithData("db0", "rp0", 1, lines...)
+
+	within := func(n, exp int64) bool { return n >= exp*97/100 && n <= exp*103/100 }
+	if n, err := s.EstimateSeriesCardinality("db0"); err != nil {
+		t.Fatal(err)
+	} else if !within(n, 1000) {
+		t.Fatalf("unexpected estimate: %d", n)
+	}
+
+	// Dropped series are subtracted from the estimate.
+	if err := s.DeleteSeries("db0", nil, influxql.MustParseExpr(`host =~ /^h[0-9][0-9]?$/`)); err != nil {
+		t.Fatal(err)
+	} else if n, err := s.SeriesCardinality("db0"); err != nil || n != 900 {
+		t.Fatalf("unexpected series cardinality: %d, %v", n, err)
+	} else if n, err := s.EstimateSeriesCardinality("db0"); err != nil {
+		t.Fatal(err)
+	} else if !within(n, 900) {
+		t.Fatalf("unexpected estimate after delete: %d", n)
+	}
+
+	if _, err := s.EstimateSeriesCardinality("no_db"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// Ensure the store shares identical tag keys and values when InternTags is set.
+func TestStore_InternStats(t *testing.T) {
+	s := NewStore()
+	s.EngineOptions.InternTags = true
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1,
+		`cpu,host=serverA,region=west value=1 0`,
+		`cpu,host=serverB,region=west value=1 0`,
+		`mem,host=serverA,region=west value=1 0`,
+	)
+
+	// The 12 tag keys and values are held as host, region, serverA, serverB
+	// and west.
+	if stats := s.InternStats(); stats != (tsdb.InternStats{Strings: 5, Bytes: 28, Lookups: 12, Hits: 7}) {
+		t.Fatalf("unexpected stats: %+v", stats)
+	} else if r := stats.DedupRatio(); r != 7.0/12 {
+		t.Fatalf("unexpected dedup ratio: %v", r)
+	}
+
+	// Strings are released when no series uses them anymore.
+	if err := s.DeleteMeasurement("db0", "mem"); err != nil {
+		t.Fatal(err)
+	} else if stats := s.InternStats(); stats.Strings != 5 {
+		t.Fatalf("unexpected stats after dropping measurement: %+v", stats)
+	}
+	cond := influxql.MustParseExpr(`host = 'serverB'`)
+	sources := []influxql.Source{&influxql.Measurement{Database: "db0", RetentionPolicy: "rp0", Name: "cpu"}}
+	if err := s.DeleteSeries("db0", sources, cond); err != nil {
+		t.Fatal(err)
+	} else if stats := s.InternStats(); stats.Strings != 4 || stats.Bytes != 21 {
+		t.Fatalf("unexpected stats after dropping series: %+v", stats)
+	}
+
+	// Tags loaded when the store opens are interned too.
+	if err := s.Store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s.Store = tsdb.NewStore(s.Path())
+	s.EngineOptions.Config.WALDir = filepath.Join(s.Path(), "wal")
+	s.EngineOptions.InternTags = true
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	} else if stats := s.InternStats(); stats != (tsdb.InternStats{Strings: 4, Bytes: 21, Lookups: 4}) {
+		t.Fatalf("unexpected stats after reopen: %+v", stats)
+	}
+
+	// Interning is off by default.
+	if err := s.Reopen(); err != nil {
+		t.Fatal(err)
+	} else if stats := s.InternStats(); stats != (tsdb.InternStats{}) {
+		t.Fatalf("unexpected stats with interning off: %+v", stats)
+	}
+}
+
+// Ensure the store can report field types for SHOW FIELD KEYS.
+func TestStore_ExecuteShowFieldKeysWithTypes(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1,
+		`cpu,host=serverA value=1,count=2i 0`,
+		`mem,host=serverA free=true,label="x" 0`,
+	)
+	s.MustCreateShardWithData("db0", "rp0", 2, `cpu,host=serverA value=1,idle=0.5 10`)
+
+	for _, tt := range []struct {
+		q   string
+		exp string
+	}{
+		{q: `SHOW FIELD KEYS`, exp: `[{"name":"cpu","columns":["fieldKey","fieldType"],"values":[["count","integer"],["idle","float"],["value","float"]]},{"name":"mem","columns":["fieldKey","fieldType"],"values":[["free","boolean"],["label","string"]]}]`},
+		{q: `SHOW FIELD KEYS FROM mem`, exp: `[{"name":"mem","columns":["fieldKey","fieldType"],"values":[["free","boolean"],["label","string"]]}]`},
+	} {
+		stmt := influxql.MustParseStatement(tt.q).(*influxql.ShowFieldKeysStatement)
+		rows, err := s.ExecuteShowFieldKeysWithTypes(stmt, "db0")
+		if err != nil {
+			t.Fatalf("%s: %s", tt.q, err)
+		} else if got := string(mustMarshalJSON(rows)); got != tt.exp {
+			t.Fatalf("%s: unexpected rows:\n\ngot=%s\n\nexp=%s", tt.q, got, tt.exp)
+		}
+	}
+
+	// The original statement keeps its single column.
+	stmt := influxql.MustParseStatement(`SHOW FIELD KEYS FROM mem`).(*influxql.ShowFieldKeysStatement)
+	if rows, err := s.ExecuteShowFieldKeysStatement(stmt, "db0"); err != nil {
+		t.Fatal(err)
+	} else if got, exp := string(mustMarshalJSON(rows)), `[{"name":"mem","columns":["fieldKey"],"values":[["free"],["label"]]}]`; got != exp {
+		t.Fatalf("unexpected rows:\n\ngot=%s\n\nexp=%s", got, exp)
+	}
+}
+
+// Ensure the store can execute SHOW TAG KEYS.
+func TestStore_ExecuteShowTagKeysStatement(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1,
+		`cpu,host=serverA,region=west value=1 0`,
+		`cpu,host=serverB value=1 0`,
+		`mem,host=serverA,core=1 value=1 0`,
+	)
+
+	for _, tt := range []struct {
+		q   string
+		exp string
+	}{
+		{q: `SHOW TAG KEYS`, exp: `[{"name":"cpu","columns":["tagKey"],"values":[["host"],["region"]]},{"name":"mem","columns":["tagKey"],"values":[["core"],["host"]]}]`},
+		{q: `SHOW TAG KEYS FROM cpu WHERE host = 'serverB'`, exp: `[{"name":"cpu","columns":["tagKey"],"values":[["host"]]}]`},
+		{q: `SHOW TAG KEYS LIMIT 2 OFFSET 1`, exp: `[{"name":"cpu","columns":["tagKey"],"values":[["region"]]},{"name":"mem","columns":["tagKey"],"values":[["core"]]}]`},
+		{q: `SHOW TAG KEYS OFFSET 3`, exp: `[{"name":"mem","columns":["tagKey"],"values":[["host"]]}]`},
+	} {
+		stmt := influxql.MustParseStatement(tt.q).(*influxql.ShowTagKeysStatement)
+		rows, err := s.ExecuteShowTagKeysStatement(stmt, "db0")
+		if err != nil {
+			t.Fatalf("%s: %s", tt.q, err)
+		} else if got := string(mustMarshalJSON(rows)); got != tt.exp {
+			t.Fatalf("%s: unexpected rows:\n\ngot=%s\n\nexp=%s", tt.q, got, tt.exp)
+		}
+	}
+
+	if rows, err := s.ExecuteShowTagKeysStatement(&influxql.ShowTagKeysStatement{}, "db1"); err != nil || rows != nil {
+		t.Fatalf("unexpected result: %v, %v", rows, err)
+	}
+}
+
+// Ensure SHOW MEASUREMENTS filters by name and tags and applies LIMIT and OFFSET.
+func TestStore_ExecuteShowMeasurementsStatement(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1,
+		`cpu,host=serverA,region=west value=1 0`,
+		`cpu_idle,host=serverB value=1 0`,
+		`disk,host=serverA value=1 0`,
+		`mem,host=serverB,region=east value=1 0`,
+	)
+
+	for _, tt := range []struct {
+		q   string
+		exp string
+	}{
+		{q: `SHOW MEASUREMENTS`, exp: `[{"name":"measurements","columns":["name"],"values":[["cpu"],["cpu_idle"],["disk"],["mem"]]}]`},
+		{q: `SHOW MEASUREMENTS WITH MEASUREMENT = cpu`, exp: `[{"name":"measurements","columns":["name"],"values":[["cpu"]]}]`},
+		{q: `SHOW MEASUREMENTS WITH MEASUREMENT =~ /^cpu/`, exp: `[{"name":"measurements","columns":["name"],"values":[["cpu"],["cpu_idle"]]}]`},
+		{q: `SHOW MEASUREMENTS WHERE host = 'serverA'`, exp: `[{"name":"measurements","columns":["name"],"values":[["cpu"],["disk"]]}]`},
+		{q: `SHOW MEASUREMENTS WITH MEASUREMENT =~ /^cpu/ WHERE host = 'serverB'`, exp: `[{"name":"measurements","columns":["name"],"values":[["cpu_idle"]]}]`},
+		{q: `SHOW MEASUREMENTS WHERE region =~ /.+/ OR host = 'serverA'`, exp: `[{"name":"measurements","columns":["name"],"values":[["cpu"],["disk"],["mem"]]}]`},
+		{q: `SHOW MEASUREMENTS LIMIT 2 OFFSET 1`, exp: `[{"name":"measurements","columns":["name"],"values":[["cpu_idle"],["disk"]]}]`},
+		{q: `SHOW MEASUREMENTS OFFSET 4`, exp: `[]`},
+		{q: `SHOW MEASUREMENTS WITH MEASUREMENT = gpu`, exp: `[]`},
+	} {
+		stmt := influxql.MustParseStatement(tt.q).(*influxql.ShowMeasurementsStatement)
+		rows, err := s.ExecuteShowMeasurementsStatement(stmt, "db0")
+		if err != nil {
+			t.Fatalf("%s: %s", tt.q, err)
+		} else if got := string(mustMarshalJSON(rows)); got != tt.exp {
+			t.Fatalf("%s: unexpected rows:\n\ngot=%s\n\nexp=%s", tt.q, got, tt.exp)
+		}
+	}
+
+	if rows, err := s.ExecuteShowMeasurementsStatement(&influxql.ShowMeasurementsStatement{}, "db1"); err != nil || rows != nil {
+		t.Fatalf("unexpected result: %v, %v", rows, err)
+	}
+}
+
+// Ensure SHOW TAG VALUES applies LIMIT and OFFSET across rows.
+func TestStore_ExecuteShowTagValuesStatement_LimitOffset(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1,
+		`cpu,host=serverA,region=east value=1 0`,
+		`cpu,host=serverB,region=west value=1 0`,
+		`mem,host=serverC value=1 0`,
+	)
+
+	for _, tt := range []struct {
+		q   string
+		exp string
+	}{
+		{q: `SHOW TAG VALUES WITH KEY IN (host, region)`, exp: `[{"name":"hostTagValues","columns":["host"],"values":[["serverA"],["serverB"],["serverC"]]},{"name":"regionTagValues","columns":["region"],"values":[["east"],["west"]]}]`},
+		{q: `SHOW TAG VALUES WITH KEY IN (host, region) LIMIT 2`, exp: `[{"name":"hostTagValues","columns":["host"],"values":[["serverA"],["serverB"]]}]`},
+		{q: `SHOW TAG VALUES WITH KEY IN (host, region) LIMIT 2 OFFSET 2`, exp: `[{"name":"hostTagValues","columns":["host"],"values":[["serverC"]]},{"name":"regionTagValues","columns":["region"],"values":[["east"]]}]`},
+		{q: `SHOW TAG VALUES WITH KEY IN (host, region) OFFSET 4`, exp: `[{"name":"regionTagValues","columns":["region"],"values":[["west"]]}]`},
+		{q: `SHOW TAG VALUES WITH KEY IN (host, region) OFFSET 5`, exp: `null`},
+	} {
+		stmt := influxql.MustParseStatement(tt.q).(*influxql.ShowTagValuesStatement)
+		rows, err := s.ExecuteShowTagValuesStatement(stmt, "db0")
+		if err != nil {
+			t.Fatalf("%s: %s", tt.q, err)
+		} else if got := string(mustMarshalJSON(rows)); got != tt.exp {
+			t.Fatalf("%s: unexpected rows:\n\ngot=%s\n\nexp=%s", tt.q, got, tt.exp)
+		}
+	}
+}
+
+// Ensure SHOW TAG VALUES selects tag keys by list and by regex.
+func TestStore_ExecuteShowTagValuesStatement_TagKeys(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1,
+		`cpu,host=serverA,region=east,rack=r1 value=1 0`,
+		`cpu,host=serverB,region=west value=1 0`,
+		`mem,host=serverC,rack=r2 value=1 0`,
+	)
+
+	for _, tt := range []struct {
+		q   string
+		exp string
+	}{
+		{q: `SHOW TAG VALUES WITH KEY IN (host, rack)`, exp: `[{"name":"hostTagValues","columns":["host"],"values":[["serverA"],["serverB"],["serverC"]]},{"name":"rackTagValues","columns":["rack"],"values":[["r1"],["r2"]]}]`},
+		{q: `SHOW TAG VALUES FROM cpu WITH KEY IN (region, missing)`, exp: `[{"name":"regionTagValues","columns":["region"],"values":[["east"],["west"]]}]`},
+		{q: `SHOW TAG VALUES WITH KEY =~ /^r/`, exp: `[{"name":"rackTagValues","columns":["rack"],"values":[["r1"],["r2"]]},{"name":"regionTagValues","columns":["region"],"values":[["east"],["west"]]}]`},
+		{q: `SHOW TAG VALUES FROM mem WITH KEY =~ /^r/`, exp: `[{"name":"rackTagValues","columns":["rack"],"values":[["r2"]]}]`},
+		{q: `SHOW TAG VALUES WITH KEY =~ /o/ WHERE region = 'west'`, exp: `[{"name":"hostTagValues","columns":["host"],"values":[["serverB"]]},{"name":"regionTagValues","columns":["region"],"values":[["west"]]}]`},
+		{q: `SHOW TAG VALUES WITH KEY =~ /^zone/`, exp: `null`},
+	} {
+		stmt := influxql.MustParseStatement(tt.q).(*influxql.ShowTagValuesStatement)
+		rows, err := s.ExecuteShowTagValuesStatement(stmt, "db0")
+		if err != nil {
+			t.Fatalf("%s: %s", tt.q, err)
+		} else if got := string(mustMarshalJSON(rows)); got != tt.exp {
+			t.Fatalf("%s: unexpected rows:\n\ngot=%s\n\nexp=%s", tt.q, got, tt.exp)
+		}
+	}
+}
+
+// Ensure writes to a shard respect the context.
+func TestStore_WriteToShardContext(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	if err := s.CreateShard("db0", "rp0", 1); err != nil {
+		t.Fatal(err)
+	}
+	points := []models.Point{models.MustNewPoint("cpu", nil, map[string]interface{}{"value": 1.0}, time.Unix(0, 0))}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := s.WriteToShardContext(ctx, 1, points); err != nil {
+		t.Fatal(err)
+	} else if err := s.WriteToShardContext(ctx, 2, points); err != tsdb.ErrShardNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cancel()
+	if err := s.WriteToShardContext(ctx, 1, points); err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestStore_WriteToShardAsync(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	s.EngineOptions.AsyncWriteQueueSize = 2
+
+	if err := s.CreateShard("db0", "rp0", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// done is called from the goroutine writing the queue, so blocking in it
+	// keeps the following writes queued.
+	started, release := make(chan error), make(chan struct{})
+	if err := s.WriteToShardAsync(1, mustParsePoints(`cpu,host=serverA value=1 10`), func(err error) {
+		started <- err
+		<-release
+	}); err != nil {
+		t.Fatal(err)
+	} else if err := <-started; err != nil {
+		t.Fatal(err)
+	}
+
+	errC := make(chan error, 2)
+	done := func(err error) { errC <- err }
+	for _, v := range []int{2, 3} {
+		if err := s.WriteToShardAsync(1, mustParsePoints(fmt.Sprintf(`cpu,host=serverA value=%d %d`, v, v*10)), done); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.WriteToShardAsync(1, mustParsePoints(`cpu,host=serverA value=4 40`), done); err != tsdb.ErrWriteQueueFull {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := s.WriteToShardAsync(2, mustParsePoints(`cpu,host=serverA value=4 40`), done); err != tsdb.ErrShardNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-errC; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := s.ExportShard(1, &buf, math.MinInt64, math.MaxInt64); err != nil {
+		t.Fatal(err)
+	} else if exp := "cpu,host=serverA value=1 10000000000\n" +
+		"cpu,host=serverA value=2 20000000000\n" +
+		"cpu,host=serverA value=3 30000000000\n"; buf.String() != exp {
+		t.Fatalf("unexpected export:\n%s\nexp:\n%s", buf.String(), exp)
+	}
+
+	// Close waits for queued writes.
+	if err := s.WriteToShardAsync(1, mustParsePoints(`cpu,host=serverA value=5 50`), done); err != nil {
+		t.Fatal(err)
+	} else if err := s.Store.Close(); err != nil {
+		t.Fatal(err)
 	}
-	if got, exp := dirExists(filepath.Join(s.EngineOptions.Config.WALDir, "db0", "rp1")), true; got != exp {
-		t.Error("directory does not exist, but should")
+	select {
+	case err := <-errC:
+		if err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatal("expected queued write to finish before close")
+	}
+	if err := s.WriteToShardAsync(1, mustParsePoints(`cpu,host=serverA value=6 60`), nil); err != tsdb.ErrStoreClosed {
+		t.Fatalf("unexpected error: %v", err)
 	}
 }
 
-// Ensure the store can create a new shard.
-func TestStore_CreateShard(t *testing.T) {
+// Ensure writes still queued when their shard is deleted or closed are not
+// made.
+func TestStore_WriteToShardAsync_ShardRemoved(t *testing.T) {
 	s := MustOpenStore()
 	defer s.Close()
 
-	// Create a new shard and verify that it exists.
-	if err := s.CreateShard("db0", "rp0", 1); err != nil {
-		t.Fatal(err)
-	} else if sh := s.Shard(1); sh == nil {
-		t.Fatalf("expected shard")
-	} else if di := s.DatabaseIndex("db0"); di == nil {
-		t.Errorf("expected database index")
+	for _, test := range []struct {
+		id     uint64
+		remove func(id uint64) error
+		exp    error
+	}{
+		{id: 1, remove: func(id uint64) error { _, err := s.DeleteShard(id); return err }, exp: tsdb.ErrShardNotFound},
+		{id: 2, remove: s.CloseShard, exp: tsdb.ErrEngineClosed},
+	} {
+		if err := s.CreateShard("db0", "rp0", test.id); err != nil {
+			t.Fatal(err)
+		}
+
+		started, release := make(chan error), make(chan struct{})
+		if err := s.WriteToShardAsync(test.id, mustParsePoints(`cpu value=1 10`), func(err error) {
+			started <- err
+			<-release
+		}); err != nil {
+			t.Fatal(err)
+		} else if err := <-started; err != nil {
+			t.Fatal(err)
+		}
+		errC := make(chan error, 1)
+		if err := s.WriteToShardAsync(test.id, mustParsePoints(`cpu value=2 20`), func(err error) { errC <- err }); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := test.remove(test.id); err != nil {
+			t.Fatal(err)
+		}
+		close(release)
+		if err := <-errC; err != test.exp {
+			t.Fatalf("shard %d: unexpected error: %v", test.id, err)
+		}
 	}
 
-	// Create another shard and verify that it exists.
-	if err := s.CreateShard("db0", "rp0", 2); err != nil {
+	// The queued write is not made once the shard is reopened.
+	if err := s.OpenShard(2); err != nil {
 		t.Fatal(err)
-	} else if sh := s.Shard(2); sh == nil {
-		t.Fatalf("expected shard")
 	}
-
-	// Reopen shard and recheck.
-	if err := s.Reopen(); err != nil {
+	var buf bytes.Buffer
+	if err := s.ExportShard(2, &buf, math.MinInt64, math.MaxInt64); err != nil {
 		t.Fatal(err)
-	} else if sh := s.Shard(1); sh == nil {
-		t.Fatalf("expected shard(1)")
-	} else if sh = s.Shard(2); sh == nil {
-		t.Fatalf("expected shard(2)")
+	} else if exp := "cpu value=1 10000000000\n"; buf.String() != exp {
+		t.Fatalf("unexpected export: %s", buf.String())
 	}
 }
 
-// Ensure the store can delete an existing shard.
-func TestStore_DeleteShard(t *testing.T) {
+// Ensure the done callback of an async write can use the store while it is
+// closing.
+func TestStore_WriteToShardAsync_DoneDuringClose(t *testing.T) {
 	s := MustOpenStore()
 	defer s.Close()
 
-	// Create a new shard and verify that it exists.
 	if err := s.CreateShard("db0", "rp0", 1); err != nil {
 		t.Fatal(err)
-	} else if sh := s.Shard(1); sh == nil {
-		t.Fatalf("expected shard")
 	}
 
-	// Reopen shard and recheck.
-	if err := s.Reopen(); err != nil {
+	release, errC := make(chan struct{}), make(chan error, 1)
+	if err := s.WriteToShardAsync(1, mustParsePoints(`cpu value=1 10`), func(error) {
+		<-release
+		errC <- s.CreateShard("db0", "rp0", 2)
+	}); err != nil {
 		t.Fatal(err)
-	} else if sh := s.Shard(1); sh == nil {
-		t.Fatalf("shard exists")
+	}
+
+	closed := make(chan error, 1)
+	go func() { closed <- s.Store.Close() }()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for close")
+	}
+	if err := <-errC; err != tsdb.ErrStoreClosed {
+		t.Fatalf("unexpected error: %v", err)
 	}
 }
 
@@ -196,6 +4930,235 @@ func TestStore_Open_InvalidShard(t *testing.T) {
 	}
 }
 
+// Ensure the store opens shards concurrently and reports every shard that fails.
+func TestStore_Open_OpenLimit(t *testing.T) {
+	for _, limit := range []int{1, 4} {
+		s := MustOpenStore()
+		defer s.Close()
+
+		for i := 0; i < 2; i++ {
+			s.MustCreateShardWithData(fmt.Sprintf("db%d", i%2), "rp0", i, `cpu,host=serverA value=1 0`)
+		}
+
+		// Create shard paths that can't be opened as an engine.
+		for _, name := range []string{"100", "101"} {
+			if _, err := os.Create(filepath.Join(s.Path(), "db0", "rp0", name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := s.Store.Close(); err != nil {
+			t.Fatal(err)
+		}
+		s.Store = tsdb.NewStore(s.Path())
+		s.EngineOptions.Config.WALDir = filepath.Join(s.Path(), "wal")
+		s.EngineOptions.OpenLimit = limit
+		s.EngineOptions.StrictOpen = true
+
+		err := s.Open()
+		if err == nil {
+			t.Fatalf("limit %d: expected error", limit)
+		} else if msg := err.Error(); !strings.Contains(msg, "[shard 100]") || !strings.Contains(msg, "[shard 101]") {
+			t.Fatalf("limit %d: unexpected error: %s", limit, msg)
+		} else if n := s.ShardN(); n != 2 {
+			t.Fatalf("limit %d: unexpected shard count: %d", limit, n)
+		}
+	}
+}
+
+// Ensure the store skips shards that fail to open and can retry them.
+func TestStore_Open_ShardOpenErrors(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 0`)
+
+	// Create a shard path that can't be opened as an engine.
+	path := filepath.Join(s.Path(), "db0", "rp0", "2")
+	if _, err := os.Create(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Store should open without the bad shard.
+	if err := s.Reopen(); err != nil {
+		t.Fatal(err)
+	} else if n := s.ShardN(); n != 1 {
+		t.Fatalf("unexpected shard count: %d", n)
+	} else if errs := s.ShardOpenErrors(); len(errs) != 1 || errs[2] == nil {
+		t.Fatalf("unexpected shard open errors: %v", errs)
+	} else if err := s.CreateShard("db0", "rp0", 2); err != errs[2] {
+		// The failed shard is not created again on the same directory.
+		t.Fatalf("unexpected error: %v", err)
+	} else if n := s.ShardN(); n != 1 {
+		t.Fatalf("unexpected shard count after create: %d", n)
+	}
+
+	// Retrying fails until the shard is fixed.
+	if err := s.ReopenShard(2); err == nil {
+		t.Fatal("expected error")
+	} else if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	} else if err := s.ReopenShard(2); err != nil {
+		t.Fatal(err)
+	} else if sh := s.Shard(2); sh == nil {
+		t.Fatal("expected shard")
+	} else if errs := s.ShardOpenErrors(); len(errs) != 0 {
+		t.Fatalf("unexpected shard open errors: %v", errs)
+	}
+
+	// Open shards can be reopened too.
+	if err := s.ReopenShard(1); err != nil {
+		t.Fatal(err)
+	} else if err := s.ReopenShard(3); err != tsdb.ErrShardNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure the store deletes a shard that failed to open.
+func TestStore_DeleteShard_Failed(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 0`)
+	if err := s.FlushWAL(1); err != nil {
+		t.Fatal(err)
+	}
+	path, walPath := s.Shard(1).Path(), filepath.Join(s.Path(), "wal", "db0", "rp0", "1")
+
+	// Corrupt the shard's TSM file.
+	if err := s.Store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files, err := filepath.Glob(filepath.Join(path, "*.tsm"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("unexpected TSM files: %v, %v", files, err)
+	} else if err := ioutil.WriteFile(files[0], []byte("corrupt"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	s.Store = tsdb.NewStore(s.Path())
+	s.EngineOptions.Config.WALDir = filepath.Join(s.Path(), "wal")
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	} else if errs := s.ShardOpenErrors(); len(errs) != 1 || errs[1] == nil {
+		t.Fatalf("unexpected shard open errors: %v", errs)
+	}
+
+	var deleted []uint64
+	s.OnShardDeleted(func(id uint64) { deleted = append(deleted, id) })
+	if ok, err := s.DeleteShard(1); err != nil || !ok {
+		t.Fatalf("unexpected result: %v, %v", ok, err)
+	} else if errs := s.ShardOpenErrors(); len(errs) != 0 {
+		t.Fatalf("unexpected shard open errors: %v", errs)
+	} else if !reflect.DeepEqual(deleted, []uint64{1}) {
+		t.Fatalf("unexpected deleted shards: %v", deleted)
+	}
+	for _, dir := range []string{path, walPath} {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be removed: %v", dir, err)
+		}
+	}
+	if ok, err := s.DeleteShard(1); err != nil || ok {
+		t.Fatalf("unexpected result of second delete: %v, %v", ok, err)
+	}
+}
+
+// Ensure the store only opens shards whose WAL directory was removed when
+// RecoverMissingWAL is set.
+func TestStore_Open_RecoverMissingWAL(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 10`)
+	if err := s.FlushWAL(1); err != nil {
+		t.Fatal(err)
+	}
+	s.MustWriteToShardString(1, `cpu,host=serverA value=2 20`)
+
+	walPath := filepath.Join(s.Path(), "wal", "db0", "rp0", "1")
+	if err := s.Store.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := os.RemoveAll(walPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// By default the shard fails to open.
+	s.Store = tsdb.NewStore(s.Path())
+	s.EngineOptions.Config.WALDir = filepath.Join(s.Path(), "wal")
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	} else if errs := s.ShardOpenErrors(); len(errs) != 1 {
+		t.Fatalf("unexpected shard open errors: %v", errs)
+	} else if err, ok := errs[1].(tsdb.ShardError); !ok || err.Err != tsdb.ErrWALMissing {
+		t.Fatalf("unexpected shard open error: %v", errs[1])
+	}
+
+	// The WAL is recreated and the flushed points are kept.
+	if err := s.Store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s.Store = tsdb.NewStore(s.Path())
+	s.EngineOptions.Config.WALDir = filepath.Join(s.Path(), "wal")
+	s.EngineOptions.RecoverMissingWAL = true
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	} else if errs := s.ShardOpenErrors(); len(errs) != 0 {
+		t.Fatalf("unexpected shard open errors: %v", errs)
+	} else if _, err := os.Stat(walPath); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := s.ExportShard(1, &buf, math.MinInt64, math.MaxInt64); err != nil {
+		t.Fatal(err)
+	} else if exp := "cpu,host=serverA value=1 10000000000\n"; buf.String() != exp {
+		t.Fatalf("unexpected points: %q", buf.String())
+	}
+}
+
+// Ensure the store summarizes itself for diagnostics.
+func TestStore_Diagnostics(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	s.MustCreateShardWithData("db0", "rp0", 1, `cpu,host=serverA value=1 0`, `cpu,host=serverB value=1 0`)
+	s.MustCreateShardWithData("db0", "rp0", 2, `cpu,host=serverA value=1 10`)
+	s.MustCreateShardWithData("db1", "rp0", 3, `mem,host=serverA value=1 0`)
+
+	// Add a shard that fails to open and a file that is skipped.
+	if _, err := os.Create(filepath.Join(s.Path(), "db0", "rp0", "4")); err != nil {
+		t.Fatal(err)
+	} else if _, err := os.Create(filepath.Join(s.Path(), "db0", "rp0", "junk")); err != nil {
+		t.Fatal(err)
+	} else if err := s.Reopen(); err != nil {
+		t.Fatal(err)
+	} else if err := s.CloseShard(2); err != nil {
+		t.Fatal(err)
+	}
+
+	d := s.Diagnostics()
+	if d["path"] != s.Path() {
+		t.Fatalf("unexpected path: %v", d["path"])
+	} else if d["databases"] != int64(3) {
+		// The WAL directory inside the store path is loaded as a database.
+		t.Fatalf("unexpected databases: %v", d["databases"])
+	} else if d["shards"] != int64(3) || d["openShards"] != int64(2) {
+		t.Fatalf("unexpected shards: %v, %v", d["shards"], d["openShards"])
+	} else if n := s.SkippedShardsN(); n == 0 || d["skippedPaths"] != int64(n) {
+		t.Fatalf("unexpected skipped paths: %v", d["skippedPaths"])
+	} else if _, ok := d["diskBytes"].(int64); !ok {
+		t.Fatalf("unexpected disk size: %v", d["diskBytes"])
+	} else if n, ok := d["walDiskBytes"].(int64); !ok || n <= 0 {
+		t.Fatalf("unexpected WAL size: %v", d["walDiskBytes"])
+	} else if exp := map[string]int64{"db0": 2, "db1": 1, "wal": 0}; !reflect.DeepEqual(d["seriesCardinality"], exp) {
+		t.Fatalf("unexpected cardinality: %v", d["seriesCardinality"])
+	}
+
+	failed, ok := d["failedShards"].([]string)
+	if !ok || len(failed) != 1 || !strings.HasPrefix(failed[0], "4: ") {
+		t.Fatalf("unexpected failed shards: %v", d["failedShards"])
+	}
+}
+
 // Ensure shards can create iterators.
 func TestShards_CreateIterator(t *testing.T) {
 	s := MustOpenStore()
@@ -379,6 +5342,15 @@ func (s *Store) MustWriteToShardString(shardID int, data ...string) {
 	}
 }
 
+// mustParsePoints parses line protocol with second precision. Panic on error.
+func mustParsePoints(data string) []models.Point {
+	points, err := models.ParsePointsWithPrecision([]byte(data), time.Time{}, "s")
+	if err != nil {
+		panic(err)
+	}
+	return points
+}
+
 // BatchWrite writes points to a shard in chunks.
 func (s *Store) BatchWrite(shardID int, points []models.Point) error {
 	nPts := len(points)
@@ -420,3 +5392,224 @@ func dirExists(path string) bool {
 	}
 	return !os.IsNotExist(err)
 }
+
+// mustMarshalJSON encodes a value to JSON.
+func mustMarshalJSON(v interface{}) []byte {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// testEngineOpens records the shard paths opened with the "tsm1-test" engine.
+var testEngineOpens = &pathCounter{m: make(map[string]int)}
+
+// blockingEngineRelease is closed to let "tsm1-blocking" engines close.
+var blockingEngineRelease = make(chan struct{})
+
+// slowOpenStarted receives a value each time a "tsm1-slowopen" engine starts
+// opening, and slowOpenRelease is closed to let them finish.
+var (
+	slowOpenStarted = make(chan struct{}, 10)
+	slowOpenRelease = make(chan struct{})
+)
+
+func init() {
+	tsdb.RegisterEngine("tsm1-test", func(path string, walPath string, opt tsdb.EngineOptions) tsdb.Engine {
+		testEngineOpens.add(path)
+		return tsm1.NewEngine(path, walPath, opt)
+	})
+	tsdb.RegisterEngine("tsm1-faildelete", func(path string, walPath string, opt tsdb.EngineOptions) tsdb.Engine {
+		return &failDeleteEngine{Engine: tsm1.NewEngine(path, walPath, opt)}
+	})
+	tsdb.RegisterEngine("tsm1-failclose", func(path string, walPath string, opt tsdb.EngineOptions) tsdb.Engine {
+		return &failCloseEngine{Engine: tsm1.NewEngine(path, walPath, opt)}
+	})
+	tsdb.RegisterEngine("tsm1-failrename", func(path string, walPath string, opt tsdb.EngineOptions) tsdb.Engine {
+		return &failRenameEngine{Engine: tsm1.NewEngine(path, walPath, opt)}
+	})
+	tsdb.RegisterEngine("tsm1-countclose", func(path string, walPath string, opt tsdb.EngineOptions) tsdb.Engine {
+		return &countCloseEngine{Engine: tsm1.NewEngine(path, walPath, opt)}
+	})
+	tsdb.RegisterEngine("tsm1-blocking", func(path string, walPath string, opt tsdb.EngineOptions) tsdb.Engine {
+		return &blockingEngine{Engine: tsm1.NewEngine(path, walPath, opt)}
+	})
+	tsdb.RegisterEngine("tsm1-slowopen", func(path string, walPath string, opt tsdb.EngineOptions) tsdb.Engine {
+		return &slowOpenEngine{Engine: tsm1.NewEngine(path, walPath, opt)}
+	})
+	tsdb.RegisterEngine("tsm1-busy", func(path string, walPath string, opt tsdb.EngineOptions) tsdb.Engine {
+		return &busyEngine{Engine: tsm1.NewEngine(path, walPath, opt)}
+	})
+}
+
+// busyEngine is an engine whose TryWritePoints always reports it is busy.
+type busyEngine struct {
+	tsdb.Engine
+}
+
+func (e *busyEngine) TryWritePoints(points []models.Point, measurementFieldsToSave map[string]*tsdb.MeasurementFields, seriesToCreate []*tsdb.SeriesCreate) error {
+	return tsdb.ErrShardBusy
+}
+
+// blockingEngine is an engine whose Close blocks until blockingEngineRelease
+// is closed.
+type blockingEngine struct {
+	tsdb.Engine
+}
+
+func (e *blockingEngine) Close() error {
+	<-blockingEngineRelease
+	return e.Engine.Close()
+}
+
+// closingEngines counts the "tsm1-countclose" engines being closed.
+var closingEngines struct {
+	n, max int64
+}
+
+// countCloseEngine is an engine that records the number of engines closing
+// at once in closingEngines.
+type countCloseEngine struct {
+	tsdb.Engine
+}
+
+func (e *countCloseEngine) Close() error {
+	n := atomic.AddInt64(&closingEngines.n, 1)
+	defer atomic.AddInt64(&closingEngines.n, -1)
+	for {
+		max := atomic.LoadInt64(&closingEngines.max)
+		if n <= max || atomic.CompareAndSwapInt64(&closingEngines.max, max, n) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	return e.Engine.Close()
+}
+
+// slowOpenEngine is an engine whose Open blocks until slowOpenRelease is
+// closed.
+type slowOpenEngine struct {
+	tsdb.Engine
+}
+
+func (e *slowOpenEngine) Open() error {
+	slowOpenStarted <- struct{}{}
+	<-slowOpenRelease
+	return e.Engine.Open()
+}
+
+// failDeleteEngine is an engine that fails to delete measurements.
+type failDeleteEngine struct {
+	tsdb.Engine
+}
+
+func (e *failDeleteEngine) DeleteMeasurement(name string, seriesKeys []string) error {
+	return errors.New("delete failed")
+}
+
+// failCloseEngine is an engine that closes its files but reports an error.
+type failCloseEngine struct {
+	tsdb.Engine
+}
+
+func (e *failCloseEngine) Close() error {
+	if err := e.Engine.Close(); err != nil {
+		return err
+	}
+	return errors.New("close failed")
+}
+
+// failRenameEngine is an engine whose measurement renames always fail.
+type failRenameEngine struct {
+	tsdb.Engine
+}
+
+func (e *failRenameEngine) RenameMeasurement(oldName, newName string) (tsdb.PendingRename, error) {
+	return nil, errors.New("rename failed")
+}
+
+// pathCounter counts occurrences of paths and is safe for concurrent use.
+type pathCounter struct {
+	mu sync.Mutex
+	m  map[string]int
+}
+
+func (c *pathCounter) add(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m[path]++
+}
+
+func (c *pathCounter) count(path string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.m[path]
+}
+
+// mustListFiles returns the size and modification time of every file under
+// path, keyed by the relative path. Panic on error.
+func mustListFiles(path string) map[string]string {
+	m := make(map[string]string)
+	if err := filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+		m[rel] = fmt.Sprintf("%d %s", fi.Size(), fi.ModTime())
+		return nil
+	}); err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// mustWriteTSM writes values to a new TSM file at path. Panic on error.
+func mustWriteTSM(path string, values map[string][]tsm1.Value) {
+	f, err := os.Create(path)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	w, err := tsm1.NewTSMWriter(f)
+	if err != nil {
+		panic(err)
+	}
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if err := w.Write(k, values[k]); err != nil {
+			panic(err)
+		}
+	}
+	if err := w.WriteIndex(); err != nil {
+		panic(err)
+	} else if err := w.Close(); err != nil {
+		panic(err)
+	}
+}
+
+// mustArchiveNames returns the names of the entries of a tar archive. Panic on
+// error.
+func mustArchiveNames(b []byte) []string {
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(b))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return names
+		} else if err != nil {
+			panic(err)
+		}
+		names = append(names, hdr.Name)
+	}
+}
@@ -0,0 +1,84 @@
+package tsdb
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// WriteHistoryWindow is how far back a shard remembers when points were
+// written to it. Write times are kept with one second resolution.
+const WriteHistoryWindow = 10 * time.Minute
+
+// ErrWriteHistoryUnavailable is returned when asking how many points were
+// written since a time that predates the write history of a shard.
+var ErrWriteHistoryUnavailable = errors.New("write history not available")
+
+// writeMark is the write sequence of a shard at the end of a second.
+type writeMark struct {
+	at  int64 // unix seconds
+	seq uint64
+}
+
+// writeHistory records how the write sequence of a shard has grown over the
+// last WriteHistoryWindow. The data files don't record when points were
+// written, only their timestamps, so the history is held in memory.
+type writeHistory struct {
+	mu sync.Mutex
+
+	// base is the oldest known mark. The sequence of any second from base.at
+	// up to the first of marks is base.seq.
+	base  writeMark
+	marks []writeMark
+}
+
+// newWriteHistory returns a history that starts at now with a sequence of 0.
+func newWriteHistory(now time.Time) *writeHistory {
+	return &writeHistory{base: writeMark{at: now.Unix()}}
+}
+
+// record notes that the write sequence reached seq.
+func (h *writeHistory) record(seq uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now().Unix()
+	if n := len(h.marks); n > 0 && h.marks[n-1].at >= now {
+		// Writes that finish concurrently may record out of order.
+		if seq > h.marks[n-1].seq {
+			h.marks[n-1].seq = seq
+		}
+	} else {
+		if n > 0 && h.marks[n-1].seq > seq {
+			seq = h.marks[n-1].seq
+		}
+		h.marks = append(h.marks, writeMark{at: now, seq: seq})
+	}
+
+	cutoff := now - int64(WriteHistoryWindow/time.Second)
+	i := 0
+	for i < len(h.marks)-1 && h.marks[i].at < cutoff {
+		i++
+	}
+	if i > 0 {
+		h.base = h.marks[i-1]
+		h.marks = append(h.marks[:0], h.marks[i:]...)
+	}
+}
+
+// seqAt returns the write sequence at the end of the second holding t.
+func (h *writeHistory) seqAt(t time.Time) (uint64, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sec := t.Unix()
+	if sec < h.base.at {
+		return 0, ErrWriteHistoryUnavailable
+	}
+	i := sort.Search(len(h.marks), func(i int) bool { return h.marks[i].at > sec })
+	if i == 0 {
+		return h.base.seq, nil
+	}
+	return h.marks[i-1].seq, nil
+}